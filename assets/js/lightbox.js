@@ -0,0 +1,168 @@
+// Adds keyboard and swipe navigation, a slideshow and full screen to the
+// lightbox. Images are swapped in place, so full screen and the slideshow
+// carry on from one to the next, while the URL still follows along.
+(function () {
+    var lightbox = document.getElementById("lightbox");
+    if (!lightbox) {
+        return;
+    }
+    // slideshowInterval is how long each image is shown in the slideshow, in ms.
+    var slideshowInterval = 5000;
+    var play = document.getElementById("lightbox-play");
+    var fullscreen = document.getElementById("lightbox-fullscreen");
+    var playing = false;
+    var timer = null;
+
+    // show loads the page of another image and swaps its image, links and
+    // details into this one.
+    function show(url, push) {
+        fetch(url, { credentials: "same-origin" }).then(function (res) {
+            if (!res.ok) {
+                throw new Error(res.statusText);
+            }
+            return res.text();
+        }).then(function (html) {
+            var doc = new DOMParser().parseFromString(html, "text/html");
+            if (!doc.getElementById("lightbox")) {
+                throw new Error("not an image page");
+            }
+            // The stage brings along the hidden copies of the images around
+            // the new one, so they start loading too
+            replace(doc, ".lightbox-stage");
+            replace(doc, ".lightbox-details");
+            document.title = doc.title;
+            if (push) {
+                history.pushState(null, "", url);
+            }
+            schedule();
+        }).catch(function () {
+            // Fall back to loading the page the usual way
+            window.location.href = url;
+        });
+    }
+
+    function replace(doc, selector) {
+        var current = document.querySelector(selector);
+        var next = doc.querySelector(selector);
+        if (current && next) {
+            current.parentNode.replaceChild(document.importNode(next, true), current);
+        }
+    }
+
+    // go shows the previous or next image, returning false if there isn't one.
+    function go(id) {
+        var link = document.getElementById(id);
+        if (!link) {
+            return false;
+        }
+        show(link.href, true);
+        return true;
+    }
+
+    function togglePlay() {
+        playing = !playing;
+        play.textContent = playing ? "\u275A\u275A Pause" : "\u25B6 Slideshow";
+        schedule();
+    }
+
+    // schedule moves on to the next image after a while during the
+    // slideshow, which stops at the last image.
+    function schedule() {
+        clearTimeout(timer);
+        if (!playing) {
+            return;
+        }
+        if (!document.getElementById("lightbox-next")) {
+            togglePlay();
+            return;
+        }
+        timer = setTimeout(function () {
+            go("lightbox-next");
+        }, slideshowInterval);
+    }
+
+    function toggleFullscreen() {
+        if (!document.fullscreenEnabled) {
+            return;
+        }
+        if (document.fullscreenElement) {
+            document.exitFullscreen();
+        } else {
+            lightbox.requestFullscreen();
+        }
+    }
+
+    play.hidden = false;
+    play.addEventListener("click", togglePlay);
+    if (document.fullscreenEnabled) {
+        fullscreen.hidden = false;
+        fullscreen.addEventListener("click", toggleFullscreen);
+    }
+
+    // The stage is replaced with every image, so its links are handled here
+    lightbox.addEventListener("click", function (e) {
+        var link = e.target.closest("#lightbox-prev, #lightbox-next");
+        if (!link || e.ctrlKey || e.metaKey || e.shiftKey) {
+            return;
+        }
+        e.preventDefault();
+        show(link.href, true);
+    });
+
+    document.addEventListener("keydown", function (e) {
+        if (e.altKey || e.ctrlKey || e.metaKey || e.target.closest("input, textarea, select, button")) {
+            return;
+        }
+        switch (e.key) {
+        case "ArrowLeft":
+            go("lightbox-prev");
+            break;
+        case "ArrowRight":
+            go("lightbox-next");
+            break;
+        case "Escape":
+            // Browsers leave full screen on Escape themselves
+            if (!document.fullscreenElement) {
+                window.location.href = document.getElementById("lightbox-close").href;
+            }
+            break;
+        case " ":
+            togglePlay();
+            break;
+        case "f":
+            toggleFullscreen();
+            break;
+        default:
+            return;
+        }
+        e.preventDefault();
+    });
+
+    var touchX = null;
+    var touchY = null;
+    lightbox.addEventListener("touchstart", function (e) {
+        if (e.touches.length !== 1) {
+            touchX = null;
+            return;
+        }
+        touchX = e.touches[0].clientX;
+        touchY = e.touches[0].clientY;
+    }, { passive: true });
+    lightbox.addEventListener("touchend", function (e) {
+        if (touchX === null) {
+            return;
+        }
+        var dx = e.changedTouches[0].clientX - touchX;
+        var dy = e.changedTouches[0].clientY - touchY;
+        touchX = null;
+        // Only count mostly sideways swipes, so scrolling still works
+        if (Math.abs(dx) < 50 || Math.abs(dx) < Math.abs(dy)) {
+            return;
+        }
+        go(dx > 0 ? "lightbox-prev" : "lightbox-next");
+    });
+
+    window.addEventListener("popstate", function () {
+        show(window.location.href, false);
+    });
+})();
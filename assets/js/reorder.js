@@ -0,0 +1,77 @@
+// Lets gallery owners drag the images on the edit page into a new order.
+// The new order is saved as soon as an image is dropped.
+(function () {
+    var list = document.getElementById("gallery-images");
+    if (!list) {
+        return;
+    }
+    var dragged = null;
+
+    list.addEventListener("dragstart", function (e) {
+        dragged = e.target.closest(".image-tile");
+        if (!dragged) {
+            return;
+        }
+        dragged.classList.add("dragging");
+        e.dataTransfer.effectAllowed = "move";
+        // Firefox won't start dragging without some data set
+        e.dataTransfer.setData("text/plain", dragged.dataset.id);
+    });
+
+    list.addEventListener("dragover", function (e) {
+        if (!dragged) {
+            return;
+        }
+        e.preventDefault();
+        var target = e.target.closest(".image-tile");
+        if (!target || target === dragged) {
+            return;
+        }
+        var rect = target.getBoundingClientRect();
+        var after = e.clientX - rect.left > rect.width / 2;
+        list.insertBefore(dragged, after ? target.nextSibling : target);
+    });
+
+    list.addEventListener("drop", function (e) {
+        e.preventDefault();
+    });
+
+    list.addEventListener("dragend", function () {
+        if (!dragged) {
+            return;
+        }
+        dragged.classList.remove("dragging");
+        dragged = null;
+        save();
+    });
+
+    function save() {
+        var ids = Array.prototype.map.call(list.querySelectorAll(".image-tile"), function (tile) {
+            return parseInt(tile.dataset.id, 10);
+        });
+        // gorilla/csrf accepts the token from this header for non-form requests
+        var token = document.querySelector("input[name='gorilla.csrf.Token']").value;
+        fetch(list.dataset.reorderUrl, {
+            method: "POST",
+            credentials: "same-origin",
+            headers: {
+                "Content-Type": "application/json",
+                "X-CSRF-Token": token
+            },
+            body: JSON.stringify({ image_ids: ids })
+        }).then(function (res) {
+            if (!res.ok) {
+                return res.json().then(function (body) {
+                    throw new Error(body.error);
+                });
+            }
+            // Reordering switches the gallery to the custom order
+            var order = document.getElementById("order");
+            if (order) {
+                order.value = "manual";
+            }
+        }).catch(function (err) {
+            alert("Couldn't save the new order: " + err.message);
+        });
+    }
+})();
@@ -0,0 +1,156 @@
+// Uploads images on the edit page in chunks, so a dropped connection only
+// loses the chunk being sent instead of the whole file. Chunks that fail
+// are retried, resuming from whatever the server received. ZIP archives
+// are still sent through the plain form.
+(function () {
+    var form = document.getElementById("upload-form");
+    if (!form || !window.fetch || !window.Blob) {
+        return;
+    }
+    var chunkSize = 5 * 1024 * 1024;
+    var maxRetries = 10;
+    var input = form.querySelector("input[type='file']");
+    var progress = document.getElementById("upload-progress");
+
+    form.addEventListener("submit", function (e) {
+        var files = Array.prototype.slice.call(input.files);
+        var zips = files.filter(function (file) {
+            return /\.zip$/i.test(file.name);
+        });
+        if (files.length === 0 || zips.length > 0) {
+            return;
+        }
+        e.preventDefault();
+        form.querySelector("button[type='submit']").disabled = true;
+
+        var failed = [];
+        var next = Promise.resolve();
+        files.forEach(function (file, i) {
+            next = next.then(function () {
+                return upload(file, function (sent) {
+                    var percent = Math.floor(sent * 100 / Math.max(file.size, 1));
+                    progress.textContent = "Uploading " + file.name + " (" + (i + 1) + " of " + files.length + "): " + percent + "%";
+                }).catch(function (err) {
+                    failed.push(file.name + ": " + err.message);
+                });
+            });
+        });
+        next.then(function () {
+            if (failed.length > 0) {
+                alert("Some files couldn't be uploaded:\n\n" + failed.join("\n"));
+            }
+            window.location.reload();
+        });
+    });
+
+    function upload(file, onProgress) {
+        return request("POST", form.dataset.uploadUrl, {
+            "Upload-Length": String(file.size),
+            "Upload-Metadata": "filename " + encodeMetadata(file.name)
+        }).then(function (res) {
+            return send(file, res.headers.get("Location"), 0, 0, onProgress);
+        });
+    }
+
+    function send(file, url, offset, retries, onProgress) {
+        onProgress(offset);
+        if (offset >= file.size) {
+            return Promise.resolve();
+        }
+        var chunk = file.slice(offset, offset + chunkSize);
+        return readChunk(chunk).then(function (data) {
+            return checksum(data).then(function (sum) {
+                var headers = {
+                    "Content-Type": "application/offset+octet-stream",
+                    "Upload-Offset": String(offset)
+                };
+                if (sum) {
+                    headers["Upload-Checksum"] = "sha256 " + sum;
+                }
+                return request("PATCH", url, headers, data);
+            });
+        }).then(function (res) {
+            var received = parseInt(res.headers.get("Upload-Offset"), 10);
+            return send(file, url, received, 0, onProgress);
+        }, function (err) {
+            if (err.status && err.status < 500 && err.status !== 409 && err.status !== 460) {
+                // The server rejected the file, sending it again won't help
+                throw err;
+            }
+            if (retries >= maxRetries) {
+                throw new Error("the connection kept failing, please try again later");
+            }
+            return wait(Math.min(1000 * Math.pow(2, retries), 30000)).then(function () {
+                // Ask the server how much it has, the failed chunk may have partly made it
+                return request("HEAD", url, {});
+            }).then(function (res) {
+                var received = parseInt(res.headers.get("Upload-Offset"), 10);
+                return send(file, url, received, retries + 1, onProgress);
+            }, function (err) {
+                if (err.status === 404) {
+                    throw new Error("the upload expired, please try again");
+                }
+                return send(file, url, offset, retries + 1, onProgress);
+            });
+        });
+    }
+
+    function request(method, url, headers, body) {
+        headers["Tus-Resumable"] = "1.0.0";
+        // gorilla/csrf accepts the token from this header for non-form requests
+        headers["X-CSRF-Token"] = form.querySelector("input[name='gorilla.csrf.Token']").value;
+        return fetch(url, {
+            method: method,
+            credentials: "same-origin",
+            headers: headers,
+            body: body
+        }).then(function (res) {
+            if (res.ok) {
+                return res;
+            }
+            return res.json().catch(function () {
+                return {};
+            }).then(function (body) {
+                var err = new Error(body.error || "upload failed with status " + res.status);
+                err.status = res.status;
+                throw err;
+            });
+        });
+    }
+
+    function readChunk(chunk) {
+        return new Promise(function (resolve, reject) {
+            var reader = new FileReader();
+            reader.onload = function () {
+                resolve(reader.result);
+            };
+            reader.onerror = function () {
+                reject(reader.error);
+            };
+            reader.readAsArrayBuffer(chunk);
+        });
+    }
+
+    // checksum resolves to the base64 encoded SHA-256 of data, or null where
+    // browsers don't let us compute it (eg: pages not served over HTTPS).
+    function checksum(data) {
+        if (!window.crypto || !window.crypto.subtle) {
+            return Promise.resolve(null);
+        }
+        return window.crypto.subtle.digest("SHA-256", data).then(function (hash) {
+            return btoa(String.fromCharCode.apply(null, new Uint8Array(hash)));
+        }, function () {
+            return null;
+        });
+    }
+
+    function encodeMetadata(value) {
+        return btoa(unescape(encodeURIComponent(value)));
+    }
+
+    function wait(ms) {
+        return new Promise(function (resolve) {
+            setTimeout(resolve, ms);
+        });
+    }
+})();
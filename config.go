@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
+
+	"github.com/torresjeff/gallery/storage"
 )
 
 //----------------- DB CONFIG -----------------//
@@ -43,14 +46,183 @@ type MailgunConfig struct {
 	Domain       string `json:"domain"`
 }
 
+//----------------- IMAGES CONFIG -----------------//
+type ImagesConfig struct {
+	// VariantWidths are the widths (in pixels) of the resized copies made of every upload.
+	// Run the app with -regen-variants after changing them.
+	VariantWidths []int `json:"variant_widths"`
+	JPEGQuality   int   `json:"jpeg_quality"`
+	// CwebpPath is the cwebp binary used to create WebP variants. WebP variants
+	// are skipped if it can't be found.
+	CwebpPath string `json:"cwebp_path"`
+	// MaxFileBytes is the size limit of a single uploaded image.
+	MaxFileBytes int64 `json:"max_file_bytes"`
+	// MaxRequestBytes is the size limit of an upload request, with all of its files.
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+	// AllowedFormats are the image formats users can upload. Supported formats are jpeg, png and gif.
+	AllowedFormats []string `json:"allowed_formats"`
+	// MaxImportEntries is the number of files a ZIP archive can have to be imported.
+	MaxImportEntries int `json:"max_import_entries"`
+	// MaxImportBytes is the size limit of an imported ZIP archive once extracted.
+	MaxImportBytes int64 `json:"max_import_bytes"`
+}
+
+func DefaultImagesConfig() ImagesConfig {
+	return ImagesConfig{
+		VariantWidths:    []int{320, 800, 1600},
+		JPEGQuality:      85,
+		CwebpPath:        "cwebp",
+		MaxFileBytes:     50 << 20,  // 50 MB
+		MaxRequestBytes:  500 << 20, // 500 MB
+		AllowedFormats:   []string{"jpeg", "png"},
+		MaxImportEntries: 1000,
+		MaxImportBytes:   2 << 30, // 2 GB
+	}
+}
+
+//----------------- QUOTAS CONFIG -----------------//
+type QuotasConfig struct {
+	// MaxBytesPerUser is the total size of the images each user can upload. 0 means no limit.
+	MaxBytesPerUser int64 `json:"max_bytes_per_user"`
+	// MaxImagesPerUser is the number of images each user can upload. 0 means no limit.
+	MaxImagesPerUser int `json:"max_images_per_user"`
+	// MaxImagesPerGallery is the number of images a single gallery can have. 0 means no limit.
+	MaxImagesPerGallery int `json:"max_images_per_gallery"`
+}
+
+func DefaultQuotasConfig() QuotasConfig {
+	return QuotasConfig{
+		MaxBytesPerUser:     5 << 30, // 5 GB
+		MaxImagesPerUser:    0,
+		MaxImagesPerGallery: 1000,
+	}
+}
+
+//----------------- UPLOADS CONFIG -----------------//
+type UploadsConfig struct {
+	// Dir is where the chunks of resumable uploads are kept until every chunk has arrived.
+	Dir string `json:"dir"`
+	// ExpiryHours is how long an unfinished upload is kept after its last chunk.
+	ExpiryHours int `json:"expiry_hours"`
+	// MaxSessionsPerUser is how many unfinished uploads each user can have. 0 means no limit.
+	MaxSessionsPerUser int `json:"max_sessions_per_user"`
+}
+
+func DefaultUploadsConfig() UploadsConfig {
+	return UploadsConfig{
+		Dir:                "uploads",
+		ExpiryHours:        24,
+		MaxSessionsPerUser: 10,
+	}
+}
+
+func (c UploadsConfig) Expiry() time.Duration {
+	return time.Duration(c.ExpiryHours) * time.Hour
+}
+
+//----------------- TRASH CONFIG -----------------//
+type TrashConfig struct {
+	// RetentionDays is how long deleted galleries and images can be restored
+	// before they are deleted for good. 0 keeps them until they are deleted by hand.
+	RetentionDays int `json:"retention_days"`
+}
+
+func DefaultTrashConfig() TrashConfig {
+	return TrashConfig{
+		RetentionDays: 30,
+	}
+}
+
+func (c TrashConfig) Retention() time.Duration {
+	return time.Duration(c.RetentionDays) * 24 * time.Hour
+}
+
+//----------------- STORAGE CONFIG -----------------//
+type StorageConfig struct {
+	// Backend is where uploaded files are kept: "local", "s3" or "memory".
+	Backend string           `json:"backend"`
+	Local   LocalStoreConfig `json:"local"`
+	S3      S3StoreConfig    `json:"s3"`
+}
+
+type LocalStoreConfig struct {
+	// Root is the directory files are stored in.
+	Root string `json:"root"`
+}
+
+type S3StoreConfig struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	UseSSL    bool   `json:"use_ssl"`
+}
+
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Backend: "local",
+		Local: LocalStoreConfig{
+			Root: "images",
+		},
+	}
+}
+
+// Storage creates the storage backend selected by the config.
+func (c StorageConfig) Storage() (storage.Storage, error) {
+	switch c.Backend {
+	case "local", "":
+		return storage.NewLocal(c.Local.Root), nil
+	case "memory":
+		return storage.NewMemory(), nil
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  c.S3.Endpoint,
+			Region:    c.S3.Region,
+			Bucket:    c.S3.Bucket,
+			AccessKey: c.S3.AccessKey,
+			SecretKey: c.S3.SecretKey,
+			UseSSL:    c.S3.UseSSL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", c.Backend)
+	}
+}
+
+//----------------- JOBS CONFIG -----------------//
+type JobsConfig struct {
+	// Workers is how many background jobs (eg: image processing) run at the same time.
+	Workers int `json:"workers"`
+	// PollIntervalSeconds is how often idle workers check for new jobs.
+	PollIntervalSeconds int `json:"poll_interval_seconds"`
+}
+
+func DefaultJobsConfig() JobsConfig {
+	return JobsConfig{
+		Workers:             4,
+		PollIntervalSeconds: 2,
+	}
+}
+
+func (c JobsConfig) PollInterval() time.Duration {
+	return time.Duration(c.PollIntervalSeconds) * time.Second
+}
+
 //----------------- APP CONFIG -----------------//
 type Config struct {
 	Port     int            `json:"port"`
 	Env      string         `json:"env"`
 	Pepper   string         `json:"pepper"`
 	HMACKey  string         `json:"hmac_key"`
+	BaseURL  string         `json:"base_url"`
 	Database PostgresConfig `json:"database"`
 	Mailgun  MailgunConfig  `json:"mailgun"`
+	Images   ImagesConfig   `json:"images"`
+	Quotas   QuotasConfig   `json:"quotas"`
+	Uploads  UploadsConfig  `json:"uploads"`
+	Trash    TrashConfig    `json:"trash"`
+	Jobs     JobsConfig     `json:"jobs"`
+	Storage  StorageConfig  `json:"storage"`
 }
 
 func (c Config) IsProd() bool {
@@ -63,7 +235,14 @@ func DefaultConfig() Config {
 		Env:      "dev",
 		Pepper:   "user-password-pepper",
 		HMACKey:  "secret-hmac-key",
+		BaseURL:  "http://localhost:3000",
 		Database: DefaultPostgresConfig(),
+		Images:   DefaultImagesConfig(),
+		Quotas:   DefaultQuotasConfig(),
+		Uploads:  DefaultUploadsConfig(),
+		Trash:    DefaultTrashConfig(),
+		Jobs:     DefaultJobsConfig(),
+		Storage:  DefaultStorageConfig(),
 	}
 }
 
@@ -78,7 +257,8 @@ func LoadConfig(configRequired bool) Config {
 	}
 	defer f.Close()
 
-	var c Config
+	// Keys missing from config.json keep their defaults
+	c := DefaultConfig()
 	dec := json.NewDecoder(f)
 	err = dec.Decode(&c)
 	if err != nil {
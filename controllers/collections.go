@@ -0,0 +1,581 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/views"
+)
+
+const (
+	IndexCollections = "index_collections"
+	EditCollection   = "edit_collection"
+)
+
+type Collections struct {
+	IndexView *views.View
+	ShowView  *views.View
+	EditView  *views.View
+	cs        models.CollectionService
+	gs        models.GalleryService
+	is        models.ImageService
+	// galleries renders the galleries of shared collections.
+	galleries *Galleries
+	r         *mux.Router
+}
+
+type CollectionForm struct {
+	Title       string `schema:"title"`
+	Description string `schema:"description"`
+	// ParentID is the collection to put this one in, 0 for none.
+	ParentID   uint   `schema:"parent_id"`
+	Visibility string `schema:"visibility"`
+}
+
+// apply copies the form to collection.
+func (form *CollectionForm) apply(collection *models.Collection) {
+	collection.Title = form.Title
+	collection.Description = form.Description
+	collection.ParentID = form.ParentID
+	collection.Visibility = models.Visibility(form.Visibility)
+}
+
+// CollectionGalleriesForm lists the galleries that should be in a collection.
+type CollectionGalleriesForm struct {
+	GalleryIDs []uint `schema:"gallery_ids"`
+}
+
+// CollectionIndex is the data the collections index page is rendered with.
+type CollectionIndex struct {
+	// Collections are the user's top level collections, with their children.
+	Collections []models.Collection
+	Form        CollectionForm
+}
+
+// CollectionEdit is the data the collection edit page is rendered with.
+type CollectionEdit struct {
+	*models.Collection
+	// Parents are the collections this one can be moved into.
+	Parents []models.Collection
+	// AllGalleries are every gallery of the user, to pick the ones in the
+	// collection from.
+	AllGalleries []models.Gallery
+}
+
+// CollectionShow is the data the collection page is rendered with.
+type CollectionShow struct {
+	*models.Collection
+	// ShareToken is the token the collection is being viewed through, if
+	// any. The galleries and collections in it are then linked through it
+	// too.
+	ShareToken string
+}
+
+// CollectionURL is the URL of a collection in the one being shown.
+func (cs *CollectionShow) CollectionURL(c models.Collection) string {
+	if cs.ShareToken != "" {
+		return fmt.Sprintf("/c/%s/collections/%d", cs.ShareToken, c.ID)
+	}
+	return c.Path()
+}
+
+// GalleryURL is the URL of a gallery in the collection being shown.
+func (cs *CollectionShow) GalleryURL(g models.Gallery) string {
+	if cs.ShareToken != "" {
+		return fmt.Sprintf("/c/%s/galleries/%d", cs.ShareToken, g.ID)
+	}
+	return g.Path()
+}
+
+func NewCollections(cs models.CollectionService, gs models.GalleryService, is models.ImageService, galleries *Galleries, r *mux.Router) *Collections {
+	return &Collections{
+		IndexView: views.NewView("bootstrap", "collections/index"),
+		ShowView:  views.NewView("bootstrap", "collections/show"),
+		EditView:  views.NewView("bootstrap", "collections/edit"),
+		cs:        cs,
+		gs:        gs,
+		is:        is,
+		galleries: galleries,
+		r:         r,
+	}
+}
+
+// Index lists the collections of the current user.
+//
+// GET /collections
+func (c *Collections) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var index CollectionIndex
+	vd.Yield = &index
+	c.renderIndex(w, r, vd, &index)
+}
+
+func (c *Collections) renderIndex(w http.ResponseWriter, r *http.Request, vd views.Data, index *CollectionIndex) {
+	user := context.User(r.Context())
+	collections, err := c.cs.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	index.Collections = nestCollections(collections)
+	c.IndexView.Render(w, r, vd)
+}
+
+// Create adds a collection.
+//
+// POST /collections
+func (c *Collections) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var index CollectionIndex
+	vd.Yield = &index
+	if err := parseForm(r, &index.Form); err != nil {
+		vd.SetAlert(err)
+		c.renderIndex(w, r, vd, &index)
+		return
+	}
+	user := context.User(r.Context())
+	collection := models.Collection{
+		UserID: user.ID,
+	}
+	index.Form.apply(&collection)
+	if err := c.cs.Create(&collection); err != nil {
+		vd.SetAlert(err)
+		c.renderIndex(w, r, vd, &index)
+		return
+	}
+	c.redirectToEdit(w, r, &collection)
+}
+
+// Show shows the galleries and collections in a collection, with their
+// cover images. Private ones are only shown to their owner.
+//
+// GET /collections/:id
+func (c *Collections) Show(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if !collection.VisibleTo(user) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+	if err := c.loadContents(collection, user); err != nil {
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yield = &CollectionShow{Collection: collection}
+	c.ShowView.Render(w, r, vd)
+}
+
+// ShowShared shows a collection to someone who followed its share link,
+// including everything private in it. The "collectionID" path parameter
+// picks one of the collections in the shared one.
+//
+// GET /c/:token
+// GET /c/:token/collections/:collectionID
+func (c *Collections) ShowShared(w http.ResponseWriter, r *http.Request) {
+	shared, err := c.sharedCollection(w, r)
+	if err != nil {
+		return
+	}
+	collection := shared
+	if id := mux.Vars(r)["collectionID"]; id != "" {
+		if collection, err = c.sharedChild(w, shared, id); err != nil {
+			return
+		}
+	}
+	if err := c.loadContents(collection, nil); err != nil {
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yield = &CollectionShow{Collection: collection, ShareToken: shared.ShareToken}
+	c.ShowView.Render(w, r, vd)
+}
+
+// ShowSharedGallery shows a gallery in a collection to someone who followed
+// the collection's share link.
+//
+// GET /c/:token/galleries/:galleryID
+func (c *Collections) ShowSharedGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, base, err := c.sharedGallery(w, r)
+	if err != nil {
+		return
+	}
+	c.galleries.renderShow(w, r, gallery, base)
+}
+
+// ShowSharedImage shows an image of a gallery in a collection in the
+// lightbox, to someone who followed the collection's share link. The
+// gallery can be private, so its own image pages would be hidden from them.
+//
+// GET /c/:token/galleries/:galleryID/images/:imageID
+func (c *Collections) ShowSharedImage(w http.ResponseWriter, r *http.Request) {
+	gallery, base, err := c.sharedGallery(w, r)
+	if err != nil {
+		return
+	}
+	backTo := base
+	if sort := r.URL.Query().Get("sort"); sort != "" {
+		backTo += "?" + url.Values{"sort": {sort}}.Encode()
+	}
+	c.galleries.renderImage(w, r, gallery, base, backTo)
+}
+
+// sharedGallery looks up the gallery in the URL, making sure it is in the
+// collection whose share link is in the URL, or one of the collections in
+// it. base is the path of the gallery under the share link. Like
+// sharedCollection, it renders any errors.
+func (c *Collections) sharedGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, string, error) {
+	shared, err := c.sharedCollection(w, r)
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["galleryID"])
+	if err != nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, "", err
+	}
+	gallery, err := c.galleries.gallery(w, r, uint(id))
+	if err != nil {
+		return nil, "", err
+	}
+	if gallery.CollectionID != shared.ID {
+		// The gallery might be in one of the collections in the shared one
+		in, err := c.cs.ByID(gallery.CollectionID)
+		if err == nil && in.ParentID != shared.ID {
+			err = models.ErrNotFound
+		}
+		if err != nil {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return nil, "", err
+		}
+	}
+	return gallery, fmt.Sprintf("/c/%s/galleries/%d", shared.ShareToken, gallery.ID), nil
+}
+
+// RenderEdit shows the page where owners edit a collection and pick the
+// galleries in it.
+//
+// GET /collections/:id/edit
+func (c *Collections) RenderEdit(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.ownCollection(w, r)
+	if err != nil {
+		return
+	}
+	c.renderEdit(w, r, views.Data{}, collection)
+}
+
+// Edit saves the title, description, parent and visibility of a collection.
+//
+// POST /collections/:id/edit
+func (c *Collections) Edit(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.ownCollection(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	var form CollectionForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		c.renderEdit(w, r, vd, collection)
+		return
+	}
+	form.apply(collection)
+	if err := c.cs.Update(collection); err != nil {
+		vd.SetAlert(err)
+	} else {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "Collection updated successfully.",
+		}
+	}
+	c.renderEdit(w, r, vd, collection)
+}
+
+// Galleries moves the checked galleries into a collection, and the
+// unchecked ones that were in it out of it.
+//
+// POST /collections/:id/galleries
+func (c *Collections) Galleries(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.ownCollection(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	var form CollectionGalleriesForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		c.renderEdit(w, r, vd, collection)
+		return
+	}
+	current, err := c.gs.ByCollectionID(collection.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		c.renderEdit(w, r, vd, collection)
+		return
+	}
+	keep := make(map[uint]bool, len(form.GalleryIDs))
+	for _, id := range form.GalleryIDs {
+		keep[id] = true
+	}
+	var removed []uint
+	for _, gallery := range current {
+		if !keep[gallery.ID] {
+			removed = append(removed, gallery.ID)
+		}
+	}
+	err = c.gs.MoveToCollection(collection.UserID, collection.ID, form.GalleryIDs)
+	if err == nil {
+		err = c.gs.MoveToCollection(collection.UserID, 0, removed)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		c.renderEdit(w, r, vd, collection)
+		return
+	}
+	c.redirectToEdit(w, r, collection)
+}
+
+// Share gives a collection a new share link. Any link it had before stops
+// working.
+//
+// POST /collections/:id/share
+func (c *Collections) Share(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.ownCollection(w, r)
+	if err != nil {
+		return
+	}
+	if err := c.cs.Share(collection); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		c.renderEdit(w, r, vd, collection)
+		return
+	}
+	c.redirectToEdit(w, r, collection)
+}
+
+// Unshare removes the share link of a collection.
+//
+// POST /collections/:id/unshare
+func (c *Collections) Unshare(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.ownCollection(w, r)
+	if err != nil {
+		return
+	}
+	if err := c.cs.Unshare(collection); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		c.renderEdit(w, r, vd, collection)
+		return
+	}
+	c.redirectToEdit(w, r, collection)
+}
+
+// Delete removes a collection. The galleries and collections in it are kept.
+//
+// POST /collections/:id/delete
+func (c *Collections) Delete(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.ownCollection(w, r)
+	if err != nil {
+		return
+	}
+	if err := c.cs.Delete(collection.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		c.renderEdit(w, r, vd, collection)
+		return
+	}
+	url, err := c.r.Get(IndexCollections).URL()
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+func (c *Collections) renderEdit(w http.ResponseWriter, r *http.Request, vd views.Data, collection *models.Collection) {
+	edit := CollectionEdit{Collection: collection}
+	collections, err := c.cs.ByUserID(collection.UserID)
+	if err == nil {
+		edit.AllGalleries, err = c.gs.ByUserId(collection.UserID)
+	}
+	if err != nil {
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	for _, other := range collections {
+		if other.ParentID == 0 && other.ID != collection.ID {
+			edit.Parents = append(edit.Parents, other)
+		}
+	}
+	vd.Yield = &edit
+	c.EditView.Render(w, r, vd)
+}
+
+// loadContents looks up the collections and galleries in collection that
+// user can see, along with their cover images. Pass a nil user to load
+// everything, for share links.
+func (c *Collections) loadContents(collection *models.Collection, user *models.User) error {
+	galleries, err := c.visibleGalleries(collection.ID, user)
+	if err != nil {
+		return err
+	}
+	collection.Galleries = galleries
+	children, err := c.cs.Children(collection.ID)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if user != nil && !child.VisibleTo(user) {
+			continue
+		}
+		// Children are shown by their first gallery's cover
+		galleries, err := c.visibleGalleries(child.ID, user)
+		if err != nil {
+			return err
+		}
+		if len(galleries) > 0 {
+			child.Cover = galleries[0].Cover
+		}
+		collection.Children = append(collection.Children, child)
+	}
+	return nil
+}
+
+// visibleGalleries returns the galleries in a collection that user can
+// see, with their cover images. A nil user sees every gallery.
+func (c *Collections) visibleGalleries(collectionID uint, user *models.User) ([]models.Gallery, error) {
+	galleries, err := c.gs.ByCollectionID(collectionID)
+	if err != nil {
+		return nil, err
+	}
+	visible := galleries[:0]
+	for _, gallery := range galleries {
+		if user != nil && !gallery.VisibleTo(user) {
+			continue
+		}
+		// Galleries without any images simply don't have a cover
+		if cover, err := c.is.Cover(&gallery); err == nil {
+			// Only the owner sees the clean cover of a watermarked gallery
+			if user == nil || user.ID != gallery.UserID {
+				cover.Watermark = gallery.WatermarkVersion()
+			}
+			gallery.Cover = cover
+		}
+		visible = append(visible, gallery)
+	}
+	return visible, nil
+}
+
+// sharedCollection looks up the collection whose share token is in the URL,
+// rendering an error if there isn't one.
+func (c *Collections) sharedCollection(w http.ResponseWriter, r *http.Request) (*models.Collection, error) {
+	collection, err := c.cs.ByShareToken(mux.Vars(r)["token"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Collection not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return collection, nil
+}
+
+// sharedChild looks up the collection with the given ID in shared,
+// rendering an error if it isn't one of shared's children.
+func (c *Collections) sharedChild(w http.ResponseWriter, shared *models.Collection, id string) (*models.Collection, error) {
+	childID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return nil, err
+	}
+	child, err := c.cs.ByID(uint(childID))
+	if err == nil && child.ParentID != shared.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Collection not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return child, nil
+}
+
+// ownCollection looks up the collection in the URL, rendering an error if
+// it can't be found or doesn't belong to the current user.
+func (c *Collections) ownCollection(w http.ResponseWriter, r *http.Request) (*models.Collection, error) {
+	collection, err := c.collectionByID(w, r)
+	if err != nil {
+		return nil, err
+	}
+	user := context.User(r.Context())
+	if collection.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this collection.", http.StatusForbidden)
+		return nil, errForbidden
+	}
+	return collection, nil
+}
+
+// collectionByID looks up the collection in the URL, rendering an error if
+// it can't be found.
+func (c *Collections) collectionByID(w http.ResponseWriter, r *http.Request) (*models.Collection, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid collection ID", http.StatusNotFound)
+		return nil, err
+	}
+	collection, err := c.cs.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Collection not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return collection, nil
+}
+
+// redirectToEdit sends the user back to the edit page of collection.
+func (c *Collections) redirectToEdit(w http.ResponseWriter, r *http.Request, collection *models.Collection) {
+	url, err := c.r.Get(EditCollection).URL("id", fmt.Sprintf("%v", collection.ID))
+	if err != nil {
+		http.Redirect(w, r, "/collections", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// nestCollections puts child collections into their parents, returning the
+// top level ones.
+func nestCollections(collections []models.Collection) []models.Collection {
+	children := make(map[uint][]models.Collection)
+	for _, collection := range collections {
+		if collection.ParentID != 0 {
+			children[collection.ParentID] = append(children[collection.ParentID], collection)
+		}
+	}
+	var top []models.Collection
+	for _, collection := range collections {
+		if collection.ParentID == 0 {
+			collection.Children = children[collection.ID]
+			top = append(top, collection)
+		}
+	}
+	return top
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/models"
+)
+
+func TestNestCollections(t *testing.T) {
+	collection := func(id, parentID uint) models.Collection {
+		return models.Collection{Model: gorm.Model{ID: id}, ParentID: parentID}
+	}
+	// Sorted by title, so children can come before their parents
+	top := nestCollections([]models.Collection{collection(3, 1), collection(1, 0), collection(2, 0), collection(4, 1)})
+
+	var got [][]uint
+	for _, c := range top {
+		ids := []uint{c.ID}
+		for _, child := range c.Children {
+			ids = append(ids, child.ID)
+		}
+		got = append(got, ids)
+	}
+	if want := [][]uint{{1, 3, 4}, {2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nestCollections() = %v; want %v", got, want)
+	}
+}
+
+func TestCollectionShowURLs(t *testing.T) {
+	collection := models.Collection{Model: gorm.Model{ID: 5}}
+	gallery := models.Gallery{Model: gorm.Model{ID: 7}, UserID: 1, Slug: "summer"}
+	tests := []struct {
+		token      string
+		collection string
+		gallery    string
+	}{
+		{"", "/collections/5", "/users/1/galleries/summer"},
+		// Private galleries are only shown to visitors of a share link under it
+		{"tok", "/c/tok/collections/5", "/c/tok/galleries/7"},
+	}
+	for _, tt := range tests {
+		show := &CollectionShow{ShareToken: tt.token}
+		if got := show.CollectionURL(collection); got != tt.collection {
+			t.Errorf("CollectionURL() with token %q = %q; want %q", tt.token, got, tt.collection)
+		}
+		if got := show.GalleryURL(gallery); got != tt.gallery {
+			t.Errorf("GalleryURL() with token %q = %q; want %q", tt.token, got, tt.gallery)
+		}
+	}
+}
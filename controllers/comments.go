@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/email"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/views"
+)
+
+// Comments handles the comments on galleries and their images, and their
+// moderation by the owners of the galleries.
+type Comments struct {
+	cs      models.CommentService
+	us      models.UserService
+	emailer *email.Client
+	// galleries looks up the galleries comments are on, and renders their
+	// edit page.
+	galleries *Galleries
+	r         *mux.Router
+	// baseURL is where the app is served from, for links in emails.
+	baseURL string
+}
+
+func NewComments(cs models.CommentService, us models.UserService, emailer *email.Client, galleries *Galleries, r *mux.Router, baseURL string) *Comments {
+	return &Comments{
+		cs:        cs,
+		us:        us,
+		emailer:   emailer,
+		galleries: galleries,
+		r:         r,
+		baseURL:   strings.TrimRight(baseURL, "/"),
+	}
+}
+
+// CommentForm posts a comment on a gallery, or one of its images.
+type CommentForm struct {
+	Body string `schema:"body"`
+	// Name is who the comment is from, only asked of visitors who aren't signed in.
+	Name string `schema:"name"`
+	// ImageID is the image the comment is on, 0 for the gallery itself.
+	ImageID uint `schema:"image_id"`
+	// Website is a field hidden from people, so anything in it was filled
+	// in by a spam bot.
+	Website  string `schema:"website"`
+	ReturnTo string `schema:"return_to"`
+}
+
+// CommentModerationForm sets whether a gallery holds new comments until
+// its owner approves them.
+type CommentModerationForm struct {
+	ModerateComments bool `schema:"moderate_comments"`
+}
+
+// CommentCreate posts a comment on a gallery, or one of its images, and
+// lets the owner know about it. Signed in users can comment on galleries
+// they can see, and visitors on galleries shared with them, passing the
+// token of the share link in the "share" query parameter.
+//
+// POST /galleries/:id/comments
+func (c *Comments) Create(w http.ResponseWriter, r *http.Request) {
+	gallery, err := c.galleries.lookupGallery(w, r)
+	if err != nil {
+		return
+	}
+	c.galleries.useShareLink(r, gallery)
+	user := context.User(r.Context())
+	if !canComment(user, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+
+	var form CommentForm
+	if err := parseForm(r, &form); err != nil {
+		redirectToShow(w, r, gallery, form.ReturnTo, err)
+		return
+	}
+	comment := models.Comment{
+		ImageID: form.ImageID,
+		Name:    form.Name,
+		Body:    form.Body,
+		Spam:    form.Website != "",
+	}
+	if user != nil {
+		comment.UserID = user.ID
+		comment.Name = user.Name
+	}
+	if err := c.cs.Post(gallery, &comment); err != nil {
+		redirectToShow(w, r, gallery, form.ReturnTo, err)
+		return
+	}
+	// Spam waits among the held comments without bothering the owner
+	if !comment.Spam && comment.UserID != gallery.UserID {
+		c.notifyComment(gallery, &comment)
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Thanks for your comment!",
+	}
+	if comment.Pending() {
+		alert.Message = "Thanks! Your comment will show once the owner of the gallery approves it."
+	}
+	views.RedirectAlert(w, r, showPath(gallery, form.ReturnTo), http.StatusFound, alert)
+}
+
+// CommentModeration sets whether a gallery holds new comments until its
+// owner approves them.
+//
+// POST /galleries/:id/comments/moderation
+func (c *Comments) Moderation(w http.ResponseWriter, r *http.Request) {
+	gallery, err := c.galleries.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanManage() {
+		http.Error(w, "You do not have permission to moderate comments in this gallery.", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form CommentModerationForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		c.galleries.EditView.Render(w, r, vd)
+		return
+	}
+	gallery.ModerateComments = form.ModerateComments
+	if err := c.galleries.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		c.galleries.EditView.Render(w, r, vd)
+		return
+	}
+	c.galleries.redirectToEdit(w, r, gallery)
+}
+
+// CommentApprove shows a pending or hidden comment on its gallery.
+//
+// POST /galleries/:id/comments/:commentID/approve
+func (c *Comments) Approve(w http.ResponseWriter, r *http.Request) {
+	gallery, comment, err := c.commentByID(w, r)
+	if err != nil {
+		return
+	}
+	c.moderated(w, r, gallery, c.cs.Approve(comment))
+}
+
+// CommentHide takes a comment off its gallery, without deleting it.
+//
+// POST /galleries/:id/comments/:commentID/hide
+func (c *Comments) Hide(w http.ResponseWriter, r *http.Request) {
+	gallery, comment, err := c.commentByID(w, r)
+	if err != nil {
+		return
+	}
+	c.moderated(w, r, gallery, c.cs.Hide(comment))
+}
+
+// CommentDelete deletes a comment.
+//
+// POST /galleries/:id/comments/:commentID/delete
+func (c *Comments) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, comment, err := c.commentByID(w, r)
+	if err != nil {
+		return
+	}
+	c.moderated(w, r, gallery, c.cs.Delete(comment.ID))
+}
+
+// moderated renders the edit page with err if moderating a comment
+// failed, or else sends the owner back to it.
+func (c *Comments) moderated(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, err error) {
+	if err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		c.galleries.EditView.Render(w, r, vd)
+		return
+	}
+	c.galleries.redirectToEdit(w, r, gallery)
+}
+
+// showComments loads the approved comments on the gallery and its images
+// into show, and whether the visitor can add to them.
+func (g *Galleries) showComments(r *http.Request, show *GalleryShow) {
+	comments, err := g.cs.Approved(show.ID)
+	if err != nil {
+		log.Printf("controllers: couldn't load comments in gallery %d: %v", show.ID, err)
+	}
+	show.Comments = comments
+	show.CanComment = canComment(context.User(r.Context()), show.Gallery)
+}
+
+// canComment reports whether user can comment on gallery. Visitors who
+// aren't signed in need to be viewing it through a share link.
+func canComment(user *models.User, gallery *models.Gallery) bool {
+	if user != nil && (gallery.VisibleTo(user) || gallery.Role.CanView()) {
+		return true
+	}
+	return gallery.Share != nil
+}
+
+// notifyComment emails the owner of gallery about comment. Comments are
+// saved either way, so failures are only logged.
+func (c *Comments) notifyComment(gallery *models.Gallery, comment *models.Comment) {
+	owner, err := c.us.ById(gallery.UserID)
+	if err != nil {
+		log.Printf("controllers: couldn't look up owner of gallery %d to notify of comment %d: %v", gallery.ID, comment.ID, err)
+		return
+	}
+	moderateURL := c.baseURL + gallery.Path()
+	if url, err := c.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID)); err == nil {
+		moderateURL = c.baseURL + url.Path + "#comments"
+	}
+	if err := c.emailer.CommentNotification(owner.Email, comment.Name, gallery.Title, comment.Body, moderateURL, comment.Pending()); err != nil {
+		log.Printf("controllers: couldn't email owner of gallery %d about comment %d: %v", gallery.ID, comment.ID, err)
+	}
+}
+
+// commentByID looks up the gallery and comment in the URL, making sure
+// the comment belongs to the gallery and the current user owns it.
+func (c *Comments) commentByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Comment, error) {
+	gallery, err := c.galleries.lookupGallery(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !gallery.Role.CanManage() {
+		http.Error(w, "You do not have permission to moderate comments in this gallery.", http.StatusForbidden)
+		return nil, nil, errForbidden
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["commentID"])
+	if err != nil {
+		http.Error(w, "Invalid comment ID", http.StatusNotFound)
+		return nil, nil, err
+	}
+	comment, err := c.cs.ByID(uint(id))
+	if err == nil && comment.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Comment not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, nil, err
+	}
+	return gallery, comment, nil
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/imaging"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/storage"
+)
+
+// Download streams a ZIP archive with every image in a gallery. Whoever can
+// see the gallery page can download it, and private galleries need a share
+// link that allows downloads, passed as the "share" query parameter. The
+// "size" query parameter picks the width of the resized copies to download
+// instead of the originals, one of the widths variants are made in.
+//
+// GET /galleries/:id/download
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	g.useShareLink(r, gallery)
+	if !canDownload(gallery, context.User(r.Context())) {
+		http.Error(w, "You do not have permission to download this gallery.", http.StatusForbidden)
+		return
+	}
+	width := 0
+	if size := r.URL.Query().Get("size"); size != "" && size != "original" {
+		width, err = strconv.Atoi(size)
+		if err != nil || !g.variantWidth(width) {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+	g.record(r, gallery, models.StatDownload, 0)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": archiveName(gallery),
+	}))
+	// Images are written straight to the response one at a time, so the
+	// archive is never held in memory or on disk as a whole.
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool)
+	for i := range gallery.Images {
+		image := &gallery.Images[i]
+		if err := g.writeArchiveEntry(zw, gallery, image, width, names); err != nil {
+			// The response has already started, so there's no way to report
+			// the error. Leaving the archive unfinished at least makes the
+			// download fail instead of silently missing images.
+			log.Printf("controllers: couldn't add image %d to archive of gallery %d: %v", image.ID, gallery.ID, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("controllers: couldn't finish archive of gallery %d: %v", gallery.ID, err)
+	}
+}
+
+// canDownload reports whether user, viewing gallery through gallery.Share
+// if any, is allowed to download it. Like the gallery page, public
+// galleries are open to everyone, and private ones to their owner and
+// collaborators.
+func canDownload(gallery *models.Gallery, user *models.User) bool {
+	if gallery.VisibleTo(user) || gallery.Role.CanView() {
+		return true
+	}
+	return gallery.Share != nil && gallery.Share.AllowDownloads
+}
+
+// variantWidth reports whether width is one of the widths variants of
+// images are made in.
+func (g *Galleries) variantWidth(width int) bool {
+	for _, w := range g.is.VariantWidths() {
+		if w == width {
+			return true
+		}
+	}
+	return false
+}
+
+// writeArchiveEntry adds the file of image to zw. names holds the names
+// already in the archive, so images uploaded with the same name don't
+// overwrite each other when extracted.
+func (g *Galleries) writeArchiveEntry(zw *zip.Writer, gallery *models.Gallery, image *models.Image, width int, names map[string]bool) error {
+	f, ext, err := g.openArchiveEntry(gallery, image, width)
+	if err == storage.ErrNotExist || err == models.ErrNotFound {
+		// Images that are still being processed don't have their files yet
+		log.Printf("controllers: skipping image %d in archive, its file doesn't exist yet", image.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	name := image.Filename
+	if ext != "" {
+		name = strings.TrimSuffix(name, path.Ext(name)) + ext
+	}
+	header := &zip.FileHeader{
+		Name: uniqueName(name, names),
+		// Images are already compressed, so deflating them again would only waste CPU
+		Method:   zip.Store,
+		Modified: image.CreatedAt,
+	}
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, f)
+	return err
+}
+
+// openArchiveEntry opens the file of image to download, along with the
+// extension to name it with if it isn't in the format it was uploaded in.
+// Visitors who are only shown the watermarked copies of a gallery download
+// those too, unless their share link allows downloads.
+func (g *Galleries) openArchiveEntry(gallery *models.Gallery, image *models.Image, width int) (io.ReadCloser, string, error) {
+	if gallery.Watermarked() && !gallery.Role.CanView() && (gallery.Share == nil || !gallery.Share.AllowDownloads) {
+		f, err := g.is.OpenWatermarked(gallery, image, width, imaging.JPEG)
+		if err == models.ErrNotFound && width != 0 {
+			// Images smaller than width only have the full size copy
+			f, err = g.is.OpenWatermarked(gallery, image, 0, imaging.JPEG)
+		}
+		return f, imaging.JPEG.Ext(), err
+	}
+	// Images without the variant asked for are downloaded as they are
+	// served, in their own format
+	f, variant, err := g.is.Open(image, width)
+	if err != nil || variant == nil {
+		return f, "", err
+	}
+	return f, variant.Format.Ext(), nil
+}
+
+// uniqueName returns name, or "name (2).ext", "name (3).ext", etc. if it
+// is already in names, and adds the result to names.
+func uniqueName(name string, names map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	unique := name
+	for i := 2; names[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	names[strings.ToLower(unique)] = true
+	return unique
+}
+
+// archiveName is the file name a gallery is downloaded as, eg:
+// "summer-wedding-2019.zip" for a gallery titled "Summer Wedding 2019".
+// It only depends on the title, so downloading twice gives the same name.
+func archiveName(gallery *models.Gallery) string {
+	name := models.Slugify(gallery.Title)
+	if name == "" {
+		name = fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	return name + ".zip"
+}
@@ -1,12 +1,20 @@
 package controllers
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"mime/multipart"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/markdown"
 	"github.com/torresjeff/gallery/models"
 	"github.com/torresjeff/gallery/views"
 )
@@ -17,53 +25,277 @@ const (
 	EditGallery    = "edit_gallery"
 
 	maxMultipartMemory = 1 << 20 // 1 MB
+	// eventDateFormat is the format of NewGalleryForm.EventDate.
+	eventDateFormat = "2006-01-02"
+
+	errEventDateInvalid publicError = "The event date must be a date, like 2019-06-21."
+	errGalleryNotFound  publicError = "Gallery not found"
 )
 
+// Galleries handles galleries and their images. The members, selections,
+// comments, stats and uploads of galleries have their own controllers,
+// which look galleries up and render their edit page through this one.
 type Galleries struct {
 	CreateGalleryView *views.View
 	ShowView          *views.View
 	EditView          *views.View
 	IndexView         *views.View
+	ImageView         *views.View
 	gs                models.GalleryService
 	is                models.ImageService
-	r                 *mux.Router
+	sls               models.ShareLinkService
+	ms                models.GalleryMemberService
+	// ss, cs and stats add the visitor's selection and the comments to
+	// gallery pages, and count views.
+	ss             models.SelectionService
+	cs             models.CommentService
+	stats          models.StatsService
+	r              *mux.Router
+	maxUploadBytes int64
 }
 
 type NewGalleryForm struct {
-	Title string `schema:"title"`
+	Title       string `schema:"title"`
+	Description string `schema:"description"`
+	// EventDate is formatted like date inputs send it, eg: "2019-06-21".
+	EventDate string `schema:"event_date"`
+	Location  string `schema:"location"`
+	Slug      string `schema:"slug"`
+	// Tags are separated by commas, eg: "wedding, family".
+	Tags       string `schema:"tags"`
+	Visibility string `schema:"visibility"`
+}
+
+// apply copies the form to gallery.
+func (form *NewGalleryForm) apply(gallery *models.Gallery) error {
+	gallery.Title = form.Title
+	gallery.Description = form.Description
+	gallery.Location = form.Location
+	gallery.Slug = form.Slug
+	gallery.Tags = models.ParseTags(form.Tags)
+	gallery.Visibility = models.Visibility(form.Visibility)
+	gallery.EventDate = nil
+	if form.EventDate != "" {
+		date, err := time.Parse(eventDateFormat, form.EventDate)
+		if err != nil {
+			return errEventDateInvalid
+		}
+		gallery.EventDate = &date
+	}
+	return nil
+}
+
+type ImageOrderForm struct {
+	Order string `schema:"order"`
+}
+
+// GalleryIndex is the data the galleries index page is rendered with.
+type GalleryIndex struct {
+	Galleries []models.Gallery
+	// Shared are the galleries of other users the current user collaborates on.
+	Shared []models.Gallery
+	Usage  *models.Usage
+	Sort   models.GallerySort
+	Pager  Pager
+}
+
+// GalleryShow is the data the gallery page is rendered with. Gallery has
+// the images of the page being shown, in Gallery.ImageOrder.
+type GalleryShow struct {
+	*models.Gallery
+	Pager Pager
+	// Selection is the selection the visitor is making, if the gallery
+	// takes selections.
+	Selection *models.Selection
+	// Comments are the approved comments on the gallery and its images,
+	// and CanComment whether the visitor can add to them.
+	Comments   []models.Comment
+	CanComment bool
+	// ReturnTo is the page to come back to after picking images or commenting.
+	ReturnTo string
+	// ImageBase is the path the pages of images are under: the gallery's
+	// own, or the collection share link's it is viewed through.
+	ImageBase string
+	// ImageQuery is the query string of links to the pages of images, to
+	// keep the share link and sort order the visitor is using.
+	ImageQuery string
+}
+
+// ImagePath is the path of the page of the image with the given ID.
+func (show GalleryShow) ImagePath(imageID uint) string {
+	return fmt.Sprintf("%s/images/%d%s", show.ImageBase, imageID, show.ImageQuery)
+}
+
+// ImagePick is what the pick form of an image is rendered with.
+type ImagePick struct {
+	GalleryShow
+	ImageID uint
+	// Pick is the image in the visitor's selection, nil if they didn't pick it.
+	Pick *models.SelectionPick
+}
+
+// PickOf returns the pick form of the image with the given ID. It must
+// only be called when show has a Selection.
+func (show GalleryShow) PickOf(imageID uint) ImagePick {
+	return ImagePick{GalleryShow: show, ImageID: imageID, Pick: show.Selection.Pick(imageID)}
+}
+
+// CommentThread is what the comments on a gallery, or one of its images,
+// are rendered with along with the form to add one.
+type CommentThread struct {
+	GalleryShow
+	// ImageID is the image the comments are on, 0 for the gallery itself.
+	ImageID  uint
+	Comments []models.Comment
+}
+
+// Thread returns the comments on the image with the given ID, or on the
+// gallery itself for 0.
+func (show GalleryShow) Thread(imageID uint) CommentThread {
+	thread := CommentThread{GalleryShow: show, ImageID: imageID}
+	for _, comment := range show.Comments {
+		if comment.ImageID == imageID {
+			thread.Comments = append(thread.Comments, comment)
+		}
+	}
+	return thread
+}
+
+// DuplicateGalleryForm is how a gallery is duplicated.
+type DuplicateGalleryForm struct {
+	// Images copies the images of the gallery too, rather than only its settings.
+	Images bool `schema:"images"`
+}
+
+type MetadataForm struct {
+	Metadata string `schema:"metadata"`
+}
+
+// ImageDetailsForm describes an image, edited on the gallery edit page.
+type ImageDetailsForm struct {
+	Title   string `schema:"title"`
+	Caption string `schema:"caption"`
+	AltText string `schema:"alt_text"`
+	// Tags are separated by commas, eg: "sunset, beach".
+	Tags string `schema:"tags"`
+}
+
+// ImageReorderRequest is the JSON body sent by the edit page after the
+// owner drags images into a new order.
+type ImageReorderRequest struct {
+	ImageIDs []uint `json:"image_ids"`
 }
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+// imageJSON is the JSON representation of an image.
+type imageJSON struct {
+	ID        uint   `json:"id"`
+	GalleryID uint   `json:"gallery_id"`
+	Filename  string `json:"filename"`
+	Title     string `json:"title"`
+	Caption   string `json:"caption"`
+	// CaptionHTML is Caption rendered from Markdown, safe to insert into pages.
+	CaptionHTML template.HTML `json:"caption_html"`
+	AltText     string        `json:"alt_text"`
+	Position    int           `json:"position"`
+	Path        string        `json:"path"`
+}
+
+func newImageJSON(image *models.Image) imageJSON {
+	return imageJSON{
+		ID:          image.ID,
+		GalleryID:   image.GalleryID,
+		Filename:    image.Filename,
+		Title:       image.Title,
+		Caption:     image.Caption,
+		CaptionHTML: markdown.Render(image.Caption),
+		AltText:     image.AltText,
+		Position:    image.Position,
+		Path:        image.Path(),
+	}
+}
+
+// NewGalleries creates the galleries controller. maxUploadBytes limits the
+// size of a single image upload request, including all of its files.
+func NewGalleries(gs models.GalleryService, is models.ImageService, sls models.ShareLinkService, ms models.GalleryMemberService, ss models.SelectionService, cs models.CommentService, stats models.StatsService, r *mux.Router, maxUploadBytes int64) *Galleries {
 	return &Galleries{
 		CreateGalleryView: views.NewView("bootstrap", "galleries/new"),
-		ShowView:          views.NewView("bootstrap", "galleries/show"),
+		ShowView:          views.NewView("bootstrap", "galleries/show", "galleries/partials"),
 		EditView:          views.NewView("bootstrap", "galleries/edit"),
 		IndexView:         views.NewView("bootstrap", "galleries/index"),
+		ImageView:         views.NewView("bootstrap", "galleries/image", "galleries/partials"),
 		gs:                gs,
 		is:                is,
+		sls:               sls,
+		ms:                ms,
+		ss:                ss,
+		cs:                cs,
+		stats:             stats,
 		r:                 r,
+		maxUploadBytes:    maxUploadBytes,
 	}
 }
 
 func (g *Galleries) RenderCreateGallery(w http.ResponseWriter, r *http.Request) {
-	g.CreateGalleryView.Render(w, r, nil)
+	var vd views.Data
+	vd.Yield = &NewGalleryForm{}
+	g.CreateGalleryView.Render(w, r, vd)
 }
 
 func (g *Galleries) RenderIndex(w http.ResponseWriter, r *http.Request) {
+	var form PageForm
+	if err := parseQuery(r, &form); err != nil {
+		renderPageError(w, errPageInvalid)
+		return
+	}
 	user := context.User(r.Context())
-	galleries, err := g.gs.ByUserId(user.ID)
+	sort := models.GallerySort(form.Sort)
+	if sort == "" {
+		sort = models.GallerySortNewest
+	}
+	galleries, pagination, err := g.gs.ByUserIDPage(user.ID, sort, form.page())
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	for i := range galleries {
+		// Galleries without any images simply don't have a cover
+		cover, err := g.is.Cover(&galleries[i])
+		if err == nil {
+			galleries[i].Cover = cover
+		}
+		usage, err := g.is.GalleryUsage(galleries[i].ID)
+		if err == nil {
+			galleries[i].Usage = usage
+		}
+	}
+	usage, err := g.is.Usage(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	shared, err := g.gs.SharedWith(user.ID)
 	if err != nil {
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
 	var vd views.Data
-	vd.Yield = galleries
+	vd.Yield = GalleryIndex{
+		Galleries: galleries,
+		Shared:    shared,
+		Usage:     usage,
+		Sort:      sort,
+		Pager: Pager{
+			Pagination: pagination,
+			Links:      newPageLinks(r.URL, pagination, false),
+		},
+	}
 	g.IndexView.Render(w, r, vd)
 }
 
 func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 	var form NewGalleryForm
+	vd.Yield = &form
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
 		g.CreateGalleryView.Render(w, r, vd)
@@ -72,9 +304,13 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 
 	user := context.User(r.Context())
 	gallery := models.Gallery{
-		Title:  form.Title,
 		UserID: user.ID,
 	}
+	if err := form.apply(&gallery); err != nil {
+		vd.SetAlert(err)
+		g.CreateGalleryView.Render(w, r, vd)
+		return
+	}
 	if err := g.gs.Create(&gallery); err != nil {
 		vd.SetAlert(err)
 		g.CreateGalleryView.Render(w, r, vd)
@@ -91,19 +327,146 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Show shows a page of the images of a gallery. The "sort" query parameter
+// picks an image order other than the gallery's own.
+//
+// GET /galleries/:id
 func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.lookupGallery(w, r)
+	if err != nil {
+		// The lookupGallery would have already rendered the error, so simply return
+		return
+	}
 
-	gallery, err := g.galleryByID(w, r)
+	// Private galleries are hidden from everyone but their owner and
+	// collaborators, unless they follow a share link
+	if !gallery.VisibleTo(context.User(r.Context())) && !gallery.Role.CanView() {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+
+	gallery.Downloadable = canDownload(gallery, context.User(r.Context()))
+	g.renderShow(w, r, gallery, imageBase(gallery))
+}
+
+// ShowShared shows a gallery to someone who followed one of its share links.
+//
+// GET /s/:token
+func (g *Galleries) ShowShared(w http.ResponseWriter, r *http.Request) {
+	link, err := g.sls.ByToken(mux.Vars(r)["token"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	gallery, err := g.gallery(w, r, link.GalleryID)
 	if err != nil {
-		// The galleryByID would have already rendered the error, so simply return
 		return
 	}
+	gallery.Share = link
+	gallery.Downloadable = canDownload(gallery, context.User(r.Context()))
+	g.renderShow(w, r, gallery, imageBase(gallery))
+}
+
+// renderShow renders the gallery page with the page of images asked for,
+// linking to the pages of images under base.
+func (g *Galleries) renderShow(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, base string) {
+	images, pagination, err := g.imagesPage(r, gallery)
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	watermarkImages(gallery, images)
+	gallery.Images = images
 
+	show := GalleryShow{
+		Gallery: gallery,
+		Pager: Pager{
+			Pagination: pagination,
+			Links:      newPageLinks(r.URL, pagination, false),
+		},
+		ReturnTo:   r.URL.RequestURI(),
+		ImageBase:  base,
+		ImageQuery: imageQuery(r, gallery),
+	}
+	g.showSelection(r, &show)
+	g.showComments(r, &show)
+	g.record(r, gallery, models.StatView, 0)
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = show
 	g.ShowView.Render(w, r, vd)
 }
 
+// ImageIndex lists a page of the images of a gallery as JSON, with the
+// other pages linked in the Link header. Like the gallery page, it takes a
+// "sort" query parameter, and private galleries need the token of a share
+// link in the "share" query parameter.
+//
+// GET /galleries/:id/images
+func (g *Galleries) ImageIndex(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.lookupGallery(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.VisibleTo(context.User(r.Context())) && !gallery.Role.CanView() && !g.sharedWith(r, gallery) {
+		renderJSONError(w, http.StatusNotFound, errGalleryNotFound)
+		return
+	}
+	images, pagination, err := g.imagesPage(r, gallery)
+	if err != nil {
+		switch err {
+		case models.ErrImageOrderInvalid, models.ErrCursorInvalid, errPageInvalid:
+			renderJSONError(w, http.StatusBadRequest, err)
+		default:
+			renderJSONError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	watermarkImages(gallery, images)
+	ret := make([]imageJSON, len(images))
+	for i := range images {
+		ret[i] = newImageJSON(&images[i])
+	}
+	setLinkHeader(w, newPageLinks(r.URL, pagination, true))
+	renderJSON(w, http.StatusOK, map[string]interface{}{
+		"images": ret,
+		"total":  pagination.Total,
+	})
+}
+
+// imagesPage looks up the page of the images of gallery asked for in the
+// URL query. The order the images are in is saved to gallery.ImageOrder.
+func (g *Galleries) imagesPage(r *http.Request, gallery *models.Gallery) ([]models.Image, *models.Pagination, error) {
+	var form PageForm
+	if err := parseQuery(r, &form); err != nil {
+		return nil, nil, errPageInvalid
+	}
+	if form.Sort != "" {
+		gallery.ImageOrder = models.ImageOrder(form.Sort)
+	}
+	return g.is.ByGalleryIDPage(gallery.ID, gallery.ImageOrder, form.page())
+}
+
+// sharedWith reports whether the request has the token of one of the share
+// links of gallery in the "share" query parameter.
+func (g *Galleries) sharedWith(r *http.Request, gallery *models.Gallery) bool {
+	link, err := g.sls.ByToken(r.URL.Query().Get("share"))
+	return err == nil && link.GalleryID == gallery.ID
+}
+
+// useShareLink sets gallery.Share to the share link whose token is in the
+// "share" query parameter, if it is one of the links of gallery.
+func (g *Galleries) useShareLink(r *http.Request, gallery *models.Gallery) {
+	link, err := g.sls.ByToken(r.URL.Query().Get("share"))
+	if err == nil && link.GalleryID == gallery.ID {
+		gallery.Share = link
+	}
+}
+
 func (g *Galleries) RenderEdit(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
@@ -111,8 +474,7 @@ func (g *Galleries) RenderEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
+	if !gallery.Role.CanUpload() {
 		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
 		return
 	}
@@ -128,8 +490,7 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
+	if !gallery.Role.CanEdit() {
 		http.Error(w, "Gallery not found", http.StatusNotFound)
 		return
 	}
@@ -143,8 +504,10 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		g.EditView.Render(w, r, vd)
 		return
 	}
-	gallery.Title = form.Title
-	err = g.gs.Update(gallery)
+	err = form.apply(gallery)
+	if err == nil {
+		err = g.gs.Update(gallery)
+	}
 	if err != nil {
 		vd.SetAlert(err)
 	} else {
@@ -163,8 +526,7 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
+	if !gallery.Role.CanManage() {
 		http.Error(w, "You do not have permission to delete this gallery", http.StatusForbidden)
 		return
 	}
@@ -186,53 +548,183 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
+// Duplicate creates a gallery like this one, for recurring events, and
+// sends the user to edit it.
+//
+// POST /galleries/:id/duplicate
+func (g *Galleries) Duplicate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanManage() {
+		http.Error(w, "You do not have permission to duplicate this gallery.", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form DuplicateGalleryForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	dup := gallery.Duplicate()
+	if err := g.gs.Create(&dup); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	if form.Images {
+		if err := g.copyImages(gallery, &dup); err != nil {
+			// The new gallery exists by now, so show what was copied before the error
+			vd.SetAlert(err)
+			g.redirectToEditAlert(w, r, &dup, *vd.Alert)
+			return
+		}
+	}
+	g.redirectToEdit(w, r, &dup)
+}
+
+// copyImages copies the images of gallery into dup, in order, keeping the
+// same cover image.
+func (g *Galleries) copyImages(gallery, dup *models.Gallery) error {
+	for i := range gallery.Images {
+		image, err := g.is.Copy(&gallery.Images[i], dup.ID)
+		if err != nil {
+			return err
+		}
+		if gallery.Images[i].ID == gallery.CoverImageID {
+			dup.CoverImageID = image.ID
+			if err := g.gs.Update(dup); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
+	if !gallery.Role.CanUpload() {
 		http.Error(w, "Gallery not found", http.StatusNotFound)
 		return
 	}
 
+	user := context.User(r.Context())
 	var vd views.Data
 	vd.Yield = gallery
+	// Stop reading the request once it goes over the limit, instead of
+	// filling up the disk with multipart temp files first
+	r.Body = http.MaxBytesReader(w, r.Body, g.maxUploadBytes)
 	err = r.ParseMultipartForm(maxMultipartMemory)
 	if err != nil {
 		// Couldn't parse form, set alert
-		vd.SetAlert(err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			vd.AlertError(fmt.Sprintf("Uploads are limited to %d MB at a time. Please upload fewer images at once.", g.maxUploadBytes>>20))
+		} else {
+			vd.SetAlert(err)
+		}
 		g.EditView.Render(w, r, vd)
 		return
 	}
 
-	// Iterate over uploaded files to process them
+	// Iterate over uploaded files to process them. A bad file doesn't stop
+	// the rest of the batch, we let the user know which ones we skipped.
+	// ZIP archives are imported entry by entry, as if each image in them
+	// had been uploaded on its own.
 	files := r.MultipartForm.File["images"]
-	for _, f := range files {
-		// Open the uploaded file
-		file, err := f.Open()
-		if err != nil {
+	var rejected []string
+	total := 0
+	for i, f := range files {
+		var err error
+		if isZip(f) {
+			var result *models.ImportResult
+			result, err = g.importImages(gallery.ID, user.ID, f)
+			if result != nil {
+				total += result.Accepted + len(result.Rejected)
+				for _, rej := range result.Rejected {
+					rejected = append(rejected, fmt.Sprintf("%s/%s: %s", f.Filename, rej.Name, publicErrorMessage(rej.Err)))
+				}
+			}
+		} else {
+			total++
+			err = g.createImage(gallery.ID, user.ID, f)
+		}
+		if quotaExceeded(err) {
+			// Every file after this one would be rejected for the same reason
+			for _, skipped := range files[i:] {
+				rejected = append(rejected, fmt.Sprintf("%s: not uploaded", skipped.Filename))
+			}
+			images, _ := g.is.ByGalleryID(gallery.ID, gallery.ImageOrder)
+			gallery.Images = images
 			vd.SetAlert(err)
+			vd.Alert.Details = rejected
 			g.EditView.Render(w, r, vd)
 			return
 		}
-		defer file.Close() // Always make sure to close the file to avoid memory leaks
-
-		err = g.is.Create(gallery.ID, file, f.Filename)
 		if err != nil {
-			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
-			return
+			if isZip(f) {
+				// The archive as a whole couldn't be imported
+				total++
+			}
+			rejected = append(rejected, fmt.Sprintf("%s: %s", f.Filename, publicErrorMessage(err)))
 		}
+	}
+	if len(rejected) == 0 {
+		g.redirectToEdit(w, r, gallery)
+		return
+	}
 
+	// Show the images that did make it
+	images, _ := g.is.ByGalleryID(gallery.ID, gallery.ImageOrder)
+	gallery.Images = images
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlWarning,
+		Message: fmt.Sprintf("Uploaded %d of %d images. The following files were rejected:", total-len(rejected), total),
+		Details: rejected,
 	}
-	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	g.EditView.Render(w, r, vd)
+}
+
+// quotaExceeded reports whether err means the user or gallery is out of space.
+func quotaExceeded(err error) bool {
+	switch err {
+	case models.ErrStorageQuotaExceeded, models.ErrImageQuotaExceeded, models.ErrGalleryQuotaExceeded:
+		return true
+	}
+	return false
+}
+
+// isZip reports whether an uploaded file is a ZIP archive of images.
+func isZip(f *multipart.FileHeader) bool {
+	return strings.EqualFold(filepath.Ext(f.Filename), ".zip")
+}
+
+// importImages adds the images in an uploaded ZIP archive to a gallery,
+// uploaded by userID.
+func (g *Galleries) importImages(galleryID, userID uint, f *multipart.FileHeader) (*models.ImportResult, error) {
+	file, err := f.Open()
 	if err != nil {
-		http.Redirect(w, r, "/galleries", http.StatusFound)
-		return
+		return nil, err
 	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	defer file.Close()
+	return g.is.Import(galleryID, userID, file, f.Size)
+}
+
+// createImage adds a single uploaded file to a gallery, uploaded by userID.
+func (g *Galleries) createImage(galleryID, userID uint, f *multipart.FileHeader) error {
+	file, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close() // Always make sure to close the file to avoid memory leaks
+	return g.is.Create(galleryID, userID, file, f.Filename)
 }
 
 func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
@@ -240,21 +732,23 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
+	if !gallery.Role.CanUpload() {
 		http.Error(w, "You do not have permission to edit this gallery or image.", http.StatusForbidden)
 		return
 	}
 
-	// Get the file name from the path
-	filename := mux.Vars(r)["filename"]
-	image := models.Image{
-		Filename:  filename,
-		GalleryID: gallery.ID,
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	// Contributors can only change the images they uploaded
+	if !gallery.CanEditImage(*image) {
+		http.Error(w, "You do not have permission to edit this image.", http.StatusForbidden)
+		return
 	}
 
 	// Try to delete the image
-	err = g.is.Delete(&image)
+	err = g.is.Delete(image)
 	if err != nil {
 		// Render edit page with any errors
 		var vd views.Data
@@ -264,7 +758,227 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The gallery falls back to its first image once its cover is gone
+	if gallery.CoverImageID == image.ID {
+		gallery.CoverImageID = 0
+		if err := g.gs.Update(gallery); err != nil {
+			var vd views.Data
+			vd.Yield = gallery
+			vd.SetAlert(err)
+			g.EditView.Render(w, r, vd)
+			return
+		}
+	}
+
 	// If all goes well redirect to the edit page
+	g.redirectToEdit(w, r, gallery)
+}
+
+// ImageOrder changes the order in which the images of a gallery are shown.
+func (g *Galleries) ImageOrder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanEdit() {
+		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ImageOrderForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	gallery.ImageOrder = models.ImageOrder(form.Order)
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// Metadata sets how much of the metadata of the gallery's images is kept
+// in the files we serve.
+//
+// POST /galleries/:id/metadata
+func (g *Galleries) Metadata(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanEdit() {
+		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form MetadataForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	gallery.Metadata = models.MetadataPolicy(form.Metadata)
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// ImageReorder saves the positions of a gallery's images after the owner
+// drags them around on the edit page. It expects an ImageReorderRequest
+// as JSON and responds with the images in their new order.
+//
+// POST /galleries/:id/images/reorder
+func (g *Galleries) ImageReorder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanEdit() {
+		renderJSONError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+
+	var req ImageReorderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderJSONError(w, http.StatusBadRequest, errInvalidJSON)
+		return
+	}
+	if err := g.is.Reorder(gallery.ID, req.ImageIDs); err != nil {
+		if err == models.ErrImageOrderMismatch {
+			renderJSONError(w, http.StatusBadRequest, err)
+		} else {
+			renderJSONError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	// Dragging images around only makes sense if we show them in that order
+	if gallery.ImageOrder != models.ImageOrderManual {
+		gallery.ImageOrder = models.ImageOrderManual
+		if err := g.gs.Update(gallery); err != nil {
+			renderJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	images, err := g.is.ByGalleryID(gallery.ID, gallery.ImageOrder)
+	if err != nil {
+		renderJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ret := make([]imageJSON, len(images))
+	for i := range images {
+		ret[i] = newImageJSON(&images[i])
+	}
+	renderJSON(w, http.StatusOK, map[string]interface{}{"images": ret})
+}
+
+// ImageDetails saves the title, caption, alt text and tags of an image.
+//
+// POST /galleries/:id/images/:imageID/details
+func (g *Galleries) ImageDetails(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanUpload() {
+		http.Error(w, "You do not have permission to edit this gallery or image.", http.StatusForbidden)
+		return
+	}
+
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	// Contributors can only change the images they uploaded
+	if !gallery.CanEditImage(*image) {
+		http.Error(w, "You do not have permission to edit this image.", http.StatusForbidden)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	var form ImageDetailsForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	image.Title = form.Title
+	image.Caption = form.Caption
+	image.AltText = form.AltText
+	image.Tags = models.ParseTags(form.Tags)
+	if err := g.is.UpdateDetails(image); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// ImageCover makes an image the cover of its gallery.
+//
+// POST /galleries/:id/images/:imageID/cover
+func (g *Galleries) ImageCover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanEdit() {
+		http.Error(w, "You do not have permission to edit this gallery or image.", http.StatusForbidden)
+		return
+	}
+
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	gallery.CoverImageID = image.ID
+	if err := g.gs.Update(gallery); err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// imageByID looks up the image in the "imageID" path parameter, making
+// sure it belongs to gallery. Like galleryByID, it renders any errors.
+func (g *Galleries) imageByID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Image, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["imageID"])
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusNotFound)
+		return nil, err
+	}
+	image, err := g.is.ByID(uint(id))
+	if err == nil && image.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Image not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return image, nil
+}
+
+// redirectToEdit sends the user back to the edit page of gallery.
+func (g *Galleries) redirectToEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
 		http.Redirect(w, r, "/galleries", http.StatusFound)
@@ -273,17 +987,34 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
+// redirectToEditAlert sends the user back to the edit page of gallery,
+// showing alert there.
+func (g *Galleries) redirectToEditAlert(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, alert views.Alert) {
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, alert)
+}
+
+// galleryByID looks up the gallery in the URL along with all of its
+// images, rendering an error if it can't be found.
 func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
-	// Gets all path parameters
-	vars := mux.Vars(r)
-	// Get the path parameter with name "id"
-	idStr := vars["id"]
-	id, err := strconv.Atoi(idStr)
+	gallery, err := g.lookupGallery(w, r)
 	if err != nil {
-		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
 		return nil, err
 	}
-	gallery, err := g.gs.ById(uint(id))
+	images, _ := g.is.ByGalleryID(gallery.ID, gallery.ImageOrder)
+	gallery.Images = images
+	return gallery, nil
+}
+
+// lookupGallery looks up the gallery in the URL without its images,
+// rendering an error if it can't be found. See galleryID for the ways
+// galleries are named in URLs.
+func (g *Galleries) lookupGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	id, err := g.galleryID(r)
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
@@ -293,8 +1024,72 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 		}
 		return nil, err
 	}
+	return g.gallery(w, r, id)
+}
 
-	images, _ := g.is.ByGalleryID(gallery.ID)
-	gallery.Images = images
+// galleryID returns the ID of the gallery in the URL. The "id" path
+// parameter is either the ID of a gallery, or the slug of one of the
+// current user's galleries. Public URLs name the owner instead, with the
+// "userID" and "slug" path parameters.
+func (g *Galleries) galleryID(r *http.Request) (uint, error) {
+	vars := mux.Vars(r)
+	slug, userID := vars["slug"], 0
+	if slug != "" {
+		var err error
+		if userID, err = strconv.Atoi(vars["userID"]); err != nil {
+			return 0, models.ErrNotFound
+		}
+	} else if id, err := strconv.Atoi(vars["id"]); err == nil {
+		return uint(id), nil
+	} else if user := context.User(r.Context()); user != nil {
+		slug, userID = vars["id"], int(user.ID)
+	} else {
+		return 0, models.ErrNotFound
+	}
+	gallery, err := g.gs.BySlug(uint(userID), slug)
+	if err != nil {
+		return 0, err
+	}
+	return gallery.ID, nil
+}
+
+// gallery looks up a gallery, rendering an error if it can't be found,
+// along with the role of the current user in it. Owners also get the
+// gallery's share links, collaborators and comments to moderate, and
+// editors the selections clients submitted.
+func (g *Galleries) gallery(w http.ResponseWriter, r *http.Request, id uint) (*models.Gallery, error) {
+	gallery, err := g.gs.ById(id)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	user := context.User(r.Context())
+	role, err := g.ms.RoleOf(gallery, user)
+	if err != nil {
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return nil, err
+	}
+	gallery.Role = role
+	if user != nil {
+		gallery.ViewerID = user.ID
+	}
+	if gallery.Role.CanManage() {
+		links, _ := g.sls.ByGalleryID(gallery.ID)
+		gallery.ShareLinks = links
+		members, _ := g.ms.ByGalleryID(gallery.ID)
+		gallery.Members = members
+		comments, _ := g.cs.ByGalleryID(gallery.ID)
+		gallery.Comments = comments
+	}
+	if gallery.Role.CanEdit() {
+		selections, _ := g.ss.Submitted(gallery.ID)
+		gallery.Selections = selections
+	}
 	return gallery, nil
 }
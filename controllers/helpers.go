@@ -1,11 +1,30 @@
 package controllers
 
 import (
+	"encoding/json"
+	"log"
 	"net/http"
 
 	"github.com/gorilla/schema"
+	"github.com/torresjeff/gallery/views"
 )
 
+const (
+	errForbidden   publicError = "You do not have permission to edit this gallery."
+	errInvalidJSON publicError = "The request body is not valid JSON."
+)
+
+// publicError is an error raised by a controller whose message is safe to show to users.
+type publicError string
+
+func (e publicError) Error() string {
+	return string(e)
+}
+
+func (e publicError) Public() string {
+	return string(e)
+}
+
 func parseForm(r *http.Request, dst interface{}) error {
 	if err := r.ParseForm(); err != nil {
 		return err
@@ -19,3 +38,35 @@ func parseForm(r *http.Request, dst interface{}) error {
 
 	return nil
 }
+
+// parseQuery is parseForm for forms sent with GET, in the URL query.
+func parseQuery(r *http.Request, dst interface{}) error {
+	dec := schema.NewDecoder()
+	dec.IgnoreUnknownKeys(true)
+	return dec.Decode(dst, r.URL.Query())
+}
+
+// renderJSON writes v to the response as JSON with the given status code.
+func renderJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// renderJSONError writes err to the response as a JSON object with an "error" key.
+// Public errors are shown as is, anything else gets a generic message.
+func renderJSONError(w http.ResponseWriter, status int, err error) {
+	renderJSON(w, status, map[string]string{"error": publicErrorMessage(err)})
+}
+
+// publicErrorMessage returns the message of err if it is safe to show to
+// users. Other errors are logged, and a generic message is returned instead.
+func publicErrorMessage(err error) string {
+	if pErr, ok := err.(views.PublicError); ok {
+		return pErr.Public()
+	}
+	log.Println(err)
+	return views.AlertMsgGeneric
+}
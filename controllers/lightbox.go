@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/views"
+)
+
+// ImagePage is the data the page of a single image of a gallery, shown
+// full size in the lightbox, is rendered with.
+type ImagePage struct {
+	GalleryShow
+	Image *models.Image
+	// Prev and Next are the images around Image in the order the visitor
+	// is viewing the gallery in, nil at either end.
+	Prev *models.Image
+	Next *models.Image
+	// BackTo is the gallery page the lightbox closes to.
+	BackTo string
+}
+
+// ImageShow shows an image of a gallery in the lightbox, with links to the
+// images before and after it. It works without JavaScript, which only adds
+// keyboard and swipe navigation, the slideshow and full screen. Like the
+// gallery page, it takes a "sort" query parameter, and private galleries
+// need the token of a share link in the "share" query parameter.
+//
+// GET /galleries/:id/images/:imageID
+func (g *Galleries) ImageShow(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.lookupGallery(w, r)
+	if err != nil {
+		return
+	}
+	g.useShareLink(r, gallery)
+	if !gallery.VisibleTo(context.User(r.Context())) && !gallery.Role.CanView() && gallery.Share == nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	g.renderImage(w, r, gallery, imageBase(gallery), showPath(gallery, ""))
+}
+
+// renderImage renders the lightbox with the image in the URL, linking to
+// the images around it under base, and closing to the gallery page at
+// backTo.
+func (g *Galleries) renderImage(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, base, backTo string) {
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	sort := r.URL.Query().Get("sort")
+	if sort != "" {
+		gallery.ImageOrder = models.ImageOrder(sort)
+	}
+	prev, next, err := g.is.Neighbours(image, gallery.ImageOrder)
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	for _, img := range []*models.Image{image, prev, next} {
+		if img != nil {
+			watermarkImage(gallery, img)
+		}
+	}
+
+	page := ImagePage{
+		GalleryShow: GalleryShow{
+			Gallery:    gallery,
+			ReturnTo:   r.URL.RequestURI(),
+			ImageBase:  base,
+			ImageQuery: imageQuery(r, gallery),
+		},
+		Image:  image,
+		Prev:   prev,
+		Next:   next,
+		BackTo: backTo,
+	}
+	if sort != "" {
+		page.BackTo += "?" + url.Values{"sort": {sort}}.Encode()
+	}
+	g.showSelection(r, &page.GalleryShow)
+	g.showComments(r, &page.GalleryShow)
+	g.record(r, gallery, models.StatImageOpen, image.ID)
+	var vd views.Data
+	vd.Yield = page
+	g.ImageView.Render(w, r, vd)
+}
+
+// imageBase is the path the pages of the images of gallery are under.
+func imageBase(gallery *models.Gallery) string {
+	return fmt.Sprintf("/galleries/%d", gallery.ID)
+}
+
+// imageQuery returns the query string links to the pages of the images of
+// gallery keep: the token of the share link it is viewed through, and the
+// order the visitor sorted it in.
+func imageQuery(r *http.Request, gallery *models.Gallery) string {
+	query := url.Values{}
+	if gallery.Share != nil {
+		query.Set("share", gallery.Share.Token)
+	}
+	if sort := r.URL.Query().Get("sort"); sort != "" {
+		query.Set("sort", sort)
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/email"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/views"
+)
+
+const ShowInvitation = "show_invitation"
+
+// Members handles the collaborators of galleries, and the invitations
+// sent to them.
+type Members struct {
+	InvitationView *views.View
+	ms             models.GalleryMemberService
+	emailer        *email.Client
+	// galleries looks up the galleries collaborators are invited to, and
+	// renders their edit page.
+	galleries *Galleries
+	r         *mux.Router
+	// baseURL is where the app is served from, for links in emails.
+	baseURL string
+}
+
+func NewMembers(ms models.GalleryMemberService, emailer *email.Client, galleries *Galleries, r *mux.Router, baseURL string) *Members {
+	return &Members{
+		InvitationView: views.NewView("bootstrap", "galleries/invitation"),
+		ms:             ms,
+		emailer:        emailer,
+		galleries:      galleries,
+		r:              r,
+		baseURL:        strings.TrimRight(baseURL, "/"),
+	}
+}
+
+// MemberForm invites someone to a gallery, or changes their role.
+type MemberForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// Invitation is the data the invitation page is rendered with.
+type Invitation struct {
+	Member  *models.GalleryMember
+	Gallery *models.Gallery
+}
+
+// MemberInvite emails an invitation to collaborate on a gallery.
+//
+// POST /galleries/:id/members
+func (m *Members) Invite(w http.ResponseWriter, r *http.Request) {
+	gallery, err := m.galleries.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanManage() {
+		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form MemberForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		m.galleries.EditView.Render(w, r, vd)
+		return
+	}
+	member := models.GalleryMember{
+		GalleryID: gallery.ID,
+		Email:     form.Email,
+		Role:      models.Role(form.Role),
+	}
+	if err := m.ms.Create(&member); err != nil {
+		vd.SetAlert(err)
+		m.galleries.EditView.Render(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	inviter := user.Name
+	if inviter == "" {
+		inviter = user.Email
+	}
+	acceptURL := m.invitationURL(&member)
+	alert := views.Alert{
+		Level: views.AlertLvlSuccess,
+		// The link can't be shown again, only its hash is saved
+		Message: fmt.Sprintf("Invited %s as a %s. Their invitation link is %s", member.Email, member.Role, acceptURL),
+	}
+	if err := m.emailer.Invite(member.Email, inviter, gallery.Title, string(member.Role), acceptURL); err != nil {
+		// The invitation is saved either way, so the link can be sent some other way
+		log.Printf("controllers: couldn't email invitation %d: %v", member.ID, err)
+		alert = views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: fmt.Sprintf("We couldn't email the invitation to %s. Send them this link instead: %s", member.Email, acceptURL),
+		}
+	}
+	m.galleries.redirectToEditAlert(w, r, gallery, alert)
+}
+
+// MemberUpdate changes the role of a collaborator.
+//
+// POST /galleries/:id/members/:memberID
+func (m *Members) Update(w http.ResponseWriter, r *http.Request) {
+	gallery, member, err := m.memberByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form MemberForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		m.galleries.EditView.Render(w, r, vd)
+		return
+	}
+	member.Role = models.Role(form.Role)
+	if err := m.ms.Update(member); err != nil {
+		vd.SetAlert(err)
+		m.galleries.EditView.Render(w, r, vd)
+		return
+	}
+	m.galleries.redirectToEdit(w, r, gallery)
+}
+
+// MemberDelete removes a collaborator from a gallery, or takes back an
+// invitation that wasn't accepted yet.
+//
+// POST /galleries/:id/members/:memberID/delete
+func (m *Members) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, member, err := m.memberByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := m.ms.Delete(member.ID); err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		m.galleries.EditView.Render(w, r, vd)
+		return
+	}
+	m.galleries.redirectToEdit(w, r, gallery)
+}
+
+// RenderInvitation shows an invitation to collaborate on a gallery, so the
+// current user can accept it.
+//
+// GET /invitations/:token
+func (m *Members) RenderInvitation(w http.ResponseWriter, r *http.Request) {
+	invitation, err := m.invitation(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = invitation
+	m.InvitationView.Render(w, r, vd)
+}
+
+// AcceptInvitation makes the current user a collaborator of the gallery
+// they were invited to.
+//
+// POST /invitations/:token
+func (m *Members) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	invitation, err := m.invitation(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if err := m.ms.Accept(invitation.Member, user); err != nil {
+		var vd views.Data
+		vd.Yield = invitation
+		vd.SetAlert(err)
+		m.InvitationView.Render(w, r, vd)
+		return
+	}
+
+	gallery := invitation.Gallery
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: fmt.Sprintf("You are now a %s of %q.", invitation.Member.Role, gallery.Title),
+	}
+	if invitation.Member.Role.CanUpload() {
+		m.galleries.redirectToEditAlert(w, r, gallery, alert)
+		return
+	}
+	url, err := m.r.Get(ShowGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, alert)
+}
+
+// invitation looks up the invitation in the URL along with its gallery,
+// rendering an error if it can't be found.
+func (m *Members) invitation(w http.ResponseWriter, r *http.Request) (*Invitation, error) {
+	member, err := m.ms.ByToken(mux.Vars(r)["token"])
+	var gallery *models.Gallery
+	if err == nil {
+		gallery, err = m.galleries.gs.ById(member.GalleryID)
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return &Invitation{Member: member, Gallery: gallery}, nil
+}
+
+// invitationURL is the absolute URL where member accepts their invitation.
+func (m *Members) invitationURL(member *models.GalleryMember) string {
+	url, err := m.r.Get(ShowInvitation).URL("token", member.Token)
+	if err != nil {
+		return m.baseURL + "/invitations/" + member.Token
+	}
+	return m.baseURL + url.Path
+}
+
+// memberByID looks up the gallery and collaborator in the URL, making sure
+// the collaborator belongs to the gallery and the current user manages it.
+func (m *Members) memberByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.GalleryMember, error) {
+	gallery, err := m.galleries.galleryByID(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !gallery.Role.CanManage() {
+		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
+		return nil, nil, errForbidden
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["memberID"])
+	if err != nil {
+		http.Error(w, "Invalid collaborator ID", http.StatusNotFound)
+		return nil, nil, err
+	}
+	member, err := m.ms.ByID(uint(id))
+	if err == nil && member.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Collaborator not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, nil, err
+	}
+	return gallery, member, nil
+}
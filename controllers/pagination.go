@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/torresjeff/gallery/models"
+)
+
+const errPageInvalid publicError = "The page must be a number."
+
+// PageForm picks a page of a listing, and how it is sorted, from the URL
+// query. Pages are picked by number, or with the cursor of the previous
+// page in "after".
+type PageForm struct {
+	Page    int    `schema:"page"`
+	PerPage int    `schema:"per_page"`
+	After   string `schema:"after"`
+	Sort    string `schema:"sort"`
+}
+
+func (form *PageForm) page() models.Page {
+	return models.Page{
+		Size:   form.PerPage,
+		Number: form.Page,
+		After:  form.After,
+	}
+}
+
+// PageLinks are the URLs of the pages around the one being shown. They are
+// empty when there is no such page.
+type PageLinks struct {
+	First string
+	Prev  string
+	Next  string
+}
+
+// Pager is what page controls are rendered with.
+type Pager struct {
+	Pagination *models.Pagination
+	Links      PageLinks
+}
+
+// newPageLinks links to the pages around p, keeping the rest of the query
+// of u, like the sort. Pages after a cursor can only link forward, with
+// the next cursor, and back to the first page. With useCursor, numbered
+// pages link to the next page with a cursor too, so clients paging through
+// a listing don't skip or repeat results that are added or removed.
+func newPageLinks(u *url.URL, p *models.Pagination, useCursor bool) PageLinks {
+	var links PageLinks
+	if p.Number != 1 {
+		links.First = pageURL(u, nil)
+	}
+	if p.Number > 1 {
+		links.Prev = pageURL(u, url.Values{"page": {strconv.Itoa(p.Number - 1)}})
+	}
+	if p.Next != "" {
+		if useCursor || p.Number == 0 {
+			links.Next = pageURL(u, url.Values{"after": {p.Next}})
+		} else {
+			links.Next = pageURL(u, url.Values{"page": {strconv.Itoa(p.Number + 1)}})
+		}
+	}
+	return links
+}
+
+// pageURL is u, picking page instead of the page u picks.
+func pageURL(u *url.URL, page url.Values) string {
+	q := u.Query()
+	q.Del("page")
+	q.Del("after")
+	for key, values := range page {
+		q[key] = values
+	}
+	return (&url.URL{Path: u.Path, RawQuery: q.Encode()}).String()
+}
+
+// renderPageError renders an error from looking up a page of a listing.
+func renderPageError(w http.ResponseWriter, err error) {
+	switch err {
+	case models.ErrGallerySortInvalid, models.ErrImageOrderInvalid, models.ErrCursorInvalid, errPageInvalid:
+		http.Error(w, publicErrorMessage(err), http.StatusBadRequest)
+	default:
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+	}
+}
+
+// setLinkHeader adds links to the response in a Link header (RFC 8288), so
+// clients of JSON listings can page through them.
+func setLinkHeader(w http.ResponseWriter, links PageLinks) {
+	var header []string
+	for _, link := range []struct{ rel, url string }{
+		{"first", links.First},
+		{"prev", links.Prev},
+		{"next", links.Next},
+	} {
+		if link.url != "" {
+			header = append(header, fmt.Sprintf(`<%s>; rel="%s"`, link.url, link.rel))
+		}
+	}
+	if len(header) > 0 {
+		w.Header().Set("Link", strings.Join(header, ", "))
+	}
+}
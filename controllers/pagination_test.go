@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/torresjeff/gallery/models"
+)
+
+func TestNewPageLinks(t *testing.T) {
+	u, err := url.Parse("/galleries?sort=title&page=2&after=old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := func(number int, next string) *models.Pagination {
+		return &models.Pagination{Page: models.Page{Size: 10, Number: number}, Next: next}
+	}
+	tests := []struct {
+		name      string
+		p         *models.Pagination
+		useCursor bool
+		want      PageLinks
+	}{
+		{"first and only page", page(1, ""), false, PageLinks{}},
+		{"first page", page(1, "c"), false, PageLinks{Next: "/galleries?page=2&sort=title"}},
+		{"middle page", page(3, "c"), false, PageLinks{
+			First: "/galleries?sort=title",
+			Prev:  "/galleries?page=2&sort=title",
+			Next:  "/galleries?page=4&sort=title",
+		}},
+		{"last page", page(3, ""), false, PageLinks{First: "/galleries?sort=title", Prev: "/galleries?page=2&sort=title"}},
+		{"after a cursor", page(0, "c"), false, PageLinks{First: "/galleries?sort=title", Next: "/galleries?after=c&sort=title"}},
+		{"numbered, with cursors", page(1, "c"), true, PageLinks{Next: "/galleries?after=c&sort=title"}},
+	}
+	for _, tt := range tests {
+		if got := newPageLinks(u, tt.p, tt.useCursor); got != tt.want {
+			t.Errorf("%s: newPageLinks() = %+v; want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/views"
+)
+
+const errSearchDateInvalid publicError = "Search dates must be dates, like 2019-06-21."
+
+type Search struct {
+	SearchView *views.View
+	ss         models.SearchService
+}
+
+// SearchForm is a search of the user's galleries and images. Every field is optional.
+type SearchForm struct {
+	Query string `schema:"q"`
+	Tag   string `schema:"tag"`
+	// From and To are formatted like date inputs send them, eg: "2019-06-21".
+	From       string `schema:"from"`
+	To         string `schema:"to"`
+	Visibility string `schema:"visibility"`
+}
+
+// SearchPage is the data the search page is rendered with. Results is nil
+// until the user searches for something.
+type SearchPage struct {
+	Form    SearchForm
+	Results *models.SearchResults
+}
+
+func NewSearch(ss models.SearchService) *Search {
+	return &Search{
+		SearchView: views.NewView("bootstrap", "galleries/search"),
+		ss:         ss,
+	}
+}
+
+// Search finds the galleries and images of the current user by their
+// text, tags, dates and visibility.
+//
+// GET /search
+func (s *Search) Search(w http.ResponseWriter, r *http.Request) {
+	var page SearchPage
+	vd := views.Data{Yield: &page}
+	if err := parseQuery(r, &page.Form); err != nil {
+		vd.SetAlert(err)
+		s.SearchView.Render(w, r, vd)
+		return
+	}
+	if page.Form == (SearchForm{}) {
+		s.SearchView.Render(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	query, err := page.Form.query(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		s.SearchView.Render(w, r, vd)
+		return
+	}
+	results, err := s.ss.Search(query)
+	if err != nil {
+		vd.SetAlert(err)
+		s.SearchView.Render(w, r, vd)
+		return
+	}
+	page.Results = results
+	s.SearchView.Render(w, r, vd)
+}
+
+// query turns the form into a search of the galleries of userID.
+func (form *SearchForm) query(userID uint) (models.SearchQuery, error) {
+	query := models.SearchQuery{
+		UserID:     userID,
+		Text:       form.Query,
+		Tag:        form.Tag,
+		Visibility: models.Visibility(form.Visibility),
+	}
+	if query.Visibility != "" && !query.Visibility.Valid() {
+		return query, models.ErrVisibilityInvalid
+	}
+	var err error
+	if query.From, err = parseSearchDate(form.From); err != nil {
+		return query, err
+	}
+	if query.To, err = parseSearchDate(form.To); err != nil {
+		return query, err
+	}
+	return query, nil
+}
+
+// parseSearchDate parses a date from a SearchForm, which may be empty.
+func parseSearchDate(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	date, err := time.Parse(eventDateFormat, s)
+	if err != nil {
+		return nil, errSearchDateInvalid
+	}
+	return &date, nil
+}
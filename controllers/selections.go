@@ -0,0 +1,361 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/views"
+)
+
+const (
+	// selectionCookiePrefix names the cookies that keep the token of the
+	// selection a visitor is making in a gallery, followed by its ID.
+	selectionCookiePrefix = "selection_"
+	// selectionCookieAge is how long visitors can take to make a selection.
+	selectionCookieAge = 90 * 24 * time.Hour
+)
+
+// Selections handles the selections clients make of the images of
+// galleries, and their export by the owners of the galleries.
+type Selections struct {
+	ss models.SelectionService
+	// galleries looks up the galleries selections are made in, and renders
+	// their edit page.
+	galleries *Galleries
+}
+
+func NewSelections(ss models.SelectionService, galleries *Galleries) *Selections {
+	return &Selections{
+		ss:        ss,
+		galleries: galleries,
+	}
+}
+
+// ProofingForm sets whether a gallery takes selections from clients.
+type ProofingForm struct {
+	Proofing bool `schema:"proofing"`
+	// MaxPicks is how many images clients can pick, 0 for no limit.
+	MaxPicks int `schema:"max_picks"`
+}
+
+// PickForm hearts an image with a note, or takes it out of the selection.
+type PickForm struct {
+	Picked bool   `schema:"picked"`
+	Note   string `schema:"note"`
+	// ReturnTo is the page of the gallery the visitor picked the image on.
+	ReturnTo string `schema:"return_to"`
+}
+
+// SubmitSelectionForm sends a selection to the owner of the gallery.
+type SubmitSelectionForm struct {
+	Name     string `schema:"name"`
+	Email    string `schema:"email"`
+	ReturnTo string `schema:"return_to"`
+}
+
+// Proofing turns selections on or off for a gallery.
+//
+// POST /galleries/:id/proofing
+func (s *Selections) Proofing(w http.ResponseWriter, r *http.Request) {
+	gallery, err := s.galleries.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanEdit() {
+		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ProofingForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		s.galleries.EditView.Render(w, r, vd)
+		return
+	}
+	gallery.Proofing = form.Proofing
+	gallery.MaxPicks = form.MaxPicks
+	if err := s.galleries.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		s.galleries.EditView.Render(w, r, vd)
+		return
+	}
+	s.galleries.redirectToEdit(w, r, gallery)
+}
+
+// SelectionPick hearts an image in the visitor's selection, saving their
+// note on it, or takes it back out.
+//
+// POST /galleries/:id/selection/images/:imageID
+func (s *Selections) Pick(w http.ResponseWriter, r *http.Request) {
+	gallery, selection, err := s.visitorSelection(w, r)
+	if err != nil {
+		return
+	}
+	imageID, err := strconv.Atoi(mux.Vars(r)["imageID"])
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusNotFound)
+		return
+	}
+	var form PickForm
+	if err := parseForm(r, &form); err != nil {
+		redirectToShow(w, r, gallery, form.ReturnTo, err)
+		return
+	}
+	if form.Picked {
+		err = s.ss.Pick(gallery, selection, uint(imageID), form.Note)
+		if err == nil {
+			// The selection may have just been started
+			setSelectionCookie(w, selection)
+		}
+	} else {
+		err = s.ss.Unpick(selection, uint(imageID))
+	}
+	redirectToShow(w, r, gallery, form.ReturnTo, err)
+}
+
+// SelectionSubmit sends the visitor's selection to the owner of the gallery.
+//
+// POST /galleries/:id/selection/submit
+func (s *Selections) Submit(w http.ResponseWriter, r *http.Request) {
+	gallery, selection, err := s.visitorSelection(w, r)
+	if err != nil {
+		return
+	}
+	var form SubmitSelectionForm
+	if err := parseForm(r, &form); err != nil {
+		redirectToShow(w, r, gallery, form.ReturnTo, err)
+		return
+	}
+	if err := s.ss.Submit(gallery, selection, form.Name, form.Email); err != nil {
+		redirectToShow(w, r, gallery, form.ReturnTo, err)
+		return
+	}
+	views.RedirectAlert(w, r, showPath(gallery, form.ReturnTo), http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: fmt.Sprintf("Thanks! Your selection of %d images was sent.", len(selection.Picks)),
+	})
+}
+
+// SelectionRestart lets a visitor who submitted a selection start another one.
+//
+// POST /galleries/:id/selection/restart
+func (s *Selections) Restart(w http.ResponseWriter, r *http.Request) {
+	gallery, _, err := s.visitorSelection(w, r)
+	if err != nil {
+		return
+	}
+	var form SubmitSelectionForm
+	parseForm(r, &form)
+	http.SetCookie(w, &http.Cookie{
+		Name:     selectionCookieName(gallery.ID),
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, showPath(gallery, form.ReturnTo), http.StatusFound)
+}
+
+// SelectionCSV exports a client's selection as a CSV file, with their
+// note on each image.
+//
+// GET /galleries/:id/selections/:selectionID/csv
+func (s *Selections) CSV(w http.ResponseWriter, r *http.Request) {
+	gallery, selection, err := s.selectionByID(w, r)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": selectionExportName(gallery, selection, ".csv"),
+	}))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Filename", "Title", "Note", "Picked at"})
+	for _, pick := range selection.Picks {
+		cw.Write([]string{pick.Filename, pick.Title, pick.Note, pick.CreatedAt.Format(time.RFC3339)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("controllers: couldn't export selection %d: %v", selection.ID, err)
+	}
+}
+
+// SelectionLightroom exports a client's selection as the list of file
+// names to paste into Lightroom's text filter.
+//
+// GET /galleries/:id/selections/:selectionID/lightroom
+func (s *Selections) Lightroom(w http.ResponseWriter, r *http.Request) {
+	gallery, selection, err := s.selectionByID(w, r)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": selectionExportName(gallery, selection, ".txt"),
+	}))
+	fmt.Fprintln(w, selection.LightroomFilter())
+}
+
+// SelectionDelete throws away a client's selection.
+//
+// POST /galleries/:id/selections/:selectionID/delete
+func (s *Selections) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, selection, err := s.selectionByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := s.ss.Delete(selection.ID); err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		s.galleries.EditView.Render(w, r, vd)
+		return
+	}
+	s.galleries.redirectToEdit(w, r, gallery)
+}
+
+// showSelection loads the selection the visitor is making into show, if
+// the gallery takes selections. Owners and collaborators don't make any.
+func (g *Galleries) showSelection(r *http.Request, show *GalleryShow) {
+	if !show.Proofing || show.Role.CanView() {
+		return
+	}
+	selection, err := g.selectionFromCookie(r, show.Gallery)
+	if err != nil {
+		log.Printf("controllers: couldn't load selection in gallery %d: %v", show.ID, err)
+		selection = &models.Selection{}
+	}
+	show.Selection = selection
+}
+
+// visitorSelection looks up the gallery in the URL and the selection the
+// visitor is making in it, which is new if they haven't picked anything
+// yet. Like the gallery page, private galleries need the token of a share
+// link in the "share" query parameter. It renders any errors.
+func (s *Selections) visitorSelection(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Selection, error) {
+	gallery, err := s.galleries.lookupGallery(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.galleries.useShareLink(r, gallery)
+	if !gallery.VisibleTo(context.User(r.Context())) && !gallery.Role.CanView() && gallery.Share == nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, nil, errGalleryNotFound
+	}
+	selection, err := s.galleries.selectionFromCookie(r, gallery)
+	if err != nil {
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return nil, nil, err
+	}
+	return gallery, selection, nil
+}
+
+// selectionFromCookie looks up the selection whose token is in the cookie
+// of gallery, returning an empty selection if there's none.
+func (g *Galleries) selectionFromCookie(r *http.Request, gallery *models.Gallery) (*models.Selection, error) {
+	cookie, err := r.Cookie(selectionCookieName(gallery.ID))
+	if err != nil {
+		return &models.Selection{}, nil
+	}
+	selection, err := g.ss.ByToken(gallery.ID, cookie.Value)
+	if err == models.ErrNotFound {
+		// The owner deleted it, or the gallery was purged and restored
+		return &models.Selection{}, nil
+	}
+	return selection, err
+}
+
+// selectionByID looks up the gallery and submitted selection in the URL,
+// making sure the selection belongs to the gallery and the current user
+// can edit it.
+func (s *Selections) selectionByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Selection, error) {
+	gallery, err := s.galleries.lookupGallery(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !gallery.Role.CanEdit() {
+		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
+		return nil, nil, errForbidden
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["selectionID"])
+	if err != nil {
+		http.Error(w, "Invalid selection ID", http.StatusNotFound)
+		return nil, nil, err
+	}
+	selection, err := s.ss.ByID(uint(id))
+	if err == nil && (selection.GalleryID != gallery.ID || !selection.Submitted()) {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Selection not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, nil, err
+	}
+	return gallery, selection, nil
+}
+
+// redirectToShow sends a visitor back to the gallery page they were on,
+// with err as an alert if it isn't nil.
+func redirectToShow(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, returnTo string, err error) {
+	path := showPath(gallery, returnTo)
+	if err == nil {
+		http.Redirect(w, r, path, http.StatusFound)
+		return
+	}
+	var vd views.Data
+	vd.SetAlert(err)
+	views.RedirectAlert(w, r, path, http.StatusFound, *vd.Alert)
+}
+
+// showPath is returnTo if it's a path on this site, or else the page of
+// gallery, through the share link the visitor is using if any.
+func showPath(gallery *models.Gallery, returnTo string) string {
+	if strings.HasPrefix(returnTo, "/") && !strings.HasPrefix(returnTo, "//") && !strings.Contains(returnTo, `\`) {
+		return returnTo
+	}
+	if gallery.Share != nil {
+		return "/s/" + gallery.Share.Token
+	}
+	return gallery.Path()
+}
+
+func setSelectionCookie(w http.ResponseWriter, selection *models.Selection) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     selectionCookieName(selection.GalleryID),
+		Value:    selection.Token,
+		Path:     "/",
+		MaxAge:   int(selectionCookieAge / time.Second),
+		HttpOnly: true,
+	})
+}
+
+func selectionCookieName(galleryID uint) string {
+	return fmt.Sprintf("%s%d", selectionCookiePrefix, galleryID)
+}
+
+// selectionExportName is the name of the file a selection is exported to.
+func selectionExportName(gallery *models.Gallery, selection *models.Selection, ext string) string {
+	name := models.Slugify(gallery.Title)
+	if name == "" {
+		name = fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	if client := models.Slugify(selection.Name); client != "" {
+		name += "-" + client
+	}
+	return fmt.Sprintf("%s-selection-%d%s", name, selection.ID, ext)
+}
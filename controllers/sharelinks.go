@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/views"
+)
+
+type ShareLinkForm struct {
+	AllowDownloads bool `schema:"allow_downloads"`
+}
+
+// ShareLinkCreate adds a share link to a gallery.
+//
+// POST /galleries/:id/share-links
+func (g *Galleries) ShareLinkCreate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanManage() {
+		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	link := models.ShareLink{
+		GalleryID:      gallery.ID,
+		AllowDownloads: form.AllowDownloads,
+	}
+	if err := g.sls.Create(&link); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// ShareLinkUpdate changes whether a share link allows downloads.
+//
+// POST /galleries/:id/share-links/:linkID
+func (g *Galleries) ShareLinkUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, link, err := g.shareLinkByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	link.AllowDownloads = form.AllowDownloads
+	if err := g.sls.Update(link); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// ShareLinkDelete removes a share link, so it stops working.
+//
+// POST /galleries/:id/share-links/:linkID/delete
+func (g *Galleries) ShareLinkDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, link, err := g.shareLinkByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := g.sls.Delete(link.ID); err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// shareLinkByID looks up the gallery and share link in the URL, making sure
+// the link belongs to the gallery and the current user manages the gallery.
+func (g *Galleries) shareLinkByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.ShareLink, error) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !gallery.Role.CanManage() {
+		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
+		return nil, nil, errForbidden
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["linkID"])
+	if err != nil {
+		http.Error(w, "Invalid share link ID", http.StatusNotFound)
+		return nil, nil, err
+	}
+	link, err := g.sls.ByID(uint(id))
+	if err == nil && link.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Share link not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, nil, err
+	}
+	return gallery, link, nil
+}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/views"
+)
+
+const (
+	// defaultStatsDays is how many days the stats page shows, unless the
+	// "days" query parameter picks one of statsDays.
+	defaultStatsDays = 30
+
+	errStatsDaysInvalid publicError = "Stats can only be shown for the last 7, 30 or 90 days."
+)
+
+// statsDays are the periods the stats page can show, in days.
+var statsDays = []int{7, 30, 90}
+
+// Stats shows the owners of galleries how they are viewed.
+type Stats struct {
+	ShowView *views.View
+	stats    models.StatsService
+	// galleries looks up the galleries stats are shown for, and records
+	// the stats.
+	galleries *Galleries
+}
+
+func NewStats(stats models.StatsService, galleries *Galleries) *Stats {
+	return &Stats{
+		ShowView:  views.NewView("bootstrap", "galleries/stats"),
+		stats:     stats,
+		galleries: galleries,
+	}
+}
+
+// GalleryStatsPage is the data the stats page of a gallery is rendered with.
+type GalleryStatsPage struct {
+	*models.Gallery
+	Stats *models.GalleryStats
+	// Days is how many days Stats are for, and Periods the other ones
+	// that can be picked.
+	Days    int
+	Periods []int
+}
+
+// Stats shows the owner how many people viewed a gallery, opened its
+// images and downloaded it, per day and per share link. The "days" query
+// parameter picks how far back to go.
+//
+// GET /galleries/:id/stats
+func (s *Stats) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, err := s.galleries.lookupGallery(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanEdit() {
+		http.Error(w, "You do not have permission to see the stats of this gallery.", http.StatusForbidden)
+		return
+	}
+
+	page := GalleryStatsPage{
+		Gallery: gallery,
+		Days:    defaultStatsDays,
+		Periods: statsDays,
+	}
+	var vd views.Data
+	vd.Yield = &page
+	if days := r.URL.Query().Get("days"); days != "" {
+		page.Days, err = strconv.Atoi(days)
+		if err != nil || !validStatsDays(page.Days) {
+			page.Days = defaultStatsDays
+			vd.SetAlert(errStatsDaysInvalid)
+		}
+	}
+	page.Stats, err = s.stats.Stats(gallery.ID, page.Days)
+	if err != nil {
+		vd.SetAlert(err)
+		page.Stats = &models.GalleryStats{}
+	}
+	s.ShowView.Render(w, r, vd)
+}
+
+// ImageOpen counts that a visitor opened an image, and sends them on to
+// it. Like the gallery page, private galleries need the token of a share
+// link in the "share" query parameter.
+//
+// GET /galleries/:id/images/:imageID/open
+func (s *Stats) ImageOpen(w http.ResponseWriter, r *http.Request) {
+	gallery, err := s.galleries.lookupGallery(w, r)
+	if err != nil {
+		return
+	}
+	s.galleries.useShareLink(r, gallery)
+	if !gallery.VisibleTo(context.User(r.Context())) && !gallery.Role.CanView() && gallery.Share == nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	image, err := s.galleries.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	s.galleries.record(r, gallery, models.StatImageOpen, image.ID)
+	watermarkImage(gallery, image)
+	http.Redirect(w, r, image.Path(), http.StatusFound)
+}
+
+// record counts that the visitor did kind in gallery. Owners and
+// collaborators aren't counted, since the stats are about everyone else.
+// Stats aren't worth failing requests over, so errors are only logged.
+func (g *Galleries) record(r *http.Request, gallery *models.Gallery, kind models.StatKind, imageID uint) {
+	if gallery.Role.CanView() {
+		return
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if err := g.stats.Record(gallery, kind, imageID, ip, r.UserAgent()); err != nil {
+		log.Printf("controllers: couldn't record %s in gallery %d: %v", kind, gallery.ID, err)
+	}
+}
+
+func validStatsDays(days int) bool {
+	for _, d := range statsDays {
+		if d == days {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/views"
+)
+
+const IndexTrash = "index_trash"
+
+type Trash struct {
+	IndexView *views.View
+	ts        models.TrashService
+	r         *mux.Router
+}
+
+func NewTrash(ts models.TrashService, r *mux.Router) *Trash {
+	return &Trash{
+		IndexView: views.NewView("bootstrap", "trash/index"),
+		ts:        ts,
+		r:         r,
+	}
+}
+
+// Index lists the galleries and images the current user deleted.
+//
+// GET /trash
+func (t *Trash) Index(w http.ResponseWriter, r *http.Request) {
+	t.render(w, r, nil)
+}
+
+// RestoreGallery takes a gallery out of the trash.
+//
+// POST /trash/galleries/:id/restore
+func (t *Trash) RestoreGallery(w http.ResponseWriter, r *http.Request) {
+	id, err := t.itemID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	gallery, err := t.ts.RestoreGallery(user.ID, id)
+	if err != nil {
+		t.renderError(w, r, err)
+		return
+	}
+	t.redirectToIndex(w, r, fmt.Sprintf("Restored the gallery %q.", gallery.Title))
+}
+
+// RestoreImage takes an image out of the trash, back into its gallery.
+//
+// POST /trash/images/:id/restore
+func (t *Trash) RestoreImage(w http.ResponseWriter, r *http.Request) {
+	id, err := t.itemID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if _, err := t.ts.RestoreImage(user.ID, id); err != nil {
+		t.renderError(w, r, err)
+		return
+	}
+	t.redirectToIndex(w, r, "Restored the image.")
+}
+
+// PurgeGallery deletes a gallery in the trash for good.
+//
+// POST /trash/galleries/:id/purge
+func (t *Trash) PurgeGallery(w http.ResponseWriter, r *http.Request) {
+	id, err := t.itemID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if err := t.ts.PurgeGallery(user.ID, id); err != nil {
+		t.renderError(w, r, err)
+		return
+	}
+	t.redirectToIndex(w, r, "Deleted the gallery for good.")
+}
+
+// PurgeImage deletes an image in the trash for good.
+//
+// POST /trash/images/:id/purge
+func (t *Trash) PurgeImage(w http.ResponseWriter, r *http.Request) {
+	id, err := t.itemID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if err := t.ts.PurgeImage(user.ID, id); err != nil {
+		t.renderError(w, r, err)
+		return
+	}
+	t.redirectToIndex(w, r, "Deleted the image for good.")
+}
+
+// render shows the trash of the current user, along with alert if it isn't nil.
+func (t *Trash) render(w http.ResponseWriter, r *http.Request, alert *views.Alert) {
+	user := context.User(r.Context())
+	trash, err := t.ts.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	vd := views.Data{Alert: alert, Yield: trash}
+	t.IndexView.Render(w, r, vd)
+}
+
+// renderError shows the trash with an alert for err. Things that aren't in
+// the trash (anymore) are not found.
+func (t *Trash) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == models.ErrNotFound {
+		http.Error(w, "Not found in the trash", http.StatusNotFound)
+		return
+	}
+	var vd views.Data
+	vd.SetAlert(err)
+	t.render(w, r, vd.Alert)
+}
+
+// itemID parses the ID of the gallery or image in the URL.
+func (t *Trash) itemID(w http.ResponseWriter, r *http.Request) (uint, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return 0, err
+	}
+	return uint(id), nil
+}
+
+// redirectToIndex sends the user back to the trash, showing msg.
+func (t *Trash) redirectToIndex(w http.ResponseWriter, r *http.Request, msg string) {
+	path := "/trash"
+	if url, err := t.r.Get(IndexTrash).URL(); err == nil {
+		path = url.Path
+	}
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: msg,
+	})
+}
@@ -0,0 +1,294 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/models"
+)
+
+// Resumable uploads follow the core tus protocol (https://tus.io/protocols/resumable-upload),
+// along with its creation, checksum, termination and expiration extensions,
+// so any tus client can upload to a gallery:
+//
+//   - POST /galleries/:id/images/uploads with an Upload-Length header starts
+//     an upload, and responds with its URL in the Location header.
+//   - HEAD on that URL returns how much has been received in Upload-Offset.
+//   - PATCH on that URL appends a chunk starting at Upload-Offset.
+//   - DELETE on that URL stops the upload.
+//
+// Like every other request that changes something, they need the CSRF
+// token in the X-CSRF-Token header.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,checksum,termination,expiration"
+	// tusContentType is the content type of PATCH requests.
+	tusContentType = "application/offset+octet-stream"
+	// statusChecksumMismatch is the status tus uses when a chunk doesn't match its checksum.
+	statusChecksumMismatch = 460
+)
+
+const (
+	errUploadVersion     publicError = "Only version " + tusVersion + " of the tus protocol is supported."
+	errUploadLength      publicError = "The Upload-Length header must be the size of the file, in bytes."
+	errUploadOffset      publicError = "The Upload-Offset header must be the offset of the chunk, in bytes."
+	errUploadContentType publicError = "Chunks must be sent with a Content-Type of " + tusContentType + "."
+	errUploadChecksum    publicError = "The Upload-Checksum header must be an algorithm and a base64 encoded checksum."
+)
+
+// Uploads handles resumable uploads of images into galleries.
+type Uploads struct {
+	ups models.UploadService
+	// galleries looks up the galleries images are uploaded into.
+	galleries *Galleries
+}
+
+func NewUploads(ups models.UploadService, galleries *Galleries) *Uploads {
+	return &Uploads{
+		ups:       ups,
+		galleries: galleries,
+	}
+}
+
+// UploadOptions describes what resumable uploads support.
+//
+// OPTIONS /galleries/:id/images/uploads
+func (u *Uploads) Options(w http.ResponseWriter, r *http.Request) {
+	algorithms := make([]string, 0, len(models.UploadChecksumAlgorithms))
+	for name := range models.UploadChecksumAlgorithms {
+		algorithms = append(algorithms, name)
+	}
+	sort.Strings(algorithms)
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", strings.Join(algorithms, ","))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadCreate starts a resumable upload. The file name is taken from the
+// "filename" (or "name") key of the Upload-Metadata header.
+//
+// POST /galleries/:id/images/uploads
+func (u *Uploads) Create(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := u.uploadGallery(w, r)
+	if !ok {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		renderJSONError(w, http.StatusBadRequest, errUploadLength)
+		return
+	}
+	metadata := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+
+	user := context.User(r.Context())
+	session, err := u.ups.Start(gallery.ID, user.ID, filename, length)
+	if err != nil {
+		switch err {
+		case models.ErrImageTooLarge:
+			renderJSONError(w, http.StatusRequestEntityTooLarge, err)
+		case models.ErrUploadLengthInvalid:
+			renderJSONError(w, http.StatusBadRequest, err)
+		case models.ErrTooManyUploads:
+			renderJSONError(w, http.StatusForbidden, err)
+		default:
+			renderJSONError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/galleries/%d/images/uploads/%s", gallery.ID, session.Token))
+	setUploadHeaders(w, session)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadStatus reports how much of a resumable upload has been received,
+// so clients know where to resume from.
+//
+// HEAD /galleries/:id/images/uploads/:token
+func (u *Uploads) Status(w http.ResponseWriter, r *http.Request) {
+	session, ok := u.uploadSession(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	setUploadHeaders(w, session)
+	w.WriteHeader(http.StatusOK)
+}
+
+// UploadAppend adds a chunk to a resumable upload. The image is created
+// once the last chunk arrives, and any error doing so is returned in the
+// response to that chunk.
+//
+// PATCH /galleries/:id/images/uploads/:token
+func (u *Uploads) Append(w http.ResponseWriter, r *http.Request) {
+	session, ok := u.uploadSession(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		renderJSONError(w, http.StatusUnsupportedMediaType, errUploadContentType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		renderJSONError(w, http.StatusBadRequest, errUploadOffset)
+		return
+	}
+	var checksum *models.UploadChecksum
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		checksum, err = parseUploadChecksum(header)
+		if err != nil {
+			renderJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	err = u.ups.Append(session, offset, r.Body, checksum)
+	switch {
+	case err == nil:
+		setUploadHeaders(w, session)
+		w.WriteHeader(http.StatusNoContent)
+	case err == models.ErrUploadOffsetMismatch, err == models.ErrUploadInProgress:
+		renderJSONError(w, http.StatusConflict, err)
+	case err == models.ErrUploadChecksumMismatch:
+		renderJSONError(w, statusChecksumMismatch, err)
+	case err == models.ErrUploadChecksumAlgorithm:
+		renderJSONError(w, http.StatusBadRequest, err)
+	case err == models.ErrUploadTooLarge:
+		renderJSONError(w, http.StatusRequestEntityTooLarge, err)
+	case err == models.ErrNotFound:
+		renderJSONError(w, http.StatusNotFound, err)
+	case quotaExceeded(err):
+		renderJSONError(w, http.StatusForbidden, err)
+	case session.Complete():
+		// Everything arrived, but the file was rejected as an image
+		renderJSONError(w, http.StatusUnprocessableEntity, err)
+	default:
+		renderJSONError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// UploadDelete stops a resumable upload.
+//
+// DELETE /galleries/:id/images/uploads/:token
+func (u *Uploads) Delete(w http.ResponseWriter, r *http.Request) {
+	session, ok := u.uploadSession(w, r)
+	if !ok {
+		return
+	}
+	if err := u.ups.Delete(session); err != nil {
+		renderJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadGallery looks up the gallery in the URL, making sure it belongs to
+// the current user, or to someone who let them upload into it, and the
+// client speaks our version of tus.
+func (u *Uploads) uploadGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, bool) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		renderJSONError(w, http.StatusPreconditionFailed, errUploadVersion)
+		return nil, false
+	}
+	var gallery *models.Gallery
+	id, err := u.galleries.galleryID(r)
+	if err == nil {
+		gallery, err = u.galleries.gs.ById(id)
+	}
+	if err == nil {
+		gallery.Role, err = u.galleries.ms.RoleOf(gallery, context.User(r.Context()))
+	}
+	if err != nil {
+		if err == models.ErrNotFound {
+			renderJSONError(w, http.StatusNotFound, err)
+		} else {
+			renderJSONError(w, http.StatusInternalServerError, err)
+		}
+		return nil, false
+	}
+	if !gallery.Role.CanUpload() {
+		renderJSONError(w, http.StatusForbidden, errForbidden)
+		return nil, false
+	}
+	return gallery, true
+}
+
+// uploadSession looks up the upload in the URL, making sure it belongs to
+// a gallery of the current user.
+func (u *Uploads) uploadSession(w http.ResponseWriter, r *http.Request) (*models.UploadSession, bool) {
+	gallery, ok := u.uploadGallery(w, r)
+	if !ok {
+		return nil, false
+	}
+	session, err := u.ups.ByToken(mux.Vars(r)["token"])
+	if err == nil && session.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		if err == models.ErrNotFound {
+			// Expired uploads are gone too, the client has to start over
+			renderJSONError(w, http.StatusNotFound, err)
+		} else {
+			renderJSONError(w, http.StatusInternalServerError, err)
+		}
+		return nil, false
+	}
+	return session, true
+}
+
+func setUploadHeaders(w http.ResponseWriter, session *models.UploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(time.RFC1123))
+}
+
+// parseUploadMetadata parses an Upload-Metadata header, a comma separated
+// list of keys followed by a space and their base64 encoded value.
+// Values that can't be decoded are left out.
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 {
+			continue
+		}
+		var value []byte
+		if len(parts) > 1 {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+				continue
+			}
+		}
+		metadata[parts[0]] = string(value)
+	}
+	return metadata
+}
+
+// parseUploadChecksum parses an Upload-Checksum header, eg: "sha1 Kq5sNclPz7QV2+lfQIuc6R7oRu0="
+func parseUploadChecksum(header string) (*models.UploadChecksum, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, errUploadChecksum
+	}
+	sum, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errUploadChecksum
+	}
+	return &models.UploadChecksum{Algorithm: parts[0], Sum: sum}, nil
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]string
+	}{
+		{"", map[string]string{}},
+		{"filename cGhvdG8uanBn", map[string]string{"filename": "photo.jpg"}},
+		{"filename cGhvdG8uanBn,filetype aW1hZ2UvanBlZw==", map[string]string{"filename": "photo.jpg", "filetype": "image/jpeg"}},
+		{" filename cGhvdG8uanBn , is_confidential", map[string]string{"filename": "photo.jpg", "is_confidential": ""}},
+		{"filename not-base64!,name cGhvdG8uanBn", map[string]string{"name": "photo.jpg"}},
+		{",,", map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := parseUploadMetadata(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseUploadMetadata(%q) = %v; want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestParseUploadChecksum(t *testing.T) {
+	tests := []struct {
+		header    string
+		algorithm string
+		sum       []byte
+		err       error
+	}{
+		{"sha1 Kq5sNclPz7QV2+lfQIuc6R7oRu0=", "sha1", []byte{0x2a, 0xae, 0x6c, 0x35, 0xc9, 0x4f, 0xcf, 0xb4, 0x15, 0xdb, 0xe9, 0x5f, 0x40, 0x8b, 0x9c, 0xe9, 0x1e, 0xe8, 0x46, 0xed}, nil},
+		{"sha256 AAEC", "sha256", []byte{0, 1, 2}, nil},
+		{"", "", nil, errUploadChecksum},
+		{"sha1", "", nil, errUploadChecksum},
+		{"sha1 AAEC extra", "", nil, errUploadChecksum},
+		{"sha1 not-base64!", "", nil, errUploadChecksum},
+	}
+	for _, tt := range tests {
+		got, err := parseUploadChecksum(tt.header)
+		if err != tt.err {
+			t.Errorf("parseUploadChecksum(%q) err = %v; want %v", tt.header, err, tt.err)
+			continue
+		}
+		if err == nil && (got.Algorithm != tt.algorithm || !bytes.Equal(got.Sum, tt.sum)) {
+			t.Errorf("parseUploadChecksum(%q) = %s %x; want %s %x", tt.header, got.Algorithm, got.Sum, tt.algorithm, tt.sum)
+		}
+	}
+}
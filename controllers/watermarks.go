@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/torresjeff/gallery/imaging"
+	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/views"
+)
+
+const errWatermarkRequired publicError = "Please choose a PNG image to use as the watermark."
+
+// WatermarkForm sets where and how the watermark of a gallery is drawn.
+// The watermark itself is the "watermark" file of the multipart form, and
+// can be left out to only change its settings.
+type WatermarkForm struct {
+	Position string `schema:"position"`
+	// Opacity and Scale are percentages, of full opacity and of the width
+	// of the images.
+	Opacity int `schema:"opacity"`
+	Scale   int `schema:"scale"`
+}
+
+// Watermark uploads a watermark for the images of a gallery served to
+// visitors, and saves where and how it is drawn.
+//
+// POST /galleries/:id/watermark
+func (g *Galleries) Watermark(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanEdit() {
+		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	r.Body = http.MaxBytesReader(w, r.Body, g.maxUploadBytes)
+	if err := r.ParseMultipartForm(maxMultipartMemory); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	var form WatermarkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	gallery.WatermarkPosition = imaging.Position(form.Position)
+	gallery.WatermarkOpacity = form.Opacity
+	gallery.WatermarkScale = form.Scale
+
+	file, _, err := r.FormFile("watermark")
+	switch err {
+	case nil:
+		defer file.Close()
+		if err := g.is.SaveWatermark(gallery, file); err != nil {
+			vd.SetAlert(err)
+			g.EditView.Render(w, r, vd)
+			return
+		}
+	case http.ErrMissingFile:
+		if !gallery.Watermarked() {
+			vd.SetAlert(errWatermarkRequired)
+			g.EditView.Render(w, r, vd)
+			return
+		}
+	default:
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.cleanWatermarks(gallery)
+	g.redirectToEdit(w, r, gallery)
+}
+
+// WatermarkDelete stops watermarking the images of a gallery.
+//
+// POST /galleries/:id/watermark/delete
+func (g *Galleries) WatermarkDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Role.CanEdit() {
+		http.Error(w, "You do not have permission to edit this gallery.", http.StatusForbidden)
+		return
+	}
+	gallery.WatermarkKey = ""
+	if err := g.gs.Update(gallery); err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.cleanWatermarks(gallery)
+	g.redirectToEdit(w, r, gallery)
+}
+
+// ImageWatermarked serves a copy of an image with the watermark of its
+// gallery. The "name" path parameter is "full.jpg" for the full size
+// image, or the width and extension of one of its variants. Like the
+// files under /images/, copies aren't guarded by the visibility of the
+// gallery: the version in the URL comes from the random key of the
+// watermark, so only those who were shown the gallery know it.
+//
+// GET /galleries/:id/images/:imageID/watermarked/:version/:name
+func (g *Galleries) ImageWatermarked(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.lookupGallery(w, r)
+	if err != nil {
+		return
+	}
+	// Copies made with other watermarks or settings are never served
+	if !gallery.Watermarked() || mux.Vars(r)["version"] != gallery.WatermarkVersion() {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	width, format, ok := parseWatermarkedName(mux.Vars(r)["name"])
+	if !ok {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	f, err := g.is.OpenWatermarked(gallery, image, width, format)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Image not found", http.StatusNotFound)
+		default:
+			log.Printf("controllers: couldn't watermark image %d: %v", image.ID, err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", format.ContentType())
+	// The URL changes along with the watermark, so copies never go stale
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", gallery.UpdatedAt, rs)
+		return
+	}
+	io.Copy(w, f)
+}
+
+// watermarkImage makes the paths of an image of gallery point to a copy
+// with its watermark, unless the viewer is the owner or a collaborator.
+func watermarkImage(gallery *models.Gallery, image *models.Image) {
+	if gallery.Role.CanView() {
+		return
+	}
+	image.Watermark = gallery.WatermarkVersion()
+}
+
+func watermarkImages(gallery *models.Gallery, images []models.Image) {
+	for i := range images {
+		watermarkImage(gallery, &images[i])
+	}
+}
+
+// cleanWatermarks deletes the watermarks gallery doesn't use anymore, and
+// copies made with them. They only take up space, so errors are only logged.
+func (g *Galleries) cleanWatermarks(gallery *models.Gallery) {
+	if err := g.is.CleanWatermarks(gallery); err != nil {
+		log.Printf("controllers: couldn't clean up old watermarks of gallery %d: %v", gallery.ID, err)
+	}
+}
+
+// parseWatermarkedName parses the name of a watermarked copy into its
+// width, 0 for the full size image, and format.
+func parseWatermarkedName(name string) (int, imaging.Format, bool) {
+	ext := path.Ext(name)
+	var format imaging.Format
+	switch ext {
+	case imaging.JPEG.Ext():
+		format = imaging.JPEG
+	case imaging.WebP.Ext():
+		format = imaging.WebP
+	default:
+		return 0, "", false
+	}
+	base := strings.TrimSuffix(name, ext)
+	if base == "full" {
+		return 0, format, true
+	}
+	width, err := strconv.Atoi(base)
+	if err != nil || width <= 0 {
+		return 0, "", false
+	}
+	return width, format, true
+}
@@ -0,0 +1,153 @@
+package email
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	mailgunAPI    = "https://api.mailgun.net/v3"
+	defaultSender = "LensLocked.com <support@lenslocked.com>"
+
+	inviteSubject = "You're invited to collaborate on a gallery"
+	inviteText    = `Hi there!
+
+%s invited you to the gallery "%s" on LensLocked.com as a %s.
+
+Sign in (or sign up) with this email address, then accept the invitation here:
+
+%s
+
+If you weren't expecting this, you can ignore this email.
+`
+	inviteHTML = `<p>Hi there!</p>
+<p>%s invited you to the gallery &quot;%s&quot; on LensLocked.com as a %s.</p>
+<p>Sign in (or sign up) with this email address, then <a href="%s">accept the invitation</a>.</p>
+<p>If you weren't expecting this, you can ignore this email.</p>
+`
+
+	commentSubject = "New comment on %s"
+	commentText    = `Hi there!
+
+%s commented on your gallery "%s" on LensLocked.com:
+
+%s
+
+%s Moderate comments here:
+
+%s
+`
+	commentHTML = `<p>Hi there!</p>
+<p>%s commented on your gallery &quot;%s&quot; on LensLocked.com:</p>
+<blockquote style="white-space: pre-line">%s</blockquote>
+<p>%s <a href="%s">Moderate comments</a>.</p>
+`
+	commentApproved = "It's shown on the gallery already."
+	commentPending  = "It's waiting for you to approve it."
+)
+
+// Client sends emails through the Mailgun API. Without an API key it only
+// logs them, so everything that sends emails can be tried in development.
+type Client struct {
+	from   string
+	domain string
+	apiKey string
+	http   *http.Client
+}
+
+type ClientConfig func(*Client)
+
+// WithMailgun sends emails from domain, a domain set up with Mailgun.
+func WithMailgun(domain, apiKey string) ClientConfig {
+	return func(c *Client) {
+		c.domain = domain
+		c.apiKey = apiKey
+	}
+}
+
+// WithSender sets who emails are sent from.
+func WithSender(name, address string) ClientConfig {
+	return func(c *Client) {
+		c.from = fmt.Sprintf("%s <%s>", name, address)
+	}
+}
+
+func NewClient(opts ...ClientConfig) *Client {
+	c := Client{
+		from: defaultSender,
+		http: &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &c
+}
+
+// Invite emails to an invitation from inviter to collaborate on a gallery
+// with the given role, which they accept by visiting acceptURL.
+func (c *Client) Invite(to, inviter, galleryTitle, role, acceptURL string) error {
+	text := fmt.Sprintf(inviteText, inviter, galleryTitle, role, acceptURL)
+	body := fmt.Sprintf(inviteHTML,
+		html.EscapeString(inviter),
+		html.EscapeString(galleryTitle),
+		html.EscapeString(role),
+		html.EscapeString(acceptURL))
+	return c.send(to, inviteSubject, text, body)
+}
+
+// CommentNotification emails to the owner of a gallery about a comment
+// author posted on it, which they moderate at moderateURL. pending says
+// whether the comment waits for their approval.
+func (c *Client) CommentNotification(to, author, galleryTitle, comment, moderateURL string, pending bool) error {
+	status := commentApproved
+	if pending {
+		status = commentPending
+	}
+	subject := fmt.Sprintf(commentSubject, galleryTitle)
+	text := fmt.Sprintf(commentText, author, galleryTitle, comment, status, moderateURL)
+	body := fmt.Sprintf(commentHTML,
+		html.EscapeString(author),
+		html.EscapeString(galleryTitle),
+		html.EscapeString(comment),
+		html.EscapeString(status),
+		html.EscapeString(moderateURL))
+	return c.send(to, subject, text, body)
+}
+
+func (c *Client) send(to, subject, text, body string) error {
+	if c.apiKey == "" {
+		log.Printf("email: not sending %q to %s without a Mailgun API key:\n%s", subject, to, text)
+		return nil
+	}
+	form := url.Values{
+		"from":    {c.from},
+		"to":      {to},
+		"subject": {subject},
+		"text":    {text},
+		"html":    {body},
+	}
+	endpoint := fmt.Sprintf("%s/%s/messages", mailgunAPI, url.PathEscape(c.domain))
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", c.apiKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("email: mailgun responded with %s: %s", resp.Status, msg)
+	}
+	return nil
+}
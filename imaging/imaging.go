@@ -0,0 +1,151 @@
+// Package imaging decodes uploaded photos and produces the resized
+// variants we serve in place of the originals.
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	// Register the decoders for the formats we accept
+	_ "image/gif"
+
+	"golang.org/x/image/draw"
+)
+
+// Format is an image encoding that variants can be stored in.
+type Format string
+
+const (
+	JPEG Format = "jpeg"
+	WebP Format = "webp"
+
+	// DefaultJPEGQuality is used when an Encoder is created without a quality.
+	DefaultJPEGQuality = 85
+)
+
+// ErrWebPUnavailable is returned when encoding WebP without the cwebp tool installed.
+var ErrWebPUnavailable = errors.New("imaging: cwebp is not available to encode webp")
+
+// Ext returns the file extension used for f, including the leading dot.
+func (f Format) Ext() string {
+	switch f {
+	case WebP:
+		return ".webp"
+	default:
+		return ".jpg"
+	}
+}
+
+// ContentType returns the MIME type of f.
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Decode reads an image in any of the registered formats.
+func Decode(r io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// Resize scales img down to the given width, keeping its aspect ratio.
+// Images that are already narrower than width are returned as is.
+func Resize(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return img
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// Encoder writes images as JPEG or WebP. Go has no WebP encoder, so
+// WebP output is produced by the cwebp command line tool.
+type Encoder struct {
+	jpegQuality int
+	cwebpPath   string
+}
+
+// NewEncoder creates an Encoder. cwebp is the name or path of the cwebp
+// binary; if it can't be found WebP is simply not offered by Formats.
+func NewEncoder(jpegQuality int, cwebp string) *Encoder {
+	if jpegQuality <= 0 || jpegQuality > 100 {
+		jpegQuality = DefaultJPEGQuality
+	}
+	e := Encoder{jpegQuality: jpegQuality}
+	if cwebp != "" {
+		if path, err := exec.LookPath(cwebp); err == nil {
+			e.cwebpPath = path
+		}
+	}
+	return &e
+}
+
+// Formats returns the formats this encoder can produce.
+func (e *Encoder) Formats() []Format {
+	if e.cwebpPath == "" {
+		return []Format{JPEG}
+	}
+	return []Format{JPEG, WebP}
+}
+
+// Encode writes img to w in the given format.
+func (e *Encoder) Encode(w io.Writer, img image.Image, f Format) error {
+	switch f {
+	case JPEG:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: e.jpegQuality})
+	case WebP:
+		return e.encodeWebP(w, img)
+	default:
+		return fmt.Errorf("imaging: unknown format %q", f)
+	}
+}
+
+// encodeWebP hands img to cwebp as a lossless PNG and copies the result to w.
+func (e *Encoder) encodeWebP(w io.Writer, img image.Image) error {
+	if e.cwebpPath == "" {
+		return ErrWebPUnavailable
+	}
+	dir, err := ioutil.TempDir("", "lenslocked-webp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src.png")
+	dst := filepath.Join(dir, "dst.webp")
+	f, err := os.Create(src)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, img)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(e.cwebpPath, "-quiet", "-q", fmt.Sprint(e.jpegQuality), src, "-o", dst)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("imaging: cwebp failed: %v: %s", err, out)
+	}
+
+	webp, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer webp.Close()
+	_, err = io.Copy(w, webp)
+	return err
+}
@@ -0,0 +1,432 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ErrNoMetadata is returned by ReadMetadata for files without any EXIF data.
+var ErrNoMetadata = errors.New("imaging: file has no EXIF metadata")
+
+// errMalformedExif is returned when EXIF data is too broken to edit safely.
+var errMalformedExif = errors.New("imaging: malformed EXIF data")
+
+// pngSignature starts every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// Metadata is the information about a photo we read from its EXIF data.
+// Fields that aren't present in the file are left at their zero value.
+type Metadata struct {
+	CapturedAt  *time.Time
+	CameraMake  string
+	CameraModel string
+	LensModel   string
+	// ExposureTime is in seconds.
+	ExposureTime float64
+	FNumber      float64
+	ISO          int
+	// FocalLength is in millimeters.
+	FocalLength float64
+	Latitude    *float64
+	Longitude   *float64
+}
+
+// ReadMetadata reads the EXIF data of a JPEG, TIFF or PNG file.
+func ReadMetadata(r io.ReadSeeker) (*Metadata, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, ErrNoMetadata
+	}
+	var src io.Reader = r
+	if string(head) == pngSignature {
+		data, err := pngExif(r)
+		if err != nil {
+			return nil, err
+		}
+		src = bytes.NewReader(data)
+	} else if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	x, err := exif.Decode(src)
+	if err != nil {
+		if x == nil || exif.IsCriticalError(err) {
+			return nil, ErrNoMetadata
+		}
+		// Anything else only means some of the tags couldn't be read
+	}
+
+	var m Metadata
+	if t, err := x.DateTime(); err == nil {
+		m.CapturedAt = &t
+	}
+	m.CameraMake = exifString(x, exif.Make)
+	m.CameraModel = exifString(x, exif.Model)
+	m.LensModel = exifString(x, exif.LensModel)
+	m.ExposureTime = exifRat(x, exif.ExposureTime)
+	m.FNumber = exifRat(x, exif.FNumber)
+	m.FocalLength = exifRat(x, exif.FocalLength)
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := tag.Int(0); err == nil {
+			m.ISO = iso
+		}
+	}
+	if lat, long, err := x.LatLong(); err == nil && !math.IsNaN(lat) && !math.IsNaN(long) {
+		m.Latitude, m.Longitude = &lat, &long
+	}
+	return &m, nil
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifRat(x *exif.Exif, name exif.FieldName) float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// pngExif returns the contents of the eXIf chunk of the PNG file r is
+// positioned in, right after the signature.
+func pngExif(r io.ReadSeeker) ([]byte, error) {
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, ErrNoMetadata
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:]) {
+		case "eXIf":
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, ErrNoMetadata
+			}
+			return data, nil
+		case "IDAT", "IEND":
+			// eXIf must come before the image data
+			return nil, ErrNoMetadata
+		}
+		if _, err := r.Seek(length+4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Strip is how much metadata StripMetadata removes.
+type Strip int
+
+const (
+	// StripGPS removes the location a photo was taken at, keeping the
+	// rest of its EXIF data. XMP packets are removed as well, since they
+	// can repeat the location.
+	StripGPS Strip = iota
+	// StripAll removes every piece of metadata that isn't needed to
+	// display the image correctly, like its color profile.
+	StripAll
+)
+
+// StripMetadata copies the JPEG or PNG image in r to w without the
+// metadata selected by level. The image data itself is copied untouched,
+// so no quality is lost. Files in other formats are copied as they are.
+func StripMetadata(w io.Writer, r io.Reader, level Strip) error {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(pngSignature))
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8}):
+		return stripJPEG(w, br, level)
+	case string(head) == pngSignature:
+		return stripPNG(w, br, level)
+	}
+	_, err = io.Copy(w, br)
+	return err
+}
+
+const (
+	jpegSOS = 0xDA
+	jpegEOI = 0xD9
+	jpegCOM = 0xFE
+	jpegAPP = 0xE0
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+func stripJPEG(w io.Writer, r *bufio.Reader, level Strip) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return err
+	}
+	for {
+		marker, err := readJPEGMarker(r)
+		if err != nil {
+			return err
+		}
+		// Markers without a payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= jpegEOI) {
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			if marker == jpegEOI {
+				return nil
+			}
+			continue
+		}
+
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(size[:]))
+		if length < 2 {
+			return errMalformedExif
+		}
+		payload := make([]byte, length-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+
+		keep, payload := jpegSegment(marker, payload, level)
+		if keep {
+			binary.BigEndian.PutUint16(size[:], uint16(len(payload)+2))
+			if _, err := w.Write([]byte{0xFF, marker, size[0], size[1]}); err != nil {
+				return err
+			}
+			if _, err := w.Write(payload); err != nil {
+				return err
+			}
+		}
+		if marker == jpegSOS {
+			// Everything after the start of scan is image data
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
+
+// readJPEGMarker reads the next marker, skipping any fill bytes before it.
+func readJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, errMalformedExif
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// jpegSegment decides whether a segment is kept, and returns its payload
+// with any edits applied.
+func jpegSegment(marker byte, payload []byte, level Strip) (bool, []byte) {
+	switch {
+	case marker == jpegAPP+1 && bytes.HasPrefix(payload, exifHeader):
+		if level == StripAll {
+			return false, nil
+		}
+		tiff := payload[len(exifHeader):]
+		if err := removeGPS(tiff); err != nil {
+			// We can't tell where the location is, so drop it all
+			return false, nil
+		}
+		return true, payload
+	case marker == jpegAPP+1 && bytes.HasPrefix(payload, xmpHeader):
+		return false, nil
+	case level == StripAll && marker == jpegCOM:
+		return false, nil
+	case level == StripAll && marker > jpegAPP && marker <= jpegAPP+15:
+		// APP0 (JFIF) isn't in this range. APP2 holds the ICC color profile
+		// and APP14 the Adobe color transform, which are both needed to
+		// show the image with the right colors.
+		return marker == jpegAPP+2 || marker == jpegAPP+14, payload
+	}
+	return true, payload
+}
+
+func stripPNG(w io.Writer, r *bufio.Reader, level Strip) error {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return err
+	}
+	if _, err := w.Write(sig); err != nil {
+		return err
+	}
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := string(header[4:])
+
+		var drop, edit bool
+		switch kind {
+		case "eXIf":
+			drop, edit = level == StripAll, level == StripGPS
+		case "iTXt":
+			// XMP is stored in an iTXt chunk, and can repeat the location
+			drop = level == StripAll || pngXMP(r)
+		case "tEXt", "zTXt", "tIME":
+			drop = level == StripAll
+		}
+
+		switch {
+		case drop:
+			if _, err := io.CopyN(ioutil.Discard, r, length+4); err != nil {
+				return err
+			}
+		case edit:
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, 4); err != nil {
+				return err
+			}
+			if err := removeGPS(data); err != nil {
+				continue
+			}
+			crc := crc32.NewIEEE()
+			crc.Write(header[4:])
+			crc.Write(data)
+			if _, err := w.Write(header[:]); err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.BigEndian, crc.Sum32()); err != nil {
+				return err
+			}
+		default:
+			if _, err := w.Write(header[:]); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, length+4); err != nil {
+				return err
+			}
+		}
+		if kind == "IEND" {
+			return nil
+		}
+	}
+}
+
+// pngXMP reports whether the iTXt chunk r is positioned at holds XMP.
+func pngXMP(r *bufio.Reader) bool {
+	const keyword = "XML:com.adobe.xmp\x00"
+	b, _ := r.Peek(len(keyword))
+	return string(b) == keyword
+}
+
+// tiffTypeSizes is the size in bytes of each TIFF field type, by type ID.
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// gpsIFDTag is the tag in IFD0 pointing to the GPS IFD.
+const gpsIFDTag = 0x8825
+
+// removeGPS wipes the GPS IFD of the TIFF structured EXIF data in t, in
+// place. The IFD is left there but empty, so no offsets have to change.
+func removeGPS(t []byte) error {
+	if len(t) < 8 {
+		return errMalformedExif
+	}
+	var bo binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(t, []byte("II*\x00")):
+		bo = binary.LittleEndian
+	case bytes.HasPrefix(t, []byte("MM\x00*")):
+		bo = binary.BigEndian
+	default:
+		return errMalformedExif
+	}
+	entries := func(off uint32) (uint32, uint32, error) {
+		if uint64(off)+2 > uint64(len(t)) {
+			return 0, 0, errMalformedExif
+		}
+		n := uint32(bo.Uint16(t[off:]))
+		if uint64(off)+2+uint64(n)*12 > uint64(len(t)) {
+			return 0, 0, errMalformedExif
+		}
+		return off + 2, n, nil
+	}
+
+	start, n, err := entries(bo.Uint32(t[4:]))
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < n; i++ {
+		entry := t[start+i*12:]
+		if bo.Uint16(entry) != gpsIFDTag {
+			continue
+		}
+		gpsOff := bo.Uint32(entry[8:])
+		gpsStart, gpsN, err := entries(gpsOff)
+		if err != nil {
+			return err
+		}
+		for j := uint32(0); j < gpsN; j++ {
+			e := t[gpsStart+j*12 : gpsStart+j*12+12]
+			size := uint64(tiffTypeSizes[bo.Uint16(e[2:])]) * uint64(bo.Uint32(e[4:]))
+			if size > 4 {
+				// The value doesn't fit in the entry, so it lives elsewhere
+				off := uint64(bo.Uint32(e[8:]))
+				if off+size > uint64(len(t)) {
+					return errMalformedExif
+				}
+				zero(t[off : off+size])
+			}
+			zero(e)
+		}
+		bo.PutUint16(t[gpsOff:], 0)
+	}
+	return nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,173 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testExif builds little endian TIFF structured EXIF data with the make of
+// the camera, and a GPS IFD with the location 1.5N 2.5E.
+func testExif() []byte {
+	le := binary.LittleEndian
+	t := make([]byte, 146)
+	copy(t, "II*\x00")
+	le.PutUint32(t[4:], 8)
+	entry := func(off int, tag, typ uint16, count, value uint32) {
+		le.PutUint16(t[off:], tag)
+		le.PutUint16(t[off+2:], typ)
+		le.PutUint32(t[off+4:], count)
+		le.PutUint32(t[off+8:], value)
+	}
+	// IFD0, with its values right after it
+	le.PutUint16(t[8:], 2)
+	entry(10, 0x010F, 2, 6, 38) // Make
+	entry(22, gpsIFDTag, 4, 1, 44)
+	copy(t[38:], "Canon\x00")
+	// GPS IFD
+	le.PutUint16(t[44:], 4)
+	entry(46, 1, 2, 2, uint32('N')) // GPSLatitudeRef
+	entry(58, 2, 5, 3, 98)          // GPSLatitude
+	entry(70, 3, 2, 2, uint32('E')) // GPSLongitudeRef
+	entry(82, 4, 5, 3, 122)         // GPSLongitude
+	rationals := func(off int, degrees, minutes uint32) {
+		for i, v := range []uint32{degrees, 1, minutes, 1, 0, 1} {
+			le.PutUint32(t[off+i*4:], v)
+		}
+	}
+	rationals(98, 1, 30)
+	rationals(122, 2, 30)
+	return t
+}
+
+func testImage() image.Image {
+	return image.NewRGBA(image.Rect(0, 0, 8, 8))
+}
+
+// testJPEG returns a JPEG with the given segments right after its start.
+func testJPEG(t *testing.T, segments ...[]byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	out := append([]byte{}, b[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, b[2:]...)
+}
+
+func jpegSeg(marker byte, payload []byte) []byte {
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// testPNG returns a PNG with the given chunks right after its header.
+func testPNG(t *testing.T, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	// The signature, then the 25 bytes of IHDR
+	ihdrEnd := len(pngSignature) + 25
+	out := append([]byte{}, b[:ihdrEnd]...)
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return append(out, b[ihdrEnd:]...)
+}
+
+func pngChunk(kind string, data []byte) []byte {
+	c := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(c, uint32(len(data)))
+	copy(c[4:], kind)
+	c = append(c, data...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(c[4:]))
+	return append(c, crc[:]...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	exifSeg := jpegSeg(jpegAPP+1, append([]byte("Exif\x00\x00"), testExif()...))
+	xmpSeg := jpegSeg(jpegAPP+1, append(append([]byte{}, xmpHeader...), "<x:xmpmeta/>"...))
+	comment := jpegSeg(jpegCOM, []byte("shot at home"))
+	iccSeg := jpegSeg(jpegAPP+2, []byte("ICC_PROFILE\x00"))
+
+	tests := []struct {
+		name    string
+		in      []byte
+		level   Strip
+		camera  string
+		kept    [][]byte
+		removed [][]byte
+	}{
+		{"jpeg, gps", testJPEG(t, exifSeg, xmpSeg, comment, iccSeg), StripGPS, "Canon",
+			[][]byte{comment, iccSeg}, [][]byte{xmpSeg}},
+		{"jpeg, all", testJPEG(t, exifSeg, xmpSeg, comment, iccSeg), StripAll, "",
+			[][]byte{iccSeg}, [][]byte{exifSeg, xmpSeg, comment}},
+		{"png, gps", testPNG(t, pngChunk("eXIf", testExif()), pngChunk("tEXt", []byte("Comment\x00hi"))), StripGPS, "Canon",
+			[][]byte{pngChunk("tEXt", []byte("Comment\x00hi"))}, nil},
+		{"png, all", testPNG(t, pngChunk("eXIf", testExif()), pngChunk("tEXt", []byte("Comment\x00hi"))), StripAll, "",
+			nil, [][]byte{[]byte("eXIf"), []byte("tEXt")}},
+	}
+	for _, tt := range tests {
+		// Make sure the location is there to begin with
+		before, err := ReadMetadata(bytes.NewReader(tt.in))
+		if err != nil || before.Latitude == nil || *before.Latitude != 1.5 || *before.Longitude != 2.5 {
+			t.Fatalf("%s: test file doesn't have its location: %+v, %v", tt.name, before, err)
+		}
+
+		var out bytes.Buffer
+		if err := StripMetadata(&out, bytes.NewReader(tt.in), tt.level); err != nil {
+			t.Errorf("%s: StripMetadata() = %v", tt.name, err)
+			continue
+		}
+		if _, _, err := image.Decode(bytes.NewReader(out.Bytes())); err != nil {
+			t.Errorf("%s: stripped image doesn't decode: %v", tt.name, err)
+		}
+		after, err := ReadMetadata(bytes.NewReader(out.Bytes()))
+		switch {
+		case tt.camera == "" && err != ErrNoMetadata:
+			t.Errorf("%s: EXIF data left: %+v, %v", tt.name, after, err)
+		case tt.camera != "" && err != nil:
+			t.Errorf("%s: ReadMetadata() = %v", tt.name, err)
+		case tt.camera != "" && (after.CameraMake != tt.camera || after.Latitude != nil || after.Longitude != nil):
+			t.Errorf("%s: got camera %q and location %v, %v; want %q and no location", tt.name, after.CameraMake, after.Latitude, after.Longitude, tt.camera)
+		}
+		for _, b := range tt.kept {
+			if !bytes.Contains(out.Bytes(), b) {
+				t.Errorf("%s: removed %q", tt.name, b)
+			}
+		}
+		for _, b := range tt.removed {
+			if bytes.Contains(out.Bytes(), b) {
+				t.Errorf("%s: kept %q", tt.name, b)
+			}
+		}
+	}
+}
+
+func TestRemoveGPSMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"too short":          []byte("II*\x00"),
+		"unknown byte order": append([]byte("XX*\x00"), make([]byte, 8)...),
+		"IFD0 out of bounds": append([]byte("II*\x00\xff\x00\x00\x00"), make([]byte, 8)...),
+		"GPS IFD out of range": func() []byte {
+			t := testExif()
+			binary.LittleEndian.PutUint32(t[22+8:], 1000)
+			return t
+		}(),
+	}
+	for name, b := range tests {
+		if err := removeGPS(b); err != errMalformedExif {
+			t.Errorf("%s: removeGPS() = %v; want %v", name, err, errMalformedExif)
+		}
+	}
+}
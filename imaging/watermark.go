@@ -0,0 +1,129 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+)
+
+// Position is where a watermark is drawn on an image.
+type Position string
+
+const (
+	Center      Position = "center"
+	TopLeft     Position = "top_left"
+	TopRight    Position = "top_right"
+	BottomLeft  Position = "bottom_left"
+	BottomRight Position = "bottom_right"
+	// Tiled repeats the watermark all over the image.
+	Tiled Position = "tiled"
+)
+
+const (
+	// MinWatermarkSide is the smallest marks are drawn, in pixels.
+	MinWatermarkSide = 8
+	// maxTiles is the most times a mark is drawn on an image when Tiled.
+	maxTiles = 400
+)
+
+// Positions lists every position, in the order they should be offered to users.
+var Positions = []Position{BottomRight, BottomLeft, TopRight, TopLeft, Center, Tiled}
+
+// Valid reports whether p is one of Positions.
+func (p Position) Valid() bool {
+	for _, position := range Positions {
+		if p == position {
+			return true
+		}
+	}
+	return false
+}
+
+// Watermark returns a copy of img with mark drawn over it at pos. mark is
+// scaled to scale percent of the width of img, always fitting inside it,
+// and drawn opacity percent opaque on top of its own transparency.
+func Watermark(img, mark image.Image, pos Position, opacity, scale int) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	// Unlike Resize, marks are scaled up as well as down
+	size := markSize(bounds.Size(), mark.Bounds().Size(), scale)
+	scaled := image.NewRGBA(image.Rectangle{Max: size})
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), mark, mark.Bounds(), draw.Src, nil)
+
+	alpha := image.NewUniform(color.Alpha{A: uint8(opacity * 255 / 100)})
+	for _, pt := range watermarkPoints(dst.Bounds().Size(), size, pos) {
+		r := image.Rectangle{Min: pt, Max: pt.Add(size)}
+		draw.DrawMask(dst, r, scaled, image.Point{}, alpha, image.Point{}, draw.Over)
+	}
+	return dst
+}
+
+// markSize returns the size a mark is drawn at on an image of size bounds:
+// scale percent of its width, keeping the mark's aspect ratio, but shrunk
+// further if it would be taller than the image. Marks are kept at least
+// MinWatermarkSide pixels on each side, as far as the image allows.
+func markSize(bounds, mark image.Point, scale int) image.Point {
+	if mark.X <= 0 || mark.Y <= 0 {
+		return image.Point{X: 1, Y: 1}
+	}
+	// Sizes are worked out in 64 bits, so extreme aspect ratios can't overflow
+	w := int64(bounds.X) * int64(scale) / 100
+	h := int64(mark.Y) * w / int64(mark.X)
+	if h > int64(bounds.Y) {
+		h = int64(bounds.Y)
+		w = int64(mark.X) * h / int64(mark.Y)
+	}
+	w, h = clampSide(w, bounds.X), clampSide(h, bounds.Y)
+	return image.Point{X: int(w), Y: int(h)}
+}
+
+// clampSide keeps a side of a mark between MinWatermarkSide and max.
+func clampSide(side int64, max int) int64 {
+	if side < MinWatermarkSide {
+		side = MinWatermarkSide
+	}
+	if side > int64(max) {
+		side = int64(max)
+	}
+	if side < 1 {
+		side = 1
+	}
+	return side
+}
+
+// watermarkPoints returns the top left corners a mark of size is drawn
+// at on an image of size bounds, for pos. Marks in corners keep a margin
+// from the edges of 2% of the width of the image.
+func watermarkPoints(bounds, size image.Point, pos Position) []image.Point {
+	margin := bounds.X / 50
+	right, bottom := bounds.X-size.X-margin, bounds.Y-size.Y-margin
+	switch pos {
+	case TopLeft:
+		return []image.Point{{X: margin, Y: margin}}
+	case TopRight:
+		return []image.Point{{X: right, Y: margin}}
+	case BottomLeft:
+		return []image.Point{{X: margin, Y: bottom}}
+	case BottomRight:
+		return []image.Point{{X: right, Y: bottom}}
+	case Tiled:
+		// Leave half a mark of space between marks, so the image still shows,
+		// and more for small marks so there are never more than maxTiles
+		var points []image.Point
+		stepX, stepY := size.X*3/2+1, size.Y*3/2+1
+		for (bounds.X/stepX+1)*(bounds.Y/stepY+1) > maxTiles {
+			stepX, stepY = stepX*2, stepY*2
+		}
+		for y := margin; y < bounds.Y; y += stepY {
+			for x := margin; x < bounds.X; x += stepX {
+				points = append(points, image.Point{X: x, Y: y})
+			}
+		}
+		return points
+	default:
+		return []image.Point{{X: (bounds.X - size.X) / 2, Y: (bounds.Y - size.Y) / 2}}
+	}
+}
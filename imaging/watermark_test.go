@@ -0,0 +1,103 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestPositionValid(t *testing.T) {
+	for _, pos := range Positions {
+		if !pos.Valid() {
+			t.Errorf("%q.Valid() = false; want true", pos)
+		}
+	}
+	for _, pos := range []Position{"", "middle", "Center"} {
+		if pos.Valid() {
+			t.Errorf("%q.Valid() = true; want false", pos)
+		}
+	}
+}
+
+func TestMarkSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds image.Point
+		mark   image.Point
+		scale  int
+		want   image.Point
+	}{
+		{"scaled down", image.Pt(1000, 800), image.Pt(400, 100), 25, image.Pt(250, 62)},
+		{"scaled up", image.Pt(1000, 800), image.Pt(40, 10), 50, image.Pt(500, 125)},
+		// Tall marks are shrunk to fit on wide images
+		{"too tall", image.Pt(1000, 100), image.Pt(100, 400), 100, image.Pt(25, 100)},
+		{"too small", image.Pt(1000, 800), image.Pt(400, 100), 1, image.Pt(10, 8)},
+		{"tiny image", image.Pt(4, 4), image.Pt(100, 100), 50, image.Pt(4, 4)},
+		{"empty mark", image.Pt(1000, 800), image.Pt(0, 0), 25, image.Pt(1, 1)},
+		{"extreme aspect", image.Pt(1<<30, 1<<30), image.Pt(1<<30, 1), 100, image.Pt(1<<30, 8)},
+	}
+	for _, tt := range tests {
+		if got := markSize(tt.bounds, tt.mark, tt.scale); got != tt.want {
+			t.Errorf("%s: markSize(%v, %v, %d) = %v; want %v", tt.name, tt.bounds, tt.mark, tt.scale, got, tt.want)
+		}
+	}
+}
+
+func TestWatermarkPoints(t *testing.T) {
+	bounds, size := image.Pt(1000, 800), image.Pt(100, 50)
+	tests := []struct {
+		pos  Position
+		want image.Point
+	}{
+		{TopLeft, image.Pt(20, 20)},
+		{TopRight, image.Pt(880, 20)},
+		{BottomLeft, image.Pt(20, 730)},
+		{BottomRight, image.Pt(880, 730)},
+		{Center, image.Pt(450, 375)},
+	}
+	for _, tt := range tests {
+		points := watermarkPoints(bounds, size, tt.pos)
+		if len(points) != 1 || points[0] != tt.want {
+			t.Errorf("watermarkPoints(%q) = %v; want [%v]", tt.pos, points, tt.want)
+		}
+	}
+
+	for _, size := range []image.Point{image.Pt(100, 50), image.Pt(8, 8)} {
+		points := watermarkPoints(bounds, size, Tiled)
+		if len(points) < 2 || len(points) > maxTiles {
+			t.Errorf("watermarkPoints(%q) of %v has %d points; want 2 to %d", Tiled, size, len(points), maxTiles)
+		}
+		for _, pt := range points {
+			if !pt.In(image.Rectangle{Max: bounds}) {
+				t.Errorf("watermarkPoints(%q) of %v has %v outside the image", Tiled, size, pt)
+			}
+		}
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	mark := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for i := 3; i < len(mark.Pix); i += 4 {
+		mark.Pix[i] = 255
+	}
+
+	marked := Watermark(img, mark, BottomRight, 50, 25)
+	if marked.Bounds() != img.Bounds() {
+		t.Fatalf("Bounds() = %v; want %v", marked.Bounds(), img.Bounds())
+	}
+	// The mark is 50 by 25 pixels, 4 pixels from the bottom right corner
+	r, g, b, _ := marked.At(170, 80).RGBA()
+	if r>>8 < 100 || r>>8 > 155 || g != r || b != r {
+		t.Errorf("At(170, 80) = %v; want half opaque black over white", marked.At(170, 80))
+	}
+	if got := color.RGBAModel.Convert(marked.At(10, 10)); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("At(10, 10) = %v; want it untouched", got)
+	}
+	if img.At(170, 80) != (color.RGBA{255, 255, 255, 255}) {
+		t.Error("Watermark() drew on the image it was given")
+	}
+}
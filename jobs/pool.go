@@ -0,0 +1,142 @@
+// Package jobs runs the background jobs stored in a models.JobQueue
+// using a fixed number of workers.
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/torresjeff/gallery/models"
+)
+
+const (
+	DefaultWorkers      = 4
+	DefaultPollInterval = 2 * time.Second
+)
+
+// Handler runs a single job. Returning an error makes the queue retry the
+// job later, unless it was the job's last attempt.
+type Handler func(job *models.Job) error
+
+// Pool is a bounded set of workers pulling jobs from a queue. Jobs are
+// dispatched to the Handler registered for their kind.
+type Pool struct {
+	queue        models.JobQueue
+	workers      int
+	pollInterval time.Duration
+	handlers     map[string]Handler
+
+	wg   sync.WaitGroup
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewPool creates a Pool with the given number of workers. Idle workers
+// check the queue for new jobs every pollInterval.
+func NewPool(queue models.JobQueue, workers int, pollInterval time.Duration) *Pool {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+	return &Pool{
+		queue:        queue,
+		workers:      workers,
+		pollInterval: pollInterval,
+		handlers:     make(map[string]Handler),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Handle registers the handler for jobs of the given kind. It must be
+// called before Start.
+func (p *Pool) Handle(kind string, h Handler) {
+	p.handlers[kind] = h
+}
+
+// Start launches the workers in the background.
+func (p *Pool) Start() {
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+}
+
+// Shutdown stops the workers from claiming new jobs and waits for the ones
+// already running to finish, or for ctx to be done, whichever comes first.
+// Jobs cut off by ctx are picked up again once their lock expires.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+
+		job, err := p.queue.Dequeue()
+		if err != nil {
+			if err != models.ErrNoJobs {
+				log.Println("jobs: couldn't dequeue job:", err)
+			}
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(p.pollInterval):
+			}
+			continue
+		}
+		p.run(job)
+	}
+}
+
+// run executes a single job and reports the outcome back to the queue.
+func (p *Pool) run(job *models.Job) {
+	err := p.handle(job)
+	if err == nil {
+		if err := p.queue.Complete(job); err != nil {
+			log.Printf("jobs: couldn't complete job %d: %v", job.ID, err)
+		}
+		return
+	}
+	log.Printf("jobs: %s job %d failed (attempt %d of %d): %v", job.Kind, job.ID, job.Attempts, job.MaxAttempts, err)
+	if err := p.queue.Fail(job, err); err != nil {
+		log.Printf("jobs: couldn't record failure of job %d: %v", job.ID, err)
+	}
+}
+
+// handle calls the handler for job, turning panics into errors so a single
+// bad job can't take down the worker.
+func (p *Pool) handle(job *models.Job) (err error) {
+	h, ok := p.handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("jobs: no handler registered for %q", job.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("jobs: handler panicked: %v", r)
+		}
+	}()
+	return h(job)
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
+	appcontext "github.com/torresjeff/gallery/context"
 	"github.com/torresjeff/gallery/controllers"
+	"github.com/torresjeff/gallery/email"
+	"github.com/torresjeff/gallery/imaging"
+	"github.com/torresjeff/gallery/jobs"
 	"github.com/torresjeff/gallery/middleware"
 	"github.com/torresjeff/gallery/models"
+	"github.com/torresjeff/gallery/storage"
 )
 
 const (
@@ -19,12 +31,29 @@ const (
 	user     = "postgres"
 	password = "password"
 	dbname   = "lenslocked_dev"
+
+	// shutdownTimeout is how long we wait for requests and background jobs to finish when stopping the server.
+	shutdownTimeout = 30 * time.Second
+	// uploadExpiryInterval is how often abandoned resumable uploads are cleaned up.
+	uploadExpiryInterval = time.Hour
+	// trashPurgeInterval is how often galleries and images are purged from the trash once their retention is over.
+	trashPurgeInterval = time.Hour
+	// statsRollupInterval is how often the stats of the days that are over are rolled up.
+	statsRollupInterval = time.Hour
 )
 
 var (
-	staticController    *controllers.Static
-	usersController     *controllers.Users
-	galleriesController *controllers.Galleries
+	staticController      *controllers.Static
+	usersController       *controllers.Users
+	galleriesController   *controllers.Galleries
+	membersController     *controllers.Members
+	selectionsController  *controllers.Selections
+	commentsController    *controllers.Comments
+	statsController       *controllers.Stats
+	uploadsController     *controllers.Uploads
+	searchController      *controllers.Search
+	collectionsController *controllers.Collections
+	trashController       *controllers.Trash
 )
 
 func must(err error) {
@@ -35,15 +64,49 @@ func must(err error) {
 
 func main() {
 	prod := flag.Bool("prod", false, "Provide this flag in production. This ensures that a config.json file is provided before the application starts.")
+	regenVariants := flag.Bool("regen-variants", false, "Recreate the resized variants of every image using the current config, then exit.")
+	recomputeUsage := flag.Bool("recompute-usage", false, "Recount the storage used by every user and gallery from the files in storage, then exit.")
+	dedupReport := flag.Bool("dedup-report", false, "Print how much storage is saved by keeping identical images once, then exit.")
 	flag.Parse()
 	config := LoadConfig(*prod)
 	dbConfig := config.Database
+	store, err := config.Storage.Storage()
+	must(err)
 	services, err := models.NewServices(
 		models.WithGorm(dbConfig.Dialect(), dbConfig.ConnectionInfo()),
 		models.WithLogMode(true),
 		models.WithUser(config.Pepper, config.HMACKey),
 		models.WithGallery(),
-		models.WithImage(),
+		models.WithGalleryMember(),
+		models.WithShareLink(),
+		models.WithCollection(),
+		models.WithSearch(),
+		models.WithJobQueue(),
+		models.WithImage(store, models.ImageConfig{
+			Encoder:          imaging.NewEncoder(config.Images.JPEGQuality, config.Images.CwebpPath),
+			VariantWidths:    config.Images.VariantWidths,
+			MaxFileBytes:     config.Images.MaxFileBytes,
+			AllowedFormats:   config.Images.AllowedFormats,
+			MaxImportEntries: config.Images.MaxImportEntries,
+			MaxImportBytes:   config.Images.MaxImportBytes,
+			Quota: models.QuotaConfig{
+				MaxBytes:         config.Quotas.MaxBytesPerUser,
+				MaxImages:        config.Quotas.MaxImagesPerUser,
+				MaxGalleryImages: config.Quotas.MaxImagesPerGallery,
+			},
+		}),
+		models.WithUpload(models.UploadConfig{
+			Dir:         config.Uploads.Dir,
+			Expiry:      config.Uploads.Expiry(),
+			MaxBytes:    config.Images.MaxFileBytes,
+			MaxSessions: config.Uploads.MaxSessionsPerUser,
+		}),
+		models.WithSelection(),
+		models.WithComment(),
+		models.WithStats(),
+		models.WithTrash(models.TrashConfig{
+			Retention: config.Trash.Retention(),
+		}),
 	)
 	// us, err := models.NewUserService(psqlInfo)
 	if err != nil {
@@ -54,6 +117,41 @@ func main() {
 	// services.DestructiveReset()
 	services.AutoMigrate()
 
+	if *regenVariants {
+		must(regenerateVariants(services.Image))
+		return
+	}
+	if *recomputeUsage {
+		must(services.Image.RecomputeUsage())
+		return
+	}
+	if *dedupReport {
+		must(printDedupReport(services.Image))
+		return
+	}
+
+	// Background workers process uploaded images so requests don't have to wait on them
+	pool := jobs.NewPool(services.Jobs, config.Jobs.Workers, config.Jobs.PollInterval())
+	pool.Handle(models.JobProcessImage, services.Image.ProcessJob)
+	pool.Handle(models.JobRollupStats, services.Stats.RollupJob)
+	pool.Start()
+	// Housekeeping runs until done is closed when shutting down
+	done := make(chan struct{})
+	var housekeeping sync.WaitGroup
+	housekeeping.Add(3)
+	go func() {
+		defer housekeeping.Done()
+		expireUploads(services.Upload, uploadExpiryInterval, done)
+	}()
+	go func() {
+		defer housekeeping.Done()
+		purgeTrash(services.Trash, trashPurgeInterval, done)
+	}()
+	go func() {
+		defer housekeeping.Done()
+		rollupStats(services.Jobs, statsRollupInterval, done)
+	}()
+
 	userMw := middleware.User{
 		UserService: services.User,
 	}
@@ -66,7 +164,16 @@ func main() {
 
 	staticController = controllers.NewStatic()
 	usersController = controllers.NewUsers(services.User)
-	galleriesController = controllers.NewGalleries(services.Gallery, services.Image, r)
+	emailer := email.NewClient(email.WithMailgun(config.Mailgun.Domain, config.Mailgun.APIKey))
+	galleriesController = controllers.NewGalleries(services.Gallery, services.Image, services.ShareLink, services.Member, services.Selection, services.Comment, services.Stats, r, config.Images.MaxRequestBytes)
+	membersController = controllers.NewMembers(services.Member, emailer, galleriesController, r, config.BaseURL)
+	selectionsController = controllers.NewSelections(services.Selection, galleriesController)
+	commentsController = controllers.NewComments(services.Comment, services.User, emailer, galleriesController, r, config.BaseURL)
+	statsController = controllers.NewStats(services.Stats, galleriesController)
+	uploadsController = controllers.NewUploads(services.Upload, galleriesController)
+	searchController = controllers.NewSearch(services.Search)
+	trashController = controllers.NewTrash(services.Trash, r)
+	collectionsController = controllers.NewCollections(services.Collection, services.Gallery, services.Image, galleriesController, r)
 
 	// User related routes
 	r.HandleFunc("/signup", usersController.RenderSignUp).Methods("GET")
@@ -80,16 +187,82 @@ func main() {
 	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesController.RenderIndex)).Methods("GET").Name(controllers.IndexGalleries)
 	r.HandleFunc("/galleries/new", requireUserMw.ApplyFn(galleriesController.RenderCreateGallery)).Methods("GET")
 	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesController.Create)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesController.Show).Methods("GET").Name(controllers.ShowGallery)
-	r.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMw.ApplyFn(galleriesController.RenderEdit)).Methods("GET").Name(controllers.EditGallery)
-	r.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMw.ApplyFn(galleriesController.Edit)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesController.Delete)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesController.ImageUpload)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesController.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}", galleriesController.Show).Methods("GET").Name(controllers.ShowGallery)
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/edit", requireUserMw.ApplyFn(galleriesController.RenderEdit)).Methods("GET").Name(controllers.EditGallery)
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/edit", requireUserMw.ApplyFn(galleriesController.Edit)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/delete", requireUserMw.ApplyFn(galleriesController.Delete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/duplicate", requireUserMw.ApplyFn(galleriesController.Duplicate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/metadata", requireUserMw.ApplyFn(galleriesController.Metadata)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/download", galleriesController.Download).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/proofing", requireUserMw.ApplyFn(selectionsController.Proofing)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/selection/images/{imageID:[0-9]+}", selectionsController.Pick).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/selection/submit", selectionsController.Submit).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/selection/restart", selectionsController.Restart).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/selections/{selectionID:[0-9]+}/csv", requireUserMw.ApplyFn(selectionsController.CSV)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/selections/{selectionID:[0-9]+}/lightroom", requireUserMw.ApplyFn(selectionsController.Lightroom)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/selections/{selectionID:[0-9]+}/delete", requireUserMw.ApplyFn(selectionsController.Delete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/stats", requireUserMw.ApplyFn(statsController.Show)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/{imageID:[0-9]+}", galleriesController.ImageShow).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/{imageID:[0-9]+}/open", statsController.ImageOpen).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/{imageID:[0-9]+}/watermarked/{version:[0-9a-f]+}/{name}", galleriesController.ImageWatermarked).Methods("GET", "HEAD")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/watermark", requireUserMw.ApplyFn(galleriesController.Watermark)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/watermark/delete", requireUserMw.ApplyFn(galleriesController.WatermarkDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/comments", commentsController.Create).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/comments/moderation", requireUserMw.ApplyFn(commentsController.Moderation)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/comments/{commentID:[0-9]+}/approve", requireUserMw.ApplyFn(commentsController.Approve)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/comments/{commentID:[0-9]+}/hide", requireUserMw.ApplyFn(commentsController.Hide)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/comments/{commentID:[0-9]+}/delete", requireUserMw.ApplyFn(commentsController.Delete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/share-links", requireUserMw.ApplyFn(galleriesController.ShareLinkCreate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/share-links/{linkID:[0-9]+}", requireUserMw.ApplyFn(galleriesController.ShareLinkUpdate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/share-links/{linkID:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesController.ShareLinkDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/members", requireUserMw.ApplyFn(membersController.Invite)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/members/{memberID:[0-9]+}", requireUserMw.ApplyFn(membersController.Update)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/members/{memberID:[0-9]+}/delete", requireUserMw.ApplyFn(membersController.Delete)).Methods("POST")
+	r.HandleFunc("/invitations/{token}", requireUserMw.ApplyFn(membersController.RenderInvitation)).Methods("GET").Name(controllers.ShowInvitation)
+	r.HandleFunc("/invitations/{token}", requireUserMw.ApplyFn(membersController.AcceptInvitation)).Methods("POST")
+	r.HandleFunc("/s/{token}", galleriesController.ShowShared).Methods("GET")
+	r.HandleFunc("/users/{userID:[0-9]+}/galleries/{slug:[0-9a-z-]+}", galleriesController.Show).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images", galleriesController.ImageIndex).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images", requireUserMw.ApplyFn(galleriesController.ImageUpload)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/uploads", requireUserMw.ApplyFn(uploadsController.Options)).Methods("OPTIONS")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/uploads", requireUserMw.ApplyFn(uploadsController.Create)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/uploads/{token}", requireUserMw.ApplyFn(uploadsController.Status)).Methods("HEAD")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/uploads/{token}", requireUserMw.ApplyFn(uploadsController.Append)).Methods("PATCH")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/uploads/{token}", requireUserMw.ApplyFn(uploadsController.Delete)).Methods("DELETE")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/{imageID:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesController.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/order", requireUserMw.ApplyFn(galleriesController.ImageOrder)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/reorder", requireUserMw.ApplyFn(galleriesController.ImageReorder)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/{imageID:[0-9]+}/details", requireUserMw.ApplyFn(galleriesController.ImageDetails)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9a-z-]+}/images/{imageID:[0-9]+}/cover", requireUserMw.ApplyFn(galleriesController.ImageCover)).Methods("POST")
+
+	// Collection related routes
+	r.HandleFunc("/collections", requireUserMw.ApplyFn(collectionsController.Index)).Methods("GET").Name(controllers.IndexCollections)
+	r.HandleFunc("/collections", requireUserMw.ApplyFn(collectionsController.Create)).Methods("POST")
+	r.HandleFunc("/collections/{id:[0-9]+}", collectionsController.Show).Methods("GET")
+	r.HandleFunc("/collections/{id:[0-9]+}/edit", requireUserMw.ApplyFn(collectionsController.RenderEdit)).Methods("GET").Name(controllers.EditCollection)
+	r.HandleFunc("/collections/{id:[0-9]+}/edit", requireUserMw.ApplyFn(collectionsController.Edit)).Methods("POST")
+	r.HandleFunc("/collections/{id:[0-9]+}/galleries", requireUserMw.ApplyFn(collectionsController.Galleries)).Methods("POST")
+	r.HandleFunc("/collections/{id:[0-9]+}/share", requireUserMw.ApplyFn(collectionsController.Share)).Methods("POST")
+	r.HandleFunc("/collections/{id:[0-9]+}/unshare", requireUserMw.ApplyFn(collectionsController.Unshare)).Methods("POST")
+	r.HandleFunc("/collections/{id:[0-9]+}/delete", requireUserMw.ApplyFn(collectionsController.Delete)).Methods("POST")
+	r.HandleFunc("/c/{token}", collectionsController.ShowShared).Methods("GET")
+	r.HandleFunc("/c/{token}/collections/{collectionID:[0-9]+}", collectionsController.ShowShared).Methods("GET")
+	r.HandleFunc("/c/{token}/galleries/{galleryID:[0-9]+}", collectionsController.ShowSharedGallery).Methods("GET")
+	r.HandleFunc("/c/{token}/galleries/{galleryID:[0-9]+}/images/{imageID:[0-9]+}", collectionsController.ShowSharedImage).Methods("GET")
+
+	// Search routes
+	r.HandleFunc("/search", requireUserMw.ApplyFn(searchController.Search)).Methods("GET")
+
+	// Trash routes
+	r.HandleFunc("/trash", requireUserMw.ApplyFn(trashController.Index)).Methods("GET").Name(controllers.IndexTrash)
+	r.HandleFunc("/trash/galleries/{id:[0-9]+}/restore", requireUserMw.ApplyFn(trashController.RestoreGallery)).Methods("POST")
+	r.HandleFunc("/trash/galleries/{id:[0-9]+}/purge", requireUserMw.ApplyFn(trashController.PurgeGallery)).Methods("POST")
+	r.HandleFunc("/trash/images/{id:[0-9]+}/restore", requireUserMw.ApplyFn(trashController.RestoreImage)).Methods("POST")
+	r.HandleFunc("/trash/images/{id:[0-9]+}/purge", requireUserMw.ApplyFn(trashController.PurgeImage)).Methods("POST")
 
 	// Image routes
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	imageHandler := hideFiles(services.Image, storage.Handler(store))
+	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", noSniff(imageHandler)))
 
 	// Asset routes
 	assetHandler := http.FileServer(http.Dir("./assets/"))
@@ -104,6 +277,168 @@ func main() {
 
 	// Apply our user middleware before our router even routes a user to the appropriate page,
 	// guaranteeing that the user is set in the request context if they are logged in.
-	fmt.Println("Starting the server on port", config.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Port), csrfMw(userMw.Apply(r))))
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: csrfMw(userMw.Apply(r)),
+	}
+	go func() {
+		fmt.Println("Starting the server on port", config.Port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for Ctrl+C (or a SIGTERM from whatever is running us), then let in
+	// flight requests and jobs finish before exiting.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	fmt.Println("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Couldn't shut down the server cleanly:", err)
+	}
+	close(done)
+	if err := wait(ctx, &housekeeping); err != nil {
+		log.Println("Couldn't wait for housekeeping to finish:", err)
+	}
+	if err := pool.Shutdown(ctx); err != nil {
+		log.Println("Couldn't wait for background jobs to finish:", err)
+	}
+}
+
+// noSniff stops browsers from guessing the content type of the files we
+// serve, so a user uploaded file is never treated as anything but what its
+// extension says it is.
+func noSniff(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hideFiles stops the files of images from being served to those who
+// mustn't see them: files of images in the trash, originals still carrying
+// the metadata their gallery strips, and the clean files of watermarked
+// images to anyone but the owner and collaborators. Pages link to the
+// stripped and watermarked copies instead.
+func hideFiles(is models.ImageService, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var userID uint
+		if user := appcontext.User(r.Context()); user != nil {
+			userID = user.ID
+		}
+		hidden, err := is.FileHidden(strings.TrimPrefix(r.URL.Path, "/"), userID)
+		if err != nil {
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		if hidden {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// every calls fn every interval until done is closed. A call in progress
+// when it is closed is finished first.
+func every(interval time.Duration, done <-chan struct{}, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// wait waits for wg, or until ctx is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// expireUploads throws away the resumable uploads that were abandoned
+// halfway, every interval until done is closed.
+func expireUploads(us models.UploadService, interval time.Duration, done <-chan struct{}) {
+	every(interval, done, func() {
+		n, err := us.DeleteExpired()
+		if err != nil {
+			log.Println("Couldn't delete expired uploads:", err)
+		}
+		if n > 0 {
+			log.Printf("Deleted %d expired uploads", n)
+		}
+	})
+}
+
+// purgeTrash deletes for good the galleries and images that have been in
+// the trash for longer than its retention, every interval until done is
+// closed.
+func purgeTrash(ts models.TrashService, interval time.Duration, done <-chan struct{}) {
+	every(interval, done, func() {
+		n, err := ts.PurgeExpired()
+		if err != nil {
+			log.Println("Couldn't purge the trash:", err)
+		}
+		if n > 0 {
+			log.Printf("Purged %d galleries and images from the trash", n)
+		}
+	})
+}
+
+// rollupStats enqueues a job rolling up the stats of the days that are
+// over, every interval until done is closed.
+func rollupStats(jobs models.JobQueue, interval time.Duration, done <-chan struct{}) {
+	every(interval, done, func() {
+		if err := jobs.Enqueue(models.JobRollupStats, nil); err != nil {
+			log.Println("Couldn't enqueue rolling up stats:", err)
+		}
+	})
+}
+
+// regenerateVariants recreates the resized variants of every image. It's
+// meant to be run after changing the variant sizes in the config.
+func regenerateVariants(is models.ImageService) error {
+	images, err := is.All()
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		fmt.Printf("Regenerating variants for image %d (%d/%d)\n", images[i].ID, i+1, len(images))
+		if err := is.RegenerateVariants(&images[i]); err != nil {
+			// Keep going, a single broken file shouldn't stop the rest
+			log.Printf("Couldn't regenerate variants for image %d: %v", images[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// printDedupReport prints how much space is saved by storing each distinct
+// image file once, no matter how many galleries it was uploaded to.
+func printDedupReport(is models.ImageService) error {
+	report, err := is.DedupReport()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Images:       %d\n", report.Images)
+	fmt.Printf("Stored files: %d (%d shared by more than one image)\n", report.Blobs, report.SharedBlobs)
+	fmt.Printf("Logical size: %s\n", models.FormatBytes(report.LogicalBytes))
+	fmt.Printf("Stored size:  %s\n", models.FormatBytes(report.StoredBytes))
+	fmt.Printf("Space saved:  %s\n", models.FormatBytes(report.SavedBytes()))
+	return nil
 }
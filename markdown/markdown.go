@@ -0,0 +1,98 @@
+// Package markdown renders the small subset of Markdown users can write in
+// captions and descriptions.
+package markdown
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	paragraphSep = regexp.MustCompile(`\n[ \t]*\n`)
+	link         = regexp.MustCompile(`\[([^\]\n]+)\]\(([^)\s]+)\)`)
+	// Like in Markdown, emphasis can't start or end with a space, so "2 * 3 * 4" isn't italic.
+	bold   = regexp.MustCompile(`\*\*([^*\s]|[^*\s][^*]*[^*\s])\*\*`)
+	italic = regexp.MustCompile(`\*([^*\s]|[^*\s][^*]*[^*\s])\*`)
+)
+
+// allowedSchemes are the only kinds of links we render. Anything else, eg:
+// "javascript:" links, is left as plain text.
+var allowedSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+}
+
+// Render converts s to HTML. It supports paragraphs, line breaks,
+// **bold**, *italic*, `code` and [links](https://example.com). Everything
+// else, including any HTML in s, is escaped, so the result is safe to use
+// in templates even when s comes from users.
+func Render(s string) template.HTML {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	var b strings.Builder
+	for _, p := range paragraphSep.Split(s, -1) {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		lines := strings.Split(p, "\n")
+		for i, line := range lines {
+			lines[i] = inline(strings.TrimSpace(line))
+		}
+		b.WriteString("<p>")
+		b.WriteString(strings.Join(lines, "<br>\n"))
+		b.WriteString("</p>\n")
+	}
+	return template.HTML(strings.TrimSuffix(b.String(), "\n"))
+}
+
+// inline renders the formatting within a single line. Nothing inside code
+// spans is formatted.
+func inline(s string) string {
+	parts := strings.Split(s, "`")
+	if len(parts)%2 == 0 {
+		// An unmatched backtick is just a backtick
+		last := len(parts) - 1
+		parts[last-1] += "`" + parts[last]
+		parts = parts[:last]
+	}
+	var b strings.Builder
+	for i, part := range parts {
+		if i%2 == 1 {
+			b.WriteString("<code>" + html.EscapeString(part) + "</code>")
+			continue
+		}
+		b.WriteString(links(part))
+	}
+	return b.String()
+}
+
+// links renders the links in s, along with the emphasis in and around them.
+func links(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range link.FindAllStringSubmatchIndex(s, -1) {
+		text, href := s[m[2]:m[3]], s[m[4]:m[5]]
+		u, err := url.Parse(href)
+		if err != nil || !allowedSchemes[strings.ToLower(u.Scheme)] {
+			continue
+		}
+		b.WriteString(emphasis(s[last:m[0]]))
+		b.WriteString(`<a href="` + html.EscapeString(u.String()) + `" rel="nofollow noopener">`)
+		b.WriteString(emphasis(text))
+		b.WriteString("</a>")
+		last = m[1]
+	}
+	b.WriteString(emphasis(s[last:]))
+	return b.String()
+}
+
+// emphasis escapes s and renders the bold and italic text in it.
+func emphasis(s string) string {
+	s = html.EscapeString(s)
+	s = bold.ReplaceAllString(s, "<strong>$1</strong>")
+	return italic.ReplaceAllString(s, "<em>$1</em>")
+}
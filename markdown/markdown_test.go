@@ -0,0 +1,43 @@
+package markdown
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want template.HTML
+	}{
+		{"empty", "", ""},
+		{"paragraphs", "one\n\ntwo", "<p>one</p>\n<p>two</p>"},
+		{"line breaks", "one\r\ntwo", "<p>one<br>\ntwo</p>"},
+		{"emphasis", "**bold** and *italic*", "<p><strong>bold</strong> and <em>italic</em></p>"},
+		{"spaced stars", "2 * 3 * 4", "<p>2 * 3 * 4</p>"},
+		{"code", "`**not bold**`", "<p><code>**not bold**</code></p>"},
+		{"unmatched backtick", "a ` b", "<p>a ` b</p>"},
+		{"link", "[site](https://example.com/?a=1&b=2)",
+			`<p><a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener">site</a></p>`},
+		{"mailto link", "[me](mailto:me@example.com)",
+			`<p><a href="mailto:me@example.com" rel="nofollow noopener">me</a></p>`},
+		{"html", `<script>alert("x")</script>`, "<p>&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</p>"},
+		{"html in code", "`<b>`", "<p><code>&lt;b&gt;</code></p>"},
+		{"html in link text", "[<img src=x onerror=alert(1)>](https://example.com)",
+			`<p><a href="https://example.com" rel="nofollow noopener">&lt;img src=x onerror=alert(1)&gt;</a></p>`},
+		{"quote in href", `[x](https://example.com/"onmouseover="alert(1))`,
+			`<p><a href="https://example.com/%22onmouseover=%22alert%281" rel="nofollow noopener">x</a>)</p>`},
+		{"javascript link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>"},
+		{"javascript link in caps", "[x](JaVaScRiPt:alert(1))", "<p>[x](JaVaScRiPt:alert(1))</p>"},
+		{"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)", "<p>[x](data:text/html;base64,PHNjcmlwdD4=)</p>"},
+		{"vbscript link", "[x](vbscript:msgbox)", "<p>[x](vbscript:msgbox)</p>"},
+		{"entity encoded scheme", "[x](&#106;avascript:alert(1))", "<p>[x](&amp;#106;avascript:alert(1))</p>"},
+		{"relative link", "[x](/galleries/1)", "<p>[x](/galleries/1)</p>"},
+	}
+	for _, tt := range tests {
+		if got := Render(tt.in); got != tt.want {
+			t.Errorf("%s: Render(%q) =\n%s\nwant\n%s", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/storage"
+)
+
+// Blob is a file stored once, no matter how many images use it. Blobs are
+// addressed by the SHA-256 hash of their contents, so uploading the same
+// photo to several galleries only stores it (and its variants) once.
+// RefCount is the number of images that point to the blob; the files are
+// removed when it drops to zero.
+type Blob struct {
+	Hash      string `gorm:"primary_key"`
+	Size      int64  `gorm:"not null"`
+	RefCount  int    `gorm:"not null;default:0"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// DedupReport summarizes how much storage content addressing saves.
+type DedupReport struct {
+	// Images is the number of images backed by a blob.
+	Images int64
+	// Blobs is the number of distinct files stored.
+	Blobs int64
+	// SharedBlobs is the number of blobs used by more than one image.
+	SharedBlobs int64
+	// LogicalBytes is the space the images would take if each one had its own copy.
+	LogicalBytes int64
+	// StoredBytes is the space the blobs actually take.
+	StoredBytes int64
+}
+
+// SavedBytes is the space saved by storing identical files once.
+func (r *DedupReport) SavedBytes() int64 {
+	return r.LogicalBytes - r.StoredBytes
+}
+
+// blobKey is the key the contents of a blob are stored under. name is the
+// hash followed by the extension, and the first two characters of the hash
+// are used as a directory so no directory grows too big.
+func blobKey(name string) string {
+	return fmt.Sprintf("blobs/%s/%s", name[:2], name)
+}
+
+// blobVariantsPrefix is the prefix of the keys the variants of a blob are stored under.
+func blobVariantsPrefix(hash string) string {
+	return fmt.Sprintf("blobs/%s/%s/", hash[:2], hash)
+}
+
+// acquireBlob adds a reference to the blob of image, storing the contents
+// of r if nobody else was using it yet.
+func (is *imageService) acquireBlob(image *Image, r io.ReadSeeker) error {
+	var blob Blob
+	now := time.Now()
+	// Counting the reference first means a concurrent releaseBlob for the
+	// last image using this file either finishes deleting it before we
+	// get here (and we store it again), or never deletes it at all.
+	err := is.db.Raw(`
+		INSERT INTO blobs (hash, size, ref_count, created_at, updated_at)
+		VALUES (?, ?, 1, ?, ?)
+		ON CONFLICT (hash) DO UPDATE SET ref_count = blobs.ref_count + 1, updated_at = EXCLUDED.updated_at
+		RETURNING *`,
+		image.Hash, image.Size, now, now,
+	).Scan(&blob).Error
+	if err != nil {
+		return err
+	}
+	if blob.RefCount > 1 {
+		_, err := is.store.Stat(image.StorageKey())
+		if err == nil {
+			return nil
+		}
+		if err != storage.ErrNotExist {
+			is.releaseBlob(image)
+			return err
+		}
+		// The file went missing (eg: an earlier upload failed half way),
+		// so store it again below.
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		is.releaseBlob(image)
+		return err
+	}
+	if err := is.store.Put(image.StorageKey(), r, image.Size); err != nil {
+		is.releaseBlob(image)
+		return err
+	}
+	return nil
+}
+
+// retainBlob adds a reference to the blob of image, which has to be
+// stored already because another image uses it.
+func (is *imageService) retainBlob(image *Image) error {
+	res := is.db.Exec(`UPDATE blobs SET ref_count = ref_count + 1, updated_at = ? WHERE hash = ?`, time.Now(), image.Hash)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// storeAsBlob makes image a blob with the contents of the file of src, an
+// image uploaded before we started storing blobs.
+func (is *imageService) storeAsBlob(image *Image, src *Image) error {
+	f, err := is.store.Get(src.StorageKey())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tmp, err := ioutil.TempFile("", "lenslocked-copy-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), f)
+	if err != nil {
+		return err
+	}
+	format, err := is.validateUpload(tmp)
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	image.Key = sum + imageExtensions[format]
+	image.Hash = sum
+	image.Size = n
+	return is.acquireBlob(image, tmp)
+}
+
+// releaseBlob removes a reference to the blob of image, deleting the blob
+// and its variants once no image uses it anymore.
+func (is *imageService) releaseBlob(image *Image) error {
+	tx := is.db.Begin()
+	var blob Blob
+	err := tx.Raw(`
+		UPDATE blobs SET ref_count = ref_count - 1, updated_at = ?
+		WHERE hash = ?
+		RETURNING *`,
+		time.Now(), image.Hash,
+	).Scan(&blob).Error
+	if err == gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if blob.RefCount > 0 {
+		return tx.Commit().Error
+	}
+	// The row stays locked until we commit, so an upload of the same file
+	// waits for the files to be gone before deciding whether to store them.
+	if err := is.deleteBlobFiles(image); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(&blob).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// deleteBlobFiles removes the stored file of the blob behind image, along
+// with every variant created from it.
+func (is *imageService) deleteBlobFiles(image *Image) error {
+	variants, err := is.store.List(blobVariantsPrefix(image.Hash))
+	if err != nil {
+		return err
+	}
+	for _, v := range variants {
+		if err := is.store.Delete(v.Key); err != nil {
+			return err
+		}
+	}
+	return is.store.Delete(image.StorageKey())
+}
+
+func (is *imageService) DedupReport() (*DedupReport, error) {
+	var report DedupReport
+	row := is.db.Raw(`
+		SELECT
+			COALESCE(SUM(ref_count), 0),
+			COUNT(*),
+			COUNT(*) FILTER (WHERE ref_count > 1),
+			COALESCE(SUM(size * ref_count), 0),
+			COALESCE(SUM(size), 0)
+		FROM blobs`,
+	).Row()
+	err := row.Scan(&report.Images, &report.Blobs, &report.SharedBlobs, &report.LogicalBytes, &report.StoredBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
@@ -0,0 +1,300 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/rand"
+)
+
+const (
+	// ErrCollectionNotFound is returned when galleries are moved to a collection the user doesn't have.
+	ErrCollectionNotFound modelError = "models: collection not found"
+	// ErrCollectionParentInvalid is returned when a collection is put inside
+	// itself, or inside a collection of another user.
+	ErrCollectionParentInvalid modelError = "models: parent collection is not valid"
+	// ErrCollectionTooDeep is returned when collections would be nested more than one level deep.
+	ErrCollectionTooDeep modelError = "models: collections can only be nested one level deep"
+)
+
+// Collection groups galleries, eg: the ceremony, portraits and reception of
+// a wedding. Collections can hold other collections, but only one level
+// deep.
+type Collection struct {
+	gorm.Model
+	UserID uint `gorm:"not null;index"`
+	// ParentID is the collection this one is in, 0 for top level collections.
+	ParentID    uint       `gorm:"not null;default:0;index"`
+	Title       string     `gorm:"not null"`
+	Description string     `gorm:"type:text;not null;default:''"`
+	Visibility  Visibility `gorm:"not null;default:'public'"`
+	// ShareToken lets anyone with it see the collection and everything in
+	// it, whatever their visibility. It is empty while the collection
+	// isn't shared.
+	ShareToken string       `gorm:"not null;default:''"`
+	Children   []Collection `gorm:"-"`
+	Galleries  []Gallery    `gorm:"-"`
+	// Cover is the cover image of the first gallery in the collection.
+	Cover *Image `gorm:"-"`
+}
+
+// VisibleTo reports whether user can see the collection without its share
+// link. user is nil for visitors who aren't signed in.
+func (c *Collection) VisibleTo(user *User) bool {
+	if user != nil && user.ID == c.UserID {
+		return true
+	}
+	return c.Visibility != VisibilityPrivate
+}
+
+func (c *Collection) Path() string {
+	return fmt.Sprintf("/collections/%d", c.ID)
+}
+
+type CollectionDB interface {
+	ByID(id uint) (*Collection, error)
+	// ByUserID returns every collection of a user, sorted by title.
+	ByUserID(userID uint) ([]Collection, error)
+	ByShareToken(token string) (*Collection, error)
+	// Children returns the collections in a collection, sorted by title.
+	Children(parentID uint) ([]Collection, error)
+	Create(c *Collection) error
+	Update(c *Collection) error
+	// Delete removes a collection. The galleries and collections in it are
+	// kept, and moved up to the top level.
+	Delete(id uint) error
+}
+
+type CollectionService interface {
+	CollectionDB
+	// Share gives a collection a new share token, so links with the old one
+	// stop working.
+	Share(c *Collection) error
+	// Unshare removes the share token of a collection.
+	Unshare(c *Collection) error
+}
+
+type collectionService struct {
+	CollectionDB
+}
+
+type collectionValidator struct {
+	CollectionDB
+}
+
+type collectionGorm struct {
+	db *gorm.DB
+}
+
+type collectionValidatorFunction func(*Collection) error
+
+var _ CollectionDB = &collectionGorm{}
+
+func NewCollectionService(db *gorm.DB) CollectionService {
+	return &collectionService{
+		CollectionDB: &collectionValidator{
+			CollectionDB: &collectionGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+func (cs *collectionService) Share(c *Collection) error {
+	token, err := rand.String(shareTokenBytes)
+	if err != nil {
+		return err
+	}
+	c.ShareToken = token
+	return cs.Update(c)
+}
+
+func (cs *collectionService) Unshare(c *Collection) error {
+	c.ShareToken = ""
+	return cs.Update(c)
+}
+
+func (cg *collectionGorm) ByID(id uint) (*Collection, error) {
+	var collection Collection
+	if err := first(cg.db.Where("id = ?", id), &collection); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+func (cg *collectionGorm) ByUserID(userID uint) ([]Collection, error) {
+	var collections []Collection
+	if err := cg.db.Where("user_id = ?", userID).Order("title, id").Find(&collections).Error; err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+func (cg *collectionGorm) ByShareToken(token string) (*Collection, error) {
+	var collection Collection
+	if err := first(cg.db.Where("share_token = ?", token), &collection); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+func (cg *collectionGorm) Children(parentID uint) ([]Collection, error) {
+	var collections []Collection
+	if err := cg.db.Where("parent_id = ?", parentID).Order("title, id").Find(&collections).Error; err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+func (cg *collectionGorm) Create(c *Collection) error {
+	return cg.db.Create(c).Error
+}
+
+func (cg *collectionGorm) Update(c *Collection) error {
+	return cg.db.Save(c).Error
+}
+
+func (cg *collectionGorm) Delete(id uint) error {
+	tx := cg.db.Begin()
+	// Galleries in the trash are moved too, so they aren't restored into a deleted collection
+	err := tx.Unscoped().Model(&Gallery{}).Where("collection_id = ?", id).UpdateColumn("collection_id", 0).Error
+	if err == nil {
+		err = tx.Model(&Collection{}).Where("parent_id = ?", id).UpdateColumn("parent_id", 0).Error
+	}
+	if err == nil {
+		err = tx.Delete(&Collection{Model: gorm.Model{ID: id}}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func runCollectionValidatorFunctions(c *Collection, validators ...collectionValidatorFunction) error {
+	for _, fn := range validators {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cv *collectionValidator) ByShareToken(token string) (*Collection, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return cv.CollectionDB.ByShareToken(token)
+}
+
+func (cv *collectionValidator) Create(c *Collection) error {
+	err := runCollectionValidatorFunctions(c,
+		cv.userIDRequired,
+		cv.normalizeText,
+		cv.titleRequired,
+		cv.descriptionLength,
+		cv.defaultVisibility,
+		cv.visibilityValid,
+		cv.parentValid)
+	if err != nil {
+		return err
+	}
+	return cv.CollectionDB.Create(c)
+}
+
+func (cv *collectionValidator) Update(c *Collection) error {
+	err := runCollectionValidatorFunctions(c,
+		cv.userIDRequired,
+		cv.normalizeText,
+		cv.titleRequired,
+		cv.descriptionLength,
+		cv.defaultVisibility,
+		cv.visibilityValid,
+		cv.parentValid)
+	if err != nil {
+		return err
+	}
+	return cv.CollectionDB.Update(c)
+}
+
+func (cv *collectionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return cv.CollectionDB.Delete(id)
+}
+
+func (cv *collectionValidator) userIDRequired(c *Collection) error {
+	if c.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (cv *collectionValidator) normalizeText(c *Collection) error {
+	c.Title = strings.TrimSpace(c.Title)
+	c.Description = strings.TrimSpace(c.Description)
+	return nil
+}
+
+func (cv *collectionValidator) titleRequired(c *Collection) error {
+	if c.Title == "" {
+		return ErrTitleRequired
+	}
+	return nil
+}
+
+func (cv *collectionValidator) descriptionLength(c *Collection) error {
+	if utf8.RuneCountInString(c.Description) > maxDescriptionLength {
+		return ErrDescriptionTooLong
+	}
+	return nil
+}
+
+func (cv *collectionValidator) defaultVisibility(c *Collection) error {
+	if c.Visibility == "" {
+		c.Visibility = VisibilityPublic
+	}
+	return nil
+}
+
+func (cv *collectionValidator) visibilityValid(c *Collection) error {
+	if !c.Visibility.Valid() {
+		return ErrVisibilityInvalid
+	}
+	return nil
+}
+
+// parentValid makes sure the parent of a collection is a top level
+// collection of the same user, and that the collection doesn't hold
+// collections itself.
+func (cv *collectionValidator) parentValid(c *Collection) error {
+	if c.ParentID == 0 {
+		return nil
+	}
+	if c.ParentID == c.ID {
+		return ErrCollectionParentInvalid
+	}
+	parent, err := cv.ByID(c.ParentID)
+	if err == ErrNotFound || (err == nil && parent.UserID != c.UserID) {
+		return ErrCollectionParentInvalid
+	}
+	if err != nil {
+		return err
+	}
+	if parent.ParentID != 0 {
+		return ErrCollectionTooDeep
+	}
+	if c.ID != 0 {
+		children, err := cv.Children(c.ID)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return ErrCollectionTooDeep
+		}
+	}
+	return nil
+}
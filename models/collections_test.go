@@ -0,0 +1,85 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// collectionsDB is a CollectionDB holding collections in memory.
+type collectionsDB struct {
+	CollectionDB
+	collections []Collection
+}
+
+func (db *collectionsDB) ByID(id uint) (*Collection, error) {
+	for i := range db.collections {
+		if db.collections[i].ID == id {
+			return &db.collections[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *collectionsDB) Children(parentID uint) ([]Collection, error) {
+	var children []Collection
+	for _, c := range db.collections {
+		if c.ParentID == parentID {
+			children = append(children, c)
+		}
+	}
+	return children, nil
+}
+
+func TestCollectionParentValid(t *testing.T) {
+	collection := func(id, userID, parentID uint) Collection {
+		return Collection{Model: gorm.Model{ID: id}, UserID: userID, ParentID: parentID}
+	}
+	cv := &collectionValidator{CollectionDB: &collectionsDB{collections: []Collection{
+		collection(1, 1, 0),
+		collection(2, 1, 1),
+		collection(3, 2, 0),
+		collection(4, 1, 0),
+	}}}
+
+	tests := []struct {
+		name string
+		c    Collection
+		want error
+	}{
+		{"top level", collection(0, 1, 0), nil},
+		{"new child", collection(0, 1, 1), nil},
+		{"moving a collection without children", collection(4, 1, 1), nil},
+		{"its own parent", collection(4, 1, 4), ErrCollectionParentInvalid},
+		{"missing parent", collection(0, 1, 99), ErrCollectionParentInvalid},
+		{"someone else's parent", collection(0, 1, 3), ErrCollectionParentInvalid},
+		{"child of a child", collection(0, 1, 2), ErrCollectionTooDeep},
+		{"moving a collection with children", collection(1, 1, 4), ErrCollectionTooDeep},
+	}
+	for _, tt := range tests {
+		if err := cv.parentValid(&tt.c); err != tt.want {
+			t.Errorf("%s: parentValid() = %v; want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCollectionVisibleTo(t *testing.T) {
+	owner := &User{Model: gorm.Model{ID: 1}}
+	other := &User{Model: gorm.Model{ID: 2}}
+	tests := []struct {
+		visibility Visibility
+		user       *User
+		want       bool
+	}{
+		{VisibilityPublic, nil, true},
+		{VisibilityPrivate, nil, false},
+		{VisibilityPrivate, other, false},
+		{VisibilityPrivate, owner, true},
+	}
+	for _, tt := range tests {
+		c := Collection{UserID: 1, Visibility: tt.visibility}
+		if got := c.VisibleTo(tt.user); got != tt.want {
+			t.Errorf("%s collection visible to %v = %v; want %v", tt.visibility, tt.user, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrCommentRequired is returned when a comment is posted without a body.
+	ErrCommentRequired modelError = "models: comment can't be empty"
+	// ErrCommentTooLong is returned when a comment is longer than maxCommentLength.
+	ErrCommentTooLong modelError = "models: comment can be at most 2000 characters long"
+	// ErrNameRequired is returned when a visitor comments without saying who they are.
+	ErrNameRequired modelError = "models: name is required"
+	// ErrCommentStatusInvalid is returned when a comment is saved with a status we don't know.
+	ErrCommentStatusInvalid modelError = "models: comment status is not valid"
+
+	maxCommentLength     = 2000
+	maxCommenterLength   = 100
+	maxCommentLinks      = 2
+	maxCommentRepeatRune = 20
+)
+
+// commentLinkPattern finds the links in comments, for the spam heuristic.
+var commentLinkPattern = regexp.MustCompile(`(?i)(https?://|www\.)`)
+
+// commentSpamWords are words legitimate comments on photos hardly ever
+// use, and spam often does.
+var commentSpamWords = []string{"viagra", "cialis", "casino", "porn", "payday loan", "crypto", "bitcoin", "forex", "seo services"}
+
+// CommentStatus is whether a comment is shown on the gallery.
+type CommentStatus string
+
+const (
+	// CommentPending comments wait for the owner of the gallery to approve them.
+	CommentPending CommentStatus = "pending"
+	// CommentApproved comments are shown to everyone who sees the gallery.
+	CommentApproved CommentStatus = "approved"
+	// CommentHidden comments were hidden by the owner of the gallery.
+	CommentHidden CommentStatus = "hidden"
+)
+
+// Comment is a comment on a gallery, or on one of its images. Signed in
+// users comment under their account, and visitors of share links under
+// the name they give.
+type Comment struct {
+	gorm.Model
+	GalleryID uint `gorm:"not null;index"`
+	// ImageID is the image the comment is on, 0 for comments on the gallery itself.
+	ImageID uint `gorm:"not null;default:0;index"`
+	// UserID is who wrote the comment, 0 for visitors of share links.
+	UserID uint          `gorm:"not null;default:0"`
+	Name   string        `gorm:"not null"`
+	Body   string        `gorm:"type:text;not null"`
+	Status CommentStatus `gorm:"not null;default:'pending'"`
+	// Spam is set for comments that look like spam, which are held for
+	// moderation whatever the gallery's settings.
+	Spam bool `gorm:"not null;default:false"`
+	// ImageFilename is the file name of the image the comment is on.
+	ImageFilename string `gorm:"-"`
+}
+
+// Approved reports whether c is shown on the gallery.
+func (c *Comment) Approved() bool {
+	return c.Status == CommentApproved
+}
+
+// Pending reports whether c is waiting for the owner of the gallery to approve it.
+func (c *Comment) Pending() bool {
+	return c.Status == CommentPending
+}
+
+// looksLikeSpam is a basic heuristic for spam: lots of links, words spam
+// uses, or the same character over and over.
+func (c *Comment) looksLikeSpam() bool {
+	if len(commentLinkPattern.FindAllString(c.Body, -1)) > maxCommentLinks {
+		return true
+	}
+	body := strings.ToLower(c.Body)
+	for _, word := range commentSpamWords {
+		if strings.Contains(body, word) {
+			return true
+		}
+	}
+	var last rune
+	repeats := 0
+	for _, r := range body {
+		if r == last && r != ' ' {
+			repeats++
+			if repeats >= maxCommentRepeatRune {
+				return true
+			}
+		} else {
+			last, repeats = r, 1
+		}
+	}
+	return false
+}
+
+type CommentDB interface {
+	ByID(id uint) (*Comment, error)
+	// ByGalleryID returns every comment on a gallery and its images,
+	// newest first, for its owner to moderate.
+	ByGalleryID(galleryID uint) ([]Comment, error)
+	// Approved returns the comments shown on a gallery and its images, oldest first.
+	Approved(galleryID uint) ([]Comment, error)
+	Create(c *Comment) error
+	Update(c *Comment) error
+	Delete(id uint) error
+}
+
+type CommentService interface {
+	CommentDB
+	// Post adds a comment to gallery. It is approved right away unless
+	// the gallery moderates comments, or the comment looks like spam.
+	Post(gallery *Gallery, c *Comment) error
+	// Approve shows a comment on its gallery.
+	Approve(c *Comment) error
+	// Hide takes a comment off its gallery, without deleting it.
+	Hide(c *Comment) error
+}
+
+type commentService struct {
+	CommentDB
+	images ImageService
+}
+
+type commentValidator struct {
+	CommentDB
+}
+
+type commentGorm struct {
+	db *gorm.DB
+}
+
+type commentValidatorFunction func(*Comment) error
+
+var _ CommentDB = &commentGorm{}
+
+func NewCommentService(db *gorm.DB, images ImageService) CommentService {
+	return &commentService{
+		CommentDB: &commentValidator{
+			CommentDB: &commentGorm{
+				db: db,
+			},
+		},
+		images: images,
+	}
+}
+
+func (cs *commentService) Post(gallery *Gallery, c *Comment) error {
+	c.GalleryID = gallery.ID
+	if c.ImageID != 0 {
+		image, err := cs.images.ByID(c.ImageID)
+		if err != nil {
+			return err
+		}
+		if image.GalleryID != gallery.ID {
+			return ErrNotFound
+		}
+	}
+	if c.looksLikeSpam() {
+		c.Spam = true
+	}
+	c.Status = CommentApproved
+	if gallery.ModerateComments || c.Spam {
+		c.Status = CommentPending
+	}
+	return cs.Create(c)
+}
+
+func (cs *commentService) Approve(c *Comment) error {
+	c.Status = CommentApproved
+	return cs.Update(c)
+}
+
+func (cs *commentService) Hide(c *Comment) error {
+	c.Status = CommentHidden
+	return cs.Update(c)
+}
+
+// selectComments loads comments along with the file name of the image
+// they are on, into Comment.ImageFilename.
+func (cg *commentGorm) selectComments() *gorm.DB {
+	return cg.db.Select("comments.*, (SELECT filename FROM images WHERE images.id = comments.image_id) AS image_filename")
+}
+
+func (cg *commentGorm) ByID(id uint) (*Comment, error) {
+	var comment Comment
+	if err := first(cg.selectComments().Where("id = ?", id), &comment); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+func (cg *commentGorm) ByGalleryID(galleryID uint) ([]Comment, error) {
+	var comments []Comment
+	if err := cg.selectComments().Where("gallery_id = ?", galleryID).Order("created_at DESC, id DESC").Find(&comments).Error; err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (cg *commentGorm) Approved(galleryID uint) ([]Comment, error) {
+	var comments []Comment
+	db := cg.selectComments().Where("gallery_id = ? AND status = ?", galleryID, CommentApproved).Order("created_at, id")
+	if err := db.Find(&comments).Error; err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (cg *commentGorm) Create(c *Comment) error {
+	return cg.db.Create(c).Error
+}
+
+func (cg *commentGorm) Update(c *Comment) error {
+	return cg.db.Save(c).Error
+}
+
+func (cg *commentGorm) Delete(id uint) error {
+	comment := Comment{Model: gorm.Model{ID: id}}
+	return cg.db.Delete(&comment).Error
+}
+
+func runCommentValidatorFunctions(c *Comment, validators ...commentValidatorFunction) error {
+	for _, fn := range validators {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cv *commentValidator) Create(c *Comment) error {
+	err := runCommentValidatorFunctions(c,
+		cv.galleryIDRequired,
+		cv.normalizeText,
+		cv.bodyRequired,
+		cv.bodyLength,
+		cv.nameRequired,
+		cv.nameLength,
+		cv.statusValid)
+	if err != nil {
+		return err
+	}
+	return cv.CommentDB.Create(c)
+}
+
+func (cv *commentValidator) Update(c *Comment) error {
+	err := runCommentValidatorFunctions(c,
+		cv.galleryIDRequired,
+		cv.statusValid)
+	if err != nil {
+		return err
+	}
+	return cv.CommentDB.Update(c)
+}
+
+func (cv *commentValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return cv.CommentDB.Delete(id)
+}
+
+func (cv *commentValidator) galleryIDRequired(c *Comment) error {
+	if c.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (cv *commentValidator) normalizeText(c *Comment) error {
+	c.Name = strings.TrimSpace(c.Name)
+	c.Body = strings.TrimSpace(c.Body)
+	return nil
+}
+
+func (cv *commentValidator) bodyRequired(c *Comment) error {
+	if c.Body == "" {
+		return ErrCommentRequired
+	}
+	return nil
+}
+
+func (cv *commentValidator) bodyLength(c *Comment) error {
+	if utf8.RuneCountInString(c.Body) > maxCommentLength {
+		return ErrCommentTooLong
+	}
+	return nil
+}
+
+func (cv *commentValidator) nameRequired(c *Comment) error {
+	if c.Name == "" {
+		return ErrNameRequired
+	}
+	return nil
+}
+
+func (cv *commentValidator) nameLength(c *Comment) error {
+	if utf8.RuneCountInString(c.Name) > maxCommenterLength {
+		return ErrClientNameTooLong
+	}
+	return nil
+}
+
+func (cv *commentValidator) statusValid(c *Comment) error {
+	switch c.Status {
+	case CommentPending, CommentApproved, CommentHidden:
+		return nil
+	}
+	return ErrCommentStatusInvalid
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestCommentLooksLikeSpam(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{"Lovely light in the third one!", false},
+		{"More at https://example.com and www.example.org", false},
+		{"http://a.example http://b.example https://c.example", true},
+		{"Cheap VIAGRA here", true},
+		{"Noooooooooooooooo way", false},
+		{"Wow" + strings.Repeat("!", maxCommentRepeatRune), true},
+		// Runs of spaces aren't suspicious
+		{"Nice" + strings.Repeat(" ", 40) + "shot", false},
+	}
+	for _, tt := range tests {
+		c := &Comment{Body: tt.body}
+		if got := c.looksLikeSpam(); got != tt.want {
+			t.Errorf("looksLikeSpam() of %q = %t; want %t", tt.body, got, tt.want)
+		}
+	}
+}
+
+type commentsDB struct {
+	CommentDB
+	created []Comment
+}
+
+func (cd *commentsDB) Create(c *Comment) error {
+	cd.created = append(cd.created, *c)
+	return nil
+}
+
+type commentImages struct {
+	ImageService
+}
+
+func (commentImages) ByID(id uint) (*Image, error) {
+	// Image 1 is in gallery 1, image 2 in gallery 2
+	return &Image{Model: gorm.Model{ID: id}, GalleryID: id}, nil
+}
+
+func TestCommentPost(t *testing.T) {
+	tests := []struct {
+		name       string
+		moderate   bool
+		imageID    uint
+		author     string
+		body       string
+		wantErr    error
+		wantStatus CommentStatus
+		wantSpam   bool
+	}{
+		{"approved", false, 0, "Ana", " Great set ", nil, CommentApproved, false},
+		{"on an image", false, 1, "Ana", "Great shot", nil, CommentApproved, false},
+		{"moderated", true, 0, "Ana", "Great set", nil, CommentPending, false},
+		{"spam", false, 0, "Ana", "best casino bonus", nil, CommentPending, true},
+		{"image of another gallery", false, 2, "Ana", "Great shot", ErrNotFound, "", false},
+		{"empty", false, 0, "Ana", "  ", ErrCommentRequired, "", false},
+		{"too long", false, 0, "Ana", strings.Repeat("a ", maxCommentLength), ErrCommentTooLong, "", false},
+		{"anonymous", false, 0, " ", "Great set", ErrNameRequired, "", false},
+	}
+	for _, tt := range tests {
+		db := &commentsDB{}
+		cs := &commentService{CommentDB: &commentValidator{CommentDB: db}, images: commentImages{}}
+		gallery := &Gallery{Model: gorm.Model{ID: 1}, ModerateComments: tt.moderate}
+		err := cs.Post(gallery, &Comment{ImageID: tt.imageID, Name: tt.author, Body: tt.body})
+		if err != tt.wantErr {
+			t.Errorf("%s: Post() = %v; want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			if len(db.created) != 0 {
+				t.Errorf("%s: comment was saved", tt.name)
+			}
+			continue
+		}
+		c := db.created[0]
+		if c.GalleryID != 1 || c.Status != tt.wantStatus || c.Spam != tt.wantSpam {
+			t.Errorf("%s: saved gallery %d, status %q, spam %t; want 1, %q, %t",
+				tt.name, c.GalleryID, c.Status, c.Spam, tt.wantStatus, tt.wantSpam)
+		}
+		if c.Body != strings.TrimSpace(tt.body) {
+			t.Errorf("%s: saved body %q; want it trimmed", tt.name, c.Body)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// storedFile is what the key of a file stored for an image says about it.
+type storedFile struct {
+	// Hash is the hash of the blob the file is of. Images from before
+	// blobs don't have one, and are found by GalleryID and Name instead.
+	Hash      string
+	GalleryID uint
+	// Name is the storage name of the image from before blobs the file is of.
+	Name string
+	// Original is whether the file is the image as it was uploaded, rather
+	// than a variant or a copy stripped of its metadata.
+	Original bool
+}
+
+// parseStoredFile parses the key of a file stored for an image. ok is false
+// for keys outside of the directories images are stored in, like those of
+// watermarks. file is nil for keys inside them that can't be of any image.
+func parseStoredFile(key string) (file *storedFile, ok bool) {
+	parts := strings.Split(key, "/")
+	switch parts[0] {
+	case "blobs":
+		// The original is named after the hash, and its variants and
+		// stripped copies are in a directory named after it.
+		if len(parts) != 3 && len(parts) != 4 {
+			return nil, true
+		}
+		hash := strings.SplitN(parts[2], ".", 2)[0]
+		if hash == "" {
+			return nil, true
+		}
+		return &storedFile{Hash: hash, Original: len(parts) == 3}, true
+	case "galleries":
+		if len(parts) < 3 {
+			return nil, true
+		}
+		galleryID, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, true
+		}
+		file := &storedFile{GalleryID: uint(galleryID), Name: parts[len(parts)-1]}
+		switch {
+		case len(parts) == 3:
+			file.Original = true
+		case len(parts) == 5 && parts[2] == "stripped":
+		case len(parts) == 5 && parts[2] == "variants":
+			// Variants have the extension of their format appended
+			file.Name = strings.TrimSuffix(file.Name, path.Ext(file.Name))
+		default:
+			return nil, true
+		}
+		if file.Name == "" {
+			return nil, true
+		}
+		return file, true
+	default:
+		return nil, false
+	}
+}
+
+// fileImage is an image a stored file is of, with what decides who its
+// files can be served to.
+type fileImage struct {
+	// Trashed is whether the image, or its gallery, is in the trash.
+	Trashed     bool
+	Metadata    MetadataPolicy
+	Watermarked bool
+	// Collaborator is whether the user asking for the file is the owner
+	// of the gallery, or collaborates on it.
+	Collaborator bool
+}
+
+// hiddenFrom reports whether file mustn't be served to a user, given the
+// images it is of. The same blob can be in several galleries, and it only
+// takes one image to serve it: one that isn't in the trash, that is in a
+// gallery keeping metadata if file is an original, and that the user isn't
+// only meant to see watermarked copies of.
+func (file *storedFile) hiddenFrom(images []fileImage) bool {
+	for _, image := range images {
+		if image.Trashed {
+			continue
+		}
+		if file.Original && image.Metadata != MetadataKeep {
+			continue
+		}
+		if image.Watermarked && !image.Collaborator {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func (is *imageService) FileHidden(key string, userID uint) (bool, error) {
+	file, ok := parseStoredFile(key)
+	if !ok {
+		return false, nil
+	}
+	if file == nil {
+		return true, nil
+	}
+	db := is.db.Unscoped().Table("images").
+		Joins("JOIN galleries ON galleries.id = images.gallery_id").
+		Select(`images.deleted_at IS NOT NULL OR galleries.deleted_at IS NOT NULL AS trashed,
+			galleries.metadata,
+			galleries.watermark_key <> '' AS watermarked,
+			galleries.user_id = ? OR galleries.id IN (SELECT gallery_id FROM gallery_members WHERE user_id = ? AND user_id <> 0 AND deleted_at IS NULL) AS collaborator`,
+			userID, userID)
+	if file.Hash != "" {
+		db = db.Where("images.hash = ?", file.Hash)
+	} else {
+		db = db.Where("images.hash = '' AND images.gallery_id = ? AND (CASE WHEN images.key = '' THEN images.filename ELSE images.key END) = ?",
+			file.GalleryID, file.Name)
+	}
+	var images []fileImage
+	if err := db.Scan(&images).Error; err != nil {
+		return false, err
+	}
+	return file.hiddenFrom(images), nil
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/imaging"
+)
+
+func TestParseStoredFile(t *testing.T) {
+	const hash = "ab12cd34"
+	blob := &Image{Model: gorm.Model{ID: 1}, GalleryID: 7, Hash: hash, Key: hash + ".png", GalleryMetadata: MetadataStripAll}
+	legacy := &Image{Model: gorm.Model{ID: 2}, GalleryID: 7, Key: "photo.jpg", GalleryMetadata: MetadataStripGPS}
+	oldest := &Image{Model: gorm.Model{ID: 3}, GalleryID: 7, Filename: "IMG 1.jpg"}
+	variant := &ImageVariant{Width: 800, Format: imaging.WebP}
+
+	tests := []struct {
+		key  string
+		file *storedFile
+		ok   bool
+	}{
+		{blob.StorageKey(), &storedFile{Hash: hash, Original: true}, true},
+		{blob.VariantStorageKey(variant), &storedFile{Hash: hash}, true},
+		{blob.ServedKey(), &storedFile{Hash: hash}, true},
+		{legacy.StorageKey(), &storedFile{GalleryID: 7, Name: "photo.jpg", Original: true}, true},
+		{legacy.VariantStorageKey(variant), &storedFile{GalleryID: 7, Name: "photo.jpg"}, true},
+		{legacy.ServedKey(), &storedFile{GalleryID: 7, Name: "photo.jpg"}, true},
+		{oldest.StorageKey(), &storedFile{GalleryID: 7, Name: "IMG 1.jpg", Original: true}, true},
+		// Not files of images
+		{"watermarks/7/abc.png", nil, false},
+		{"uploads/abc", nil, false},
+		// In the directories of images, but not of any image
+		{"blobs/ab", nil, true},
+		{"blobs/ab/.png", nil, true},
+		{"blobs/ab/" + hash + "/x/800.jpg", nil, true},
+		{"galleries/7", nil, true},
+		{"galleries/x/photo.jpg", nil, true},
+		{"galleries/7/", nil, true},
+		{"galleries/7/variants/photo.jpg", nil, true},
+		{"galleries/7/other/800/photo.jpg", nil, true},
+	}
+	for _, tt := range tests {
+		file, ok := parseStoredFile(tt.key)
+		if ok != tt.ok || !reflect.DeepEqual(file, tt.file) {
+			t.Errorf("parseStoredFile(%q) = %+v, %v; want %+v, %v", tt.key, file, ok, tt.file, tt.ok)
+		}
+	}
+}
+
+func TestStoredFileHiddenFrom(t *testing.T) {
+	original := &storedFile{Hash: "ab12", Original: true}
+	variant := &storedFile{Hash: "ab12"}
+	public := fileImage{Metadata: MetadataStripGPS}
+	keep := fileImage{Metadata: MetadataKeep}
+
+	tests := []struct {
+		name   string
+		file   *storedFile
+		images []fileImage
+		hidden bool
+	}{
+		{"no images", variant, nil, true},
+		{"variant", variant, []fileImage{public}, false},
+		{"trashed", variant, []fileImage{{Trashed: true}}, true},
+		{"trashed in one gallery only", variant, []fileImage{{Trashed: true}, public}, false},
+		{"original of a gallery stripping metadata", original, []fileImage{public}, true},
+		{"original of a gallery keeping metadata", original, []fileImage{keep}, false},
+		{"original kept in one gallery only", original, []fileImage{public, keep}, false},
+		{"trashed original kept", original, []fileImage{{Trashed: true, Metadata: MetadataKeep}}, true},
+		{"watermarked", variant, []fileImage{{Watermarked: true}}, true},
+		{"watermarked, to a collaborator", variant, []fileImage{{Watermarked: true, Collaborator: true}}, false},
+		{"watermarked in one gallery only", variant, []fileImage{{Watermarked: true}, public}, false},
+		// Each gallery has to allow serving the file on its own
+		{"kept original of a watermarked gallery", original, []fileImage{{Metadata: MetadataKeep, Watermarked: true}, public}, true},
+	}
+	for _, tt := range tests {
+		if hidden := tt.file.hiddenFrom(tt.images); hidden != tt.hidden {
+			t.Errorf("%s: hiddenFrom = %v; want %v", tt.name, hidden, tt.hidden)
+		}
+	}
+}
@@ -1,25 +1,242 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/torresjeff/gallery/imaging"
+)
 
 const (
 	ErrUserIDRequired modelError = "models: user ID is required"
 	ErrTitleRequired  modelError = "models: title is required"
+	// ErrMetadataPolicyInvalid is returned when a gallery is saved with a metadata policy we don't know.
+	ErrMetadataPolicyInvalid modelError = "models: metadata policy is not valid"
+	// ErrDescriptionTooLong is returned when a gallery description is longer than maxDescriptionLength.
+	ErrDescriptionTooLong modelError = "models: description is too long"
+	// ErrLocationTooLong is returned when a gallery location is longer than maxLocationLength.
+	ErrLocationTooLong modelError = "models: location is too long"
+	// ErrSlugInvalid is returned when a slug isn't made of lowercase letters, numbers and dashes.
+	ErrSlugInvalid modelError = "models: URL name can only have lowercase letters, numbers and dashes, and can't be only numbers"
+	// ErrVisibilityInvalid is returned when a gallery is saved with a visibility we don't know.
+	ErrVisibilityInvalid modelError = "models: visibility is not valid"
+	// ErrSlugTaken is returned when a user already has another gallery with the same slug.
+	ErrSlugTaken modelError = "models: URL name is already used by another one of your galleries"
+	// ErrGallerySortInvalid is returned when galleries are listed in an order we don't know.
+	ErrGallerySortInvalid modelError = "models: gallery sort is not valid"
+
+	maxDescriptionLength = 5000
+	maxLocationLength    = 200
+	maxSlugLength        = 100
+	// slugIndex is the unique index on the slugs of each user's galleries.
+	slugIndex = "idx_galleries_user_id_slug"
+	// slugRetries is how many times a new slug is generated for a gallery
+	// whose slug was taken by another one while it was being saved.
+	slugRetries = 3
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// reservedSlugs can't be used as slugs, because they are already taken by
+// other routes under /galleries.
+var reservedSlugs = map[string]bool{
+	"new": true,
+}
+
+// MetadataPolicy is how much of the metadata (EXIF) of a gallery's images
+// is left in the files we serve. The metadata is always read on upload and
+// kept in the database either way.
+type MetadataPolicy string
+
+const (
+	// MetadataKeep serves the files exactly as they were uploaded.
+	MetadataKeep MetadataPolicy = "keep"
+	// MetadataStripGPS removes the location photos were taken at.
+	MetadataStripGPS MetadataPolicy = "strip_gps"
+	// MetadataStripAll removes every piece of metadata.
+	MetadataStripAll MetadataPolicy = "strip_all"
+)
+
+// MetadataPolicies lists every metadata policy, in the order they should be offered to users.
+var MetadataPolicies = []MetadataPolicy{MetadataStripGPS, MetadataStripAll, MetadataKeep}
+
+// Valid reports whether p is one of the supported metadata policies.
+func (p MetadataPolicy) Valid() bool {
+	for _, policy := range MetadataPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Visibility is who can see a gallery.
+type Visibility string
+
+const (
+	// VisibilityPublic galleries can be seen by anyone who knows their URL.
+	VisibilityPublic Visibility = "public"
+	// VisibilityPrivate galleries can only be seen by their owner, and by
+	// people they sent a share link to.
+	VisibilityPrivate Visibility = "private"
+)
+
+// Valid reports whether v is one of the supported visibilities.
+func (v Visibility) Valid() bool {
+	return v == VisibilityPublic || v == VisibilityPrivate
+}
+
+// GallerySort is the order galleries are listed in.
+type GallerySort string
+
+const (
+	// GallerySortNewest lists the most recently created galleries first.
+	GallerySortNewest GallerySort = "newest"
+	// GallerySortOldest lists the galleries created first first.
+	GallerySortOldest GallerySort = "oldest"
+	// GallerySortTitle lists galleries alphabetically by title.
+	GallerySortTitle GallerySort = "title"
+	// GallerySortDate lists the galleries of the most recent events first,
+	// using the day galleries without an event date were created on.
+	GallerySortDate GallerySort = "date"
 )
 
+// GallerySorts lists every gallery sort, in the order they should be offered to users.
+var GallerySorts = []GallerySort{GallerySortNewest, GallerySortOldest, GallerySortTitle, GallerySortDate}
+
+// Valid reports whether s is one of the supported gallery sorts.
+func (s GallerySort) Valid() bool {
+	for _, sort := range GallerySorts {
+		if s == sort {
+			return true
+		}
+	}
+	return false
+}
+
+func (s GallerySort) keyset() keyset {
+	switch s {
+	case GallerySortOldest:
+		return keyset{expr: "created_at"}
+	case GallerySortTitle:
+		return keyset{expr: "title"}
+	case GallerySortDate:
+		return keyset{expr: "COALESCE(event_date, created_at::date)", desc: true}
+	default:
+		return keyset{expr: "created_at", desc: true}
+	}
+}
+
+// cursorValue is the value of the keyset expression for gallery.
+func (s GallerySort) cursorValue(gallery *Gallery) string {
+	switch s {
+	case GallerySortTitle:
+		return gallery.Title
+	case GallerySortDate:
+		if gallery.EventDate != nil {
+			return gallery.EventDate.Format(dateLayout)
+		}
+		return gallery.CreatedAt.Format(dateLayout)
+	default:
+		return gallery.CreatedAt.Format(time.RFC3339Nano)
+	}
+}
+
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not null;index"`
-	Title  string  `gorm:"not null"`
-	Images []Image `gorm:"-"`
+	UserID uint   `gorm:"not null;index"`
+	Title  string `gorm:"not null"`
+	// Slug names the gallery in URLs instead of its ID. It is unique among
+	// the galleries of each user.
+	Slug string `gorm:"not null;default:''"`
+	// Description is written in the limited Markdown supported by the markdown package.
+	Description string `gorm:"type:text;not null;default:''"`
+	// EventDate is the day the photos were taken, eg: the day of a wedding.
+	EventDate *time.Time `gorm:"type:date"`
+	// Location is where the photos were taken, in the owner's own words.
+	Location   string     `gorm:"not null;default:''"`
+	Tags       Tags       `gorm:"type:text[];not null;default:'{}'"`
+	Visibility Visibility `gorm:"not null;default:'public'"`
+	// CollectionID is the collection the gallery is in, 0 if it isn't in one.
+	CollectionID uint       `gorm:"not null;default:0;index"`
+	CoverImageID uint       `gorm:"not null;default:0"`
+	ImageOrder   ImageOrder `gorm:"not null;default:'manual'"`
+	// Metadata defaults to stripping GPS, so nobody publishes where their
+	// photos were taken without choosing to.
+	Metadata MetadataPolicy `gorm:"not null;default:'strip_gps'"`
+	// ModerateComments holds new comments until the owner approves them.
+	ModerateComments bool `gorm:"not null;default:false"`
+	// Proofing lets visitors pick images and submit their selection, and
+	// MaxPicks is how many they can pick, 0 meaning there's no limit.
+	Proofing bool          `gorm:"not null;default:false"`
+	MaxPicks int           `gorm:"not null;default:0"`
+	Images   []Image       `gorm:"-"`
+	Cover    *Image        `gorm:"-"`
+	Usage    *GalleryUsage `gorm:"-"`
+	// WatermarkKey is the storage key of the PNG drawn over the images
+	// served to visitors, empty if there isn't one. It is drawn at
+	// WatermarkPosition, WatermarkOpacity percent opaque and
+	// WatermarkScale percent of the width of each image.
+	WatermarkKey      string           `gorm:"not null;default:''"`
+	WatermarkPosition imaging.Position `gorm:"not null;default:'bottom_right'"`
+	WatermarkOpacity  int              `gorm:"not null;default:50"`
+	WatermarkScale    int              `gorm:"not null;default:25"`
+	// ShareLinks and Members are only loaded for the owner of the gallery.
+	ShareLinks []ShareLink     `gorm:"-"`
+	Members    []GalleryMember `gorm:"-"`
+	// Selections are only loaded for users who can edit the gallery.
+	Selections []Selection `gorm:"-"`
+	// Comments are every comment on the gallery, whatever their status,
+	// and only loaded for the owner of the gallery to moderate.
+	Comments []Comment `gorm:"-"`
+	// Role is what the user viewing the gallery can do in it, and ViewerID
+	// who they are. Both are empty for visitors who aren't signed in.
+	Role     Role `gorm:"-"`
+	ViewerID uint `gorm:"-"`
+	// Share is the link the gallery is being viewed through, if any.
+	Share *ShareLink `gorm:"-"`
+	// Downloadable is whether whoever is viewing the gallery can download it.
+	Downloadable bool `gorm:"-"`
 }
 
 type GalleryDB interface {
 	Create(*Gallery) error
 	ById(uint) (*Gallery, error)
 	ByUserId(uint) ([]Gallery, error)
+	// ByUserIDPage returns a page of a user's galleries, sorted by sort.
+	ByUserIDPage(userID uint, sort GallerySort, page Page) ([]Gallery, *Pagination, error)
+	// BySlug looks up one of a user's galleries by its slug.
+	BySlug(userID uint, slug string) (*Gallery, error)
+	// SharedWith returns the galleries a user collaborates on, sorted by
+	// title, with their Role set to the user's role in each.
+	SharedWith(userID uint) ([]Gallery, error)
+	// ByCollectionID returns the galleries in a collection, newest first.
+	ByCollectionID(collectionID uint) ([]Gallery, error)
+	// MoveToCollection moves galleries of a user into one of their
+	// collections, or out of any collection when collectionID is 0. Either
+	// every gallery is moved, or none are.
+	MoveToCollection(userID, collectionID uint, galleryIDs []uint) error
 	Update(*Gallery) error
+	// Delete moves a gallery to the trash, where it can be restored from.
 	Delete(uint) error
+	// Trashed returns the galleries of a user in the trash, most recently deleted first.
+	Trashed(userID uint) ([]Gallery, error)
+	// TrashedByID looks up a gallery in the trash.
+	TrashedByID(id uint) (*Gallery, error)
+	// DeletedBefore returns the galleries of every user moved to the trash before t.
+	DeletedBefore(t time.Time) ([]Gallery, error)
+	// Restore takes a gallery out of the trash. If another gallery took its
+	// slug in the meantime, it gets a new one.
+	Restore(*Gallery) error
+	// Purge deletes a gallery in the trash for good, along with its share
+	// links, members and selections. Its images have to be purged first.
+	Purge(id uint) error
 }
 
 type GalleryService interface {
@@ -52,6 +269,57 @@ func NewGalleryService(db *gorm.DB) GalleryService {
 	}
 }
 
+// VisibleTo reports whether user can see the gallery without a share link.
+// user is nil for visitors who aren't signed in.
+func (g *Gallery) VisibleTo(user *User) bool {
+	if user != nil && user.ID == g.UserID {
+		return true
+	}
+	return g.Visibility != VisibilityPrivate
+}
+
+// Path is the public URL of the gallery, using its slug when it has one.
+func (g *Gallery) Path() string {
+	if g.Slug == "" {
+		return fmt.Sprintf("/galleries/%d", g.ID)
+	}
+	return fmt.Sprintf("/users/%d/galleries/%s", g.UserID, g.Slug)
+}
+
+// CanEditImage reports whether the user viewing the gallery can edit or
+// delete image. Contributors can only change the images they uploaded.
+func (g *Gallery) CanEditImage(image Image) bool {
+	if g.Role.CanEdit() {
+		return true
+	}
+	return g.Role.CanUpload() && g.ViewerID != 0 && image.UploadedByID == g.ViewerID
+}
+
+// Duplicate returns a new gallery with the same description, settings and
+// tags as g, for recurring events. The event date is left for the new event,
+// and the slug is picked when the duplicate is created.
+func (g *Gallery) Duplicate() Gallery {
+	return Gallery{
+		UserID:           g.UserID,
+		Title:            g.Title + " (copy)",
+		Description:      g.Description,
+		Location:         g.Location,
+		Tags:             append(Tags(nil), g.Tags...),
+		Visibility:       g.Visibility,
+		CollectionID:     g.CollectionID,
+		ImageOrder:       g.ImageOrder,
+		Metadata:         g.Metadata,
+		Proofing:         g.Proofing,
+		MaxPicks:         g.MaxPicks,
+		ModerateComments: g.ModerateComments,
+		// The watermark itself belongs to this gallery's storage, so only
+		// its settings are copied
+		WatermarkPosition: g.WatermarkPosition,
+		WatermarkOpacity:  g.WatermarkOpacity,
+		WatermarkScale:    g.WatermarkScale,
+	}
+}
+
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
 	// Create our 2D slice
 	ret := make([][]Image, n)
@@ -66,8 +334,17 @@ func (g *Gallery) ImagesSplitN(n int) [][]Image {
 	return ret
 }
 
+// IsCover reports whether image is the cover of the gallery. Galleries
+// without a cover image set use their first image instead.
+func (g *Gallery) IsCover(image Image) bool {
+	if g.CoverImageID != 0 {
+		return image.ID == g.CoverImageID
+	}
+	return len(g.Images) > 0 && g.Images[0].ID == image.ID
+}
+
 func (gg *galleryGorm) Create(gallery *Gallery) error {
-	return gg.db.Create(gallery).Error
+	return slugConflict(gg.db.Create(gallery).Error)
 }
 
 func (gg *galleryGorm) ById(id uint) (*Gallery, error) {
@@ -80,6 +357,15 @@ func (gg *galleryGorm) ById(id uint) (*Gallery, error) {
 	return &gallery, nil
 }
 
+func (gg *galleryGorm) BySlug(userID uint, slug string) (*Gallery, error) {
+	var gallery Gallery
+	err := first(gg.db.Where("user_id = ? AND slug = ?", userID, slug), &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
 func (gg *galleryGorm) ByUserId(userId uint) ([]Gallery, error) {
 	var galleries []Gallery
 	db := gg.db.Where("user_id = ?", userId)
@@ -90,8 +376,82 @@ func (gg *galleryGorm) ByUserId(userId uint) ([]Gallery, error) {
 	return galleries, nil
 }
 
+func (gg *galleryGorm) ByUserIDPage(userID uint, sort GallerySort, page Page) ([]Gallery, *Pagination, error) {
+	var total int
+	db := gg.db.Model(&Gallery{}).Where("user_id = ?", userID)
+	if err := db.Count(&total).Error; err != nil {
+		return nil, nil, err
+	}
+	db, err := sort.keyset().apply(db, page)
+	if err != nil {
+		return nil, nil, err
+	}
+	var galleries []Gallery
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, nil, err
+	}
+
+	pagination := &Pagination{Page: page, Total: total}
+	if len(galleries) > page.Size {
+		galleries = galleries[:page.Size]
+		last := &galleries[len(galleries)-1]
+		pagination.Next = encodeCursor(sort.cursorValue(last), last.ID)
+	}
+	return galleries, pagination, nil
+}
+
+func (gg *galleryGorm) SharedWith(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Select("galleries.*, gallery_members.role AS role").
+		Joins("JOIN gallery_members ON gallery_members.gallery_id = galleries.id AND gallery_members.deleted_at IS NULL").
+		Where("gallery_members.user_id = ?", userID).
+		Order("galleries.title, galleries.id")
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) ByCollectionID(collectionID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Where("collection_id = ?", collectionID).Order("created_at DESC, id DESC")
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) MoveToCollection(userID, collectionID uint, galleryIDs []uint) error {
+	if len(galleryIDs) == 0 {
+		return nil
+	}
+	tx := gg.db.Begin()
+	if collectionID != 0 {
+		var collection Collection
+		err := first(tx.Where("id = ? AND user_id = ?", collectionID, userID), &collection)
+		if err != nil {
+			tx.Rollback()
+			if err == ErrNotFound {
+				return ErrCollectionNotFound
+			}
+			return err
+		}
+	}
+	res := tx.Model(&Gallery{}).Where("id IN (?) AND user_id = ?", galleryIDs, userID).UpdateColumn("collection_id", collectionID)
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected != int64(len(galleryIDs)) {
+		// Some of the galleries don't exist, or aren't the user's
+		tx.Rollback()
+		return ErrNotFound
+	}
+	return tx.Commit().Error
+}
+
 func (gg *galleryGorm) Update(gallery *Gallery) error {
-	return gg.db.Save(gallery).Error
+	return slugConflict(gg.db.Save(gallery).Error)
 }
 
 func (gg *galleryGorm) Delete(id uint) error {
@@ -99,6 +459,80 @@ func (gg *galleryGorm) Delete(id uint) error {
 	return gg.db.Delete(&gallery).Error
 }
 
+func (gg *galleryGorm) Trashed(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL", userID).Order("deleted_at desc, id")
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) TrashedByID(id uint) (*Gallery, error) {
+	var gallery Gallery
+	if err := first(gg.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id), &gallery); err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+func (gg *galleryGorm) DeletedBefore(t time.Time) ([]Gallery, error) {
+	var galleries []Gallery
+	if err := gg.db.Unscoped().Where("deleted_at < ?", t).Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) Restore(gallery *Gallery) error {
+	err := gg.db.Unscoped().Model(gallery).Updates(map[string]interface{}{
+		"deleted_at": nil,
+		"slug":       gallery.Slug,
+	}).Error
+	if err != nil {
+		return slugConflict(err)
+	}
+	gallery.DeletedAt = nil
+	return nil
+}
+
+func (gg *galleryGorm) Purge(id uint) error {
+	tx := gg.db.Begin()
+	err := tx.Unscoped().Where("gallery_id = ?", id).Delete(&ShareLink{}).Error
+	if err == nil {
+		err = tx.Unscoped().Where("gallery_id = ?", id).Delete(&GalleryMember{}).Error
+	}
+	if err == nil {
+		err = tx.Where("selection_id IN (SELECT id FROM selections WHERE gallery_id = ?)", id).Delete(&SelectionPick{}).Error
+	}
+	if err == nil {
+		err = tx.Unscoped().Where("gallery_id = ?", id).Delete(&Selection{}).Error
+	}
+	if err == nil {
+		err = tx.Unscoped().Where("gallery_id = ?", id).Delete(&Comment{}).Error
+	}
+	if err == nil {
+		err = tx.Where("gallery_id = ?", id).Delete(&StatEvent{}).Error
+	}
+	if err == nil {
+		err = tx.Where("gallery_id = ?", id).Delete(&GalleryStat{}).Error
+	}
+	if err == nil {
+		err = tx.Where("gallery_id = ?", id).Delete(&ImageStat{}).Error
+	}
+	if err == nil {
+		err = tx.Where("gallery_id = ?", id).Delete(&GalleryUsage{}).Error
+	}
+	if err == nil {
+		err = tx.Unscoped().Delete(&Gallery{Model: gorm.Model{ID: id}}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
 func runGalleryValidatorFunctions(gallery *Gallery, validators ...galleryValidatorFunction) error {
 	for _, fn := range validators {
 		if err := fn(gallery); err != nil {
@@ -109,23 +543,75 @@ func runGalleryValidatorFunctions(gallery *Gallery, validators ...galleryValidat
 }
 
 func (gv *galleryValidator) Create(gallery *Gallery) error {
+	generated := strings.TrimSpace(gallery.Slug) == ""
 	err := runGalleryValidatorFunctions(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.normalizeText,
+		gv.titleRequired,
+		gv.defaultImageOrder,
+		gv.imageOrderValid,
+		gv.defaultMetadata,
+		gv.metadataValid,
+		gv.maxPicksValid,
+		gv.defaultWatermark,
+		gv.watermarkValid,
+		gv.descriptionLength,
+		gv.tagsValid,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.locationLength,
+		gv.defaultSlug,
+		gv.slugValid,
+		gv.slugAvailable)
 	if err != nil {
 		return err
 	}
-	return gv.GalleryDB.Create(gallery)
+	return gv.saveWithSlug(gallery, generated, gv.GalleryDB.Create)
 }
 
 func (gv *galleryValidator) Update(gallery *Gallery) error {
+	generated := strings.TrimSpace(gallery.Slug) == ""
 	err := runGalleryValidatorFunctions(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.normalizeText,
+		gv.titleRequired,
+		gv.defaultImageOrder,
+		gv.imageOrderValid,
+		gv.defaultMetadata,
+		gv.metadataValid,
+		gv.maxPicksValid,
+		gv.defaultWatermark,
+		gv.watermarkValid,
+		gv.descriptionLength,
+		gv.tagsValid,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.locationLength,
+		gv.defaultSlug,
+		gv.slugValid,
+		gv.slugAvailable)
 	if err != nil {
 		return err
 	}
-	return gv.GalleryDB.Update(gallery)
+	return gv.saveWithSlug(gallery, generated, gv.GalleryDB.Update)
+}
+
+func (gv *galleryValidator) ByUserIDPage(userID uint, sort GallerySort, page Page) ([]Gallery, *Pagination, error) {
+	if sort == "" {
+		sort = GallerySortNewest
+	}
+	if !sort.Valid() {
+		return nil, nil, ErrGallerySortInvalid
+	}
+	page.normalize()
+	return gv.GalleryDB.ByUserIDPage(userID, sort, page)
+}
+
+func (gv *galleryValidator) MoveToCollection(userID, collectionID uint, galleryIDs []uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return gv.GalleryDB.MoveToCollection(userID, collectionID, dedupIDs(galleryIDs))
 }
 
 func (gv *galleryValidator) Delete(id uint) error {
@@ -137,6 +623,39 @@ func (gv *galleryValidator) Delete(id uint) error {
 	return gv.GalleryDB.Delete(gallery.ID)
 }
 
+func (gv *galleryValidator) Restore(gallery *Gallery) error {
+	if err := runGalleryValidatorFunctions(gallery, gv.nonZeroID, gv.restoreSlug); err != nil {
+		return err
+	}
+	return gv.saveWithSlug(gallery, true, gv.GalleryDB.Restore)
+}
+
+// saveWithSlug saves gallery with save. The slugs checked by slugAvailable
+// can be taken by another gallery before this one is saved, in which case
+// the unique index on them makes save fail with ErrSlugTaken. Slugs we
+// generated are simply generated again, the user only hears about the
+// ones they picked.
+func (gv *galleryValidator) saveWithSlug(gallery *Gallery, generated bool, save func(*Gallery) error) error {
+	err := save(gallery)
+	for i := 0; err == ErrSlugTaken && generated && i < slugRetries; i++ {
+		gallery.Slug = ""
+		if err = gv.defaultSlug(gallery); err != nil {
+			return err
+		}
+		err = save(gallery)
+	}
+	return err
+}
+
+func (gv *galleryValidator) Purge(id uint) error {
+	var gallery Gallery
+	gallery.ID = id
+	if err := runGalleryValidatorFunctions(&gallery, gv.nonZeroID); err != nil {
+		return err
+	}
+	return gv.GalleryDB.Purge(gallery.ID)
+}
+
 func (gv *galleryValidator) userIDRequired(g *Gallery) error {
 	if g.UserID <= 0 {
 		return ErrUserIDRequired
@@ -151,9 +670,237 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) defaultImageOrder(g *Gallery) error {
+	if g.ImageOrder == "" {
+		g.ImageOrder = ImageOrderManual
+	}
+	return nil
+}
+
+func (gv *galleryValidator) imageOrderValid(g *Gallery) error {
+	if !g.ImageOrder.Valid() {
+		return ErrImageOrderInvalid
+	}
+	return nil
+}
+
+func (gv *galleryValidator) defaultMetadata(g *Gallery) error {
+	if g.Metadata == "" {
+		g.Metadata = MetadataStripGPS
+	}
+	return nil
+}
+
+func (gv *galleryValidator) metadataValid(g *Gallery) error {
+	if !g.Metadata.Valid() {
+		return ErrMetadataPolicyInvalid
+	}
+	return nil
+}
+
+func (gv *galleryValidator) maxPicksValid(g *Gallery) error {
+	if g.MaxPicks < 0 {
+		return ErrMaxPicksInvalid
+	}
+	return nil
+}
+
+func (gv *galleryValidator) defaultWatermark(g *Gallery) error {
+	if g.WatermarkPosition == "" {
+		g.WatermarkPosition = imaging.BottomRight
+	}
+	if g.WatermarkOpacity == 0 {
+		g.WatermarkOpacity = DefaultWatermarkOpacity
+	}
+	if g.WatermarkScale == 0 {
+		g.WatermarkScale = DefaultWatermarkScale
+	}
+	return nil
+}
+
+func (gv *galleryValidator) watermarkValid(g *Gallery) error {
+	if !g.WatermarkPosition.Valid() {
+		return ErrWatermarkPositionInvalid
+	}
+	if g.WatermarkOpacity < 1 || g.WatermarkOpacity > 100 {
+		return ErrWatermarkOpacityInvalid
+	}
+	if g.WatermarkScale < 1 || g.WatermarkScale > 100 {
+		return ErrWatermarkScaleInvalid
+	}
+	return nil
+}
+
+func (gv *galleryValidator) BySlug(userID uint, slug string) (*Gallery, error) {
+	slug = strings.ToLower(strings.TrimSpace(slug))
+	if !slugPattern.MatchString(slug) {
+		return nil, ErrNotFound
+	}
+	return gv.GalleryDB.BySlug(userID, slug)
+}
+
+func (gv *galleryValidator) normalizeText(g *Gallery) error {
+	g.Title = strings.TrimSpace(g.Title)
+	g.Description = strings.TrimSpace(g.Description)
+	g.Location = strings.TrimSpace(g.Location)
+	g.Slug = strings.ToLower(strings.TrimSpace(g.Slug))
+	return nil
+}
+
+func (gv *galleryValidator) descriptionLength(g *Gallery) error {
+	if utf8.RuneCountInString(g.Description) > maxDescriptionLength {
+		return ErrDescriptionTooLong
+	}
+	return nil
+}
+
+func (gv *galleryValidator) tagsValid(g *Gallery) error {
+	return validateTags(&g.Tags)
+}
+
+func (gv *galleryValidator) defaultVisibility(g *Gallery) error {
+	if g.Visibility == "" {
+		g.Visibility = VisibilityPublic
+	}
+	return nil
+}
+
+func (gv *galleryValidator) visibilityValid(g *Gallery) error {
+	if !g.Visibility.Valid() {
+		return ErrVisibilityInvalid
+	}
+	return nil
+}
+
+func (gv *galleryValidator) locationLength(g *Gallery) error {
+	if utf8.RuneCountInString(g.Location) > maxLocationLength {
+		return ErrLocationTooLong
+	}
+	return nil
+}
+
+// defaultSlug creates a slug from the title of galleries that don't have
+// one, adding a number to it if the user already has a gallery with it.
+// Slugs aren't changed when the title is, so links keep working.
+func (gv *galleryValidator) defaultSlug(g *Gallery) error {
+	if g.Slug != "" {
+		return nil
+	}
+	base := Slugify(g.Title)
+	if base == "" || !validSlug(base) {
+		base = strings.Trim("gallery-"+base, "-")
+	}
+	// Leave room for the number
+	if len(base) > maxSlugLength-5 {
+		base = strings.TrimRight(base[:maxSlugLength-5], "-")
+	}
+	slug := base
+	for i := 2; ; i++ {
+		existing, err := gv.GalleryDB.BySlug(g.UserID, slug)
+		if err == ErrNotFound || (err == nil && existing.ID == g.ID) {
+			g.Slug = slug
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+func (gv *galleryValidator) slugValid(g *Gallery) error {
+	if !validSlug(g.Slug) {
+		return ErrSlugInvalid
+	}
+	return nil
+}
+
+func (gv *galleryValidator) slugAvailable(g *Gallery) error {
+	existing, err := gv.GalleryDB.BySlug(g.UserID, g.Slug)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.ID != g.ID {
+		return ErrSlugTaken
+	}
+	return nil
+}
+
+// restoreSlug gives a gallery coming out of the trash a new slug if
+// another gallery took its own while it was in there.
+func (gv *galleryValidator) restoreSlug(g *Gallery) error {
+	if g.Slug == "" {
+		return nil
+	}
+	err := gv.slugAvailable(g)
+	if err != ErrSlugTaken {
+		return err
+	}
+	g.Slug = ""
+	return gv.defaultSlug(g)
+}
+
+// slugConflict turns the error of saving a gallery with a slug another
+// one of the user's galleries already has into ErrSlugTaken.
+func slugConflict(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && pqErr.Constraint == slugIndex {
+		return ErrSlugTaken
+	}
+	return err
+}
+
 func (gv *galleryValidator) nonZeroID(gallery *Gallery) error {
 	if gallery.ID <= 0 {
 		return ErrIDInvalid
 	}
 	return nil
 }
+
+// dedupIDs returns ids without the ones repeated, so each one is only counted once.
+func dedupIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	var deduped []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			deduped = append(deduped, id)
+		}
+	}
+	return deduped
+}
+
+// validSlug reports whether slug can be used in URLs. Slugs that are only
+// digits aren't allowed, so they can't be mistaken for IDs.
+func validSlug(slug string) bool {
+	if len(slug) > maxSlugLength || !slugPattern.MatchString(slug) || reservedSlugs[slug] {
+		return false
+	}
+	return strings.IndexFunc(slug, func(r rune) bool { return r < '0' || r > '9' }) != -1
+}
+
+// Slugify turns s into something that can be used in URLs and file names,
+// eg: "summer-wedding-2019" for "Summer Wedding 2019". It only keeps ASCII
+// letters and digits, so it may return an empty string.
+func Slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	slug := b.String()
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+	return slug
+}
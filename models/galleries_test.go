@@ -0,0 +1,109 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Summer Wedding 2019", "summer-wedding-2019"},
+		{"  Summer   Wedding  ", "summer-wedding"},
+		{"Rock & Roll!", "rock-roll"},
+		{"--already-a-slug--", "already-a-slug"},
+		{"Café Müller", "caf-m-ller"},
+		{"東京", ""},
+		{"", ""},
+		{strings.Repeat("a", 99) + " b", strings.Repeat("a", 99)},
+		{strings.Repeat("a", maxSlugLength+10), strings.Repeat("a", maxSlugLength)},
+	}
+	for _, tt := range tests {
+		if got := Slugify(tt.in); got != tt.want {
+			t.Errorf("Slugify(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidSlug(t *testing.T) {
+	tests := []struct {
+		slug string
+		want bool
+	}{
+		{"summer-wedding-2019", true},
+		{"a", true},
+		{"2019-a", true},
+		{strings.Repeat("a", maxSlugLength), true},
+		{"", false},
+		{"2019", false},
+		{"new", false},
+		{"Summer", false},
+		{"summer wedding", false},
+		{"-summer", false},
+		{"summer-", false},
+		{"summer--wedding", false},
+		{"summer_wedding", false},
+		{"../summer", false},
+		{strings.Repeat("a", maxSlugLength+1), false},
+	}
+	for _, tt := range tests {
+		if got := validSlug(tt.slug); got != tt.want {
+			t.Errorf("validSlug(%q) = %v; want %v", tt.slug, got, tt.want)
+		}
+	}
+}
+
+// slugDB is a GalleryDB that only knows which slugs are taken.
+type slugDB struct {
+	GalleryDB
+	taken map[string]bool
+}
+
+func (db *slugDB) BySlug(userID uint, slug string) (*Gallery, error) {
+	if !db.taken[slug] {
+		return nil, ErrNotFound
+	}
+	return &Gallery{Model: gorm.Model{ID: 99}, UserID: userID, Slug: slug}, nil
+}
+
+func TestSaveWithSlug(t *testing.T) {
+	tests := []struct {
+		name      string
+		generated bool
+		// races is how many times another gallery takes the slug between
+		// checking and saving it.
+		races    int
+		wantSlug string
+		wantErr  error
+	}{
+		{"no race", true, 0, "summer", nil},
+		{"generated slug taken", true, 1, "summer-2", nil},
+		{"generated slug taken again", true, 2, "summer-3", nil},
+		{"generated slug keeps being taken", true, slugRetries + 1, "", ErrSlugTaken},
+		{"picked slug taken", false, 1, "summer", ErrSlugTaken},
+	}
+	for _, tt := range tests {
+		db := &slugDB{taken: make(map[string]bool)}
+		gv := &galleryValidator{GalleryDB: db}
+		gallery := &Gallery{UserID: 1, Title: "Summer", Slug: "summer"}
+		races := tt.races
+		err := gv.saveWithSlug(gallery, tt.generated, func(g *Gallery) error {
+			if races > 0 {
+				races--
+				db.taken[g.Slug] = true
+				return ErrSlugTaken
+			}
+			return nil
+		})
+		if err != tt.wantErr {
+			t.Errorf("%s: err = %v; want %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && gallery.Slug != tt.wantSlug {
+			t.Errorf("%s: slug = %q; want %q", tt.name, gallery.Slug, tt.wantSlug)
+		}
+	}
+}
@@ -1,97 +1,1108 @@
 package models
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"image"
 	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/imaging"
+	"github.com/torresjeff/gallery/storage"
+)
+
+const (
+	// ErrImageOrderInvalid is returned when a gallery is saved with an image order we don't know how to sort by.
+	ErrImageOrderInvalid modelError = "models: image order is not valid"
+	// ErrImageOrderMismatch is returned when a reorder doesn't list every image in the gallery exactly once.
+	ErrImageOrderMismatch modelError = "models: image order must include every image in the gallery exactly once"
+	// ErrImageTooLarge is returned when an uploaded file is bigger than ImageConfig.MaxFileBytes.
+	ErrImageTooLarge modelError = "models: image is larger than the maximum allowed size"
+	// ErrImageTooManyPixels is returned when an uploaded image has larger dimensions than we are willing to decode.
+	ErrImageTooManyPixels modelError = "models: image dimensions are too large"
+	// ErrImageTypeNotAllowed is returned when an uploaded file isn't an image in one of ImageConfig.AllowedFormats.
+	ErrImageTypeNotAllowed modelError = "models: file type is not allowed"
+	// ErrImageInvalid is returned when an uploaded file looks like an image but can't be decoded.
+	ErrImageInvalid modelError = "models: file is not a valid image"
+	// ErrImageTitleTooLong is returned when an image title is longer than maxImageTitleLength.
+	ErrImageTitleTooLong modelError = "models: image title is too long"
+	// ErrImageCaptionTooLong is returned when an image caption is longer than maxImageCaptionLength.
+	ErrImageCaptionTooLong modelError = "models: image caption is too long"
+	// ErrImageAltTextTooLong is returned when the alt text of an image is longer than maxImageAltTextLength.
+	ErrImageAltTextTooLong modelError = "models: image alt text is too long"
+
+	// maxImagePixels stops us from accepting images that would take
+	// gigabytes of memory to decode (aka: decompression bombs).
+	maxImagePixels = 100 * 1000 * 1000
+)
+
+// imageExtensions is the extension we store each image format with.
+// Formats are named the same way image.DecodeConfig names them.
+var imageExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+}
+
+// maxImageFilenameLength is the longest original file name we keep, in bytes.
+const maxImageFilenameLength = 255
+
+// The longest text owners can describe an image with, in characters.
+const (
+	maxImageTitleLength   = 200
+	maxImageCaptionLength = 2000
+	maxImageAltTextLength = 500
+)
+
+// ImageConfig holds the settings used to validate and process uploaded images.
+type ImageConfig struct {
+	// Encoder writes the resized variants of an image.
+	Encoder *imaging.Encoder
+	// VariantWidths are the widths of the resized variants created for every image.
+	VariantWidths []int
+	// MaxFileBytes is the largest file that can be uploaded as an image.
+	MaxFileBytes int64
+	// AllowedFormats are the image formats that can be uploaded, eg: "jpeg", "png", "gif".
+	AllowedFormats []string
+	// MaxImportEntries is the number of files a ZIP archive can have to be imported. 0 means no limit.
+	MaxImportEntries int
+	// MaxImportBytes is the total size of the files in a ZIP archive once
+	// extracted, checked while importing it. 0 means no limit.
+	MaxImportBytes int64
+	// Quota limits how much each user can upload.
+	Quota QuotaConfig
+}
+
+// JobProcessImage is the kind of the job that creates the variants of a newly uploaded image.
+const JobProcessImage = "process_image"
+
+// ImageStatus tracks the background processing of an uploaded image.
+type ImageStatus string
+
+const (
+	// ImagePending images are waiting for a worker to process them.
+	ImagePending ImageStatus = "pending"
+	// ImageProcessing images are being processed right now.
+	ImageProcessing ImageStatus = "processing"
+	// ImageReady images have all of their variants.
+	ImageReady ImageStatus = "ready"
+	// ImageFailed images couldn't be processed, even after retrying. Their
+	// original file is still served.
+	ImageFailed ImageStatus = "failed"
+)
+
+// ImageOrder is the order in which the images of a gallery are displayed.
+type ImageOrder string
+
+const (
+	// ImageOrderManual sorts images by the position the owner dragged them to.
+	ImageOrderManual ImageOrder = "manual"
+	// ImageOrderUploaded sorts images by upload time, oldest first.
+	ImageOrderUploaded ImageOrder = "uploaded"
+	// ImageOrderCaptured sorts images by the time the photo was taken, falling back
+	// to the upload time for images where we don't know it.
+	ImageOrderCaptured ImageOrder = "captured"
+	// ImageOrderFilename sorts images alphabetically by file name.
+	ImageOrderFilename ImageOrder = "filename"
 )
 
+// ImageOrders lists every supported image order, in the order they should be offered to users.
+var ImageOrders = []ImageOrder{ImageOrderManual, ImageOrderUploaded, ImageOrderCaptured, ImageOrderFilename}
+
+// Valid reports whether o is one of the supported image orders.
+func (o ImageOrder) Valid() bool {
+	for _, order := range ImageOrders {
+		if o == order {
+			return true
+		}
+	}
+	return false
+}
+
+// orderBy returns the SQL ORDER BY clause used to sort images by o.
+func (o ImageOrder) orderBy() string {
+	return o.keyset().expr + ", id"
+}
+
+func (o ImageOrder) keyset() keyset {
+	switch o {
+	case ImageOrderUploaded:
+		return keyset{expr: "created_at"}
+	case ImageOrderCaptured:
+		return keyset{expr: "COALESCE(captured_at, created_at)"}
+	case ImageOrderFilename:
+		return keyset{expr: "filename"}
+	default:
+		return keyset{expr: "position"}
+	}
+}
+
+// cursorValue is the value of the keyset expression for image.
+func (o ImageOrder) cursorValue(image *Image) string {
+	switch o {
+	case ImageOrderUploaded:
+		return image.CreatedAt.Format(time.RFC3339Nano)
+	case ImageOrderCaptured:
+		if image.CapturedAt != nil {
+			return image.CapturedAt.Format(time.RFC3339Nano)
+		}
+		return image.CreatedAt.Format(time.RFC3339Nano)
+	case ImageOrderFilename:
+		return image.Filename
+	default:
+		return strconv.Itoa(image.Position)
+	}
+}
+
 type ImageService interface {
-	Create(galleryID uint, r io.Reader, filename string) error
-	ByGalleryID(galleryID uint) ([]Image, error)
+	// Create adds an image uploaded by userID to a gallery.
+	Create(galleryID, userID uint, r io.Reader, filename string) error
+	// Import adds every image in a ZIP archive of size bytes, uploaded by
+	// userID, to a gallery, reporting which files were imported and which
+	// were rejected.
+	Import(galleryID, userID uint, r io.ReaderAt, size int64) (*ImportResult, error)
+	// Copy adds a copy of image to the end of another gallery, with the same
+	// details. The copy shares the stored file with image.
+	Copy(image *Image, galleryID uint) (*Image, error)
+	ByID(id uint) (*Image, error)
+	// ByGalleryID returns the images of a gallery sorted by the given order.
+	ByGalleryID(galleryID uint, order ImageOrder) ([]Image, error)
+	// ByGalleryIDPage returns a page of the images of a gallery sorted by the given order.
+	ByGalleryIDPage(galleryID uint, order ImageOrder, page Page) ([]Image, *Pagination, error)
+	// Neighbours returns the images right before and after image in its
+	// gallery, sorted by order. Either is nil at the ends of the gallery.
+	Neighbours(image *Image, order ImageOrder) (prev, next *Image, err error)
+	// Cover returns the cover image of a gallery. If the gallery has no cover
+	// image set, the first image in the gallery's order is used instead.
+	Cover(gallery *Gallery) (*Image, error)
+	// Reorder sets the manual position of every image in a gallery. ids must
+	// contain the ID of each image in the gallery exactly once.
+	Reorder(galleryID uint, ids []uint) error
+	// All returns every image, across all galleries.
+	All() ([]Image, error)
+	// RegenerateVariants throws away the resized variants of an image and
+	// creates them again from the original, using the current sizes.
+	RegenerateVariants(i *Image) error
+	// ProcessJob is the handler for JobProcessImage jobs.
+	ProcessJob(job *Job) error
+	// UpdateDetails saves the title, caption, alt text and tags of an image.
+	UpdateDetails(i *Image) error
+	// Delete moves an image to the trash. Its files are kept until it is
+	// purged, but it stops counting against quotas.
 	Delete(i *Image) error
+	// Trashed returns the images of a user in the trash, most recently
+	// deleted first. Images of galleries in the trash are left out, since
+	// they can only be restored along with their gallery.
+	Trashed(userID uint) ([]Image, error)
+	// TrashedByID looks up an image in the trash.
+	TrashedByID(id uint) (*Image, error)
+	// DeletedBefore returns the images of every user moved to the trash before t.
+	DeletedBefore(t time.Time) ([]Image, error)
+	// Restore takes an image out of the trash, counting it against quotas again.
+	Restore(i *Image) error
+	// Purge deletes an image for good, along with its files.
+	Purge(i *Image) error
+	// PurgeGallery deletes every image of a gallery for good, whether they
+	// are in the trash or not.
+	PurgeGallery(galleryID uint) error
+	// DedupReport reports how much space is saved by storing identical files once.
+	DedupReport() (*DedupReport, error)
+	// Open opens the file of image that is served to visitors. If width is
+	// not 0 the JPEG variant of that width is opened instead, and returned
+	// along with the file. Images smaller than width, or still being
+	// processed, don't have that variant, so the file served for the
+	// original is opened for them and the variant is nil. The caller must
+	// close the file.
+	Open(image *Image, width int) (io.ReadCloser, *ImageVariant, error)
+	// VariantWidths are the widths of the variants made of every image
+	// larger than them.
+	VariantWidths() []int
+	// SaveWatermark stores the PNG watermark read from r for a gallery,
+	// setting its WatermarkKey. The gallery still has to be saved.
+	SaveWatermark(gallery *Gallery, r io.Reader) error
+	// CleanWatermarks deletes the watermarks of a gallery other than its
+	// current one, and the copies of its images made with them.
+	CleanWatermarks(gallery *Gallery) error
+	// OpenWatermarked opens a copy of image with the watermark of gallery,
+	// width pixels wide in format or full size for width 0, making it the
+	// first time it is asked for. The caller must close it.
+	OpenWatermarked(gallery *Gallery, image *Image, width int, format imaging.Format) (io.ReadCloser, error)
+	// FileHidden reports whether the file stored under key mustn't be
+	// served to userID, 0 for visitors who aren't signed in. See
+	// storedFile.hiddenFrom for who is served what.
+	FileHidden(key string, userID uint) (bool, error)
+	// Usage returns how much a user has uploaded, along with their quota.
+	Usage(userID uint) (*Usage, error)
+	// GalleryUsage returns how many images a gallery has, and how much space they take.
+	GalleryUsage(galleryID uint) (*GalleryUsage, error)
+	// RecomputeUsage counts the usage of every user and gallery again, from
+	// the sizes of the files in storage.
+	RecomputeUsage() error
 }
 
 // Image is used to represent images stored in a Gallery.
-// Image is NOT stored in the database, and instead
-// references data stored on disk.
+// The image file itself is stored on disk, while the database
+// keeps track of its position in the gallery.
+//
+// Files are stored in a Blob named after the SHA-256 Hash of their
+// contents, so identical uploads share a single file; Key is the hash
+// followed by the extension. The name the file was uploaded with is only
+// kept, sanitized, as Filename.
 type Image struct {
-	GalleryID uint
-	Filename  string
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	Key       string `gorm:"not null;default:'';index"`
+	Hash      string `gorm:"not null;default:'';index"`
+	Size      int64  `gorm:"not null;default:0"`
+	Filename  string `gorm:"not null"`
+	Title     string `gorm:"not null;default:''"`
+	// Caption is written in the limited Markdown supported by the markdown package.
+	Caption string `gorm:"type:text;not null;default:''"`
+	// AltText describes the image for people who can't see it.
+	AltText    string      `gorm:"not null;default:''"`
+	Tags       Tags        `gorm:"type:text[];not null;default:'{}'"`
+	Position   int         `gorm:"not null;default:0"`
+	Width      int         `gorm:"not null;default:0"`
+	Height     int         `gorm:"not null;default:0"`
+	Status     ImageStatus `gorm:"not null;default:'ready'"`
+	CapturedAt *time.Time
+	Variants   []ImageVariant
+
+	// Metadata read from the EXIF data of the file when it was uploaded
+	CameraMake   string  `gorm:"not null;default:''"`
+	CameraModel  string  `gorm:"not null;default:''"`
+	LensModel    string  `gorm:"not null;default:''"`
+	ExposureTime float64 `gorm:"not null;default:0"`
+	FNumber      float64 `gorm:"not null;default:0"`
+	ISO          int     `gorm:"not null;default:0"`
+	FocalLength  float64 `gorm:"not null;default:0"`
+	Latitude     *float64
+	Longitude    *float64
+
+	// UploadedByID is the user who uploaded the image, who may be a
+	// collaborator rather than the owner of the gallery. It is 0 for images
+	// uploaded before galleries had collaborators.
+	UploadedByID uint `gorm:"not null;default:0;index"`
+
+	// GalleryMetadata is the metadata policy of the image's gallery,
+	// loaded along with the image so we know which file to serve.
+	GalleryMetadata MetadataPolicy `gorm:"-"`
+	// UploaderName is the name of the user who uploaded the image.
+	UploaderName string `gorm:"-"`
+	// Watermark is the WatermarkVersion of the image's gallery when it is
+	// shown to visitors, who are served watermarked copies instead of its
+	// files. It is empty for everyone else.
+	Watermark string `gorm:"-"`
+}
+
+// setMetadata copies the metadata read from the image's file.
+func (i *Image) setMetadata(m *imaging.Metadata) {
+	i.CapturedAt = m.CapturedAt
+	i.CameraMake = m.CameraMake
+	i.CameraModel = m.CameraModel
+	i.LensModel = m.LensModel
+	i.ExposureTime = m.ExposureTime
+	i.FNumber = m.FNumber
+	i.ISO = m.ISO
+	i.FocalLength = m.FocalLength
+	i.Latitude = m.Latitude
+	i.Longitude = m.Longitude
+}
+
+// Alt is the text for the alt attribute of the image. Images without alt
+// text fall back to their title.
+func (i *Image) Alt() string {
+	if i.AltText != "" {
+		return i.AltText
+	}
+	return i.Title
+}
+
+// Camera is the make and model of the camera the image was taken with.
+func (i *Image) Camera() string {
+	// Most cameras already include the make in the model, eg: "Canon EOS 5D"
+	if strings.HasPrefix(strings.ToLower(i.CameraModel), strings.ToLower(i.CameraMake)) {
+		return i.CameraModel
+	}
+	return strings.TrimSpace(i.CameraMake + " " + i.CameraModel)
+}
+
+// Exposure summarizes the settings the image was taken with, eg:
+// "1/250s · f/2.8 · ISO 200 · 50mm".
+func (i *Image) Exposure() string {
+	var parts []string
+	switch {
+	case i.ExposureTime >= 1:
+		parts = append(parts, fmt.Sprintf("%gs", round(i.ExposureTime, 1)))
+	case i.ExposureTime > 0:
+		parts = append(parts, fmt.Sprintf("1/%.0fs", 1/i.ExposureTime))
+	}
+	if i.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%g", round(i.FNumber, 1)))
+	}
+	if i.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", i.ISO))
+	}
+	if i.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("%gmm", round(i.FocalLength, 0)))
+	}
+	return strings.Join(parts, " · ")
+}
+
+func round(f float64, decimals int) float64 {
+	pow := math.Pow(10, float64(decimals))
+	return math.Round(f*pow) / pow
+}
+
+// ShowsLocation reports whether the location the image was taken at can
+// be shown. It is only public in galleries that keep metadata.
+func (i *Image) ShowsLocation() bool {
+	return i.Latitude != nil && i.Longitude != nil && i.GalleryMetadata == MetadataKeep
+}
+
+// Location formats the coordinates the image was taken at.
+func (i *Image) Location() string {
+	if i.Latitude == nil || i.Longitude == nil {
+		return ""
+	}
+	return fmt.Sprintf("%.5f, %.5f", *i.Latitude, *i.Longitude)
+}
+
+// ShowsMetadata reports whether there is any metadata to show for the
+// image. Nothing is shown for galleries that strip all metadata.
+func (i *Image) ShowsMetadata() bool {
+	if i.GalleryMetadata == MetadataStripAll {
+		return false
+	}
+	return i.CapturedAt != nil || i.Camera() != "" || i.LensModel != "" || i.Exposure() != "" || i.ShowsLocation()
+}
+
+// Processed reports whether the background processing of the image is over,
+// whether it succeeded or not.
+func (i *Image) Processed() bool {
+	return i.Status == ImageReady || i.Status == ImageFailed
+}
+
+// ImageVariant is a resized copy of an Image, stored on disk next to the
+// original so pages don't have to load full resolution files.
+type ImageVariant struct {
+	ID        uint           `gorm:"primary_key"`
+	ImageID   uint           `gorm:"not null;index"`
+	Width     int            `gorm:"not null"`
+	Height    int            `gorm:"not null"`
+	Format    imaging.Format `gorm:"not null"`
+	CreatedAt time.Time
 }
 
 type imageService struct {
+	db     *gorm.DB
+	jobs   JobQueue
+	store  storage.Storage
+	config ImageConfig
+	// watermarking makes each watermarked copy once, however many
+	// visitors ask for it at the same time.
+	watermarking inflight
+}
+
+// processImagePayload is the payload of JobProcessImage jobs.
+type processImagePayload struct {
+	ImageID uint `json:"image_id"`
 }
 
-func NewImageService() ImageService {
-	return &imageService{}
+// NewImageService creates an ImageService that keeps image files in store.
+// Alongside every image it stores a resized variant for each of the
+// configured widths, in every format the encoder supports. The variants are
+// created in the background by jobs added to the given queue.
+func NewImageService(db *gorm.DB, jobs JobQueue, store storage.Storage, config ImageConfig) ImageService {
+	return &imageService{
+		db:     db,
+		jobs:   jobs,
+		store:  store,
+		config: config,
+	}
 }
 
-func (is *imageService) Create(galleryID uint, r io.Reader, filename string) error {
-	path, err := is.mkImagePath(galleryID)
+func (is *imageService) Create(galleryID, userID uint, r io.Reader, filename string) error {
+	// Write the upload to a temporary file first, so nothing we reject
+	// ever ends up where it could be served.
+	tmp, err := ioutil.TempFile("", "lenslocked-upload-")
 	if err != nil {
 		return err
 	}
-	dst, err := os.Create(filepath.Join(path, filename))
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, is.config.MaxFileBytes+1))
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, r)
+	if n > is.config.MaxFileBytes {
+		return ErrImageTooLarge
+	}
+	format, err := is.validateUpload(tmp)
 	if err != nil {
 		return err
 	}
-	return nil
+	// Plenty of images have no EXIF data at all, so this is best effort
+	meta, metaErr := imaging.ReadMetadata(tmp)
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	image := Image{
+		GalleryID:    galleryID,
+		Key:          sum + imageExtensions[format],
+		Hash:         sum,
+		Size:         n,
+		Filename:     sanitizeFilename(filename, format),
+		UploadedByID: userID,
+	}
+	if metaErr == nil {
+		image.setMetadata(meta)
+	}
+	if err := is.reserveUsage(galleryID, n); err != nil {
+		return err
+	}
+	if err := is.acquireBlob(&image, tmp); err != nil {
+		is.releaseUsage(galleryID, n)
+		return err
+	}
+
+	if err := is.createRecord(&image); err != nil {
+		is.releaseBlob(&image)
+		is.releaseUsage(galleryID, n)
+		return err
+	}
+	return is.enqueueProcessing(&image)
+}
+
+func (is *imageService) Copy(image *Image, galleryID uint) (*Image, error) {
+	dup := *image
+	dup.Model = gorm.Model{}
+	dup.GalleryID = galleryID
+	dup.Variants = nil
+	if image.Hash == "" {
+		// Images uploaded before we stored blobs are stored again as one
+		if err := is.storeAsBlob(&dup, image); err != nil {
+			return nil, err
+		}
+	} else if err := is.retainBlob(&dup); err != nil {
+		return nil, err
+	}
+	if err := is.reserveUsage(galleryID, dup.Size); err != nil {
+		is.releaseBlob(&dup)
+		return nil, err
+	}
+	if err := is.createRecord(&dup); err != nil {
+		is.releaseBlob(&dup)
+		is.releaseUsage(galleryID, dup.Size)
+		return nil, err
+	}
+	// Processing reuses the variants the blob already has
+	if err := is.enqueueProcessing(&dup); err != nil {
+		return nil, err
+	}
+	return &dup, nil
+}
+
+// enqueueProcessing adds the job that processes a newly created image. If
+// that fails, nothing would ever take the image out of ImagePending, so it
+// is deleted again along with the space and blob it took.
+func (is *imageService) enqueueProcessing(image *Image) error {
+	err := is.jobs.Enqueue(JobProcessImage, processImagePayload{ImageID: image.ID})
+	if err == nil {
+		return nil
+	}
+	if derr := is.db.Unscoped().Delete(image).Error; derr != nil {
+		log.Printf("models: couldn't delete image %d that was never processed: %v", image.ID, derr)
+		return err
+	}
+	is.releaseBlob(image)
+	is.releaseUsage(image.GalleryID, image.Size)
+	return err
+}
+
+// createRecord saves a new pending image at the end of its gallery.
+func (is *imageService) createRecord(image *Image) error {
+	var last Image
+	err := first(is.db.Where("gallery_id = ?", image.GalleryID).Order("position desc"), &last)
+	switch err {
+	case nil:
+		image.Position = last.Position + 1
+	case ErrNotFound:
+		image.Position = 0
+	default:
+		return err
+	}
+	image.Status = ImagePending
+	return is.db.Create(image).Error
+}
+
+// sanitizeFilename cleans up the name a file was uploaded with so it is
+// safe to display and to use in eg: a download. The name is never used to
+// find the file on disk.
+func sanitizeFilename(filename, format string) string {
+	// Browsers on Windows can send full paths
+	filename = path.Base(strings.Replace(filename, "\\", "/", -1))
+	filename = strings.Map(func(r rune) rune {
+		if r == '/' || unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = strings.TrimSpace(filename)
+	if filename == "" || filename == "." || filename == ".." {
+		filename = "image" + imageExtensions[format]
+	}
+	if len(filename) > maxImageFilenameLength {
+		ext := path.Ext(filename)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		filename = strings.ToValidUTF8(filename[:maxImageFilenameLength-len(ext)], "") + ext
+	}
+	return filename
+}
+
+// selectImages loads images along with the metadata policy of their
+// gallery, into Image.GalleryMetadata, and the name of who uploaded them,
+// into Image.UploaderName.
+func (is *imageService) selectImages() *gorm.DB {
+	return is.db.Select(`images.*,
+		(SELECT metadata FROM galleries WHERE galleries.id = images.gallery_id) AS gallery_metadata,
+		(SELECT name FROM users WHERE users.id = images.uploaded_by_id) AS uploader_name`)
 }
 
-func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imagePath(galleryID)
-	paths, err := filepath.Glob(filepath.Join(path, "*"))
+func (is *imageService) ByID(id uint) (*Image, error) {
+	var image Image
+	err := first(is.selectImages().Preload("Variants").Where("id = ?", id), &image)
 	if err != nil {
 		return nil, err
 	}
-	images := make([]Image, len(paths))
-	for i, imgStr := range paths {
-		images[i] = Image{
-			Filename:  filepath.Base(imgStr), // Base returns the last element of a path. Eg: file name
-			GalleryID: galleryID,
+	return &image, nil
+}
+
+func (is *imageService) ByGalleryID(galleryID uint, order ImageOrder) ([]Image, error) {
+	var images []Image
+	db := is.selectImages().Preload("Variants").Where("gallery_id = ?", galleryID).Order(order.orderBy())
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (is *imageService) ByGalleryIDPage(galleryID uint, order ImageOrder, page Page) ([]Image, *Pagination, error) {
+	if !order.Valid() {
+		return nil, nil, ErrImageOrderInvalid
+	}
+	page.normalize()
+	var total int
+	if err := is.db.Model(&Image{}).Where("gallery_id = ?", galleryID).Count(&total).Error; err != nil {
+		return nil, nil, err
+	}
+	db, err := order.keyset().apply(is.selectImages().Preload("Variants").Where("gallery_id = ?", galleryID), page)
+	if err != nil {
+		return nil, nil, err
+	}
+	var images []Image
+	if err := db.Find(&images).Error; err != nil {
+		return nil, nil, err
+	}
+
+	pagination := &Pagination{Page: page, Total: total}
+	if len(images) > page.Size {
+		images = images[:page.Size]
+		last := &images[len(images)-1]
+		pagination.Next = encodeCursor(order.cursorValue(last), last.ID)
+	}
+	return images, pagination, nil
+}
+
+func (is *imageService) Neighbours(image *Image, order ImageOrder) (*Image, *Image, error) {
+	if !order.Valid() {
+		return nil, nil, ErrImageOrderInvalid
+	}
+	var neighbours [2]*Image
+	for i, before := range []bool{true, false} {
+		var images []Image
+		db := order.keyset().adjacent(is.selectImages().Preload("Variants").Where("gallery_id = ?", image.GalleryID),
+			order.cursorValue(image), image.ID, before)
+		if err := db.Find(&images).Error; err != nil {
+			return nil, nil, err
+		}
+		if len(images) > 0 {
+			neighbours[i] = &images[0]
+		}
+	}
+	return neighbours[0], neighbours[1], nil
+}
+
+func (is *imageService) Cover(gallery *Gallery) (*Image, error) {
+	if gallery.CoverImageID != 0 {
+		var image Image
+		err := first(is.selectImages().Preload("Variants").Where("id = ? AND gallery_id = ?", gallery.CoverImageID, gallery.ID), &image)
+		if err == nil {
+			return &image, nil
+		}
+		if err != ErrNotFound {
+			return nil, err
+		}
+	}
+	var image Image
+	err := first(is.selectImages().Preload("Variants").Where("gallery_id = ?", gallery.ID).Order(gallery.ImageOrder.orderBy()), &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (is *imageService) Reorder(galleryID uint, ids []uint) error {
+	images, err := is.ByGalleryID(galleryID, ImageOrderManual)
+	if err != nil {
+		return err
+	}
+	if len(images) != len(ids) {
+		return ErrImageOrderMismatch
+	}
+	positions := make(map[uint]int, len(ids))
+	for i, id := range ids {
+		if _, ok := positions[id]; ok {
+			return ErrImageOrderMismatch
 		}
+		positions[id] = i
+	}
+	for _, image := range images {
+		if _, ok := positions[image.ID]; !ok {
+			return ErrImageOrderMismatch
+		}
+	}
+
+	tx := is.db.Begin()
+	for id, position := range positions {
+		err := tx.Model(&Image{}).Where("id = ?", id).Update("position", position).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (is *imageService) All() ([]Image, error) {
+	var images []Image
+	if err := is.selectImages().Preload("Variants").Order("id").Find(&images).Error; err != nil {
+		return nil, err
 	}
 	return images, nil
 }
 
-func (is *imageService) Delete(image *Image) error {
-	return os.Remove(image.RelativePath())
+func (is *imageService) RegenerateVariants(image *Image) error {
+	// Images uploaded before we read EXIF data get their metadata now
+	if err := is.refreshMetadata(image); err != nil {
+		return err
+	}
+	if err := is.deleteVariants(image); err != nil {
+		return err
+	}
+	err := is.createVariants(image, false)
+	if err == nil {
+		err = is.createStripped(image, false)
+	}
+	if err != nil {
+		is.setStatus(image, ImageFailed)
+		return err
+	}
+	return is.setStatus(image, ImageReady)
+}
+
+func (is *imageService) ProcessJob(job *Job) error {
+	var payload processImagePayload
+	if err := job.DecodePayload(&payload); err != nil {
+		return err
+	}
+	image, err := is.ByID(payload.ImageID)
+	if err == ErrNotFound {
+		// The image was deleted before we got to it, there's nothing left to do
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := is.setStatus(image, ImageProcessing); err != nil {
+		return err
+	}
+	// Clear out anything left behind by a previous attempt
+	if err := is.deleteVariants(image); err != nil {
+		return err
+	}
+	// Variants of a file another image already uses are reused as they are
+	err = is.createVariants(image, true)
+	if err == nil {
+		err = is.createStripped(image, true)
+	}
+	if err != nil {
+		status := ImagePending
+		if job.LastAttempt() {
+			status = ImageFailed
+		}
+		if err := is.setStatus(image, status); err != nil {
+			log.Printf("models: couldn't update status of image %d: %v", image.ID, err)
+		}
+		return err
+	}
+	return is.setStatus(image, ImageReady)
 }
 
-func (is *imageService) imagePath(galleryID uint) string {
-	return filepath.Join("images", "galleries", fmt.Sprintf("%v", galleryID))
+func (is *imageService) UpdateDetails(image *Image) error {
+	image.Title = strings.TrimSpace(image.Title)
+	image.Caption = strings.TrimSpace(image.Caption)
+	image.AltText = strings.TrimSpace(image.AltText)
+	switch {
+	case utf8.RuneCountInString(image.Title) > maxImageTitleLength:
+		return ErrImageTitleTooLong
+	case utf8.RuneCountInString(image.Caption) > maxImageCaptionLength:
+		return ErrImageCaptionTooLong
+	case utf8.RuneCountInString(image.AltText) > maxImageAltTextLength:
+		return ErrImageAltTextTooLong
+	}
+	if err := validateTags(&image.Tags); err != nil {
+		return err
+	}
+	return is.db.Model(image).Updates(map[string]interface{}{
+		"title":    image.Title,
+		"caption":  image.Caption,
+		"alt_text": image.AltText,
+		"tags":     image.Tags,
+	}).Error
 }
 
-func (is *imageService) mkImagePath(galleryID uint) (string, error) {
-	galleryPath := is.imagePath(galleryID)
-	err := os.MkdirAll(galleryPath, 0755)
+func (is *imageService) Delete(image *Image) error {
+	existing, err := is.ByID(image.ID)
 	if err != nil {
+		return err
+	}
+	if err := is.db.Delete(existing).Error; err != nil {
+		return err
+	}
+	return is.releaseUsage(existing.GalleryID, existing.Size)
+}
+
+func (is *imageService) Open(image *Image, width int) (io.ReadCloser, *ImageVariant, error) {
+	if width != 0 {
+		for i := range image.Variants {
+			v := &image.Variants[i]
+			if v.Width == width && v.Format == imaging.JPEG {
+				f, err := is.store.Get(image.VariantStorageKey(v))
+				return f, v, err
+			}
+		}
+	}
+	f, err := is.store.Get(image.ServedKey())
+	return f, nil, err
+}
+
+func (is *imageService) VariantWidths() []int {
+	return is.config.VariantWidths
+}
+
+// validateUpload makes sure f is an image in one of the allowed formats,
+// and returns its format. We don't trust the name or content type sent by
+// the client: the format is sniffed from the contents of the file, and then
+// checked by actually decoding the image header with the matching decoder.
+func (is *imageService) validateUpload(f io.ReadSeeker) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
 		return "", err
 	}
-	return galleryPath, nil
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return "", ErrImageInvalid
+		}
+		return "", err
+	}
+	contentType := http.DetectContentType(head[:n])
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", ErrImageTypeNotAllowed
+	}
+	format := strings.TrimPrefix(contentType, "image/")
+	if !is.formatAllowed(format) {
+		return "", ErrImageTypeNotAllowed
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	config, decodedFormat, err := image.DecodeConfig(f)
+	if err != nil || decodedFormat != format {
+		return "", ErrImageInvalid
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return "", ErrImageInvalid
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return "", ErrImageTooManyPixels
+	}
+	return format, nil
+}
+
+func (is *imageService) formatAllowed(format string) bool {
+	if _, ok := imageExtensions[format]; !ok {
+		// We can't decode it, so it doesn't matter what the config says
+		return false
+	}
+	for _, allowed := range is.config.AllowedFormats {
+		if format == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (is *imageService) setStatus(image *Image, status ImageStatus) error {
+	image.Status = status
+	return is.db.Model(image).Update("status", status).Error
+}
+
+// createVariants decodes the original file of image and stores a resized
+// copy for each configured width that is smaller than the original. If
+// reuse is true, variant files already stored for the image's blob are
+// kept instead of being encoded again.
+func (is *imageService) createVariants(image *Image, reuse bool) error {
+	f, err := is.store.Get(image.StorageKey())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, err := imaging.Decode(f)
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	image.Width, image.Height = bounds.Dx(), bounds.Dy()
+	err = is.db.Model(image).Updates(map[string]interface{}{"width": image.Width, "height": image.Height}).Error
+	if err != nil {
+		return err
+	}
+
+	image.Variants = nil
+	for _, width := range is.config.VariantWidths {
+		if width >= image.Width {
+			// Never upscale, the original is the largest size we serve
+			continue
+		}
+		resized := imaging.Resize(img, width)
+		for _, format := range is.config.Encoder.Formats() {
+			variant := ImageVariant{
+				ImageID: image.ID,
+				Width:   resized.Bounds().Dx(),
+				Height:  resized.Bounds().Dy(),
+				Format:  format,
+			}
+			key := image.VariantStorageKey(&variant)
+			if !reuse || !is.variantStored(image, key) {
+				if err := is.writeVariant(key, variant.Format, resized); err != nil {
+					return err
+				}
+			}
+			if err := is.db.Create(&variant).Error; err != nil {
+				return err
+			}
+			image.Variants = append(image.Variants, variant)
+		}
+	}
+	return nil
+}
+
+// variantStored reports whether the variant file stored under key can be
+// reused. Only blobs have variants that outlive a single image.
+func (is *imageService) variantStored(image *Image, key string) bool {
+	if image.Hash == "" {
+		return false
+	}
+	_, err := is.store.Stat(key)
+	return err == nil
+}
+
+// stripLevels is how much metadata is stripped from the files served for
+// each policy that strips anything.
+var stripLevels = map[MetadataPolicy]imaging.Strip{
+	MetadataStripGPS: imaging.StripGPS,
+	MetadataStripAll: imaging.StripAll,
+}
+
+// createStripped stores a copy of the original file of image with its
+// metadata stripped for each policy in stripLevels, so changing the policy
+// of a gallery takes effect right away. If reuse is true, copies already
+// stored for the image's blob are kept.
+func (is *imageService) createStripped(image *Image, reuse bool) error {
+	for policy, level := range stripLevels {
+		key := image.strippedKey(policy)
+		if reuse && is.variantStored(image, key) {
+			continue
+		}
+		f, err := is.store.Get(image.StorageKey())
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		err = imaging.StripMetadata(&buf, f, level)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if err := is.store.Put(key, &buf, int64(buf.Len())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshMetadata reads the metadata of image from its stored file again.
+func (is *imageService) refreshMetadata(image *Image) error {
+	f, err := is.store.Get(image.StorageKey())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		rs = bytes.NewReader(b)
+	}
+	meta, err := imaging.ReadMetadata(rs)
+	if err != nil {
+		return nil
+	}
+	image.setMetadata(meta)
+	return is.db.Model(image).Updates(map[string]interface{}{
+		"captured_at":   image.CapturedAt,
+		"camera_make":   image.CameraMake,
+		"camera_model":  image.CameraModel,
+		"lens_model":    image.LensModel,
+		"exposure_time": image.ExposureTime,
+		"f_number":      image.FNumber,
+		"iso":           image.ISO,
+		"focal_length":  image.FocalLength,
+		"latitude":      image.Latitude,
+		"longitude":     image.Longitude,
+	}).Error
+}
+
+func (is *imageService) writeVariant(key string, format imaging.Format, src image.Image) error {
+	// Variants are small enough to encode in memory, and knowing their size
+	// up front saves some storage backends from having to buffer them.
+	var buf bytes.Buffer
+	if err := is.config.Encoder.Encode(&buf, src, format); err != nil {
+		return err
+	}
+	return is.store.Put(key, &buf, int64(buf.Len()))
+}
+
+// deleteVariants removes every variant of image. The files of variants
+// created from a blob may be shared with other images, so those are only
+// removed along with the blob itself.
+func (is *imageService) deleteVariants(image *Image) error {
+	if image.Hash == "" {
+		for i := range image.Variants {
+			if err := is.store.Delete(image.VariantStorageKey(&image.Variants[i])); err != nil {
+				return err
+			}
+		}
+	}
+	image.Variants = nil
+	return is.db.Where("image_id = ?", image.ID).Delete(&ImageVariant{}).Error
 }
 
 // Path is used to build the absolute path used to reference this image
 // via a web request.
 func (i *Image) Path() string {
+	if i.Watermark != "" {
+		return i.watermarkedPath(watermarkedName(0, imaging.JPEG))
+	}
 	// Build the path with a URL to be able to escape (encode) special HTML characters (like ?, /, etc.)
 	temp := url.URL{
-		Path: "/" + i.RelativePath(),
+		Path: "/images/" + i.ServedKey(),
+	}
+	return temp.String()
+}
+
+// ServedKey is the key of the file served as the original image. Unless
+// its gallery keeps metadata, that is a copy with the metadata stripped.
+func (i *Image) ServedKey() string {
+	if i.GalleryMetadata == MetadataKeep {
+		return i.StorageKey()
+	}
+	if _, ok := stripLevels[i.GalleryMetadata]; !ok {
+		return i.strippedKey(MetadataStripGPS)
+	}
+	return i.strippedKey(i.GalleryMetadata)
+}
+
+// strippedKey is the key of the copy of the image stripped by policy.
+// They are stored with the variants.
+func (i *Image) strippedKey(policy MetadataPolicy) string {
+	name := strings.Replace(string(policy), "_", "-", -1)
+	if i.Hash != "" {
+		return fmt.Sprintf("%s%s%s", blobVariantsPrefix(i.Hash), name, path.Ext(i.Key))
+	}
+	return fmt.Sprintf("galleries/%v/stripped/%s/%s", i.GalleryID, name, i.storageName())
+}
+
+// StorageKey is the key this image's file is stored under.
+func (i *Image) StorageKey() string {
+	if i.Hash != "" {
+		return blobKey(i.Key)
+	}
+	return fmt.Sprintf("galleries/%v/%s", i.GalleryID, i.storageName())
+}
+
+// storageName is the name of the file an image uploaded before we started
+// storing blobs is kept in inside its gallery. The oldest images are
+// stored under their original file name.
+func (i *Image) storageName() string {
+	if i.Key == "" {
+		return i.Filename
+	}
+	return i.Key
+}
+
+// VariantPath is used to build the absolute path used to reference a
+// variant of this image via a web request.
+func (i *Image) VariantPath(v *ImageVariant) string {
+	if i.Watermark != "" {
+		return i.watermarkedPath(watermarkedName(v.Width, v.Format))
+	}
+	temp := url.URL{
+		Path: "/images/" + i.VariantStorageKey(v),
 	}
 	return temp.String()
 }
 
-// RelativePath is used to build the path to this image on our local
-// disk, relative to where our Go application is run from.
-func (i *Image) RelativePath() string {
-	galleryID := fmt.Sprintf("%v", i.GalleryID)
-	return filepath.ToSlash(filepath.Join("images", "galleries", galleryID, i.Filename))
+// VariantStorageKey is the key a variant of this image is stored under.
+// Variants of a blob live in a directory named after its hash, while older
+// images keep theirs in a "variants" directory inside the gallery, grouped
+// by width.
+func (i *Image) VariantStorageKey(v *ImageVariant) string {
+	if i.Hash != "" {
+		return fmt.Sprintf("%s%v%s", blobVariantsPrefix(i.Hash), v.Width, v.Format.Ext())
+	}
+	return fmt.Sprintf("galleries/%v/variants/%v/%s%s", i.GalleryID, v.Width, i.storageName(), v.Format.Ext())
 }
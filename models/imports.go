@@ -0,0 +1,188 @@
+package models
+
+import (
+	"archive/zip"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// ErrImportInvalid is returned when an uploaded archive isn't a valid ZIP file.
+	ErrImportInvalid modelError = "models: file is not a valid ZIP archive"
+	// ErrImportTooManyEntries is returned when an archive has more than ImageConfig.MaxImportEntries files.
+	ErrImportTooManyEntries modelError = "models: ZIP archive has too many files"
+	// ErrImportTooLarge is returned for the entries of an archive that go over ImageConfig.MaxImportBytes once extracted.
+	ErrImportTooLarge modelError = "models: ZIP archive is too large once extracted"
+	// ErrImportPathInvalid is returned for archive entries with absolute paths or paths outside of the archive.
+	ErrImportPathInvalid modelError = "models: file path is not allowed"
+	// ErrImportEncrypted is returned for archive entries that are encrypted.
+	ErrImportEncrypted modelError = "models: file is encrypted"
+)
+
+// ImportResult is what happened to each of the files in an imported archive.
+type ImportResult struct {
+	// Accepted is the number of images that were added to the gallery.
+	Accepted int
+	// Rejected are the files that couldn't be imported, along with the reason.
+	Rejected []ImportRejection
+}
+
+// ImportRejection is a file from an archive that wasn't imported.
+type ImportRejection struct {
+	Name string
+	Err  error
+}
+
+// Import adds every image in the ZIP archive r to a gallery. Files that
+// aren't valid images are rejected one by one, like uploads are, without
+// stopping the import. The import stops at the first error that affects
+// the whole archive, eg: running out of quota, which is returned along
+// with what was imported so far.
+//
+// Nothing is ever extracted to disk under the names in the archive, and
+// the size of each file is enforced while reading it, since the sizes in
+// the archive can't be trusted.
+func (is *imageService) Import(galleryID, userID uint, r io.ReaderAt, size int64) (*ImportResult, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, ErrImportInvalid
+	}
+	var files []*zip.File
+	for _, f := range zr.File {
+		if importIgnored(f) {
+			continue
+		}
+		files = append(files, f)
+	}
+	if max := is.config.MaxImportEntries; max > 0 && len(files) > max {
+		return nil, ErrImportTooManyEntries
+	}
+
+	var result ImportResult
+	budget := newImportBudget(is.config.MaxImportBytes)
+	for _, f := range files {
+		err := is.importFile(galleryID, userID, f, budget)
+		switch err {
+		case nil:
+			result.Accepted++
+			continue
+		case ErrStorageQuotaExceeded, ErrImageQuotaExceeded, ErrGalleryQuotaExceeded:
+			return &result, err
+		}
+		result.Rejected = append(result.Rejected, ImportRejection{Name: f.Name, Err: err})
+	}
+	return &result, nil
+}
+
+func (is *imageService) importFile(galleryID, userID uint, f *zip.File, budget *importBudget) error {
+	name, ok := importName(f.Name)
+	if !ok {
+		return ErrImportPathInvalid
+	}
+	if f.Flags&0x1 != 0 {
+		return ErrImportEncrypted
+	}
+	if f.UncompressedSize64 > uint64(is.config.MaxFileBytes) {
+		return ErrImageTooLarge
+	}
+	if budget.exhausted() {
+		return ErrImportTooLarge
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return ErrImportInvalid
+	}
+	defer rc.Close()
+	err = is.Create(galleryID, userID, budget.reader(rc), name)
+	if err != nil && budget.exceeded {
+		return ErrImportTooLarge
+	}
+	if err == zip.ErrChecksum || err == zip.ErrFormat || err == zip.ErrAlgorithm {
+		return ErrImportInvalid
+	}
+	return err
+}
+
+// importIgnored reports whether f is a file we skip without telling the
+// user, because it's not something they meant to upload: directories, and
+// the hidden files some systems add to the archives they create.
+func importIgnored(f *zip.File) bool {
+	if f.FileInfo().IsDir() || strings.HasSuffix(f.Name, "/") {
+		return true
+	}
+	name := strings.Replace(f.Name, `\`, "/", -1)
+	if strings.HasPrefix(name, "__MACOSX/") {
+		return true
+	}
+	return strings.HasPrefix(path.Base(name), ".")
+}
+
+// importName returns the name an archive entry is saved under, which is
+// just its base name. It refuses absolute paths and paths that climb out of
+// the archive, as they are a sign of a malicious archive.
+func importName(name string) (string, bool) {
+	name = strings.Replace(name, `\`, "/", -1)
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, ":") {
+		return "", false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	base := path.Base(name)
+	if base == "." || base == "/" {
+		return "", false
+	}
+	return base, true
+}
+
+// importBudget keeps track of how many bytes can still be extracted from
+// an archive.
+type importBudget struct {
+	remaining int64
+	unlimited bool
+	exceeded  bool
+}
+
+// newImportBudget returns a budget of max bytes. 0 means there is no limit.
+func newImportBudget(max int64) *importBudget {
+	return &importBudget{remaining: max, unlimited: max <= 0}
+}
+
+func (b *importBudget) exhausted() bool {
+	return !b.unlimited && b.remaining <= 0
+}
+
+// reader wraps r so reading from it uses up the budget, and fails once it
+// runs out.
+func (b *importBudget) reader(r io.Reader) io.Reader {
+	if b.unlimited {
+		return r
+	}
+	return &budgetReader{r: r, budget: b}
+}
+
+type budgetReader struct {
+	r      io.Reader
+	budget *importBudget
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	if br.budget.remaining <= 0 {
+		// A file that ends exactly at the limit still fits
+		var b [1]byte
+		if n, err := br.r.Read(b[:]); n == 0 && err == io.EOF {
+			return 0, io.EOF
+		}
+		br.budget.exceeded = true
+		return 0, ErrImportTooLarge
+	}
+	if int64(len(p)) > br.budget.remaining {
+		p = p[:br.budget.remaining]
+	}
+	n, err := br.r.Read(p)
+	br.budget.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestImportName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"photo.jpg", "photo.jpg", true},
+		{"holiday/day 1/photo.jpg", "photo.jpg", true},
+		{"./photo.jpg", "photo.jpg", true},
+		{`holiday\photo.jpg`, "photo.jpg", true},
+		{"...jpg", "...jpg", true},
+		{"", "", false},
+		{".", "", false},
+		{"/etc/passwd", "", false},
+		{`\Windows\win.ini`, "", false},
+		{"C:/photo.jpg", "", false},
+		{`C:\photo.jpg`, "", false},
+		{"../photo.jpg", "", false},
+		{"holiday/../../photo.jpg", "", false},
+		{`holiday\..\..\photo.jpg`, "", false},
+		{"holiday/..", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := importName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("importName(%q) = %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestImportBudget(t *testing.T) {
+	tests := []struct {
+		name  string
+		max   int64
+		files []int
+		// read is how many bytes of each file can be read, or -1 if it
+		// goes over the budget.
+		read      []int
+		exhausted bool
+	}{
+		{"under the limit", 10, []int{4, 5}, []int{4, 5}, false},
+		{"exactly at the limit", 10, []int{10}, []int{10}, true},
+		{"one byte over", 10, []int{11}, []int{-1}, true},
+		{"files exactly at the limit", 10, []int{4, 6}, []int{4, 6}, true},
+		{"files one byte over", 10, []int{4, 7}, []int{4, -1}, true},
+		{"empty file at the limit", 10, []int{10, 0}, []int{10, 0}, true},
+		{"no limit", 0, []int{100, 200}, []int{100, 200}, false},
+	}
+	for _, tt := range tests {
+		budget := newImportBudget(tt.max)
+		for i, size := range tt.files {
+			b, err := ioutil.ReadAll(budget.reader(bytes.NewReader(make([]byte, size))))
+			switch {
+			case tt.read[i] == -1 && err != ErrImportTooLarge:
+				t.Errorf("%s: file %d: err = %v; want ErrImportTooLarge", tt.name, i, err)
+			case tt.read[i] != -1 && (err != nil || len(b) != tt.read[i]):
+				t.Errorf("%s: file %d: read %d bytes, err = %v; want %d bytes", tt.name, i, len(b), err, tt.read[i])
+			}
+		}
+		if got := budget.exhausted(); got != tt.exhausted {
+			t.Errorf("%s: exhausted() = %v; want %v", tt.name, got, tt.exhausted)
+		}
+		wantExceeded := false
+		for _, n := range tt.read {
+			wantExceeded = wantExceeded || n == -1
+		}
+		if budget.exceeded != wantExceeded {
+			t.Errorf("%s: exceeded = %v; want %v", tt.name, budget.exceeded, wantExceeded)
+		}
+	}
+}
+
+// TestImportBudgetSmallReads makes sure the limit holds when the file is
+// read a byte at a time, like a decompressor can.
+func TestImportBudgetSmallReads(t *testing.T) {
+	budget := newImportBudget(3)
+	r := budget.reader(strings.NewReader("abcd"))
+	var got []byte
+	p := make([]byte, 1)
+	var err error
+	for err == nil {
+		var n int
+		n, err = r.Read(p)
+		got = append(got, p[:n]...)
+	}
+	if err != ErrImportTooLarge || string(got) != "abc" {
+		t.Errorf("read %q, err = %v; want %q, ErrImportTooLarge", got, err, "abc")
+	}
+}
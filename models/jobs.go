@@ -0,0 +1,243 @@
+package models
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrNoJobs is returned by JobQueue.Dequeue when there is nothing to run right now.
+	ErrNoJobs modelError = "models: no jobs are ready to run"
+
+	// DefaultJobMaxAttempts is how many times a job is tried before it is marked as failed.
+	DefaultJobMaxAttempts = 5
+	// jobLockTimeout is how long a job can stay running before we assume the
+	// worker running it died, and hand it to another worker.
+	jobLockTimeout = 15 * time.Minute
+)
+
+// JobStatus is the state of a background job.
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobRunning JobStatus = "running"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is a unit of background work. Payload holds the JSON encoded
+// arguments of the job, and its meaning depends on Kind.
+type Job struct {
+	ID          uint      `gorm:"primary_key"`
+	Kind        string    `gorm:"not null"`
+	Payload     string    `gorm:"type:text;not null"`
+	Status      JobStatus `gorm:"not null;index"`
+	Attempts    int       `gorm:"not null;default:0"`
+	MaxAttempts int       `gorm:"not null"`
+	RunAt       time.Time `gorm:"not null;index"`
+	LockedAt    *time.Time
+	LastError   string `gorm:"type:text"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// LastAttempt reports whether the current run of the job is the last one
+// it gets, ie: it won't be retried if it fails.
+func (j *Job) LastAttempt() bool {
+	return j.Attempts >= j.MaxAttempts
+}
+
+// DecodePayload unmarshals the JSON payload of the job into dst.
+func (j *Job) DecodePayload(dst interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), dst)
+}
+
+// JobQueue stores background jobs until a worker is free to run them.
+type JobQueue interface {
+	// Enqueue adds a job of the given kind. payload is encoded as JSON.
+	Enqueue(kind string, payload interface{}) error
+	// Dequeue claims the next job that is ready to run, returning ErrNoJobs
+	// if there aren't any. Claiming a job counts as an attempt.
+	Dequeue() (*Job, error)
+	// Complete removes a job that ran successfully.
+	Complete(job *Job) error
+	// Fail records that a job failed. It is scheduled to run again later
+	// unless it has run out of attempts, in which case it is marked failed.
+	Fail(job *Job, jobErr error) error
+}
+
+// retryDelay is how long we wait before retrying a job that has failed
+// attempts times, backing off quadratically.
+func retryDelay(attempts int) time.Duration {
+	return time.Duration(attempts*attempts) * 10 * time.Second
+}
+
+func newJob(kind string, payload interface{}) (*Job, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Job{
+		Kind:        kind,
+		Payload:     string(b),
+		Status:      JobPending,
+		MaxAttempts: DefaultJobMaxAttempts,
+		RunAt:       time.Now(),
+	}, nil
+}
+
+// failJob updates job after a failed attempt, either scheduling a retry or
+// giving up on it.
+func failJob(job *Job, jobErr error) {
+	job.LastError = jobErr.Error()
+	job.LockedAt = nil
+	if job.LastAttempt() {
+		job.Status = JobFailed
+		return
+	}
+	job.Status = JobPending
+	job.RunAt = time.Now().Add(retryDelay(job.Attempts))
+}
+
+// jobGorm is a JobQueue backed by the jobs table in Postgres.
+type jobGorm struct {
+	db *gorm.DB
+}
+
+var _ JobQueue = &jobGorm{}
+
+func NewJobQueue(db *gorm.DB) JobQueue {
+	return &jobGorm{
+		db: db,
+	}
+}
+
+func (jg *jobGorm) Enqueue(kind string, payload interface{}) error {
+	job, err := newJob(kind, payload)
+	if err != nil {
+		return err
+	}
+	return jg.db.Create(job).Error
+}
+
+func (jg *jobGorm) Dequeue() (*Job, error) {
+	var job Job
+	// SKIP LOCKED lets several workers (or servers) claim jobs at the same
+	// time without ever handing the same job to two of them.
+	err := jg.db.Raw(`
+		UPDATE jobs SET status = ?, locked_at = ?, attempts = attempts + 1, updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (status = ? AND run_at <= ?) OR (status = ? AND locked_at < ?)
+			ORDER BY run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		JobRunning, time.Now(), time.Now(),
+		JobPending, time.Now(), JobRunning, time.Now().Add(-jobLockTimeout),
+	).Scan(&job).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrNoJobs
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (jg *jobGorm) Complete(job *Job) error {
+	return jg.db.Delete(job).Error
+}
+
+func (jg *jobGorm) Fail(job *Job, jobErr error) error {
+	failJob(job, jobErr)
+	return jg.db.Save(job).Error
+}
+
+// jobMemory is a JobQueue that keeps jobs in memory. It is meant for tests
+// and for running the app without Postgres; jobs are lost on restart.
+type jobMemory struct {
+	mu     sync.Mutex
+	jobs   []*Job
+	nextID uint
+}
+
+var _ JobQueue = &jobMemory{}
+
+func NewMemoryJobQueue() JobQueue {
+	return &jobMemory{
+		nextID: 1,
+	}
+}
+
+func (jm *jobMemory) Enqueue(kind string, payload interface{}) error {
+	job, err := newJob(kind, payload)
+	if err != nil {
+		return err
+	}
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	job.ID = jm.nextID
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+	jm.nextID++
+	jm.jobs = append(jm.jobs, job)
+	return nil
+}
+
+func (jm *jobMemory) Dequeue() (*Job, error) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	now := time.Now()
+	var next *Job
+	for _, job := range jm.jobs {
+		ready := job.Status == JobPending && !job.RunAt.After(now)
+		stale := job.Status == JobRunning && job.LockedAt != nil && job.LockedAt.Before(now.Add(-jobLockTimeout))
+		if !ready && !stale {
+			continue
+		}
+		if next == nil || job.RunAt.Before(next.RunAt) {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, ErrNoJobs
+	}
+	next.Status = JobRunning
+	next.LockedAt = &now
+	next.Attempts++
+	next.UpdatedAt = now
+	// Hand out a copy so callers can't change the queue without going through it
+	job := *next
+	return &job, nil
+}
+
+func (jm *jobMemory) Complete(job *Job) error {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	for i, j := range jm.jobs {
+		if j.ID == job.ID {
+			jm.jobs = append(jm.jobs[:i], jm.jobs[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (jm *jobMemory) Fail(job *Job, jobErr error) error {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	for _, j := range jm.jobs {
+		if j.ID == job.ID {
+			failJob(job, jobErr)
+			job.UpdatedAt = time.Now()
+			*j = *job
+			return nil
+		}
+	}
+	return ErrNotFound
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 40 * time.Second},
+		{3, 90 * time.Second},
+		{4, 160 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v; want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryJobQueueRetries(t *testing.T) {
+	queue := NewMemoryJobQueue()
+	jm := queue.(*jobMemory)
+	if err := queue.Enqueue("test", map[string]int{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	jobErr := errors.New("boom")
+
+	for attempt := 1; attempt <= DefaultJobMaxAttempts; attempt++ {
+		job, err := queue.Dequeue()
+		if err != nil {
+			t.Fatalf("attempt %d: Dequeue() err = %v", attempt, err)
+		}
+		if job.Attempts != attempt || job.Status != JobRunning {
+			t.Fatalf("attempt %d: got attempts %d, status %q", attempt, job.Attempts, job.Status)
+		}
+		if _, err := queue.Dequeue(); err != ErrNoJobs {
+			t.Fatalf("attempt %d: running job was handed out twice, err = %v", attempt, err)
+		}
+
+		before := time.Now()
+		if err := queue.Fail(job, jobErr); err != nil {
+			t.Fatal(err)
+		}
+		stored := jm.jobs[0]
+		if stored.LastError != jobErr.Error() || stored.LockedAt != nil {
+			t.Fatalf("attempt %d: got last error %q, locked at %v", attempt, stored.LastError, stored.LockedAt)
+		}
+		if attempt == DefaultJobMaxAttempts {
+			if stored.Status != JobFailed {
+				t.Fatalf("last attempt: status = %q; want %q", stored.Status, JobFailed)
+			}
+			break
+		}
+		if stored.Status != JobPending {
+			t.Fatalf("attempt %d: status = %q; want %q", attempt, stored.Status, JobPending)
+		}
+		delay := stored.RunAt.Sub(before)
+		if delay < retryDelay(attempt) || delay > retryDelay(attempt)+time.Second {
+			t.Fatalf("attempt %d: retried after %v; want %v", attempt, delay, retryDelay(attempt))
+		}
+		if _, err := queue.Dequeue(); err != ErrNoJobs {
+			t.Fatalf("attempt %d: job was retried before its delay, err = %v", attempt, err)
+		}
+		// Skip the wait
+		stored.RunAt = time.Now().Add(-time.Second)
+	}
+
+	if _, err := queue.Dequeue(); err != ErrNoJobs {
+		t.Errorf("failed job was handed out again, err = %v", err)
+	}
+}
+
+func TestMemoryJobQueueOrder(t *testing.T) {
+	queue := NewMemoryJobQueue()
+	jm := queue.(*jobMemory)
+	for i := 1; i <= 3; i++ {
+		if err := queue.Enqueue("test", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The last job is due first, and the first one isn't due yet
+	jm.jobs[0].RunAt = time.Now().Add(time.Hour)
+	jm.jobs[2].RunAt = time.Now().Add(-time.Hour)
+
+	var got []uint
+	for {
+		job, err := queue.Dequeue()
+		if err == ErrNoJobs {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, job.ID)
+		if err := queue.Complete(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[0] != 3 || got[1] != 2 {
+		t.Errorf("ran jobs %v; want [3 2]", got)
+	}
+	if len(jm.jobs) != 1 || jm.jobs[0].ID != 1 {
+		t.Errorf("completed jobs weren't removed, %d left", len(jm.jobs))
+	}
+}
+
+func TestMemoryJobQueueStaleLock(t *testing.T) {
+	queue := NewMemoryJobQueue()
+	jm := queue.(*jobMemory)
+	if err := queue.Enqueue("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Dequeue(); err != nil {
+		t.Fatal(err)
+	}
+	// The worker running it died
+	locked := time.Now().Add(-jobLockTimeout - time.Minute)
+	jm.jobs[0].LockedAt = &locked
+
+	job, err := queue.Dequeue()
+	if err != nil {
+		t.Fatalf("stale job wasn't handed to another worker, err = %v", err)
+	}
+	if job.Attempts != 2 {
+		t.Errorf("attempts = %d; want 2", job.Attempts)
+	}
+}
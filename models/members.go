@@ -0,0 +1,365 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/hash"
+	"github.com/torresjeff/gallery/rand"
+)
+
+const (
+	// ErrRoleInvalid is returned when a collaborator is given a role we don't know.
+	ErrRoleInvalid modelError = "models: role is not valid"
+	// ErrMemberExists is returned when someone is invited to a gallery they were already invited to.
+	ErrMemberExists modelError = "models: that email address was already invited to this gallery"
+	// ErrMemberIsOwner is returned when the owner of a gallery invites themselves.
+	ErrMemberIsOwner modelError = "models: you own this gallery already"
+	// ErrInvitationAccepted is returned when an invitation is accepted a second time.
+	ErrInvitationAccepted modelError = "models: this invitation was already accepted"
+	// ErrInvitationEmailMismatch is returned when an invitation is accepted
+	// by a user with a different email address than the one it was sent to.
+	ErrInvitationEmailMismatch modelError = "models: this invitation was sent to a different email address"
+
+	// invitationTokenBytes is the amount of randomness in invitation tokens.
+	invitationTokenBytes = 24
+)
+
+// Role is what a collaborator can do in a gallery.
+type Role string
+
+const (
+	// RoleViewer can see the gallery, even when it's private, and download it.
+	RoleViewer Role = "viewer"
+	// RoleContributor can also upload images, and edit or delete the ones they uploaded.
+	RoleContributor Role = "contributor"
+	// RoleEditor can also edit the gallery and every image in it.
+	RoleEditor Role = "editor"
+	// RoleOwner is the role of the user who created the gallery. It can't
+	// be given to collaborators.
+	RoleOwner Role = "owner"
+)
+
+// Roles lists every role collaborators can have, in the order they should be offered to users.
+var Roles = []Role{RoleViewer, RoleContributor, RoleEditor}
+
+// Valid reports whether r is a role collaborators can have.
+func (r Role) Valid() bool {
+	for _, role := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// CanView reports whether r can see the gallery whatever its visibility.
+// The empty role, of visitors who don't collaborate on the gallery, can't.
+func (r Role) CanView() bool {
+	return r == RoleOwner || r.Valid()
+}
+
+// CanUpload reports whether r can add images to the gallery.
+func (r Role) CanUpload() bool {
+	return r == RoleOwner || r == RoleEditor || r == RoleContributor
+}
+
+// CanEdit reports whether r can change the gallery and any image in it.
+func (r Role) CanEdit() bool {
+	return r == RoleOwner || r == RoleEditor
+}
+
+// CanManage reports whether r can delete the gallery, and decide who else
+// sees it through share links and collaborators.
+func (r Role) CanManage() bool {
+	return r == RoleOwner
+}
+
+// GalleryMember is someone invited to collaborate on a gallery, eg: a
+// second shooter uploading their photos into the lead's gallery. Members
+// are invited by email, and join once they accept with an account using
+// that email address.
+type GalleryMember struct {
+	gorm.Model
+	GalleryID uint `gorm:"not null;index"`
+	// UserID is the user who accepted the invitation, 0 until then.
+	UserID uint   `gorm:"not null;default:0;index"`
+	Email  string `gorm:"not null"`
+	Role   Role   `gorm:"not null"`
+	// Token is sent in the invitation, to accept it with. Only its HMAC is
+	// saved, so Token is only set right after the invitation is created,
+	// and when it is looked up by its token.
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	AcceptedAt *time.Time
+	// Name is the name of the user who accepted the invitation.
+	Name string `gorm:"-"`
+}
+
+// Accepted reports whether the invitation of m was accepted.
+func (m *GalleryMember) Accepted() bool {
+	return m.UserID != 0
+}
+
+type GalleryMemberDB interface {
+	ByID(id uint) (*GalleryMember, error)
+	ByToken(token string) (*GalleryMember, error)
+	// ByGalleryID returns everyone invited to a gallery, in the order they were invited.
+	ByGalleryID(galleryID uint) ([]GalleryMember, error)
+	// ByGalleryAndUser looks up the membership of a user who accepted an
+	// invitation to a gallery.
+	ByGalleryAndUser(galleryID, userID uint) (*GalleryMember, error)
+	// Create saves an invitation, generating its token.
+	Create(m *GalleryMember) error
+	Update(m *GalleryMember) error
+	Delete(id uint) error
+}
+
+type GalleryMemberService interface {
+	GalleryMemberDB
+	// Accept makes user a member of the gallery m invites them to.
+	Accept(m *GalleryMember, user *User) error
+	// RoleOf returns what user can do in gallery. It is empty for users
+	// who don't collaborate on it, and nil users who aren't signed in.
+	RoleOf(gallery *Gallery, user *User) (Role, error)
+}
+
+type galleryMemberService struct {
+	GalleryMemberDB
+}
+
+type galleryMemberValidator struct {
+	GalleryMemberDB
+	galleries  GalleryDB
+	users      UserDB
+	hmac       hash.HMAC
+	emailRegex *regexp.Regexp
+}
+
+type galleryMemberGorm struct {
+	db *gorm.DB
+}
+
+type galleryMemberValidatorFunction func(*GalleryMember) error
+
+var _ GalleryMemberDB = &galleryMemberGorm{}
+
+func NewGalleryMemberService(db *gorm.DB, galleries GalleryDB, users UserDB, hmacKey string) GalleryMemberService {
+	return &galleryMemberService{
+		GalleryMemberDB: &galleryMemberValidator{
+			GalleryMemberDB: &galleryMemberGorm{
+				db: db,
+			},
+			galleries:  galleries,
+			users:      users,
+			hmac:       hash.NewHMAC(hmacKey),
+			emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		},
+	}
+}
+
+func (ms *galleryMemberService) Accept(m *GalleryMember, user *User) error {
+	if m.Accepted() {
+		return ErrInvitationAccepted
+	}
+	if !strings.EqualFold(strings.TrimSpace(user.Email), m.Email) {
+		return ErrInvitationEmailMismatch
+	}
+	now := time.Now()
+	m.UserID = user.ID
+	m.AcceptedAt = &now
+	m.Name = user.Name
+	return ms.Update(m)
+}
+
+func (ms *galleryMemberService) RoleOf(gallery *Gallery, user *User) (Role, error) {
+	if user == nil {
+		return "", nil
+	}
+	if user.ID == gallery.UserID {
+		return RoleOwner, nil
+	}
+	member, err := ms.ByGalleryAndUser(gallery.ID, user.ID)
+	switch err {
+	case nil:
+		return member.Role, nil
+	case ErrNotFound:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// selectMembers loads members along with the name of the user who accepted
+// their invitation, into GalleryMember.Name.
+func (mg *galleryMemberGorm) selectMembers() *gorm.DB {
+	return mg.db.Select("gallery_members.*, (SELECT name FROM users WHERE users.id = gallery_members.user_id) AS name")
+}
+
+func (mg *galleryMemberGorm) ByID(id uint) (*GalleryMember, error) {
+	var member GalleryMember
+	if err := first(mg.selectMembers().Where("id = ?", id), &member); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (mg *galleryMemberGorm) ByToken(tokenHash string) (*GalleryMember, error) {
+	var member GalleryMember
+	if err := first(mg.selectMembers().Where("token_hash = ?", tokenHash), &member); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (mg *galleryMemberGorm) ByGalleryID(galleryID uint) ([]GalleryMember, error) {
+	var members []GalleryMember
+	if err := mg.selectMembers().Where("gallery_id = ?", galleryID).Order("id").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (mg *galleryMemberGorm) ByGalleryAndUser(galleryID, userID uint) (*GalleryMember, error) {
+	var member GalleryMember
+	if err := first(mg.selectMembers().Where("gallery_id = ? AND user_id = ?", galleryID, userID), &member); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (mg *galleryMemberGorm) Create(m *GalleryMember) error {
+	return mg.db.Create(m).Error
+}
+
+func (mg *galleryMemberGorm) Update(m *GalleryMember) error {
+	return mg.db.Save(m).Error
+}
+
+func (mg *galleryMemberGorm) Delete(id uint) error {
+	member := GalleryMember{Model: gorm.Model{ID: id}}
+	return mg.db.Delete(&member).Error
+}
+
+func runGalleryMemberValidatorFunctions(m *GalleryMember, validators ...galleryMemberValidatorFunction) error {
+	for _, fn := range validators {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mv *galleryMemberValidator) ByToken(token string) (*GalleryMember, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	member, err := mv.GalleryMemberDB.ByToken(mv.hmac.Hash(token))
+	if err != nil {
+		return nil, err
+	}
+	member.Token = token
+	return member, nil
+}
+
+func (mv *galleryMemberValidator) Create(m *GalleryMember) error {
+	err := runGalleryMemberValidatorFunctions(m,
+		mv.galleryIDRequired,
+		mv.normalizeEmail,
+		mv.emailValid,
+		mv.roleValid,
+		mv.notOwner,
+		mv.notInvited,
+		mv.generateToken)
+	if err != nil {
+		return err
+	}
+	return mv.GalleryMemberDB.Create(m)
+}
+
+func (mv *galleryMemberValidator) Update(m *GalleryMember) error {
+	err := runGalleryMemberValidatorFunctions(m,
+		mv.galleryIDRequired,
+		mv.roleValid)
+	if err != nil {
+		return err
+	}
+	return mv.GalleryMemberDB.Update(m)
+}
+
+func (mv *galleryMemberValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return mv.GalleryMemberDB.Delete(id)
+}
+
+func (mv *galleryMemberValidator) galleryIDRequired(m *GalleryMember) error {
+	if m.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (mv *galleryMemberValidator) normalizeEmail(m *GalleryMember) error {
+	m.Email = strings.ToLower(strings.TrimSpace(m.Email))
+	return nil
+}
+
+func (mv *galleryMemberValidator) emailValid(m *GalleryMember) error {
+	if m.Email == "" {
+		return ErrEmailRequired
+	}
+	if !mv.emailRegex.MatchString(m.Email) {
+		return ErrEmailNotValid
+	}
+	return nil
+}
+
+func (mv *galleryMemberValidator) roleValid(m *GalleryMember) error {
+	if !m.Role.Valid() {
+		return ErrRoleInvalid
+	}
+	return nil
+}
+
+// notOwner makes sure the owner of a gallery doesn't invite themselves.
+func (mv *galleryMemberValidator) notOwner(m *GalleryMember) error {
+	gallery, err := mv.galleries.ById(m.GalleryID)
+	if err != nil {
+		return err
+	}
+	owner, err := mv.users.ById(gallery.UserID)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(owner.Email, m.Email) {
+		return ErrMemberIsOwner
+	}
+	return nil
+}
+
+func (mv *galleryMemberValidator) notInvited(m *GalleryMember) error {
+	members, err := mv.ByGalleryID(m.GalleryID)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.Email == m.Email {
+			return ErrMemberExists
+		}
+	}
+	return nil
+}
+
+func (mv *galleryMemberValidator) generateToken(m *GalleryMember) error {
+	token, err := rand.String(invitationTokenBytes)
+	if err != nil {
+		return err
+	}
+	m.Token = token
+	m.TokenHash = mv.hmac.Hash(token)
+	return nil
+}
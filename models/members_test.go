@@ -0,0 +1,25 @@
+package models
+
+import "testing"
+
+func TestRolePermissions(t *testing.T) {
+	tests := []struct {
+		role                           Role
+		valid, view, upload, edit, own bool
+	}{
+		{"", false, false, false, false, false},
+		{"admin", false, false, false, false, false},
+		{RoleViewer, true, true, false, false, false},
+		{RoleContributor, true, true, true, false, false},
+		{RoleEditor, true, true, true, true, false},
+		// Owners aren't a role collaborators can be given
+		{RoleOwner, false, true, true, true, true},
+	}
+	for _, tt := range tests {
+		got := [5]bool{tt.role.Valid(), tt.role.CanView(), tt.role.CanUpload(), tt.role.CanEdit(), tt.role.CanManage()}
+		want := [5]bool{tt.valid, tt.view, tt.upload, tt.edit, tt.own}
+		if got != want {
+			t.Errorf("role %q: Valid, CanView, CanUpload, CanEdit, CanManage = %v; want %v", tt.role, got, want)
+		}
+	}
+}
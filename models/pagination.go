@@ -0,0 +1,127 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrCursorInvalid is returned when a page is asked for after a cursor we didn't hand out.
+	ErrCursorInvalid modelError = "models: page cursor is not valid"
+
+	// DefaultPageSize is the size of pages that don't ask for one.
+	DefaultPageSize = 24
+	// MaxPageSize is the most results a page can have.
+	MaxPageSize = 100
+)
+
+// Page selects part of a sorted listing. Pages are either numbered, or
+// the results after a cursor. Cursors keep working when results are added
+// or removed in earlier pages, numbers are easier to jump around with.
+type Page struct {
+	// Size is the most results in the page, DefaultPageSize if it's 0.
+	Size int
+	// Number is the number of the page, starting at 1. It is ignored, and
+	// set to 0, when After is set.
+	Number int
+	// After is the Pagination.Next cursor of the previous page.
+	After string
+}
+
+// normalize keeps the page within the sizes we allow.
+func (p *Page) normalize() {
+	if p.Size <= 0 {
+		p.Size = DefaultPageSize
+	}
+	if p.Size > MaxPageSize {
+		p.Size = MaxPageSize
+	}
+	switch {
+	case p.After != "":
+		p.Number = 0
+	case p.Number < 1:
+		p.Number = 1
+	}
+}
+
+// Pagination describes a page of a listing, and how to get the next one.
+type Pagination struct {
+	Page
+	// Total is the number of results in the whole listing.
+	Total int
+	// Next is the cursor of the page after this one. It is empty on the last page.
+	Next string
+}
+
+// Pages is the number of pages in the listing.
+func (p *Pagination) Pages() int {
+	if p.Total == 0 {
+		return 1
+	}
+	return (p.Total + p.Size - 1) / p.Size
+}
+
+// keyset sorts a listing by an SQL expression, then by ID, and pages
+// through it. The expression must never be NULL.
+type keyset struct {
+	expr string
+	desc bool
+}
+
+// cursor is what a Pagination.Next cursor is made of: the sort value and
+// the ID of the last result of a page.
+type cursor struct {
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func encodeCursor(value string, id uint) string {
+	b, _ := json.Marshal(cursor{Value: value, ID: id})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrCursorInvalid
+	}
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID == 0 {
+		return nil, ErrCursorInvalid
+	}
+	return &c, nil
+}
+
+// apply sorts db and selects page from it. One more result than the page
+// holds is asked for, so we know whether there is a next page.
+func (k keyset) apply(db *gorm.DB, page Page) (*gorm.DB, error) {
+	dir, cmp := "ASC", ">"
+	if k.desc {
+		dir, cmp = "DESC", "<"
+	}
+	db = db.Order(fmt.Sprintf("%s %s, id %s", k.expr, dir, dir))
+	if page.After != "" {
+		c, err := decodeCursor(page.After)
+		if err != nil {
+			return nil, err
+		}
+		db = db.Where(fmt.Sprintf("(%s, id) %s (?, ?)", k.expr, cmp), c.Value, c.ID)
+	} else {
+		db = db.Offset((page.Number - 1) * page.Size)
+	}
+	return db.Limit(page.Size + 1), nil
+}
+
+// adjacent sorts db and selects the result right before, or right after,
+// the one with the given sort value and ID.
+func (k keyset) adjacent(db *gorm.DB, value string, id uint, before bool) *gorm.DB {
+	dir, cmp := "ASC", ">"
+	if k.desc != before {
+		dir, cmp = "DESC", "<"
+	}
+	db = db.Order(fmt.Sprintf("%s %s, id %s", k.expr, dir, dir))
+	return db.Where(fmt.Sprintf("(%s, id) %s (?, ?)", k.expr, cmp), value, id).Limit(1)
+}
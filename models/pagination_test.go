@@ -0,0 +1,83 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestPageNormalize(t *testing.T) {
+	tests := []struct {
+		in, want Page
+	}{
+		{Page{}, Page{Size: DefaultPageSize, Number: 1}},
+		{Page{Size: -5, Number: -1}, Page{Size: DefaultPageSize, Number: 1}},
+		{Page{Size: 1000, Number: 3}, Page{Size: MaxPageSize, Number: 3}},
+		{Page{Size: 10, Number: 3, After: "c"}, Page{Size: 10, After: "c"}},
+	}
+	for _, tt := range tests {
+		got := tt.in
+		got.normalize()
+		if got != tt.want {
+			t.Errorf("%+v.normalize() = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPaginationPages(t *testing.T) {
+	tests := []struct {
+		total, size, pages int
+	}{
+		{0, 10, 1},
+		{1, 10, 1},
+		{10, 10, 1},
+		{11, 10, 2},
+	}
+	for _, tt := range tests {
+		p := Pagination{Page: Page{Size: tt.size}, Total: tt.total}
+		if got := p.Pages(); got != tt.pages {
+			t.Errorf("Pages() of %d results, %d a page = %d; want %d", tt.total, tt.size, got, tt.pages)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	for _, value := range []string{"", "2019-06-01T10:00:00Z", "Ünïcode, \"quoted\" & /slashed/"} {
+		c, err := decodeCursor(encodeCursor(value, 42))
+		if err != nil || c.Value != value || c.ID != 42 {
+			t.Errorf("cursor of %q, 42 decodes to %+v, %v", value, c, err)
+		}
+	}
+	for _, s := range []string{"", "not base64!", encodeCursor("x", 0), "bm90IGpzb24"} {
+		if _, err := decodeCursor(s); err != ErrCursorInvalid {
+			t.Errorf("decodeCursor(%q) = %v; want %v", s, err, ErrCursorInvalid)
+		}
+	}
+}
+
+func TestImageOrderCursorValue(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	captured := time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	image := Image{Model: gorm.Model{CreatedAt: created}, Filename: "a.jpg", Position: 7}
+	withCapture := image
+	withCapture.CapturedAt = &captured
+
+	tests := []struct {
+		order ImageOrder
+		image Image
+		want  string
+	}{
+		{ImageOrderManual, image, "7"},
+		{ImageOrderUploaded, image, "2020-01-02T03:04:05.000000006Z"},
+		{ImageOrderCaptured, withCapture, "2019-06-01T10:00:00Z"},
+		// Like the keyset, it falls back to the upload time
+		{ImageOrderCaptured, image, "2020-01-02T03:04:05.000000006Z"},
+		{ImageOrderFilename, image, "a.jpg"},
+	}
+	for _, tt := range tests {
+		if got := tt.order.cursorValue(&tt.image); got != tt.want {
+			t.Errorf("%s: cursorValue() = %q; want %q", tt.order, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+)
+
+// searchLimit is the most galleries, and the most images, a search returns.
+const searchLimit = 50
+
+// The text galleries and images are searched by, as Postgres text search
+// documents. The "simple" configuration matches words as they are
+// written, without guessing at their language.
+const (
+	gallerySearchDocument = `to_tsvector('simple', galleries.title || ' ' || galleries.description || ' ' || galleries.location || ' ' || array_to_string(galleries.tags, ' '))`
+	imageSearchDocument   = `to_tsvector('simple', images.title || ' ' || images.caption || ' ' || images.alt_text || ' ' || array_to_string(images.tags, ' '))`
+)
+
+// SearchQuery is what a user is looking for among their galleries and images.
+// Every field other than UserID is optional.
+type SearchQuery struct {
+	UserID uint
+	// Text must match every word in it, in any order.
+	Text string
+	Tag  string
+	// From and To limit results to the galleries whose event date, and the
+	// images whose capture date, is between them, both included. Galleries
+	// without an event date use the day they were created instead.
+	From *time.Time
+	To   *time.Time
+	// Visibility limits results to galleries with that visibility, and the
+	// images in them.
+	Visibility Visibility
+}
+
+// SearchResults are the galleries and images matching a search, best matches first.
+type SearchResults struct {
+	Galleries []Gallery
+	Images    []Image
+}
+
+type SearchService interface {
+	Search(q SearchQuery) (*SearchResults, error)
+}
+
+// searchGorm searches with Postgres full text search.
+type searchGorm struct {
+	db *gorm.DB
+}
+
+var _ SearchService = &searchGorm{}
+
+func NewSearchService(db *gorm.DB) SearchService {
+	return &searchGorm{
+		db: db,
+	}
+}
+
+func (sg *searchGorm) Search(q SearchQuery) (*SearchResults, error) {
+	q.Tag = strings.ToLower(strings.TrimSpace(q.Tag))
+	var results SearchResults
+	if err := sg.galleries(q).Limit(searchLimit).Find(&results.Galleries).Error; err != nil {
+		return nil, err
+	}
+	err := sg.images(q).Preload("Variants").Limit(searchLimit).Find(&results.Images).Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+func (sg *searchGorm) galleries(q SearchQuery) *gorm.DB {
+	db := sg.db.Where("galleries.user_id = ?", q.UserID)
+	if strings.TrimSpace(q.Text) != "" {
+		db = db.Where(gallerySearchDocument+" @@ plainto_tsquery('simple', ?)", q.Text).
+			Order(gorm.Expr("ts_rank("+gallerySearchDocument+", plainto_tsquery('simple', ?)) DESC", q.Text))
+	}
+	if q.Tag != "" {
+		db = db.Where("? = ANY(galleries.tags)", q.Tag)
+	}
+	const date = "COALESCE(galleries.event_date, galleries.created_at::date)"
+	if q.From != nil {
+		db = db.Where(date+" >= ?", q.From.Format(dateLayout))
+	}
+	if q.To != nil {
+		db = db.Where(date+" <= ?", q.To.Format(dateLayout))
+	}
+	if q.Visibility != "" {
+		db = db.Where("galleries.visibility = ?", q.Visibility)
+	}
+	return db.Order(date + " DESC").Order("galleries.id DESC")
+}
+
+func (sg *searchGorm) images(q SearchQuery) *gorm.DB {
+	db := sg.db.Select("images.*, galleries.metadata AS gallery_metadata").
+		Joins("JOIN galleries ON galleries.id = images.gallery_id AND galleries.deleted_at IS NULL").
+		Where("galleries.user_id = ?", q.UserID)
+	if strings.TrimSpace(q.Text) != "" {
+		db = db.Where(imageSearchDocument+" @@ plainto_tsquery('simple', ?)", q.Text).
+			Order(gorm.Expr("ts_rank("+imageSearchDocument+", plainto_tsquery('simple', ?)) DESC", q.Text))
+	}
+	if q.Tag != "" {
+		db = db.Where("? = ANY(images.tags)", q.Tag)
+	}
+	const date = "COALESCE(images.captured_at::date, galleries.event_date, images.created_at::date)"
+	if q.From != nil {
+		db = db.Where(date+" >= ?", q.From.Format(dateLayout))
+	}
+	if q.To != nil {
+		db = db.Where(date+" <= ?", q.To.Format(dateLayout))
+	}
+	if q.Visibility != "" {
+		db = db.Where("galleries.visibility = ?", q.Visibility)
+	}
+	return db.Order(date + " DESC").Order("images.id DESC")
+}
+
+// MemorySearch is a SearchService that keeps everything in memory, for
+// tests and development without Postgres. It only knows about the
+// galleries and images put into it, and matches words a bit more loosely
+// than Postgres does.
+type MemorySearch struct {
+	mu        sync.Mutex
+	galleries map[uint]Gallery
+	images    map[uint]Image
+}
+
+var _ SearchService = &MemorySearch{}
+
+func NewMemorySearch() *MemorySearch {
+	return &MemorySearch{
+		galleries: make(map[uint]Gallery),
+		images:    make(map[uint]Image),
+	}
+}
+
+// PutGallery adds a gallery to the search, or updates it.
+func (ms *MemorySearch) PutGallery(gallery Gallery) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.galleries[gallery.ID] = gallery
+}
+
+// PutImage adds an image to the search, or updates it. It only shows up in
+// results once its gallery is in the search too.
+func (ms *MemorySearch) PutImage(image Image) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.images[image.ID] = image
+}
+
+// Delete removes a gallery and all of its images from the search.
+func (ms *MemorySearch) Delete(galleryID uint) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.galleries, galleryID)
+	for id, image := range ms.images {
+		if image.GalleryID == galleryID {
+			delete(ms.images, id)
+		}
+	}
+}
+
+// DeleteImage removes an image from the search.
+func (ms *MemorySearch) DeleteImage(id uint) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.images, id)
+}
+
+func (ms *MemorySearch) Search(q SearchQuery) (*SearchResults, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	words := searchWords(q.Text)
+	tag := strings.ToLower(strings.TrimSpace(q.Tag))
+
+	var galleries []searchMatch
+	for _, gallery := range ms.galleries {
+		date := gallery.CreatedAt
+		if gallery.EventDate != nil {
+			date = *gallery.EventDate
+		}
+		if gallery.UserID != q.UserID || !matchesWords(words, gallery.Title, gallery.Description, gallery.Location, strings.Join(gallery.Tags, " ")) ||
+			(tag != "" && !hasTag(gallery.Tags, tag)) || !q.inDateRange(date) || (q.Visibility != "" && gallery.Visibility != q.Visibility) {
+			continue
+		}
+		galleries = append(galleries, searchMatch{id: gallery.ID, day: date.Format(dateLayout)})
+	}
+	var images []searchMatch
+	for _, image := range ms.images {
+		gallery, ok := ms.galleries[image.GalleryID]
+		if !ok {
+			continue
+		}
+		date := image.CreatedAt
+		switch {
+		case image.CapturedAt != nil:
+			date = *image.CapturedAt
+		case gallery.EventDate != nil:
+			date = *gallery.EventDate
+		}
+		if gallery.UserID != q.UserID || !matchesWords(words, image.Title, image.Caption, image.AltText, strings.Join(image.Tags, " ")) ||
+			(tag != "" && !hasTag(image.Tags, tag)) || !q.inDateRange(date) || (q.Visibility != "" && gallery.Visibility != q.Visibility) {
+			continue
+		}
+		images = append(images, searchMatch{id: image.ID, day: date.Format(dateLayout)})
+	}
+
+	var results SearchResults
+	for _, match := range newestFirst(galleries) {
+		results.Galleries = append(results.Galleries, ms.galleries[match.id])
+	}
+	for _, match := range newestFirst(images) {
+		image := ms.images[match.id]
+		image.GalleryMetadata = ms.galleries[image.GalleryID].Metadata
+		results.Images = append(results.Images, image)
+	}
+	return &results, nil
+}
+
+// inDateRange reports whether the day of t is within the dates of q.
+func (q *SearchQuery) inDateRange(t time.Time) bool {
+	day := t.Format(dateLayout)
+	if q.From != nil && day < q.From.Format(dateLayout) {
+		return false
+	}
+	if q.To != nil && day > q.To.Format(dateLayout) {
+		return false
+	}
+	return true
+}
+
+// searchMatch is a gallery or image found by a MemorySearch, and the day it
+// is sorted by.
+type searchMatch struct {
+	id  uint
+	day string
+}
+
+// newestFirst sorts matches by day, newest first, and keeps the first
+// searchLimit of them. Every match has every word searched for, so there
+// isn't much else to rank them by.
+func newestFirst(matches []searchMatch) []searchMatch {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].day != matches[j].day {
+			return matches[i].day > matches[j].day
+		}
+		return matches[i].id > matches[j].id
+	})
+	if len(matches) > searchLimit {
+		matches = matches[:searchLimit]
+	}
+	return matches
+}
+
+// searchWords splits text into lowercase words, the way Postgres' simple
+// text search configuration does.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// matchesWords reports whether fields contain every one of words.
+func matchesWords(words []string, fields ...string) bool {
+	if len(words) == 0 {
+		return true
+	}
+	found := make(map[string]bool)
+	for _, field := range fields {
+		for _, word := range searchWords(field) {
+			found[word] = true
+		}
+	}
+	for _, word := range words {
+		if !found[word] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Tags
+	}{
+		{"", Tags{}},
+		{"Wedding, #family", Tags{"wedding", "family"}},
+		{" ##Summer   Holiday ,summer holiday, ,#", Tags{"summer holiday"}},
+	}
+	for _, tt := range tests {
+		if got := ParseTags(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTags(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMemorySearch(t *testing.T) {
+	day := func(s string) *time.Time {
+		d, err := time.Parse(dateLayout, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &d
+	}
+	search := NewMemorySearch()
+	search.PutGallery(Gallery{Model: gorm.Model{ID: 1}, UserID: 1, Title: "Summer Wedding", Tags: Tags{"wedding"},
+		Visibility: VisibilityPublic, EventDate: day("2019-06-01")})
+	search.PutGallery(Gallery{Model: gorm.Model{ID: 2}, UserID: 1, Title: "Family holiday", Location: "Lisbon",
+		Visibility: VisibilityPrivate, EventDate: day("2020-08-15")})
+	search.PutGallery(Gallery{Model: gorm.Model{ID: 3}, UserID: 2, Title: "Someone else's wedding", Tags: Tags{"wedding"},
+		Visibility: VisibilityPublic, EventDate: day("2021-01-01")})
+	search.PutImage(Image{Model: gorm.Model{ID: 10}, GalleryID: 1, Caption: "First dance", Tags: Tags{"dance"}})
+	search.PutImage(Image{Model: gorm.Model{ID: 11}, GalleryID: 2, Title: "Tram", Tags: Tags{"wedding"}, CapturedAt: day("2020-08-16")})
+	// Its gallery isn't in the search
+	search.PutImage(Image{Model: gorm.Model{ID: 12}, GalleryID: 4, Title: "Wedding"})
+
+	tests := []struct {
+		name      string
+		q         SearchQuery
+		galleries []uint
+		images    []uint
+	}{
+		{"everything, newest first", SearchQuery{UserID: 1}, []uint{2, 1}, []uint{11, 10}},
+		{"other user", SearchQuery{UserID: 2, Text: "wedding"}, []uint{3}, nil},
+		{"words in any order and case", SearchQuery{UserID: 1, Text: "WEDDING summer"}, []uint{1}, nil},
+		{"every word must match", SearchQuery{UserID: 1, Text: "summer lisbon"}, nil, nil},
+		{"location", SearchQuery{UserID: 1, Text: "lisbon"}, []uint{2}, nil},
+		{"image caption", SearchQuery{UserID: 1, Text: "dance"}, nil, []uint{10}},
+		{"tag", SearchQuery{UserID: 1, Tag: " Wedding "}, []uint{1}, []uint{11}},
+		{"date range", SearchQuery{UserID: 1, From: day("2020-08-16"), To: day("2020-12-31")}, nil, []uint{11}},
+		{"date range includes both ends", SearchQuery{UserID: 1, From: day("2019-06-01"), To: day("2020-08-15")}, []uint{2, 1}, []uint{10}},
+		{"visibility", SearchQuery{UserID: 1, Visibility: VisibilityPrivate}, []uint{2}, []uint{11}},
+	}
+	for _, tt := range tests {
+		results, err := search.Search(tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var galleries, images []uint
+		for _, g := range results.Galleries {
+			galleries = append(galleries, g.ID)
+		}
+		for _, i := range results.Images {
+			images = append(images, i.ID)
+		}
+		if !reflect.DeepEqual(galleries, tt.galleries) || !reflect.DeepEqual(images, tt.images) {
+			t.Errorf("%s: found galleries %v and images %v; want %v and %v", tt.name, galleries, images, tt.galleries, tt.images)
+		}
+	}
+
+	search.Delete(2)
+	results, err := search.Search(SearchQuery{UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Galleries) != 1 || len(results.Images) != 1 {
+		t.Errorf("deleted gallery is still found: %d galleries, %d images", len(results.Galleries), len(results.Images))
+	}
+}
@@ -0,0 +1,406 @@
+package models
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/rand"
+)
+
+const (
+	// ErrProofingDisabled is returned when images are picked in a gallery that doesn't take selections.
+	ErrProofingDisabled modelError = "models: this gallery isn't taking selections"
+	// ErrSelectionSubmitted is returned when a selection is changed after it was submitted.
+	ErrSelectionSubmitted modelError = "models: this selection was already submitted"
+	// ErrSelectionEmpty is returned when a selection is submitted without any picks.
+	ErrSelectionEmpty modelError = "models: pick at least one image before submitting your selection"
+	// ErrSelectionTooLarge is returned when more images are picked than the gallery allows.
+	ErrSelectionTooLarge modelError = "models: you picked more images than this gallery allows"
+	// ErrNoteTooLong is returned when the note on a pick is longer than maxNoteLength.
+	ErrNoteTooLong modelError = "models: notes can be at most 500 characters long"
+	// ErrClientNameTooLong is returned when a selection is submitted with a name longer than maxClientNameLength.
+	ErrClientNameTooLong modelError = "models: name is too long"
+	// ErrMaxPicksInvalid is returned when a gallery is saved with a negative maximum number of picks.
+	ErrMaxPicksInvalid modelError = "models: the maximum number of picks can't be negative"
+
+	// selectionTokenBytes is the amount of randomness in selection tokens.
+	selectionTokenBytes = 24
+	maxNoteLength       = 500
+	maxClientNameLength = 200
+)
+
+// Selection is the images a client picked in a gallery that takes
+// selections. Clients don't need an account, so a selection is tied to
+// the browser it's made in by its token, until it's submitted to the owner.
+type Selection struct {
+	gorm.Model
+	GalleryID uint `gorm:"not null;index"`
+	// Token is kept in a cookie by the browser making the selection.
+	Token string `gorm:"not null;unique_index"`
+	// Name and Email are who made the selection, if they said so.
+	Name        string `gorm:"not null;default:''"`
+	Email       string `gorm:"not null;default:''"`
+	SubmittedAt *time.Time
+	Picks       []SelectionPick `gorm:"-"`
+}
+
+// Submitted reports whether s was sent to the owner of the gallery, after
+// which it can't be changed.
+func (s *Selection) Submitted() bool {
+	return s.SubmittedAt != nil
+}
+
+// Pick returns the pick of the image imageID, or nil if it wasn't picked.
+func (s *Selection) Pick(imageID uint) *SelectionPick {
+	for i := range s.Picks {
+		if s.Picks[i].ImageID == imageID {
+			return &s.Picks[i]
+		}
+	}
+	return nil
+}
+
+// Client is how the owner of the gallery refers to whoever made s.
+func (s *Selection) Client() string {
+	switch {
+	case s.Name != "" && s.Email != "":
+		return s.Name + " <" + s.Email + ">"
+	case s.Name != "":
+		return s.Name
+	case s.Email != "":
+		return s.Email
+	}
+	return "Anonymous client"
+}
+
+// LightroomFilter is the file names of the picked images without their
+// extensions, separated by commas, to paste into the text filter of
+// Lightroom's library and find the originals.
+func (s *Selection) LightroomFilter() string {
+	names := make([]string, len(s.Picks))
+	for i, pick := range s.Picks {
+		names[i] = strings.TrimSuffix(pick.Filename, path.Ext(pick.Filename))
+	}
+	return strings.Join(names, ", ")
+}
+
+// SelectionPick is an image a client hearted, along with their note on it.
+type SelectionPick struct {
+	ID          uint   `gorm:"primary_key"`
+	SelectionID uint   `gorm:"not null;unique_index:idx_selection_picks_image"`
+	ImageID     uint   `gorm:"not null;unique_index:idx_selection_picks_image;index"`
+	Note        string `gorm:"not null;default:''"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	// Filename and Title are those of the picked image.
+	Filename string `gorm:"-"`
+	Title    string `gorm:"-"`
+}
+
+type SelectionDB interface {
+	ByID(id uint) (*Selection, error)
+	// ByToken looks up the selection a browser is making in a gallery.
+	ByToken(galleryID uint, token string) (*Selection, error)
+	// Submitted returns the submitted selections of a gallery, oldest first.
+	Submitted(galleryID uint) ([]Selection, error)
+	// Create saves a new selection, generating its token.
+	Create(s *Selection) error
+	Update(s *Selection) error
+	Delete(id uint) error
+	// SavePick adds a pick to a selection, or changes its note if the
+	// image was already picked.
+	SavePick(pick *SelectionPick) error
+	// DeletePick removes the pick of an image from a selection.
+	DeletePick(selectionID, imageID uint) error
+}
+
+type SelectionService interface {
+	SelectionDB
+	// Pick hearts an image of gallery with a note, starting the selection
+	// if it has no picks yet.
+	Pick(gallery *Gallery, s *Selection, imageID uint, note string) error
+	// Unpick takes an image out of a selection.
+	Unpick(s *Selection, imageID uint) error
+	// Submit sends a selection to the owner of gallery, along with the
+	// name and email address of the client, which are both optional.
+	Submit(gallery *Gallery, s *Selection, name, email string) error
+}
+
+type selectionService struct {
+	SelectionDB
+	images ImageService
+}
+
+type selectionValidator struct {
+	SelectionDB
+	emailRegex *regexp.Regexp
+}
+
+type selectionGorm struct {
+	db *gorm.DB
+}
+
+type selectionValidatorFunction func(*Selection) error
+
+var _ SelectionDB = &selectionGorm{}
+
+func NewSelectionService(db *gorm.DB, images ImageService) SelectionService {
+	return &selectionService{
+		SelectionDB: &selectionValidator{
+			SelectionDB: &selectionGorm{
+				db: db,
+			},
+			emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		},
+		images: images,
+	}
+}
+
+func (ss *selectionService) Pick(gallery *Gallery, s *Selection, imageID uint, note string) error {
+	if !gallery.Proofing {
+		return ErrProofingDisabled
+	}
+	if s.Submitted() {
+		return ErrSelectionSubmitted
+	}
+	note = strings.TrimSpace(note)
+	if utf8.RuneCountInString(note) > maxNoteLength {
+		return ErrNoteTooLong
+	}
+	image, err := ss.images.ByID(imageID)
+	if err != nil {
+		return err
+	}
+	if image.GalleryID != gallery.ID {
+		return ErrNotFound
+	}
+	pick := s.Pick(imageID)
+	if pick == nil {
+		if gallery.MaxPicks > 0 && len(s.Picks) >= gallery.MaxPicks {
+			return ErrSelectionTooLarge
+		}
+		pick = &SelectionPick{ImageID: imageID}
+	}
+	if s.ID == 0 {
+		s.GalleryID = gallery.ID
+		if err := ss.Create(s); err != nil {
+			return err
+		}
+	}
+	pick.SelectionID = s.ID
+	pick.Note = note
+	return ss.SavePick(pick)
+}
+
+func (ss *selectionService) Unpick(s *Selection, imageID uint) error {
+	if s.Submitted() {
+		return ErrSelectionSubmitted
+	}
+	if s.ID == 0 {
+		return nil
+	}
+	return ss.DeletePick(s.ID, imageID)
+}
+
+func (ss *selectionService) Submit(gallery *Gallery, s *Selection, name, email string) error {
+	if s.Submitted() {
+		return ErrSelectionSubmitted
+	}
+	if len(s.Picks) == 0 {
+		return ErrSelectionEmpty
+	}
+	if gallery.MaxPicks > 0 && len(s.Picks) > gallery.MaxPicks {
+		return ErrSelectionTooLarge
+	}
+	now := time.Now()
+	s.Name = name
+	s.Email = email
+	s.SubmittedAt = &now
+	if err := ss.Update(s); err != nil {
+		s.SubmittedAt = nil
+		return err
+	}
+	return nil
+}
+
+// selectPicks loads picks along with the file name and title of their image.
+func (sg *selectionGorm) selectPicks() *gorm.DB {
+	return sg.db.Select(`selection_picks.*,
+		(SELECT filename FROM images WHERE images.id = selection_picks.image_id) AS filename,
+		(SELECT title FROM images WHERE images.id = selection_picks.image_id) AS title`)
+}
+
+// loadPicks loads the picks of selections, in the order they were made.
+func (sg *selectionGorm) loadPicks(selections ...*Selection) error {
+	if len(selections) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(selections))
+	for i, s := range selections {
+		ids[i] = s.ID
+	}
+	var picks []SelectionPick
+	if err := sg.selectPicks().Where("selection_id IN (?)", ids).Order("created_at, id").Find(&picks).Error; err != nil {
+		return err
+	}
+	for _, s := range selections {
+		s.Picks = nil
+		for _, pick := range picks {
+			if pick.SelectionID == s.ID {
+				s.Picks = append(s.Picks, pick)
+			}
+		}
+	}
+	return nil
+}
+
+func (sg *selectionGorm) ByID(id uint) (*Selection, error) {
+	var s Selection
+	if err := first(sg.db.Where("id = ?", id), &s); err != nil {
+		return nil, err
+	}
+	if err := sg.loadPicks(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (sg *selectionGorm) ByToken(galleryID uint, token string) (*Selection, error) {
+	var s Selection
+	if err := first(sg.db.Where("gallery_id = ? AND token = ?", galleryID, token), &s); err != nil {
+		return nil, err
+	}
+	if err := sg.loadPicks(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (sg *selectionGorm) Submitted(galleryID uint) ([]Selection, error) {
+	var selections []Selection
+	db := sg.db.Where("gallery_id = ? AND submitted_at IS NOT NULL", galleryID).Order("submitted_at, id")
+	if err := db.Find(&selections).Error; err != nil {
+		return nil, err
+	}
+	ptrs := make([]*Selection, len(selections))
+	for i := range selections {
+		ptrs[i] = &selections[i]
+	}
+	if err := sg.loadPicks(ptrs...); err != nil {
+		return nil, err
+	}
+	return selections, nil
+}
+
+func (sg *selectionGorm) Create(s *Selection) error {
+	return sg.db.Create(s).Error
+}
+
+func (sg *selectionGorm) Update(s *Selection) error {
+	return sg.db.Save(s).Error
+}
+
+func (sg *selectionGorm) Delete(id uint) error {
+	tx := sg.db.Begin()
+	err := tx.Where("selection_id = ?", id).Delete(&SelectionPick{}).Error
+	if err == nil {
+		err = tx.Delete(&Selection{Model: gorm.Model{ID: id}}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (sg *selectionGorm) SavePick(pick *SelectionPick) error {
+	return sg.db.Save(pick).Error
+}
+
+func (sg *selectionGorm) DeletePick(selectionID, imageID uint) error {
+	return sg.db.Where("selection_id = ? AND image_id = ?", selectionID, imageID).Delete(&SelectionPick{}).Error
+}
+
+func runSelectionValidatorFunctions(s *Selection, validators ...selectionValidatorFunction) error {
+	for _, fn := range validators {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sv *selectionValidator) ByToken(galleryID uint, token string) (*Selection, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return sv.SelectionDB.ByToken(galleryID, token)
+}
+
+func (sv *selectionValidator) Create(s *Selection) error {
+	err := runSelectionValidatorFunctions(s,
+		sv.galleryIDRequired,
+		sv.normalizeClient,
+		sv.clientValid,
+		sv.generateToken)
+	if err != nil {
+		return err
+	}
+	return sv.SelectionDB.Create(s)
+}
+
+func (sv *selectionValidator) Update(s *Selection) error {
+	err := runSelectionValidatorFunctions(s,
+		sv.galleryIDRequired,
+		sv.normalizeClient,
+		sv.clientValid)
+	if err != nil {
+		return err
+	}
+	return sv.SelectionDB.Update(s)
+}
+
+func (sv *selectionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SelectionDB.Delete(id)
+}
+
+func (sv *selectionValidator) galleryIDRequired(s *Selection) error {
+	if s.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (sv *selectionValidator) normalizeClient(s *Selection) error {
+	s.Name = strings.TrimSpace(s.Name)
+	s.Email = strings.ToLower(strings.TrimSpace(s.Email))
+	return nil
+}
+
+// clientValid checks the name and email address of the client, which they
+// don't have to give.
+func (sv *selectionValidator) clientValid(s *Selection) error {
+	if utf8.RuneCountInString(s.Name) > maxClientNameLength {
+		return ErrClientNameTooLong
+	}
+	if s.Email != "" && !sv.emailRegex.MatchString(s.Email) {
+		return ErrEmailNotValid
+	}
+	return nil
+}
+
+func (sv *selectionValidator) generateToken(s *Selection) error {
+	token, err := rand.String(selectionTokenBytes)
+	if err != nil {
+		return err
+	}
+	s.Token = token
+	return nil
+}
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestSelectionClient(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		want  string
+	}{
+		{"Ana", "ana@example.com", "Ana <ana@example.com>"},
+		{"Ana", "", "Ana"},
+		{"", "ana@example.com", "ana@example.com"},
+		{"", "", "Anonymous client"},
+	}
+	for _, tt := range tests {
+		s := &Selection{Name: tt.name, Email: tt.email}
+		if got := s.Client(); got != tt.want {
+			t.Errorf("Client() with %q, %q = %q; want %q", tt.name, tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestSelectionLightroomFilter(t *testing.T) {
+	s := &Selection{Picks: []SelectionPick{
+		{Filename: "IMG_0001.jpg"},
+		{Filename: "wedding.final.png"},
+		{Filename: "scan"},
+	}}
+	if got, want := s.LightroomFilter(), "IMG_0001, wedding.final, scan"; got != want {
+		t.Errorf("LightroomFilter() = %q; want %q", got, want)
+	}
+}
+
+type selectionsDB struct {
+	SelectionDB
+	picks   []SelectionPick
+	updated bool
+}
+
+func (sd *selectionsDB) Create(s *Selection) error {
+	s.ID = 1
+	return nil
+}
+
+func (sd *selectionsDB) Update(s *Selection) error {
+	sd.updated = true
+	return nil
+}
+
+func (sd *selectionsDB) SavePick(pick *SelectionPick) error {
+	sd.picks = append(sd.picks, *pick)
+	return nil
+}
+
+type selectionImages struct {
+	ImageService
+}
+
+func (selectionImages) ByID(id uint) (*Image, error) {
+	// Images 1 to 9 are in gallery 1, the rest in gallery 2
+	if id < 10 {
+		return &Image{Model: gorm.Model{ID: id}, GalleryID: 1}, nil
+	}
+	return &Image{Model: gorm.Model{ID: id}, GalleryID: 2}, nil
+}
+
+func newTestSelectionService(db *selectionsDB) *selectionService {
+	return &selectionService{
+		SelectionDB: &selectionValidator{
+			SelectionDB: db,
+			emailRegex:  regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		},
+		images: selectionImages{},
+	}
+}
+
+func TestSelectionPick(t *testing.T) {
+	gallery := &Gallery{Model: gorm.Model{ID: 1}, Proofing: true, MaxPicks: 2}
+	picked := []SelectionPick{{ImageID: 1}, {ImageID: 2}}
+	tests := []struct {
+		name    string
+		gallery *Gallery
+		s       *Selection
+		imageID uint
+		want    error
+	}{
+		{"first pick", gallery, &Selection{}, 1, nil},
+		{"not proofing", &Gallery{Model: gorm.Model{ID: 1}}, &Selection{}, 1, ErrProofingDisabled},
+		{"submitted", gallery, &Selection{SubmittedAt: &gallery.CreatedAt}, 1, ErrSelectionSubmitted},
+		{"other gallery", gallery, &Selection{}, 10, ErrNotFound},
+		{"too many", gallery, &Selection{Model: gorm.Model{ID: 1}, Picks: picked}, 3, ErrSelectionTooLarge},
+		// Changing the note of a pick doesn't add to it
+		{"repick", gallery, &Selection{Model: gorm.Model{ID: 1}, Picks: picked}, 2, nil},
+	}
+	for _, tt := range tests {
+		db := &selectionsDB{}
+		ss := newTestSelectionService(db)
+		err := ss.Pick(tt.gallery, tt.s, tt.imageID, " note ")
+		if err != tt.want {
+			t.Errorf("%s: Pick() = %v; want %v", tt.name, err, tt.want)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if tt.s.ID == 0 {
+			t.Errorf("%s: selection wasn't started", tt.name)
+		}
+		if len(db.picks) != 1 || db.picks[0].ImageID != tt.imageID || db.picks[0].Note != "note" {
+			t.Errorf("%s: saved picks %+v; want image %d with note %q", tt.name, db.picks, tt.imageID, "note")
+		}
+	}
+}
+
+func TestSelectionSubmit(t *testing.T) {
+	gallery := &Gallery{Model: gorm.Model{ID: 1}, Proofing: true, MaxPicks: 1}
+	picks := []SelectionPick{{ImageID: 1}}
+	tests := []struct {
+		name  string
+		s     *Selection
+		email string
+		want  error
+	}{
+		{"submitted", &Selection{GalleryID: 1, Picks: picks}, " Ana@Example.com ", nil},
+		{"anonymous", &Selection{GalleryID: 1, Picks: picks}, "", nil},
+		{"empty", &Selection{GalleryID: 1}, "", ErrSelectionEmpty},
+		// The gallery allows fewer picks than when they were made
+		{"too many", &Selection{GalleryID: 1, Picks: append(picks, SelectionPick{ImageID: 2})}, "", ErrSelectionTooLarge},
+		{"bad email", &Selection{GalleryID: 1, Picks: picks}, "ana", ErrEmailNotValid},
+	}
+	for _, tt := range tests {
+		db := &selectionsDB{}
+		ss := newTestSelectionService(db)
+		err := ss.Submit(gallery, tt.s, "Ana", tt.email)
+		if err != tt.want {
+			t.Errorf("%s: Submit() = %v; want %v", tt.name, err, tt.want)
+			continue
+		}
+		if submitted := err == nil; tt.s.Submitted() != submitted || db.updated != submitted {
+			t.Errorf("%s: Submitted() = %t, updated %t; want %t", tt.name, tt.s.Submitted(), db.updated, submitted)
+		}
+	}
+	s := &Selection{GalleryID: 1, Picks: picks}
+	ss := newTestSelectionService(&selectionsDB{})
+	if err := ss.Submit(gallery, s, "Ana", " Ana@Example.com "); err != nil {
+		t.Fatal(err)
+	}
+	if s.Email != "ana@example.com" {
+		t.Errorf("Email = %q; want it trimmed and lowercased", s.Email)
+	}
+	if err := ss.Submit(gallery, s, "Ana", ""); err != ErrSelectionSubmitted {
+		t.Errorf("Submit() twice = %v; want %v", err, ErrSelectionSubmitted)
+	}
+}
@@ -1,12 +1,26 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/storage"
+)
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	db      *gorm.DB
+	Gallery    GalleryService
+	User       UserService
+	Image      ImageService
+	ShareLink  ShareLinkService
+	Member     GalleryMemberService
+	Selection  SelectionService
+	Comment    CommentService
+	Stats      StatsService
+	Collection CollectionService
+	Upload     UploadService
+	Search     SearchService
+	Trash      TrashService
+	Jobs       JobQueue
+	db         *gorm.DB
+	hmacKey    string
 }
 
 type ServicesConfig func(*Services) error
@@ -43,6 +57,7 @@ func WithLogMode(mode bool) ServicesConfig {
 func WithUser(pepper, hmacKey string) ServicesConfig {
 	return func(s *Services) error {
 		s.User = NewUserService(s.db, pepper, hmacKey)
+		s.hmacKey = hmacKey
 		return nil
 	}
 }
@@ -54,9 +69,93 @@ func WithGallery() ServicesConfig {
 	}
 }
 
-func WithImage() ServicesConfig {
+func WithShareLink() ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.ShareLink = NewShareLinkService(s.db)
+		return nil
+	}
+}
+
+// WithGalleryMember adds gallery collaborators. It must come after WithUser
+// and WithGallery.
+func WithGalleryMember() ServicesConfig {
+	return func(s *Services) error {
+		s.Member = NewGalleryMemberService(s.db, s.Gallery, s.User, s.hmacKey)
+		return nil
+	}
+}
+
+func WithCollection() ServicesConfig {
+	return func(s *Services) error {
+		s.Collection = NewCollectionService(s.db)
+		return nil
+	}
+}
+
+// WithJobQueue stores background jobs in the database. It must come before
+// any config for services that enqueue jobs, like WithImage.
+func WithJobQueue() ServicesConfig {
+	return func(s *Services) error {
+		s.Jobs = NewJobQueue(s.db)
+		return nil
+	}
+}
+
+func WithImage(store storage.Storage, config ImageConfig) ServicesConfig {
+	return func(s *Services) error {
+		s.Image = NewImageService(s.db, s.Jobs, store, config)
+		return nil
+	}
+}
+
+// WithUpload adds resumable uploads, which are turned into images when
+// they finish. It must come after WithImage.
+func WithUpload(config UploadConfig) ServicesConfig {
+	return func(s *Services) error {
+		s.Upload = NewUploadService(s.db, s.Image, config)
+		return nil
+	}
+}
+
+// WithTrash lets users restore what they deleted, and purges it for good
+// after config.Retention. It must come after WithGallery and WithImage.
+func WithTrash(config TrashConfig) ServicesConfig {
+	return func(s *Services) error {
+		s.Trash = NewTrashService(s.Gallery, s.Image, config)
+		return nil
+	}
+}
+
+// WithSelection lets clients pick images in galleries that take
+// selections. It must come after WithImage.
+func WithSelection() ServicesConfig {
+	return func(s *Services) error {
+		s.Selection = NewSelectionService(s.db, s.Image)
+		return nil
+	}
+}
+
+// WithComment lets users and visitors of share links comment on
+// galleries and their images. It must come after WithImage.
+func WithComment() ServicesConfig {
+	return func(s *Services) error {
+		s.Comment = NewCommentService(s.db, s.Image)
+		return nil
+	}
+}
+
+// WithStats records what visitors do in galleries, for their owners to see.
+func WithStats() ServicesConfig {
+	return func(s *Services) error {
+		s.Stats = NewStatsService(s.db)
+		return nil
+	}
+}
+
+// WithSearch adds searching galleries and images with Postgres full text search.
+func WithSearch() ServicesConfig {
+	return func(s *Services) error {
+		s.Search = NewSearchService(s.db)
 		return nil
 	}
 }
@@ -66,11 +165,23 @@ func (s *Services) Close() {
 }
 
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}).Error
+	err := s.db.AutoMigrate(&User{}, &Gallery{}, &Image{}, &ImageVariant{}, &Blob{}, &UserUsage{}, &GalleryUsage{}, &ShareLink{}, &GalleryMember{}, &Selection{}, &SelectionPick{}, &Comment{}, &StatEvent{}, &StatSalt{}, &GalleryStat{}, &ImageStat{}, &Collection{}, &UploadSession{}, &Job{}).Error
+	if err != nil {
+		return err
+	}
+	// gorm can't create partial indexes. Galleries created before slugs
+	// existed don't have one until they are saved again.
+	err = s.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS ` + slugIndex + `
+		ON galleries (user_id, slug) WHERE slug <> '' AND deleted_at IS NULL`).Error
+	if err != nil {
+		return err
+	}
+	return s.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_collections_share_token
+		ON collections (share_token) WHERE share_token <> ''`).Error
 }
 
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &Image{}, &ImageVariant{}, &Blob{}, &UserUsage{}, &GalleryUsage{}, &ShareLink{}, &GalleryMember{}, &Selection{}, &SelectionPick{}, &Comment{}, &StatEvent{}, &StatSalt{}, &GalleryStat{}, &ImageStat{}, &Collection{}, &UploadSession{}, &Job{}).Error
 	if err != nil {
 		return err
 	}
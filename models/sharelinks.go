@@ -0,0 +1,159 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/rand"
+)
+
+const (
+	// ErrGalleryIDRequired is returned when a share link is saved without a gallery.
+	ErrGalleryIDRequired modelError = "models: gallery ID is required"
+
+	// shareTokenBytes is the amount of randomness in share link tokens.
+	shareTokenBytes = 24
+)
+
+// ShareLink lets people who aren't signed in see a gallery, eg: the
+// clients a photographer took the photos for. Anyone with the link has
+// access, until the owner deletes it.
+type ShareLink struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	Token     string `gorm:"not null;unique_index"`
+	// AllowDownloads lets people with the link download the gallery as a ZIP.
+	AllowDownloads bool `gorm:"not null;default:false"`
+}
+
+type ShareLinkDB interface {
+	ByID(id uint) (*ShareLink, error)
+	ByToken(token string) (*ShareLink, error)
+	// ByGalleryID returns the share links of a gallery, oldest first.
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+	// Create saves a new share link, generating its token.
+	Create(link *ShareLink) error
+	Update(link *ShareLink) error
+	Delete(id uint) error
+}
+
+type ShareLinkService interface {
+	ShareLinkDB
+}
+
+type shareLinkService struct {
+	ShareLinkDB
+}
+
+type shareLinkValidator struct {
+	ShareLinkDB
+}
+
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+type shareLinkValidatorFunction func(*ShareLink) error
+
+var _ ShareLinkDB = &shareLinkGorm{}
+
+func NewShareLinkService(db *gorm.DB) ShareLinkService {
+	return &shareLinkService{
+		ShareLinkDB: &shareLinkValidator{
+			ShareLinkDB: &shareLinkGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+func (sg *shareLinkGorm) ByID(id uint) (*ShareLink, error) {
+	var link ShareLink
+	if err := first(sg.db.Where("id = ?", id), &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (sg *shareLinkGorm) ByToken(token string) (*ShareLink, error) {
+	var link ShareLink
+	if err := first(sg.db.Where("token = ?", token), &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (sg *shareLinkGorm) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+	var links []ShareLink
+	if err := sg.db.Where("gallery_id = ?", galleryID).Order("id").Find(&links).Error; err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (sg *shareLinkGorm) Create(link *ShareLink) error {
+	return sg.db.Create(link).Error
+}
+
+func (sg *shareLinkGorm) Update(link *ShareLink) error {
+	return sg.db.Save(link).Error
+}
+
+func (sg *shareLinkGorm) Delete(id uint) error {
+	link := ShareLink{Model: gorm.Model{ID: id}}
+	return sg.db.Delete(&link).Error
+}
+
+func runShareLinkValidatorFunctions(link *ShareLink, validators ...shareLinkValidatorFunction) error {
+	for _, fn := range validators {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) ByToken(token string) (*ShareLink, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return sv.ShareLinkDB.ByToken(token)
+}
+
+func (sv *shareLinkValidator) Create(link *ShareLink) error {
+	err := runShareLinkValidatorFunctions(link,
+		sv.galleryIDRequired,
+		sv.generateToken)
+	if err != nil {
+		return err
+	}
+	return sv.ShareLinkDB.Create(link)
+}
+
+func (sv *shareLinkValidator) Update(link *ShareLink) error {
+	if err := runShareLinkValidatorFunctions(link, sv.galleryIDRequired); err != nil {
+		return err
+	}
+	return sv.ShareLinkDB.Update(link)
+}
+
+func (sv *shareLinkValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.ShareLinkDB.Delete(id)
+}
+
+func (sv *shareLinkValidator) galleryIDRequired(link *ShareLink) error {
+	if link.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) generateToken(link *ShareLink) error {
+	token, err := rand.String(shareTokenBytes)
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	return nil
+}
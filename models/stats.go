@@ -0,0 +1,431 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/rand"
+)
+
+const (
+	// ErrStatKindInvalid is returned when an event is recorded with a kind we don't know.
+	ErrStatKindInvalid modelError = "models: stat kind is not valid"
+
+	// JobRollupStats rolls the events of the days that are over up into
+	// GalleryStat and ImageStat.
+	JobRollupStats = "rollup_stats"
+
+	// statSaltBytes is the amount of randomness in the daily salts.
+	statSaltBytes = 32
+	// statVisitorHashBytes is how much of the hash of a visitor is kept.
+	statVisitorHashBytes = 16
+	// statTopImages is how many images GalleryStats.Images has.
+	statTopImages = 10
+)
+
+// StatKind is what a visitor did in a gallery.
+type StatKind string
+
+const (
+	StatView      StatKind = "view"
+	StatImageOpen StatKind = "image_open"
+	StatDownload  StatKind = "download"
+)
+
+// StatEvent is something a visitor did in a gallery. Events are kept
+// until their day is over, and then rolled up into GalleryStat and
+// ImageStat.
+type StatEvent struct {
+	ID        uint `gorm:"primary_key"`
+	GalleryID uint `gorm:"not null;index"`
+	// ShareLinkID is the link the visitor followed, 0 if they didn't.
+	ShareLinkID uint `gorm:"not null;default:0"`
+	// ImageID is the image opened, for StatImageOpen events.
+	ImageID uint     `gorm:"not null;default:0"`
+	Kind    StatKind `gorm:"not null"`
+	// VisitorHash tells visitors apart for the day without storing who
+	// they are: it hashes their IP address and user agent with a salt
+	// that changes every day, and goes away with the day's events.
+	VisitorHash string    `gorm:"not null"`
+	CreatedAt   time.Time `gorm:"not null;index"`
+}
+
+// StatSalt is the salt visitors are hashed with on Day. It is deleted
+// once the day is over, so the hashes can't be matched to anyone later.
+type StatSalt struct {
+	Day  time.Time `gorm:"type:date;primary_key"`
+	Salt string    `gorm:"not null"`
+}
+
+// GalleryStat counts what visitors did in a gallery on a day, through a
+// share link, or directly for ShareLinkID 0.
+type GalleryStat struct {
+	GalleryID   uint      `gorm:"primary_key;auto_increment:false"`
+	ShareLinkID uint      `gorm:"primary_key;auto_increment:false"`
+	Day         time.Time `gorm:"type:date;primary_key"`
+	Views       int       `gorm:"not null;default:0"`
+	Visitors    int       `gorm:"not null;default:0"`
+	ImageOpens  int       `gorm:"not null;default:0"`
+	Downloads   int       `gorm:"not null;default:0"`
+}
+
+// ImageStat counts how many times an image was opened on a day.
+type ImageStat struct {
+	ImageID   uint      `gorm:"primary_key;auto_increment:false"`
+	Day       time.Time `gorm:"type:date;primary_key"`
+	GalleryID uint      `gorm:"not null;index"`
+	Opens     int       `gorm:"not null;default:0"`
+}
+
+// StatCounts are the totals of a day, a share link, or a whole period.
+// Visitors are unique for the day, so someone who comes back on another
+// day, or through another share link, is counted again.
+type StatCounts struct {
+	Views      int
+	Visitors   int
+	ImageOpens int
+	Downloads  int
+}
+
+func (c *StatCounts) add(other StatCounts) {
+	c.Views += other.Views
+	c.Visitors += other.Visitors
+	c.ImageOpens += other.ImageOpens
+	c.Downloads += other.Downloads
+}
+
+// DayStats are the totals of a gallery on a day.
+type DayStats struct {
+	Day time.Time
+	StatCounts
+}
+
+// ShareLinkStats are the totals of a gallery through one of its share
+// links, or directly for ShareLinkID 0. Token is empty for those, and for
+// links that were deleted.
+type ShareLinkStats struct {
+	ShareLinkID uint
+	Token       string
+	StatCounts
+}
+
+// ImageStats is how many times an image was opened.
+type ImageStats struct {
+	ImageID  uint
+	Filename string
+	Title    string
+	Opens    int
+}
+
+// GalleryStats are the stats of a gallery over its last few days,
+// including today.
+type GalleryStats struct {
+	// Days has every day of the period oldest first, even the ones
+	// nobody visited on.
+	Days []DayStats
+	// ShareLinks are most viewed first.
+	ShareLinks []ShareLinkStats
+	// Images are the most opened images, most opened first.
+	Images []ImageStats
+	Total  StatCounts
+}
+
+// BarHeight is the height of the bar of views in the chart of days, from
+// 0 to 100 for the most viewed day.
+func (s *GalleryStats) BarHeight(views int) int {
+	max := 0
+	for _, day := range s.Days {
+		if day.Views > max {
+			max = day.Views
+		}
+	}
+	if max == 0 {
+		return 0
+	}
+	return views * 100 / max
+}
+
+type StatsDB interface {
+	Create(event *StatEvent) error
+	// Salt returns the salt visitors are hashed with on day, creating it
+	// if it doesn't exist yet.
+	Salt(day time.Time) (string, error)
+	// Rollup adds up the events from before day into GalleryStat and
+	// ImageStat, and deletes them along with the salts they used.
+	Rollup(day time.Time) error
+	// Daily returns the totals of a gallery per day since from, for the
+	// days anyone visited it on, oldest first.
+	Daily(galleryID uint, from time.Time) ([]DayStats, error)
+	// ByShareLink returns the totals of a gallery per share link since
+	// from, most viewed first.
+	ByShareLink(galleryID uint, from time.Time) ([]ShareLinkStats, error)
+	// TopImages returns the images of a gallery opened the most since
+	// from, most opened first.
+	TopImages(galleryID uint, from time.Time, limit int) ([]ImageStats, error)
+}
+
+type StatsService interface {
+	StatsDB
+	// Record saves that a visitor, told apart by their IP address and
+	// user agent, did kind in gallery. imageID is the image opened, for
+	// StatImageOpen.
+	Record(gallery *Gallery, kind StatKind, imageID uint, ip, userAgent string) error
+	// Stats returns the stats of a gallery over the last days days.
+	Stats(galleryID uint, days int) (*GalleryStats, error)
+	// RollupJob is the handler for JobRollupStats jobs.
+	RollupJob(job *Job) error
+}
+
+type statsService struct {
+	StatsDB
+	// mu guards the salt of saltDay, kept so every event doesn't need to
+	// look it up.
+	mu      sync.Mutex
+	saltDay time.Time
+	salt    string
+}
+
+type statsValidator struct {
+	StatsDB
+}
+
+type statsGorm struct {
+	db *gorm.DB
+}
+
+var _ StatsDB = &statsGorm{}
+
+func NewStatsService(db *gorm.DB) StatsService {
+	return &statsService{
+		StatsDB: &statsValidator{
+			StatsDB: &statsGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// statsDay is the day t is on. Days are in UTC, so they start at the same
+// time for everyone.
+func statsDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// statsDate formats day to compare it with date columns, which times
+// can't be compared with without depending on the time zone of the
+// database.
+func statsDate(day time.Time) string {
+	return day.Format("2006-01-02")
+}
+
+func (ss *statsService) Record(gallery *Gallery, kind StatKind, imageID uint, ip, userAgent string) error {
+	salt, err := ss.daySalt(statsDay(time.Now()))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(salt + "\x00" + ip + "\x00" + userAgent))
+	event := StatEvent{
+		GalleryID:   gallery.ID,
+		ImageID:     imageID,
+		Kind:        kind,
+		VisitorHash: hex.EncodeToString(sum[:statVisitorHashBytes]),
+	}
+	if gallery.Share != nil {
+		event.ShareLinkID = gallery.Share.ID
+	}
+	return ss.Create(&event)
+}
+
+func (ss *statsService) daySalt(day time.Time) (string, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.saltDay.Equal(day) {
+		return ss.salt, nil
+	}
+	salt, err := ss.Salt(day)
+	if err != nil {
+		return "", err
+	}
+	ss.saltDay, ss.salt = day, salt
+	return salt, nil
+}
+
+func (ss *statsService) Stats(galleryID uint, days int) (*GalleryStats, error) {
+	today := statsDay(time.Now())
+	from := today.AddDate(0, 0, 1-days)
+	daily, err := ss.Daily(galleryID, from)
+	if err != nil {
+		return nil, err
+	}
+	var stats GalleryStats
+	stats.ShareLinks, err = ss.ByShareLink(galleryID, from)
+	if err != nil {
+		return nil, err
+	}
+	stats.Images, err = ss.TopImages(galleryID, from, statTopImages)
+	if err != nil {
+		return nil, err
+	}
+	// Fill in the days nobody visited on, so the chart doesn't skip them
+	for day := from; !day.After(today); day = day.AddDate(0, 0, 1) {
+		counts := DayStats{Day: day}
+		if len(daily) > 0 && statsDay(daily[0].Day).Equal(day) {
+			counts.StatCounts = daily[0].StatCounts
+			daily = daily[1:]
+		}
+		stats.Days = append(stats.Days, counts)
+		stats.Total.add(counts.StatCounts)
+	}
+	return &stats, nil
+}
+
+func (ss *statsService) RollupJob(job *Job) error {
+	return ss.Rollup(statsDay(time.Now()))
+}
+
+func (sg *statsGorm) Create(event *StatEvent) error {
+	return sg.db.Create(event).Error
+}
+
+func (sg *statsGorm) Salt(day time.Time) (string, error) {
+	var salt StatSalt
+	err := first(sg.db.Where("day = ?", statsDate(day)), &salt)
+	if err != ErrNotFound {
+		return salt.Salt, err
+	}
+	generated, err := rand.String(statSaltBytes)
+	if err != nil {
+		return "", err
+	}
+	// Another server may be creating the salt at the same time, in which
+	// case everyone uses the one that made it in first.
+	err = sg.db.Exec("INSERT INTO stat_salts (day, salt) VALUES (?, ?) ON CONFLICT (day) DO NOTHING", statsDate(day), generated).Error
+	if err != nil {
+		return "", err
+	}
+	if err := first(sg.db.Where("day = ?", statsDate(day)), &salt); err != nil {
+		return "", err
+	}
+	return salt.Salt, nil
+}
+
+func (sg *statsGorm) Rollup(day time.Time) error {
+	tx := sg.db.Begin()
+	// Rollups lock each other out, so no event is ever counted twice
+	err := tx.Exec("LOCK TABLE stat_events IN SHARE ROW EXCLUSIVE MODE").Error
+	if err == nil {
+		err = tx.Exec(`
+			INSERT INTO gallery_stats (gallery_id, share_link_id, day, views, visitors, image_opens, downloads)
+			SELECT gallery_id, share_link_id, (created_at AT TIME ZONE 'UTC')::date,
+				COUNT(*) FILTER (WHERE kind = ?), COUNT(DISTINCT visitor_hash),
+				COUNT(*) FILTER (WHERE kind = ?), COUNT(*) FILTER (WHERE kind = ?)
+			FROM stat_events WHERE created_at < ?
+			GROUP BY 1, 2, 3
+			ON CONFLICT (gallery_id, share_link_id, day) DO UPDATE
+			SET views = gallery_stats.views + EXCLUDED.views,
+				visitors = gallery_stats.visitors + EXCLUDED.visitors,
+				image_opens = gallery_stats.image_opens + EXCLUDED.image_opens,
+				downloads = gallery_stats.downloads + EXCLUDED.downloads`,
+			StatView, StatImageOpen, StatDownload, day).Error
+	}
+	if err == nil {
+		err = tx.Exec(`
+			INSERT INTO image_stats (image_id, day, gallery_id, opens)
+			SELECT image_id, (created_at AT TIME ZONE 'UTC')::date, gallery_id, COUNT(*)
+			FROM stat_events WHERE kind = ? AND created_at < ?
+			GROUP BY 1, 2, 3
+			ON CONFLICT (image_id, day) DO UPDATE
+			SET opens = image_stats.opens + EXCLUDED.opens`,
+			StatImageOpen, day).Error
+	}
+	if err == nil {
+		err = tx.Where("created_at < ?", day).Delete(&StatEvent{}).Error
+	}
+	if err == nil {
+		err = tx.Where("day < ?", statsDate(day)).Delete(&StatSalt{}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// statRowsSQL selects the counts of a gallery per share link and day since
+// a date, from the rollups of the days that are over and the events of
+// the ones that aren't yet. It takes the gallery ID and date twice.
+const statRowsSQL = `
+	SELECT share_link_id, day, views, visitors, image_opens, downloads
+	FROM gallery_stats WHERE gallery_id = ? AND day >= ?
+	UNION ALL
+	SELECT share_link_id, (created_at AT TIME ZONE 'UTC')::date,
+		COUNT(*) FILTER (WHERE kind = 'view'), COUNT(DISTINCT visitor_hash),
+		COUNT(*) FILTER (WHERE kind = 'image_open'), COUNT(*) FILTER (WHERE kind = 'download')
+	FROM stat_events WHERE gallery_id = ? AND created_at >= ?
+	GROUP BY 1, 2`
+
+func (sg *statsGorm) Daily(galleryID uint, from time.Time) ([]DayStats, error) {
+	var days []DayStats
+	err := sg.db.Raw(`
+		SELECT day, SUM(views) AS views, SUM(visitors) AS visitors,
+			SUM(image_opens) AS image_opens, SUM(downloads) AS downloads
+		FROM (`+statRowsSQL+`) AS s
+		GROUP BY day ORDER BY day`,
+		galleryID, statsDate(from), galleryID, from).Scan(&days).Error
+	if err != nil {
+		return nil, err
+	}
+	return days, nil
+}
+
+func (sg *statsGorm) ByShareLink(galleryID uint, from time.Time) ([]ShareLinkStats, error) {
+	var links []ShareLinkStats
+	err := sg.db.Raw(`
+		SELECT share_link_id, COALESCE((SELECT token FROM share_links WHERE share_links.id = s.share_link_id AND deleted_at IS NULL), '') AS token,
+			SUM(views) AS views, SUM(visitors) AS visitors,
+			SUM(image_opens) AS image_opens, SUM(downloads) AS downloads
+		FROM (`+statRowsSQL+`) AS s
+		GROUP BY share_link_id ORDER BY views DESC, share_link_id`,
+		galleryID, statsDate(from), galleryID, from).Scan(&links).Error
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (sg *statsGorm) TopImages(galleryID uint, from time.Time, limit int) ([]ImageStats, error) {
+	var images []ImageStats
+	// Images in the trash keep their stats, purged ones are left out
+	err := sg.db.Raw(`
+		SELECT s.image_id, images.filename, images.title, SUM(s.opens) AS opens
+		FROM (
+			SELECT image_id, opens FROM image_stats WHERE gallery_id = ? AND day >= ?
+			UNION ALL
+			SELECT image_id, COUNT(*) FROM stat_events
+			WHERE gallery_id = ? AND kind = 'image_open' AND created_at >= ?
+			GROUP BY 1
+		) AS s
+		JOIN images ON images.id = s.image_id
+		GROUP BY s.image_id, images.filename, images.title
+		ORDER BY opens DESC, s.image_id LIMIT ?`,
+		galleryID, statsDate(from), galleryID, from, limit).Scan(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (sv *statsValidator) Create(event *StatEvent) error {
+	if event.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	switch event.Kind {
+	case StatView, StatImageOpen, StatDownload:
+	default:
+		return ErrStatKindInvalid
+	}
+	return sv.StatsDB.Create(event)
+}
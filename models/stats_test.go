@@ -0,0 +1,145 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsDay(t *testing.T) {
+	bogota := time.FixedZone("COT", -5*60*60)
+	tests := []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), "2026-03-01"},
+		{time.Date(2026, 3, 1, 23, 59, 59, 0, time.UTC), "2026-03-01"},
+		// Late in the evening in Bogotá is already the next day in UTC
+		{time.Date(2026, 3, 1, 21, 0, 0, 0, bogota), "2026-03-02"},
+	}
+	for _, tt := range tests {
+		day := statsDay(tt.t)
+		if got := statsDate(day); got != tt.want {
+			t.Errorf("statsDay(%v) = %s; want %s", tt.t, got, tt.want)
+		}
+		if day.Location() != time.UTC {
+			t.Errorf("statsDay(%v) is in %v; want UTC", tt.t, day.Location())
+		}
+	}
+}
+
+func TestGalleryStatsBarHeight(t *testing.T) {
+	stats := &GalleryStats{Days: []DayStats{
+		{StatCounts: StatCounts{Views: 3}},
+		{StatCounts: StatCounts{Views: 12}},
+		{},
+	}}
+	for views, want := range map[int]int{0: 0, 3: 25, 12: 100} {
+		if got := stats.BarHeight(views); got != want {
+			t.Errorf("BarHeight(%d) = %d; want %d", views, got, want)
+		}
+	}
+	if got := (&GalleryStats{Days: []DayStats{{}}}).BarHeight(0); got != 0 {
+		t.Errorf("BarHeight(0) with no views = %d; want 0", got)
+	}
+}
+
+type statsDB struct {
+	StatsDB
+	daily  []DayStats
+	events []StatEvent
+}
+
+func (sd *statsDB) Daily(galleryID uint, from time.Time) ([]DayStats, error) {
+	return sd.daily, nil
+}
+
+func (sd *statsDB) ByShareLink(galleryID uint, from time.Time) ([]ShareLinkStats, error) {
+	return nil, nil
+}
+
+func (sd *statsDB) TopImages(galleryID uint, from time.Time, limit int) ([]ImageStats, error) {
+	return nil, nil
+}
+
+func (sd *statsDB) Salt(day time.Time) (string, error) {
+	return "salt " + statsDate(day), nil
+}
+
+func (sd *statsDB) Create(event *StatEvent) error {
+	sd.events = append(sd.events, *event)
+	return nil
+}
+
+func TestStatsFillsDays(t *testing.T) {
+	today := statsDay(time.Now())
+	db := &statsDB{daily: []DayStats{
+		{Day: today.AddDate(0, 0, -5), StatCounts: StatCounts{Views: 2, Visitors: 1}},
+		{Day: today.AddDate(0, 0, -2), StatCounts: StatCounts{Views: 4, Visitors: 2, Downloads: 1}},
+		{Day: today, StatCounts: StatCounts{Views: 1, Visitors: 1, ImageOpens: 3}},
+	}}
+	ss := &statsService{StatsDB: db}
+	stats, err := ss.Stats(1, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Days) != 7 {
+		t.Fatalf("got %d days; want 7", len(stats.Days))
+	}
+	wantViews := []int{0, 2, 0, 0, 4, 0, 1}
+	for i, day := range stats.Days {
+		if want := today.AddDate(0, 0, i-6); !day.Day.Equal(want) {
+			t.Errorf("Days[%d] is %s; want %s", i, statsDate(day.Day), statsDate(want))
+		}
+		if day.Views != wantViews[i] {
+			t.Errorf("Days[%d].Views = %d; want %d", i, day.Views, wantViews[i])
+		}
+	}
+	if want := (StatCounts{Views: 7, Visitors: 4, ImageOpens: 3, Downloads: 1}); stats.Total != want {
+		t.Errorf("Total = %+v; want %+v", stats.Total, want)
+	}
+}
+
+func TestStatsRecord(t *testing.T) {
+	db := &statsDB{}
+	ss := &statsService{StatsDB: &statsValidator{StatsDB: db}}
+	gallery := &Gallery{}
+	gallery.ID = 1
+	record := func(kind StatKind, ip, userAgent string) error {
+		return ss.Record(gallery, kind, 0, ip, userAgent)
+	}
+	if err := record(StatView, "10.0.0.1", "Firefox"); err != nil {
+		t.Fatal(err)
+	}
+	if err := record(StatDownload, "10.0.0.1", "Firefox"); err != nil {
+		t.Fatal(err)
+	}
+	if err := record(StatView, "10.0.0.2", "Firefox"); err != nil {
+		t.Fatal(err)
+	}
+	gallery.Share = &ShareLink{}
+	gallery.Share.ID = 3
+	if err := record(StatView, "10.0.0.1", "Safari"); err != nil {
+		t.Fatal(err)
+	}
+	if err := record("like", "10.0.0.1", "Firefox"); err != ErrStatKindInvalid {
+		t.Errorf("Record() of an unknown kind = %v; want %v", err, ErrStatKindInvalid)
+	}
+
+	if len(db.events) != 4 {
+		t.Fatalf("recorded %d events; want 4", len(db.events))
+	}
+	hashes := make(map[string]bool)
+	for _, event := range db.events {
+		if len(event.VisitorHash) != 2*statVisitorHashBytes {
+			t.Errorf("VisitorHash %q is %d characters long; want %d", event.VisitorHash, len(event.VisitorHash), 2*statVisitorHashBytes)
+		}
+		hashes[event.VisitorHash] = true
+	}
+	// The same visitor has the same hash all day, and no one else does
+	if len(hashes) != 3 || db.events[0].VisitorHash != db.events[1].VisitorHash {
+		t.Errorf("got visitor hashes %v; want 3 different ones, the first two the same", hashes)
+	}
+	if db.events[3].ShareLinkID != 3 || db.events[0].ShareLinkID != 0 {
+		t.Errorf("share links %d and %d; want 0 and 3", db.events[0].ShareLinkID, db.events[3].ShareLinkID)
+	}
+}
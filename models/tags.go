@@ -0,0 +1,68 @@
+package models
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// ErrTooManyTags is returned when something is saved with more than maxTags tags.
+	ErrTooManyTags modelError = "models: too many tags"
+	// ErrTagTooLong is returned when a tag is longer than maxTagLength.
+	ErrTagTooLong modelError = "models: tag is too long"
+
+	maxTags      = 20
+	maxTagLength = 50
+)
+
+// Tags are the labels galleries and images can be searched by. They are
+// stored as a Postgres array.
+type Tags = pq.StringArray
+
+// ParseTags splits a comma separated list of tags, eg: "Wedding, #family".
+func ParseTags(s string) Tags {
+	return normalizeTags(strings.Split(s, ","))
+}
+
+// normalizeTags lowercases tags and removes the "#" people like to start
+// them with, dropping empty and repeated ones.
+func normalizeTags(tags Tags) Tags {
+	seen := make(map[string]bool)
+	normalized := Tags{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(tag), "#")))
+		tag = strings.Join(strings.Fields(tag), " ")
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// validateTags normalizes tags and makes sure they are within the limits.
+func validateTags(tags *Tags) error {
+	*tags = normalizeTags(*tags)
+	if len(*tags) > maxTags {
+		return ErrTooManyTags
+	}
+	for _, tag := range *tags {
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return ErrTagTooLong
+		}
+	}
+	return nil
+}
+
+// hasTag reports whether tags includes tag.
+func hasTag(tags Tags, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// TrashConfig is how long deleted galleries and images are kept.
+type TrashConfig struct {
+	// Retention is how long galleries and images stay in the trash before
+	// they are purged. 0 keeps them until they are purged by hand.
+	Retention time.Duration
+}
+
+// Trash is what a user deleted and can still restore.
+type Trash struct {
+	Galleries []Gallery
+	Images    []Image
+	// GalleryTitles are the titles of the galleries the images are in, by ID.
+	GalleryTitles map[uint]string
+	Retention     time.Duration
+}
+
+// RetentionDays is how many days things are kept in the trash.
+func (t *Trash) RetentionDays() int {
+	return int(t.Retention / (24 * time.Hour))
+}
+
+// PurgeAt is when something moved to the trash at deletedAt is purged.
+func (t *Trash) PurgeAt(deletedAt *time.Time) time.Time {
+	if deletedAt == nil {
+		return time.Time{}
+	}
+	return deletedAt.Add(t.Retention)
+}
+
+// TrashService lets users restore the galleries and images they deleted,
+// or delete them for good. Every method that takes a userID only finds what
+// that user deleted, and returns ErrNotFound for anything else.
+type TrashService interface {
+	// ByUserID returns everything a user has in the trash.
+	ByUserID(userID uint) (*Trash, error)
+	RestoreGallery(userID, galleryID uint) (*Gallery, error)
+	RestoreImage(userID, imageID uint) (*Image, error)
+	// PurgeGallery deletes a gallery in the trash for good, with all of its images.
+	PurgeGallery(userID, galleryID uint) error
+	PurgeImage(userID, imageID uint) error
+	// PurgeExpired purges every gallery and image that has been in the trash
+	// for longer than TrashConfig.Retention, returning how many there were.
+	PurgeExpired() (int, error)
+}
+
+type trashService struct {
+	galleries GalleryService
+	images    ImageService
+	config    TrashConfig
+}
+
+func NewTrashService(galleries GalleryService, images ImageService, config TrashConfig) TrashService {
+	return &trashService{
+		galleries: galleries,
+		images:    images,
+		config:    config,
+	}
+}
+
+func (ts *trashService) ByUserID(userID uint) (*Trash, error) {
+	galleries, err := ts.galleries.Trashed(userID)
+	if err != nil {
+		return nil, err
+	}
+	images, err := ts.images.Trashed(userID)
+	if err != nil {
+		return nil, err
+	}
+	titles := make(map[uint]string)
+	if len(images) > 0 {
+		owned, err := ts.galleries.ByUserId(userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, gallery := range owned {
+			titles[gallery.ID] = gallery.Title
+		}
+	}
+	return &Trash{
+		Galleries:     galleries,
+		Images:        images,
+		GalleryTitles: titles,
+		Retention:     ts.config.Retention,
+	}, nil
+}
+
+func (ts *trashService) RestoreGallery(userID, galleryID uint) (*Gallery, error) {
+	gallery, err := ts.trashedGallery(userID, galleryID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ts.galleries.Restore(gallery); err != nil {
+		return nil, err
+	}
+	return gallery, nil
+}
+
+func (ts *trashService) RestoreImage(userID, imageID uint) (*Image, error) {
+	image, err := ts.trashedImage(userID, imageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ts.images.Restore(image); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+func (ts *trashService) PurgeGallery(userID, galleryID uint) error {
+	gallery, err := ts.trashedGallery(userID, galleryID)
+	if err != nil {
+		return err
+	}
+	return ts.purgeGallery(gallery.ID)
+}
+
+func (ts *trashService) PurgeImage(userID, imageID uint) error {
+	image, err := ts.trashedImage(userID, imageID)
+	if err != nil {
+		return err
+	}
+	return ts.images.Purge(image)
+}
+
+func (ts *trashService) PurgeExpired() (int, error) {
+	if ts.config.Retention <= 0 {
+		return 0, nil
+	}
+	before := time.Now().Add(-ts.config.Retention)
+	var n int
+	images, err := ts.images.DeletedBefore(before)
+	if err != nil {
+		return n, err
+	}
+	for i := range images {
+		if err := ts.images.Purge(&images[i]); err != nil {
+			return n, err
+		}
+		n++
+	}
+	galleries, err := ts.galleries.DeletedBefore(before)
+	if err != nil {
+		return n, err
+	}
+	for _, gallery := range galleries {
+		if err := ts.purgeGallery(gallery.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// purgeGallery deletes a gallery for good, after its images so their files
+// are gone before the gallery they are counted against.
+func (ts *trashService) purgeGallery(galleryID uint) error {
+	if err := ts.images.PurgeGallery(galleryID); err != nil {
+		return err
+	}
+	return ts.galleries.Purge(galleryID)
+}
+
+// trashedGallery looks up a gallery userID has in the trash.
+func (ts *trashService) trashedGallery(userID, galleryID uint) (*Gallery, error) {
+	gallery, err := ts.galleries.TrashedByID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	if gallery.UserID != userID {
+		return nil, ErrNotFound
+	}
+	return gallery, nil
+}
+
+// trashedImage looks up an image userID has in the trash, in a gallery
+// that isn't in the trash itself.
+func (ts *trashService) trashedImage(userID, imageID uint) (*Image, error) {
+	image, err := ts.images.TrashedByID(imageID)
+	if err != nil {
+		return nil, err
+	}
+	gallery, err := ts.galleries.ById(image.GalleryID)
+	if err != nil {
+		return nil, err
+	}
+	if gallery.UserID != userID {
+		return nil, ErrNotFound
+	}
+	return image, nil
+}
+
+func (is *imageService) Trashed(userID uint) ([]Image, error) {
+	var images []Image
+	db := is.selectImages().Unscoped().Preload("Variants").
+		Where("images.deleted_at IS NOT NULL AND gallery_id IN (SELECT id FROM galleries WHERE user_id = ? AND deleted_at IS NULL)", userID).
+		Order("images.deleted_at desc, id")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (is *imageService) TrashedByID(id uint) (*Image, error) {
+	var image Image
+	err := first(is.selectImages().Unscoped().Preload("Variants").Where("id = ? AND deleted_at IS NOT NULL", id), &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (is *imageService) DeletedBefore(t time.Time) ([]Image, error) {
+	var images []Image
+	if err := is.db.Unscoped().Preload("Variants").Where("deleted_at < ?", t).Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (is *imageService) Restore(image *Image) error {
+	if err := is.reserveUsage(image.GalleryID, image.Size); err != nil {
+		return err
+	}
+	if err := is.db.Unscoped().Model(image).Update("deleted_at", nil).Error; err != nil {
+		is.releaseUsage(image.GalleryID, image.Size)
+		return err
+	}
+	image.DeletedAt = nil
+	return nil
+}
+
+func (is *imageService) Purge(image *Image) error {
+	if err := is.deleteVariants(image); err != nil {
+		return err
+	}
+	if err := is.db.Unscoped().Delete(image).Error; err != nil {
+		return err
+	}
+	// Clients' picks of the image go with it
+	if err := is.db.Where("image_id = ?", image.ID).Delete(&SelectionPick{}).Error; err != nil {
+		return err
+	}
+	// So are the comments on it
+	if err := is.db.Unscoped().Where("image_id = ?", image.ID).Delete(&Comment{}).Error; err != nil {
+		return err
+	}
+	if err := is.db.Where("image_id = ?", image.ID).Delete(&ImageStat{}).Error; err != nil {
+		return err
+	}
+	// Images in the trash already gave their space back
+	if image.DeletedAt == nil {
+		if err := is.releaseUsage(image.GalleryID, image.Size); err != nil {
+			return err
+		}
+	}
+	if image.Hash != "" {
+		return is.releaseBlob(image)
+	}
+	for policy := range stripLevels {
+		if err := is.store.Delete(image.strippedKey(policy)); err != nil {
+			return err
+		}
+	}
+	return is.store.Delete(image.StorageKey())
+}
+
+func (is *imageService) PurgeGallery(galleryID uint) error {
+	var images []Image
+	if err := is.db.Unscoped().Preload("Variants").Where("gallery_id = ?", galleryID).Find(&images).Error; err != nil {
+		return err
+	}
+	for i := range images {
+		if err := is.Purge(&images[i]); err != nil {
+			return err
+		}
+	}
+	// With no current watermark, every watermark and copy goes
+	gallery := Gallery{Model: gorm.Model{ID: galleryID}}
+	return is.CleanWatermarks(&gallery)
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestTrashRetention(t *testing.T) {
+	deletedAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	trash := &Trash{Retention: 30 * 24 * time.Hour}
+	if got := trash.RetentionDays(); got != 30 {
+		t.Errorf("RetentionDays() = %d; want 30", got)
+	}
+	if got, want := trash.PurgeAt(&deletedAt), time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("PurgeAt() = %v; want %v", got, want)
+	}
+	if got := trash.PurgeAt(nil); !got.IsZero() {
+		t.Errorf("PurgeAt(nil) = %v; want the zero time", got)
+	}
+}
+
+type trashGalleries struct {
+	GalleryService
+	galleries map[uint]*Gallery
+	restored  []uint
+}
+
+func (tg *trashGalleries) gallery(id uint, trashed bool) (*Gallery, error) {
+	gallery, ok := tg.galleries[id]
+	if !ok || (gallery.DeletedAt != nil) != trashed {
+		return nil, ErrNotFound
+	}
+	return gallery, nil
+}
+
+func (tg *trashGalleries) ById(id uint) (*Gallery, error) {
+	return tg.gallery(id, false)
+}
+
+func (tg *trashGalleries) TrashedByID(id uint) (*Gallery, error) {
+	return tg.gallery(id, true)
+}
+
+func (tg *trashGalleries) Restore(gallery *Gallery) error {
+	tg.restored = append(tg.restored, gallery.ID)
+	return nil
+}
+
+type trashImages struct {
+	ImageService
+	images   map[uint]*Image
+	restored []uint
+}
+
+func (ti *trashImages) TrashedByID(id uint) (*Image, error) {
+	image, ok := ti.images[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return image, nil
+}
+
+func (ti *trashImages) Restore(image *Image) error {
+	ti.restored = append(ti.restored, image.ID)
+	return nil
+}
+
+func TestTrashRestoreOwnOnly(t *testing.T) {
+	deletedAt := time.Now()
+	galleries := &trashGalleries{galleries: map[uint]*Gallery{
+		1: {Model: gorm.Model{ID: 1, DeletedAt: &deletedAt}, UserID: 1},
+		2: {Model: gorm.Model{ID: 2}, UserID: 1},
+		3: {Model: gorm.Model{ID: 3, DeletedAt: &deletedAt}, UserID: 2},
+	}}
+	images := &trashImages{images: map[uint]*Image{
+		10: {Model: gorm.Model{ID: 10}, GalleryID: 2},
+		// In a gallery that is in the trash itself
+		11: {Model: gorm.Model{ID: 11}, GalleryID: 1},
+		12: {Model: gorm.Model{ID: 12}, GalleryID: 3},
+	}}
+	ts := NewTrashService(galleries, images, TrashConfig{})
+
+	galleryTests := []struct {
+		galleryID uint
+		want      error
+	}{
+		{1, nil},
+		{2, ErrNotFound},
+		{3, ErrNotFound},
+		{4, ErrNotFound},
+	}
+	for _, tt := range galleryTests {
+		if _, err := ts.RestoreGallery(1, tt.galleryID); err != tt.want {
+			t.Errorf("RestoreGallery(1, %d) = %v; want %v", tt.galleryID, err, tt.want)
+		}
+	}
+	if len(galleries.restored) != 1 || galleries.restored[0] != 1 {
+		t.Errorf("restored galleries %v; want [1]", galleries.restored)
+	}
+
+	imageTests := []struct {
+		imageID uint
+		want    error
+	}{
+		{10, nil},
+		{11, ErrNotFound},
+		{12, ErrNotFound},
+		{13, ErrNotFound},
+	}
+	for _, tt := range imageTests {
+		if _, err := ts.RestoreImage(1, tt.imageID); err != tt.want {
+			t.Errorf("RestoreImage(1, %d) = %v; want %v", tt.imageID, err, tt.want)
+		}
+	}
+	if len(images.restored) != 1 || images.restored[0] != 10 {
+		t.Errorf("restored images %v; want [10]", images.restored)
+	}
+}
+
+func TestTrashPurgeExpiredKeepsForever(t *testing.T) {
+	// With no retention nothing is looked up, let alone purged
+	ts := NewTrashService(&trashGalleries{}, &trashImages{}, TrashConfig{})
+	if n, err := ts.PurgeExpired(); n != 0 || err != nil {
+		t.Errorf("PurgeExpired() = %d, %v; want 0, nil", n, err)
+	}
+}
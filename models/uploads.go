@@ -0,0 +1,355 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/torresjeff/gallery/rand"
+)
+
+const (
+	// ErrUploadLengthInvalid is returned when an upload is started without a valid size.
+	ErrUploadLengthInvalid modelError = "models: upload length is not valid"
+	// ErrUploadOffsetMismatch is returned when a chunk doesn't start where the upload left off.
+	ErrUploadOffsetMismatch modelError = "models: upload offset does not match the size received so far"
+	// ErrUploadChecksumMismatch is returned when a chunk doesn't match the checksum it was sent with.
+	ErrUploadChecksumMismatch modelError = "models: upload chunk does not match its checksum"
+	// ErrUploadChecksumAlgorithm is returned for checksums in an algorithm we don't support.
+	ErrUploadChecksumAlgorithm modelError = "models: upload checksum algorithm is not supported"
+	// ErrUploadTooLarge is returned when a chunk goes past the length the upload was started with.
+	ErrUploadTooLarge modelError = "models: upload is larger than the length it was started with"
+	// ErrUploadInProgress is returned when a chunk is sent while another one is still being received.
+	ErrUploadInProgress modelError = "models: another chunk of this upload is still being received"
+	// ErrTooManyUploads is returned when a user starts more uploads than UploadConfig.MaxSessions.
+	ErrTooManyUploads modelError = "models: too many uploads have been started without being finished"
+
+	// uploadTokenBytes is the amount of randomness in upload tokens.
+	uploadTokenBytes = 24
+	// uploadLease is how long a request has to write its chunk before
+	// another one can take over the upload, and uploadWriteTimeout is when
+	// it stops reading the chunk, so it's done before the lease runs out.
+	uploadLease        = 10 * time.Minute
+	uploadWriteTimeout = uploadLease - 2*time.Minute
+)
+
+// UploadChecksumAlgorithms are the algorithms chunks can be checksummed with.
+var UploadChecksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// UploadConfig holds the settings of resumable uploads.
+type UploadConfig struct {
+	// Dir is where the chunks of unfinished uploads are kept. It must be on
+	// a disk shared by every server that handles uploads.
+	Dir string
+	// Expiry is how long an upload can go without receiving a chunk before
+	// it is thrown away.
+	Expiry time.Duration
+	// MaxBytes is the largest file that can be uploaded.
+	MaxBytes int64
+	// MaxSessions is how many unfinished uploads each user can have, as
+	// each of them takes up disk space. 0 means no limit.
+	MaxSessions int
+}
+
+// UploadSession is an image being uploaded in chunks, which can be resumed
+// from Offset if the connection drops. Once every chunk has arrived the
+// file is added to the gallery as an image, and the session is deleted.
+type UploadSession struct {
+	ID        uint   `gorm:"primary_key"`
+	Token     string `gorm:"not null;unique_index"`
+	GalleryID uint   `gorm:"not null;index"`
+	// UserID is who is uploading the file.
+	UserID   uint   `gorm:"not null;default:0"`
+	Filename string `gorm:"not null"`
+	// Length is the size of the whole file.
+	Length int64 `gorm:"not null"`
+	// Offset is how much of the file has been received so far.
+	Offset    int64     `gorm:"not null;default:0"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	// Writer identifies the request writing a chunk, until WriterExpiresAt.
+	Writer          string `gorm:"not null;default:''"`
+	WriterExpiresAt *time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// Complete reports whether the whole file has been received.
+func (us *UploadSession) Complete() bool {
+	return us.Offset == us.Length
+}
+
+// UploadChecksum is the checksum a chunk was sent with.
+type UploadChecksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+type UploadService interface {
+	// Start begins the upload of a file of length bytes to a gallery, by userID.
+	Start(galleryID, userID uint, filename string, length int64) (*UploadSession, error)
+	// ByToken returns an upload that hasn't expired.
+	ByToken(token string) (*UploadSession, error)
+	// Append writes a chunk read from r to an upload, starting at offset.
+	// If checksum isn't nil the chunk is thrown away unless it matches.
+	// Once the last chunk arrives the file is added to the gallery through
+	// the ImageService, and any error from doing so is returned.
+	Append(session *UploadSession, offset int64, r io.Reader, checksum *UploadChecksum) error
+	// Delete stops an upload, throwing away what was received.
+	Delete(session *UploadSession) error
+	// DeleteExpired throws away the uploads that haven't received a chunk in
+	// UploadConfig.Expiry, returning how many there were.
+	DeleteExpired() (int, error)
+}
+
+type uploadService struct {
+	db     *gorm.DB
+	images ImageService
+	config UploadConfig
+}
+
+func NewUploadService(db *gorm.DB, images ImageService, config UploadConfig) UploadService {
+	return &uploadService{
+		db:     db,
+		images: images,
+		config: config,
+	}
+}
+
+func (us *uploadService) Start(galleryID, userID uint, filename string, length int64) (*UploadSession, error) {
+	if length <= 0 {
+		return nil, ErrUploadLengthInvalid
+	}
+	if us.config.MaxBytes > 0 && length > us.config.MaxBytes {
+		return nil, ErrImageTooLarge
+	}
+	if galleryID <= 0 {
+		return nil, ErrGalleryIDRequired
+	}
+	if us.config.MaxSessions > 0 {
+		var open int
+		err := us.db.Model(&UploadSession{}).Where("user_id = ? AND expires_at > ?", userID, time.Now()).Count(&open).Error
+		if err != nil {
+			return nil, err
+		}
+		if open >= us.config.MaxSessions {
+			return nil, ErrTooManyUploads
+		}
+	}
+	token, err := rand.String(uploadTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	session := UploadSession{
+		Token:     token,
+		GalleryID: galleryID,
+		UserID:    userID,
+		Filename:  filename,
+		Length:    length,
+		ExpiresAt: time.Now().Add(us.config.Expiry),
+	}
+	if err := os.MkdirAll(us.config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(us.path(&session), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if err := us.db.Create(&session).Error; err != nil {
+		os.Remove(us.path(&session))
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (us *uploadService) ByToken(token string) (*UploadSession, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	var session UploadSession
+	err := first(us.db.Where("token = ? AND expires_at > ?", token, time.Now()), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (us *uploadService) Append(session *UploadSession, offset int64, r io.Reader, checksum *UploadChecksum) error {
+	var newHash func() hash.Hash
+	if checksum != nil {
+		var ok bool
+		if newHash, ok = UploadChecksumAlgorithms[checksum.Algorithm]; !ok {
+			return ErrUploadChecksumAlgorithm
+		}
+	}
+
+	// The upload is claimed for the time it takes to write the chunk, so two
+	// requests resuming it can't write over each other, without keeping a
+	// transaction open while the client sends it. The second one gets
+	// ErrUploadInProgress, or ErrUploadOffsetMismatch once the first is done.
+	writer, err := rand.String(uploadTokenBytes)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	db := us.db.Model(&UploadSession{}).
+		Where(`id = ? AND "offset" = ? AND (writer = '' OR writer_expires_at < ?)`, session.ID, offset, now).
+		Updates(map[string]interface{}{"writer": writer, "writer_expires_at": now.Add(uploadLease)})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		if err := first(us.db.Where("id = ?", session.ID), session); err != nil {
+			return err
+		}
+		if offset != session.Offset {
+			return ErrUploadOffsetMismatch
+		}
+		return ErrUploadInProgress
+	}
+	session.Offset = offset
+
+	n, err := us.writeChunk(session, &deadlineReader{r: r, deadline: now.Add(uploadWriteTimeout)}, newHash, checksum)
+	expires := time.Now().Add(us.config.Expiry)
+	release := map[string]interface{}{"writer": "", "writer_expires_at": nil}
+	if n > 0 {
+		release["offset"] = session.Offset + n
+		release["expires_at"] = expires
+	}
+	db = us.db.Model(&UploadSession{}).Where("id = ? AND writer = ?", session.ID, writer).Updates(release)
+	if err != nil {
+		return err
+	}
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		// The upload was deleted, or the lease ran out and someone else
+		// took it over
+		return ErrUploadInProgress
+	}
+	if n > 0 {
+		session.Offset += n
+		session.ExpiresAt = expires
+	}
+	if !session.Complete() {
+		return nil
+	}
+	return us.finish(session)
+}
+
+// writeChunk appends what's left of r to the file of session, returning
+// how many bytes were written. The file is truncated back to where it was
+// if anything goes wrong, so a failed chunk can simply be sent again.
+func (us *uploadService) writeChunk(session *UploadSession, r io.Reader, newHash func() hash.Hash, checksum *UploadChecksum) (int64, error) {
+	f, err := os.OpenFile(us.path(session), os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(session.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	w := io.Writer(f)
+	var h hash.Hash
+	if newHash != nil {
+		h = newHash()
+		w = io.MultiWriter(f, h)
+	}
+	remaining := session.Length - session.Offset
+	n, err := io.Copy(w, io.LimitReader(r, remaining+1))
+	if err == nil && n > remaining {
+		err = ErrUploadTooLarge
+	}
+	if err == nil && h != nil && !bytes.Equal(h.Sum(nil), checksum.Sum) {
+		err = ErrUploadChecksumMismatch
+	}
+	if err != nil {
+		// Clients can send whatever made it before the connection dropped
+		// without a checksum, and we keep it. With a checksum we can't tell
+		// a partial chunk from a corrupted one, so it is discarded.
+		if h != nil || err == ErrUploadTooLarge {
+			n = 0
+		}
+		if terr := f.Truncate(session.Offset + n); terr != nil {
+			return 0, terr
+		}
+		if n > 0 {
+			return n, nil
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// errUploadWriteTimeout stops a chunk that takes longer than
+// uploadWriteTimeout to arrive.
+var errUploadWriteTimeout = errors.New("models: upload chunk took too long to arrive")
+
+// deadlineReader stops reading from r once deadline has passed.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(dr.deadline) {
+		return 0, errUploadWriteTimeout
+	}
+	return dr.r.Read(p)
+}
+
+// finish adds a fully received file to its gallery. The session is
+// deleted whether that works or not, as a rejected file won't become
+// valid by uploading it again.
+func (us *uploadService) finish(session *UploadSession) error {
+	defer func() {
+		if err := us.Delete(session); err != nil {
+			log.Printf("models: couldn't delete finished upload %d: %v", session.ID, err)
+		}
+	}()
+	f, err := os.Open(us.path(session))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return us.images.Create(session.GalleryID, session.UserID, f, session.Filename)
+}
+
+func (us *uploadService) Delete(session *UploadSession) error {
+	if err := os.Remove(us.path(session)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return us.db.Delete(session).Error
+}
+
+func (us *uploadService) DeleteExpired() (int, error) {
+	var sessions []UploadSession
+	if err := us.db.Where("expires_at <= ?", time.Now()).Find(&sessions).Error; err != nil {
+		return 0, err
+	}
+	for i := range sessions {
+		if err := us.Delete(&sessions[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// path is where the file of session is written to while it's uploaded.
+// Tokens are URL safe base64, so they are safe to use as file names.
+func (us *uploadService) path(session *UploadSession) string {
+	return filepath.Join(us.config.Dir, session.Token)
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadlineReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Time
+		want     string
+		err      error
+	}{
+		{"before the deadline", time.Now().Add(time.Minute), "chunk", nil},
+		{"after the deadline", time.Now().Add(-time.Second), "", errUploadWriteTimeout},
+	}
+	for _, tt := range tests {
+		b, err := ioutil.ReadAll(&deadlineReader{r: strings.NewReader("chunk"), deadline: tt.deadline})
+		if string(b) != tt.want || err != tt.err {
+			t.Errorf("%s: read %q, err = %v; want %q, %v", tt.name, b, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package models
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/torresjeff/gallery/storage"
+)
+
+const (
+	// ErrStorageQuotaExceeded is returned when an upload would take a user over QuotaConfig.MaxBytes.
+	ErrStorageQuotaExceeded modelError = "models: you have used all of your storage space. Delete some images to upload more"
+	// ErrImageQuotaExceeded is returned when an upload would take a user over QuotaConfig.MaxImages.
+	ErrImageQuotaExceeded modelError = "models: you have reached the maximum number of images you can upload"
+	// ErrGalleryQuotaExceeded is returned when an upload would take a gallery over QuotaConfig.MaxGalleryImages.
+	ErrGalleryQuotaExceeded modelError = "models: this gallery has reached the maximum number of images"
+)
+
+// QuotaConfig limits how much users can upload. Zero means there is no limit.
+type QuotaConfig struct {
+	// MaxBytes is the total size of the images a user can have.
+	MaxBytes int64
+	// MaxImages is the number of images a user can have.
+	MaxImages int
+	// MaxGalleryImages is the number of images a single gallery can have.
+	MaxGalleryImages int
+}
+
+// exceeded returns the error for the quota that adding an image of size
+// bytes would go over, given what the user and gallery already have, or
+// nil if it fits.
+func (q QuotaConfig) exceeded(user UserUsage, gallery GalleryUsage, size int64) error {
+	switch {
+	case q.MaxImages > 0 && user.Images >= q.MaxImages:
+		return ErrImageQuotaExceeded
+	case q.MaxBytes > 0 && user.Bytes+size > q.MaxBytes:
+		return ErrStorageQuotaExceeded
+	case q.MaxGalleryImages > 0 && gallery.Images >= q.MaxGalleryImages:
+		return ErrGalleryQuotaExceeded
+	}
+	return nil
+}
+
+// UserUsage counts the images a user has uploaded across all of their
+// galleries, and how much space they take. Every image counts in full, even
+// when its file is shared with another image.
+type UserUsage struct {
+	UserID uint  `gorm:"primary_key;auto_increment:false"`
+	Bytes  int64 `gorm:"not null;default:0"`
+	Images int   `gorm:"not null;default:0"`
+}
+
+// GalleryUsage counts the images in a gallery, and how much space they take.
+type GalleryUsage struct {
+	GalleryID uint  `gorm:"primary_key;auto_increment:false"`
+	Bytes     int64 `gorm:"not null;default:0"`
+	Images    int   `gorm:"not null;default:0"`
+}
+
+// Usage is how much a user has uploaded, along with their quota.
+type Usage struct {
+	Bytes     int64
+	Images    int
+	MaxBytes  int64
+	MaxImages int
+}
+
+// Percent is how much of their storage quota the user has used, from 0
+// to 100. It is always 0 for users without a quota.
+func (u *Usage) Percent() int {
+	if u.MaxBytes <= 0 {
+		return 0
+	}
+	percent := int(u.Bytes * 100 / u.MaxBytes)
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
+// NearLimit reports whether the user is close to running out of space.
+func (u *Usage) NearLimit() bool {
+	return u.Percent() >= 90
+}
+
+// FormatBytes formats a number of bytes for humans, eg: "12.3 MB". Like
+// the rest of the app, it counts 1024 bytes to a kilobyte.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// reserveUsage counts a new image of size bytes against the quotas of
+// galleryID and its owner, failing if either would go over them, or with
+// ErrNotFound if there is no such gallery. The checks, the same as
+// QuotaConfig.exceeded, and updates happen in a single statement each, so
+// concurrent uploads can't sneak past the limits together.
+func (is *imageService) reserveUsage(galleryID uint, size int64) error {
+	quota := is.config.Quota
+	if err := quota.exceeded(UserUsage{}, GalleryUsage{}, size); err != nil {
+		return err
+	}
+
+	tx := is.db.Begin()
+	res := tx.Exec(`
+		INSERT INTO user_usages (user_id, bytes, images)
+		SELECT user_id, ?, 1 FROM galleries WHERE id = ?
+		ON CONFLICT (user_id) DO UPDATE
+		SET bytes = user_usages.bytes + EXCLUDED.bytes, images = user_usages.images + 1
+		WHERE (? = 0 OR user_usages.bytes + EXCLUDED.bytes <= ?) AND (? = 0 OR user_usages.images < ?)`,
+		size, galleryID, quota.MaxBytes, quota.MaxBytes, quota.MaxImages, quota.MaxImages)
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// Nothing is inserted either when the gallery doesn't exist
+		var galleries int
+		err := tx.Unscoped().Model(&Gallery{}).Where("id = ?", galleryID).Count(&galleries).Error
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		if galleries == 0 {
+			return ErrNotFound
+		}
+		if err := quota.exceeded(is.userUsage(galleryID), GalleryUsage{}, size); err != nil {
+			return err
+		}
+		// The usage went down again since
+		return ErrStorageQuotaExceeded
+	}
+
+	res = tx.Exec(`
+		INSERT INTO gallery_usages (gallery_id, bytes, images)
+		VALUES (?, ?, 1)
+		ON CONFLICT (gallery_id) DO UPDATE
+		SET bytes = gallery_usages.bytes + EXCLUDED.bytes, images = gallery_usages.images + 1
+		WHERE (? = 0 OR gallery_usages.images < ?)`,
+		galleryID, size, quota.MaxGalleryImages, quota.MaxGalleryImages)
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrGalleryQuotaExceeded
+	}
+	return tx.Commit().Error
+}
+
+// userUsage returns the usage of the owner of galleryID, empty if it can't
+// be found.
+func (is *imageService) userUsage(galleryID uint) UserUsage {
+	var usage UserUsage
+	first(is.db.Where("user_id = (SELECT user_id FROM galleries WHERE id = ?)", galleryID), &usage)
+	return usage
+}
+
+// releaseUsage gives back the space of an image of size bytes that was
+// removed from galleryID.
+func (is *imageService) releaseUsage(galleryID uint, size int64) error {
+	tx := is.db.Begin()
+	err := tx.Exec(`
+		UPDATE user_usages SET bytes = GREATEST(bytes - ?, 0), images = GREATEST(images - 1, 0)
+		WHERE user_id = (SELECT user_id FROM galleries WHERE id = ?)`,
+		size, galleryID).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Exec(`
+		UPDATE gallery_usages SET bytes = GREATEST(bytes - ?, 0), images = GREATEST(images - 1, 0)
+		WHERE gallery_id = ?`,
+		size, galleryID).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (is *imageService) Usage(userID uint) (*Usage, error) {
+	usage := Usage{
+		MaxBytes:  is.config.Quota.MaxBytes,
+		MaxImages: is.config.Quota.MaxImages,
+	}
+	var counts UserUsage
+	err := first(is.db.Where("user_id = ?", userID), &counts)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	usage.Bytes, usage.Images = counts.Bytes, counts.Images
+	return &usage, nil
+}
+
+func (is *imageService) GalleryUsage(galleryID uint) (*GalleryUsage, error) {
+	usage := GalleryUsage{GalleryID: galleryID}
+	err := first(is.db.Where("gallery_id = ?", galleryID), &usage)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (is *imageService) RecomputeUsage() error {
+	images, err := is.All()
+	if err != nil {
+		return err
+	}
+	// The size of the stored file is the source of truth, and images
+	// uploaded before we tracked sizes don't have one yet.
+	for i := range images {
+		image := &images[i]
+		info, err := is.store.Stat(image.StorageKey())
+		if err == storage.ErrNotExist {
+			log.Printf("models: file of image %d is missing from storage", image.ID)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Size == image.Size {
+			continue
+		}
+		if err := is.db.Model(image).Update("size", info.Size).Error; err != nil {
+			return err
+		}
+	}
+
+	statements := []string{
+		`DELETE FROM user_usages`,
+		`INSERT INTO user_usages (user_id, bytes, images)
+		SELECT galleries.user_id, SUM(images.size), COUNT(*)
+		FROM images JOIN galleries ON galleries.id = images.gallery_id
+		WHERE images.deleted_at IS NULL
+		GROUP BY galleries.user_id`,
+		`DELETE FROM gallery_usages`,
+		`INSERT INTO gallery_usages (gallery_id, bytes, images)
+		SELECT gallery_id, SUM(size), COUNT(*)
+		FROM images
+		WHERE deleted_at IS NULL
+		GROUP BY gallery_id`,
+	}
+	tx := is.db.Begin()
+	for _, stmt := range statements {
+		if err := tx.Exec(stmt).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,70 @@
+package models
+
+import "testing"
+
+func TestQuotaExceeded(t *testing.T) {
+	quota := QuotaConfig{MaxBytes: 1000, MaxImages: 10, MaxGalleryImages: 5}
+	tests := []struct {
+		name    string
+		quota   QuotaConfig
+		user    UserUsage
+		gallery GalleryUsage
+		size    int64
+		want    error
+	}{
+		{"empty", quota, UserUsage{}, GalleryUsage{}, 100, nil},
+		{"larger than the whole quota", quota, UserUsage{}, GalleryUsage{}, 1001, ErrStorageQuotaExceeded},
+		{"exactly fills the quota", quota, UserUsage{Bytes: 900, Images: 9}, GalleryUsage{Images: 4}, 100, nil},
+		{"one byte over", quota, UserUsage{Bytes: 900}, GalleryUsage{}, 101, ErrStorageQuotaExceeded},
+		{"too many images", quota, UserUsage{Images: 10}, GalleryUsage{}, 1, ErrImageQuotaExceeded},
+		{"too many images and bytes", quota, UserUsage{Bytes: 1000, Images: 10}, GalleryUsage{}, 1, ErrImageQuotaExceeded},
+		{"full gallery", quota, UserUsage{}, GalleryUsage{Images: 5}, 1, ErrGalleryQuotaExceeded},
+		{"no limits", QuotaConfig{}, UserUsage{Bytes: 1 << 40, Images: 1 << 20}, GalleryUsage{Images: 1 << 20}, 1 << 30, nil},
+	}
+	for _, tt := range tests {
+		if err := tt.quota.exceeded(tt.user, tt.gallery, tt.size); err != tt.want {
+			t.Errorf("%s: exceeded() = %v; want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestUsagePercent(t *testing.T) {
+	tests := []struct {
+		usage     Usage
+		percent   int
+		nearLimit bool
+	}{
+		{Usage{Bytes: 500}, 0, false},
+		{Usage{Bytes: 0, MaxBytes: 1000}, 0, false},
+		{Usage{Bytes: 899, MaxBytes: 1000}, 89, false},
+		{Usage{Bytes: 900, MaxBytes: 1000}, 90, true},
+		// Lowering the quota can leave users over it
+		{Usage{Bytes: 3000, MaxBytes: 1000}, 100, true},
+	}
+	for _, tt := range tests {
+		if got := tt.usage.Percent(); got != tt.percent {
+			t.Errorf("%+v: Percent() = %d; want %d", tt.usage, got, tt.percent)
+		}
+		if got := tt.usage.NearLimit(); got != tt.nearLimit {
+			t.Errorf("%+v: NearLimit() = %v; want %v", tt.usage, got, tt.nearLimit)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{5 << 30, "5.0 GB"},
+	}
+	for _, tt := range tests {
+		if got := FormatBytes(tt.n); got != tt.want {
+			t.Errorf("FormatBytes(%d) = %q; want %q", tt.n, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package models
 
 import "github.com/jinzhu/gorm"
 
+// dateLayout formats the day of a time, the way Postgres formats dates.
+const dateLayout = "2006-01-02"
+
 func first(db *gorm.DB, dst interface{}) error {
 	err := db.First(dst).Error
 	if err == gorm.ErrRecordNotFound {
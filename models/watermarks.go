@@ -0,0 +1,240 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/torresjeff/gallery/imaging"
+	"github.com/torresjeff/gallery/rand"
+	"github.com/torresjeff/gallery/storage"
+)
+
+const (
+	// ErrWatermarkInvalid is returned when a watermark that isn't a PNG image is uploaded.
+	ErrWatermarkInvalid modelError = "models: watermarks must be PNG images"
+	// ErrWatermarkTooLarge is returned when a watermark over maxWatermarkBytes or maxWatermarkSide is uploaded.
+	ErrWatermarkTooLarge modelError = "models: watermarks can be at most 2 MB, and 4000 pixels wide and high"
+	// ErrWatermarkShape is returned when a watermark that is tiny, or very long and thin, is uploaded.
+	ErrWatermarkShape modelError = "models: watermarks must be at least 8 pixels wide and high, and at most 10 times as wide as they are high or the other way around"
+	// ErrWatermarkPositionInvalid is returned when a gallery is saved with a watermark position we don't know.
+	ErrWatermarkPositionInvalid modelError = "models: watermark position is not valid"
+	// ErrWatermarkOpacityInvalid is returned when a gallery is saved with a watermark opacity outside 1-100%.
+	ErrWatermarkOpacityInvalid modelError = "models: watermark opacity must be between 1 and 100%"
+	// ErrWatermarkScaleInvalid is returned when a gallery is saved with a watermark scale outside 1-100%.
+	ErrWatermarkScaleInvalid modelError = "models: watermark size must be between 1 and 100% of the width of the images"
+
+	maxWatermarkBytes = 2 << 20
+	maxWatermarkSide  = 4000
+	// maxWatermarkAspect is how many times longer a watermark can be on one
+	// side than on the other.
+	maxWatermarkAspect = 10
+	// watermarkTokenBytes is the amount of randomness in the keys of watermarks.
+	watermarkTokenBytes = 12
+
+	// DefaultWatermarkOpacity and DefaultWatermarkScale are the settings
+	// watermarks start with, in percent.
+	DefaultWatermarkOpacity = 50
+	DefaultWatermarkScale   = 25
+)
+
+// Watermarked reports whether the images of g are served to visitors with
+// a watermark.
+func (g *Gallery) Watermarked() bool {
+	return g.WatermarkKey != ""
+}
+
+// WatermarkVersion identifies the watermark of g along with its settings,
+// so copies of images made with other settings aren't served anymore once
+// they change. It is empty if g isn't watermarked.
+func (g *Gallery) WatermarkVersion() string {
+	if !g.Watermarked() {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%d", g.WatermarkKey, g.WatermarkPosition, g.WatermarkOpacity, g.WatermarkScale)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// WatermarkPath is the path the watermark of g is served at, for its owner
+// to preview.
+func (g *Gallery) WatermarkPath() string {
+	return "/images/" + g.WatermarkKey
+}
+
+// watermarksPrefix is the prefix of the keys of the watermarks of a
+// gallery, and the copies of its images made with them.
+func watermarksPrefix(galleryID uint) string {
+	return fmt.Sprintf("watermarks/%d/", galleryID)
+}
+
+// watermarkedName is the name of the copy of an image width pixels wide
+// in format, or full size for width 0.
+func watermarkedName(width int, format imaging.Format) string {
+	if width == 0 {
+		return "full" + format.Ext()
+	}
+	return strconv.Itoa(width) + format.Ext()
+}
+
+// watermarkedPath is the path the copy named name of the image is served
+// at, with the watermark version in i.Watermark.
+func (i *Image) watermarkedPath(name string) string {
+	return fmt.Sprintf("/galleries/%d/images/%d/watermarked/%s/%s", i.GalleryID, i.ID, i.Watermark, name)
+}
+
+func (is *imageService) SaveWatermark(gallery *Gallery, r io.Reader) error {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxWatermarkBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxWatermarkBytes {
+		return ErrWatermarkTooLarge
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil || format != "png" {
+		return ErrWatermarkInvalid
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return ErrWatermarkInvalid
+	}
+	if config.Width > maxWatermarkSide || config.Height > maxWatermarkSide {
+		return ErrWatermarkTooLarge
+	}
+	if config.Width < imaging.MinWatermarkSide || config.Height < imaging.MinWatermarkSide ||
+		config.Width > config.Height*maxWatermarkAspect || config.Height > config.Width*maxWatermarkAspect {
+		return ErrWatermarkShape
+	}
+	// Every watermark gets a new key, so copies made with the old one are
+	// never mistaken for ones made with it
+	token, err := rand.String(watermarkTokenBytes)
+	if err != nil {
+		return err
+	}
+	key := watermarksPrefix(gallery.ID) + token + ".png"
+	if err := is.store.Put(key, bytes.NewReader(b), int64(len(b))); err != nil {
+		return err
+	}
+	gallery.WatermarkKey = key
+	return nil
+}
+
+func (is *imageService) CleanWatermarks(gallery *Gallery) error {
+	prefix := watermarksPrefix(gallery.ID)
+	objects, err := is.store.List(prefix)
+	if err != nil {
+		return err
+	}
+	current := prefix + gallery.WatermarkVersion() + "/"
+	for _, obj := range objects {
+		if obj.Key == gallery.WatermarkKey || (gallery.Watermarked() && strings.HasPrefix(obj.Key, current)) {
+			continue
+		}
+		if err := is.store.Delete(obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) OpenWatermarked(gallery *Gallery, image *Image, width int, format imaging.Format) (io.ReadCloser, error) {
+	if !gallery.Watermarked() || image.GalleryID != gallery.ID {
+		return nil, ErrNotFound
+	}
+	key := watermarksPrefix(gallery.ID) + fmt.Sprintf("%s/%d/%s", gallery.WatermarkVersion(), image.ID, watermarkedName(width, format))
+	f, err := is.store.Get(key)
+	if err != storage.ErrNotExist {
+		return f, err
+	}
+
+	// Copies are made from the JPEG variant of the same width, which is
+	// much quicker to decode than the original
+	src := image.StorageKey()
+	if width != 0 {
+		src = ""
+		for i := range image.Variants {
+			v := &image.Variants[i]
+			if v.Width == width && v.Format == format {
+				jpeg := ImageVariant{Width: v.Width, Format: imaging.JPEG}
+				src = image.VariantStorageKey(&jpeg)
+			}
+		}
+		if src == "" {
+			return nil, ErrNotFound
+		}
+	} else if format != imaging.JPEG {
+		return nil, ErrNotFound
+	}
+	// Full size copies take a lot of memory to make, so requests for the
+	// same copy wait for the first one to make it rather than each making
+	// their own
+	err = is.watermarking.do(key, func() error {
+		if _, err := is.store.Stat(key); err == nil {
+			return nil
+		}
+		img, err := is.decodeStored(src)
+		if err != nil {
+			return err
+		}
+		mark, err := is.decodeStored(gallery.WatermarkKey)
+		if err != nil {
+			return err
+		}
+		marked := imaging.Watermark(img, mark, gallery.WatermarkPosition, gallery.WatermarkOpacity, gallery.WatermarkScale)
+		return is.writeVariant(key, format, marked)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return is.store.Get(key)
+}
+
+// inflight runs a function once per key at a time. Callers that come in
+// while it runs wait for it and get its error, instead of running it again.
+type inflight struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+type inflightCall struct {
+	done chan struct{}
+	err  error
+}
+
+func (f *inflight) do(key string, fn func() error) error {
+	f.mu.Lock()
+	if call, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	if f.calls == nil {
+		f.calls = make(map[string]*inflightCall)
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	f.calls[key] = call
+	f.mu.Unlock()
+
+	call.err = fn()
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// decodeStored decodes the image stored under key.
+func (is *imageService) decodeStored(key string) (image.Image, error) {
+	f, err := is.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return imaging.Decode(f)
+}
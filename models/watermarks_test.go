@@ -0,0 +1,88 @@
+package models
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/torresjeff/gallery/imaging"
+)
+
+func TestGalleryWatermarkVersion(t *testing.T) {
+	gallery := Gallery{WatermarkKey: "watermarks/1/abc.png", WatermarkPosition: imaging.BottomRight, WatermarkOpacity: 50, WatermarkScale: 25}
+	version := gallery.WatermarkVersion()
+	if version == "" {
+		t.Fatal("WatermarkVersion() is empty for a watermarked gallery")
+	}
+	if (&Gallery{}).WatermarkVersion() != "" {
+		t.Error("WatermarkVersion() isn't empty for a gallery without a watermark")
+	}
+	changes := []func(g *Gallery){
+		func(g *Gallery) { g.WatermarkKey = "watermarks/1/def.png" },
+		func(g *Gallery) { g.WatermarkPosition = imaging.Tiled },
+		func(g *Gallery) { g.WatermarkOpacity = 51 },
+		func(g *Gallery) { g.WatermarkScale = 26 },
+	}
+	for i, change := range changes {
+		changed := gallery
+		change(&changed)
+		if changed.WatermarkVersion() == version {
+			t.Errorf("change %d kept WatermarkVersion() %q", i, version)
+		}
+	}
+}
+
+func TestWatermarkedName(t *testing.T) {
+	tests := []struct {
+		width  int
+		format imaging.Format
+		want   string
+	}{
+		{0, imaging.JPEG, "full.jpg"},
+		{1024, imaging.JPEG, "1024.jpg"},
+		{1024, imaging.WebP, "1024.webp"},
+	}
+	for _, tt := range tests {
+		if got := watermarkedName(tt.width, tt.format); got != tt.want {
+			t.Errorf("watermarkedName(%d, %q) = %q; want %q", tt.width, tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestSaveWatermarkRejects(t *testing.T) {
+	encode := func(w, h int, enc func(*bytes.Buffer, image.Image) error) []byte {
+		var buf bytes.Buffer
+		if err := enc(&buf, image.NewNRGBA(image.Rect(0, 0, w, h))); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	pngOf := func(w, h int) []byte {
+		return encode(w, h, func(buf *bytes.Buffer, img image.Image) error { return png.Encode(buf, img) })
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"not an image", []byte("hello"), ErrWatermarkInvalid},
+		{"jpeg", encode(100, 100, func(buf *bytes.Buffer, img image.Image) error { return jpeg.Encode(buf, img, nil) }), ErrWatermarkInvalid},
+		{"too big", make([]byte, maxWatermarkBytes+1), ErrWatermarkTooLarge},
+		{"too wide", pngOf(maxWatermarkSide+1, 500), ErrWatermarkTooLarge},
+		{"tiny", pngOf(imaging.MinWatermarkSide-1, 100), ErrWatermarkShape},
+		{"thin", pngOf(1100, 100), ErrWatermarkShape},
+	}
+	// None of these reach the store, so the service doesn't need one
+	is := &imageService{}
+	for _, tt := range tests {
+		gallery := &Gallery{}
+		if err := is.SaveWatermark(gallery, bytes.NewReader(tt.b)); err != tt.want {
+			t.Errorf("%s: SaveWatermark() = %v; want %v", tt.name, err, tt.want)
+		}
+		if gallery.WatermarkKey != "" {
+			t.Errorf("%s: WatermarkKey was set to %q", tt.name, gallery.WatermarkKey)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memory keeps objects in memory. It is meant for tests and local
+// experiments; everything is lost when the process exits.
+type memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+var _ Storage = &memory{}
+
+// NewMemory creates an empty in-memory Storage.
+func NewMemory() Storage {
+	return &memory{
+		objects: make(map[string]memoryObject),
+	}
+}
+
+func (m *memory) Put(key string, r io.Reader, size int64) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{
+		data:    data,
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+func (m *memory) Get(key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	// Objects are never modified in place, so readers can share the data
+	return readSeekNopCloser{bytes.NewReader(obj.data)}, nil
+}
+
+func (m *memory) Delete(key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memory) List(prefix string) ([]ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var objects []ObjectInfo
+	for key, obj := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{
+				Key:     key,
+				Size:    int64(len(obj.data)),
+				ModTime: obj.modTime,
+			})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (m *memory) Stat(key string) (*ObjectInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return &ObjectInfo{
+		Key:     key,
+		Size:    int64(len(obj.data)),
+		ModTime: obj.modTime,
+	}, nil
+}
+
+// readSeekNopCloser lets Handler serve in-memory objects with http.ServeContent.
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"mime"
+	"path"
+	"sort"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the settings needed to connect to an S3 compatible
+// object store, eg: AWS S3, or MinIO running locally.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// s3 stores objects in a bucket of an S3 compatible object store.
+type s3 struct {
+	client *minio.Client
+	bucket string
+}
+
+var _ Storage = &s3{}
+
+// NewS3 creates a Storage backed by an S3 bucket. The bucket is created
+// if it doesn't exist yet.
+func NewS3(config S3Config) (Storage, error) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &s3{
+		client: client,
+		bucket: config.Bucket,
+	}, nil
+}
+
+// isNotExist reports whether err means the key or bucket wasn't found.
+func isNotExist(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NoSuchBucket" || code == "NotFound"
+}
+
+func (s *s3) Put(key string, r io.Reader, size int64) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(context.Background(), s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+	})
+	return err
+}
+
+func (s *s3) Get(key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, so check the object is actually there before
+	// handing it out. minio.Object also implements io.Seeker.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if isNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *s3) Delete(key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	err = s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+	if err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *s3) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	opts := minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, ObjectInfo{
+			Key:     obj.Key,
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (s *s3) Stat(key string) (*ObjectInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:     info.Key,
+		Size:    info.Size,
+		ModTime: info.LastModified,
+	}, nil
+}
@@ -0,0 +1,104 @@
+// Package storage stores the files uploaded by users (eg: images) behind
+// a common interface, so they can live on the local disk, in memory or in
+// an S3 compatible object store.
+package storage
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotExist is returned when there is no object stored under a key.
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// ErrInvalidKey is returned for keys that could escape the storage, eg: "../config.json".
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// Storage stores objects (files) under slash separated keys, eg:
+// "galleries/1/abc.jpg". Objects are always streamed, never loaded into
+// memory as a whole.
+type Storage interface {
+	// Put stores the contents of r under key, replacing any existing object.
+	// size is the number of bytes in r, or -1 if it isn't known.
+	Put(key string, r io.Reader, size int64) error
+	// Get opens the object stored under key. The caller must close it.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key. Deleting an object that
+	// doesn't exist is not an error.
+	Delete(key string) error
+	// List returns every object whose key starts with prefix, sorted by key.
+	List(prefix string) ([]ObjectInfo, error)
+	// Stat returns information about the object stored under key.
+	Stat(key string) (*ObjectInfo, error)
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// cleanKey normalizes key and makes sure it can't point outside of the storage.
+func cleanKey(key string) (string, error) {
+	if key == "" || strings.Contains(key, "\\") || strings.ContainsRune(key, 0) {
+		return "", ErrInvalidKey
+	}
+	clean := strings.TrimPrefix(path.Clean("/"+key), "/")
+	if clean == "" || clean != strings.TrimPrefix(key, "/") {
+		return "", ErrInvalidKey
+	}
+	return clean, nil
+}
+
+// Handler serves the objects in s over HTTP, using the request path as the
+// key. It is meant to be mounted with http.StripPrefix.
+func Handler(s Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		info, err := s.Stat(key)
+		if err != nil {
+			if err == ErrNotExist || err == ErrInvalidKey {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		obj, err := s.Get(key)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer obj.Close()
+
+		// Content type comes from the extension, which the server picked
+		// when storing the object, never from sniffing the contents.
+		contentType := mime.TypeByExtension(path.Ext(key))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		if rs, ok := obj.(io.ReadSeeker); ok {
+			// Gives us range requests and conditional GETs for free
+			http.ServeContent(w, r, key, info.ModTime, rs)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodHead {
+			return
+		}
+		io.Copy(w, obj)
+	})
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+		err  error
+	}{
+		{"galleries/1/abc.jpg", "galleries/1/abc.jpg", nil},
+		{"/galleries/1/abc.jpg", "galleries/1/abc.jpg", nil},
+		{"abc.jpg", "abc.jpg", nil},
+		{"", "", ErrInvalidKey},
+		{"/", "", ErrInvalidKey},
+		{".", "", ErrInvalidKey},
+		{"..", "", ErrInvalidKey},
+		{"../config.json", "", ErrInvalidKey},
+		{"/../config.json", "", ErrInvalidKey},
+		{"galleries/../../config.json", "", ErrInvalidKey},
+		{"galleries/1/../2/abc.jpg", "", ErrInvalidKey},
+		{"galleries/./abc.jpg", "", ErrInvalidKey},
+		{"galleries//abc.jpg", "", ErrInvalidKey},
+		{"galleries/", "", ErrInvalidKey},
+		{`..\config.json`, "", ErrInvalidKey},
+		{`galleries\abc.jpg`, "", ErrInvalidKey},
+		{"abc.jpg\x00.png", "", ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		got, err := cleanKey(tt.key)
+		if got != tt.want || err != tt.err {
+			t.Errorf("cleanKey(%q) = %q, %v; want %q, %v", tt.key, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestStorageRejectsEscapingKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+
+	stores := map[string]Storage{
+		"local":  NewLocal(root),
+		"memory": NewMemory(),
+	}
+	for name, s := range stores {
+		for _, key := range []string{"../escaped", "a/../../escaped", `..\escaped`} {
+			if err := s.Put(key, strings.NewReader("x"), 1); err != ErrInvalidKey {
+				t.Errorf("%s: Put(%q) = %v; want ErrInvalidKey", name, key, err)
+			}
+			if _, err := s.Get(key); err != ErrInvalidKey {
+				t.Errorf("%s: Get(%q) = %v; want ErrInvalidKey", name, key, err)
+			}
+			if _, err := s.Stat(key); err != ErrInvalidKey {
+				t.Errorf("%s: Stat(%q) = %v; want ErrInvalidKey", name, key, err)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside of the storage root: %v", err)
+	}
+}
@@ -31,6 +31,9 @@ type Data struct {
 type Alert struct {
 	Level   string
 	Message string
+	// Details are listed below the message, eg: the files that failed in a batch upload.
+	// They are not kept when an alert is persisted across a redirect.
+	Details []string
 }
 
 func (d *Data) SetAlert(err error) {
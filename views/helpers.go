@@ -0,0 +1,72 @@
+package views
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/torresjeff/gallery/imaging"
+	"github.com/torresjeff/gallery/models"
+)
+
+// imageFromData lets image helpers accept both models.Image values (eg: when
+// ranging over Gallery.Images) and pointers (eg: Gallery.Cover).
+func imageFromData(data interface{}) *models.Image {
+	switch img := data.(type) {
+	case *models.Image:
+		return img
+	case models.Image:
+		return &img
+	default:
+		return nil
+	}
+}
+
+// srcset builds the value of a srcset attribute listing every variant of an
+// image in the given format. The original is used when there aren't any.
+func srcset(data interface{}, format string) string {
+	img := imageFromData(data)
+	if img == nil {
+		return ""
+	}
+	var candidates []string
+	for i := range img.Variants {
+		v := &img.Variants[i]
+		if v.Format != imaging.Format(format) {
+			continue
+		}
+		candidates = append(candidates, fmt.Sprintf("%s %dw", img.VariantPath(v), v.Width))
+	}
+	if len(candidates) == 0 && imaging.Format(format) == imaging.JPEG && img.Width > 0 {
+		candidates = append(candidates, fmt.Sprintf("%s %dw", img.Path(), img.Width))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// imageSrc returns the path of the smallest JPEG variant of an image that is
+// at least width pixels wide, for use as the src of an img tag. It falls back
+// to the largest variant, and finally to the original.
+func imageSrc(data interface{}, width int) string {
+	img := imageFromData(data)
+	if img == nil {
+		return ""
+	}
+	var best *models.ImageVariant
+	for i := range img.Variants {
+		v := &img.Variants[i]
+		if v.Format != imaging.JPEG {
+			continue
+		}
+		switch {
+		case best == nil:
+			best = v
+		case best.Width < width && v.Width > best.Width:
+			best = v
+		case v.Width >= width && v.Width < best.Width:
+			best = v
+		}
+	}
+	if best == nil {
+		return img.Path()
+	}
+	return img.VariantPath(best)
+}
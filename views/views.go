@@ -8,9 +8,12 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strings"
 
 	"github.com/gorilla/csrf"
 	"github.com/torresjeff/gallery/context"
+	"github.com/torresjeff/gallery/markdown"
+	"github.com/torresjeff/gallery/models"
 )
 
 type View struct {
@@ -41,6 +44,11 @@ func NewView(layout string, files ...string) *View {
 		"pathEscape": func(s string) string {
 			return url.PathEscape(s)
 		},
+		"srcset":      srcset,
+		"imageSrc":    imageSrc,
+		"formatBytes": models.FormatBytes,
+		"markdown":    markdown.Render,
+		"join":        strings.Join,
 	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)